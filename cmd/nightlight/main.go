@@ -49,18 +49,38 @@ var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
 
 var out  = flag.String("out", "out.fits", "save output to `file`")
 var jpg  = flag.String("jpg", "%auto",  "save 8bit preview of output as JPEG to `file`. `%auto` replaces suffix of output file with .jpg")
+var img  = flag.String("img", "", "save 16-bit PNG or TIFF of output to `file`. Format is selected by suffix .png, .tif or .tiff, unless -imgFormat is given")
+var imgFormat= flag.String("imgFormat", "", "format for -img output, one of png16, tiff16 or tiff32 for 32-bit floating point TIFF. Blank selects by suffix")
 var log  = flag.String("log", "%auto",    "save log output to `file`. `%auto` replaces suffix of output file with .log")
 var pre  = flag.String("pre",  "",  "save pre-processed frames with given filename pattern, e.g. `pre%04d.fits`")
 var stars= flag.String("stars","","save star detections with given filename pattern, e.g. `stars%04d.fits`")
 var back = flag.String("back","","save extracted background with given filename pattern, e.g. `back%04d.fits`")
 var post = flag.String("post", "",  "save post-processed frames with given filename pattern, e.g. `post%04d.fits`")
+var report= flag.String("report", "", "save per-frame statistics of the stats command to `file`, as CSV, JSON or HTML with charts depending on the suffix")
 var batch= flag.String("batch", "", "save stacked batches with given filename pattern, e.g. `batch%04d.fits`")
+var fzQuant= flag.Float64("fzQuant", 4, "quantization level for Rice compressed .fz outputs of floating point data, as fraction of noise. Higher is more precise")
+var outFormat= flag.String("outFormat", "float32", "sample format for FITS outputs, one of float32, float64, int32 or uint16. Integer formats are multiplied with outScale and clip")
+var outScale = flag.Float64("outScale", 1, "factor multiplying data for integer outputs, recorded as BSCALE. E.g. 65535 for uint16 output of data normalized to [0,1]")
+var keepNaN  = flag.Bool("keepNaN", false, "keep NaNs in FITS outputs instead of replacing them with zeros. Integer formats mark them with BLANK")
+var xisfCompress= flag.String("xisfCompress", "", "compression for .xisf outputs, one of zlib or lz4, optionally with +sh suffix for byte shuffling. Blank for none")
 
+var bias = flag.String("bias", "", "apply bias frame from `file`")
 var dark = flag.String("dark", "", "apply dark frame from `file`")
+var darkOpt= flag.Bool("darkOpt", false, "optimize the dark scale factor to minimize noise in calibrated lights, instead of scaling by exposure time")
 var flat = flag.String("flat", "", "apply flat frame from `file`")
+var calib= flag.String("calib", "", "select bias, dark and flat for each light from the master frames in `directory`, unless given with -bias, -dark or -flat")
+var calibTemp= flag.Float64("calibTemp", 2, "maximum sensor temperature difference in degrees Celsius between lights and library darks or bias")
+var calibExp = flag.Float64("calibExp", 0.1, "maximum relative exposure difference between lights and library darks, unless a bias allows scaling")
 
-var debayer = flag.String("debayer", "", "debayer the given channel, one of R, G, B or blank for no op")
-var cfa     = flag.String("cfa", "RGGB", "color filter array type for debayering, one of RGGB, GRBG, GBRG, BGGR")
+var debayer = flag.String("debayer", "", "debayer the given channel, one of R, G, B, RGB for a three-channel data cube, or blank for no op")
+var debayerMode= flag.String("debayerMode", "bilinear", "debayering algorithm, one of bilinear, vng, ahd or super for superpixel mode at half resolution")
+var cfa     = flag.String("cfa", "", "color filter array type for debayering, one of RGGB, GRBG, GBRG, BGGR. Blank detects it from BAYERPAT, XBAYROFF, YBAYROFF and ROWORDER headers, defaulting to RGGB")
+
+var overscan= flag.String("overscan", "", "subtract the overscan level given by BIASSEC and trim to TRIMSEC or DATASEC, with `mode` row for line by line, mean for a constant, polyN for a polynomial of degree N, or trim to only trim. Blank for no op")
+var pedestal= flag.Float64("pedestal", 0, "add this pedestal to lights after calibration, so values stay positive")
+
+var defects= flag.String("defects", "", "correct defective pixels, columns and rows from the defect map in `file`, as written by the defects command")
+var defectLines= flag.Float64("defectLines", 0, "sigma for detecting defective columns and rows when building a defect map, 0=off")
 
 var binning= flag.Int64("binning", 0, "apply NxN binning, 0 or 1=no binning")
 
@@ -71,6 +91,13 @@ var starSig   = flag.Float64("starSig", 15.0,"sigma for star detection as multip
 var starBpSig = flag.Float64("starBpSig",-1.0,"sigma for star detection bad pixel removal as multiple of standard deviations, -1: auto")
 var starInOut = flag.Float64("starInOut",1.4,"minimal ratio of brightness inside HFR to outside HFR for star detection")
 var starRadius= flag.Int64("starRadius", 16.0, "radius for star detection in pixels")
+var psf       = flag.String("psf", "", "fit point spread functions to the brightest stars with `model` gaussian or moffat, reporting FWHM, eccentricity and angle. Blank for no op")
+var psfStars  = flag.Int64("psfStars", 200, "maximum number of stars for PSF fitting, 0=all")
+var pixelScale= flag.Float64("pixelScale", 0, "pixel scale in arc seconds per pixel for reporting FWHM, 0=from PIXSCALE, SCALE or XPIXSZ and FOCALLEN headers")
+
+var inspectMode= flag.String("inspectMode", "heatmap", "output of the inspect command, heatmap for a false color map of FWHM or HFR across the field, or mosaic for 3x3 crops of corners, edges and center")
+var inspectGrid= flag.Int64("inspectGrid", 8, "grid size for binning star metrics across the field with the inspect command")
+var inspectSize= flag.Int64("inspectSize", 0, "width of the inspect heat map, or crop size of the inspect mosaic in pixels, 0=auto")
 
 var backGrid  = flag.Int64("backGrid", 0, "automated background extraction: grid size in pixels, 0=off")
 var backSigma = flag.Float64("backSigma", 1.5 ,"automated background extraction: sigma for detecting foreground objects")
@@ -83,6 +110,7 @@ var usmThresh = flag.Float64("usmThresh", 1, "unsharp masking threshold, in stan
 var align     = flag.Int64("align",1,"1=align frames, 0=do not align")
 var alignK    = flag.Int64("alignK",20,"use triangles fromed from K brightest stars for initial alignment")
 var alignT    = flag.Float64("alignT",1.0,"skip frames if alignment to reference frame has residual greater than this")
+var reject    = flag.String("reject", "", "reject frames before stacking by comma-separated `rules` like stars<0.5,fwhm>4,back>3sigma on metrics stars (relative to reference), hfr, fwhm, ecc, back and noise. Sigma limits are relative to the median of all frames. With several batches, frames are graded in a first pass over the session, which doubles preprocessing time")
 var alignTo   = flag.String("alignTo", "", "use given `file` as alignment reference")
 
 var lsEst     = flag.Int64("lsEst",3,"location and scale estimators 0=mean/stddev, 1=median/MAD, 2=IKSS, 3=iterative sigma-clipped sampled median and sampled Qn (standard), 4=histogram peak")
@@ -94,7 +122,8 @@ var stClipPercLow = flag.Float64("stClipPercLow", 0.5,"set desired low clipping
 var stClipPercHigh= flag.Float64("stClipPercHigh",0.5,"set desired high clipping percentage for stacking, 0=ignore (overrides sigmas)")
 var stSigLow  = flag.Float64("stSigLow", -1,"low sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
 var stSigHigh = flag.Float64("stSigHigh",-1,"high sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
-var stWeight  = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise")
+var stWeight  = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise, 3=by PSF signal, 4=by SNR, 5=by stars/HFR, 6=by formula. Weights 1 and 3-6 with several batches are computed in a first pass over the session, which doubles preprocessing time")
+var stWeightFormula= flag.String("stWeightFormula", "", "weight `formula` for stWeight 6 over stars, hfr, fwhm, ecc, back, noise, exposure, snr and psfsignal, e.g. snr^2*stars/hfr")
 var stMemory  = flag.Int64("stMemory", int64((totalMiBs*7)/10), "total MiB of memory to use for stacking, default=0.7x physical memory")
 
 var refSelMode= flag.Int64("refSelMode", 0, "reference frame selection mode, 0=best #stars/HFR (default), 1=median HFR (for master flats)")
@@ -130,6 +159,9 @@ var scaleBlack= flag.Float64("scaleBlack", 0, "move black point so histogram pea
 
 var lights   =[]*nl.FITSImage{}
 
+// Processing outcomes recorded along the way, for output as FITS HISTORY entries
+var history  nl.History
+
 func main() {
 	debug.SetGCPercent(10)
 	start:=time.Now()
@@ -139,11 +171,20 @@ This program comes with ABSOLUTELY NO WARRANTY.
 This is free software, and you are welcome to redistribute it under certain conditions.
 Refer to https://www.gnu.org/licenses/gpl-3.0.en.html for details.
 
-Usage: %s [-flag value] (stats|stack|rgb|argb|lrgb|legal) (img0.fits ... imgn.fits)
+Usage: %s [-flag value] (stats|hdus|inspect|stack|master|defects|rgb|argb|lrgb|legal) (img0.fits ... imgn.fits)
+
+Input files can select a header data unit by index or extension name, e.g. img.fits[1] or img.fits[SCI].
+Inputs and outputs with .xisf suffix are read and written as XISF.
+SER videos are read frame by frame, or a single frame is selected by index, e.g. capture.ser[10].
+Camera raw files with .dng, .cr2, .nef or .arw suffix are read as undemosaiced color filter array data.
 
 Commands:
-  stats   Show input image statistics
+  stats   Show input image statistics, and save them as report with -report
+  hdus    List header data units of input files
+  inspect Analyze star sizes and shapes across the field for tilt, curvature and coma, saving a heat map or mosaic
   stack   Stack input images
+  master  Build a master calibration frame: master (bias|dark|flat) img0.fits ... imgn.fits
+  defects Build a defect map from a master dark or many lights, written as text list if -out ends in .txt
   stretch Stretch single image
   rgb     Combine color channels. Inputs are treated as r, g and b channel in that order
   argb    Combine color channels and align with luminance. Inputs are treated as l, r, g and b channels
@@ -156,6 +197,8 @@ Flags:
 	    flag.PrintDefaults()
 	}
 	flag.Parse()
+	nl.FZQuantLevel=float32(*fzQuant)
+	nl.XISFCompression=*xisfCompress
 
 	// Initialize logging to file in addition to stdout, if selected
 	if *log=="%auto" {
@@ -179,6 +222,12 @@ Flags:
 		}
 	}
 
+	// Select sample format for FITS outputs
+	sf, err:=nl.ParseSampleFormat(*outFormat)
+	if err!=nil { nl.LogFatal(err) }
+	if *outScale<=0 { nl.LogFatalf("Error: outScale must be positive, got %g\n", *outScale) }
+	nl.OutputFormat, nl.OutputKeepNaN, nl.OutputScale=sf, *keepNaN, *outScale
+
 	// Enable CPU profiling if flagged
     if *cpuprofile != "" {
         f, err := os.Create(*cpuprofile)
@@ -197,7 +246,7 @@ Flags:
     	flag.Usage()
     	return
     }
-    if args[0]=="stats" || args[0]=="stack" || args[0]=="stretch" || args[0]=="rgb" || args[0]=="argb" || args[0]=="lrgb" {
+    if args[0]=="stats" || args[0]=="inspect" || args[0]=="stack" || args[0]=="master" || args[0]=="stretch" || args[0]=="rgb" || args[0]=="argb" || args[0]=="lrgb" {
 	    nl.LogPrintf("Using location and scale estimator %d\n", *lsEst)
 		nl.LSEstimator=nl.LSEstimatorMode(*lsEst)
 	}
@@ -207,8 +256,16 @@ Flags:
     	rest.Serve();
     case "stats":
     	cmdStats(args[1:])
+    case "hdus":
+    	cmdHDUs(args[1:])
+    case "inspect":
+    	cmdInspect(args[1:])
     case "stack":
     	cmdStack(args[1:], *batch)
+    case "master":
+    	cmdMaster(args[1:])
+    case "defects":
+    	cmdDefects(args[1:])
     case "stretch":
     	cmdStretch(args[1:])
     case "rgb":
@@ -254,26 +311,30 @@ func cmdStats(args []string) {
 	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
 	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination, we don't know if stats are called on single frame or resulting stack
 
-    // Load dark and flat if flagged
+	parseOverscanMode()
+
+    // Load bias, dark and flat if flagged
+    if *bias!="" { state.BiasF=nl.LoadBias(*bias) }
     if *dark!="" { state.DarkF=nl.LoadDark(*dark) }
     if *flat!="" { state.FlatF=nl.LoadFlat(*flat) }
-	if state.DarkF!=nil && state.FlatF!=nil && !nl.EqualInt32Slice(state.DarkF.Naxisn, state.FlatF.Naxisn) {
-		nl.LogFatal("Error: flat and dark files differ in size")
-	}
+	checkCalibrationSizes()
+	openCalibrationLibrary()
+	loadDefectMap()
 
 	// Glob file name wildcards
 	fileNames:=globFilenameWildcards(args)
 
 	// Preprocess light frames (subtract dark, divide flat, remove bad pixels, detect stars and HFR)
-	nl.LogPrintf("\nPreprocessing %d frames with dark=%d flat=%d debayer=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
-		len(fileNames), btoi(state.DarkF!=nil), btoi(state.FlatF!=nil), *debayer, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
+	nl.LogPrintf("\nPreprocessing %d frames with bias=%d dark=%d darkOpt=%t flat=%d debayer=%s debayerMode=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
+		len(fileNames), btoi(state.BiasF!=nil), btoi(state.DarkF!=nil), *darkOpt, btoi(state.FlatF!=nil), *debayer, *debayerMode, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
 
+	reports:=make([]*nl.FrameReport, len(fileNames))
 	sem   :=make(chan bool, runtime.NumCPU())
 	for id, fileName := range(fileNames) {
 		sem <- true 
 		go func(id int, fileName string) {
 			defer func() { <-sem }()
-			lightP, err:=nl.PreProcessLight(id, fileName, state.DarkF, state.FlatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back)
+			lightP, err:=nl.PreProcessLight(id, fileName, state.BiasF, state.DarkF, state.FlatF, state.Library, *darkOpt, state.Defects, state.Overscan, float32(*pedestal), *debayer, *debayerMode, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), psfModel(), int32(*psfStars), float32(*pixelScale), int32(*backGrid), float32(*backSigma), int32(*backClip), *back)
 			if err!=nil {
 				nl.LogPrintf("%d: Error: %s\n", id, err.Error())
 			} else {
@@ -287,6 +348,8 @@ func cmdStats(args []string) {
 					if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 					starsFits.Data=nil
 				}
+				r:=nl.NewFrameReport(lightP)
+				reports[id]=&r
 				lightP.Data=nil
 			}
 		}(id, fileName)
@@ -294,6 +357,158 @@ func cmdStats(args []string) {
 	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
 		sem <- true
 	}
+
+	// Save per-frame statistics as report if desired
+	if *report!="" {
+		rows:=[]nl.FrameReport{}
+		for _, r:=range reports {
+			if r!=nil { rows=append(rows, *r) }
+		}
+		nl.SortFrameReports(rows)
+		if err:=nl.WriteReport(*report, rows); err!=nil { nl.LogFatalf("Error writing report: %s\n", err) }
+		nl.LogPrintf("Saved report on %d frames to %s\n", len(rows), *report)
+	}
+}
+
+
+// List header data units of the input files
+func cmdHDUs(args []string) {
+	fileNames:=globFilenameWildcards(args)
+	for id, fileName:=range fileNames {
+		name, _:=nl.SplitHDUSuffix(fileName)
+		hdus, err:=nl.ListHDUs(name)
+		if err!=nil { nl.LogPrintf("%d: Error: %s\n", id, err.Error()) }
+		for _, hdu:=range hdus {
+			nl.LogPrintf("%d: HDU %d %-8s %-8s BITPIX %d NAXISn %v\n", id, hdu.Index, hdu.Type, hdu.ExtName, hdu.Bitpix, hdu.Naxisn)
+		}
+	}
+}
+
+
+// Analyze star metrics across the field of a single frame, for diagnosing sensor tilt, field curvature and coma
+func cmdInspect(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
+	if *starBpSig<0 { *starBpSig=5 }
+
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)!=1 { nl.LogFatal("Need exactly one file to inspect") }
+	if *inspectGrid<1 { nl.LogFatal("Error: inspectGrid must be positive") }
+	if *inspectMode!="heatmap" && *inspectMode!="mosaic" { nl.LogFatalf("Error: unknown inspect mode %s\n", *inspectMode) }
+
+	parseOverscanMode()
+	if *bias!="" { state.BiasF=nl.LoadBias(*bias) }
+	if *dark!="" { state.DarkF=nl.LoadDark(*dark) }
+	if *flat!="" { state.FlatF=nl.LoadFlat(*flat) }
+	checkCalibrationSizes()
+	openCalibrationLibrary()
+	loadDefectMap()
+
+	f, err:=nl.PreProcessLight(0, fileNames[0], state.BiasF, state.DarkF, state.FlatF, state.Library, *darkOpt, state.Defects, state.Overscan, float32(*pedestal), *debayer, *debayerMode, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), psfModel(), int32(*psfStars), float32(*pixelScale), int32(*backGrid), float32(*backSigma), int32(*backClip), *back)
+	if err!=nil { nl.LogFatalf("Error: %s\n", err) }
+	if len(f.Stars)==0 { nl.LogFatal("Error: no stars detected, try lowering -starSig") }
+
+	a:=nl.AnalyzeField(f, int32(*inspectGrid), int32(*inspectGrid))
+	nl.LogPrintf("\nField analysis of %d stars on a %dx%d grid:\n%s", len(f.Stars), a.Cols, a.Rows, a)
+
+	var res *nl.FITSImage
+	if *inspectMode=="heatmap" {
+		width:=int32(*inspectSize)
+		if width<=0 { width=800 }
+		res=a.RenderHeatMap(width)
+	} else {
+		size:=int32(*inspectSize)
+		if size<=0 { size=f.Naxisn[0]/6 }
+		res=f.AberrationMosaic(size, 4)
+	}
+	addHistory(&res.Header, "inspect", fileNames)
+
+	nl.LogPrintf("Writing FITS to %s ...\n", *out)
+	err=res.WriteFile(*out)
+	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	if (*jpg)!="" {
+		nl.LogPrintf("Writing JPG to %s ...\n", *jpg)
+		if res.NumPlanes()==3 {
+			err=res.WriteJPGToFile(*jpg, 95)
+		} else {
+			err=res.WriteMonoJPGToFile(*jpg, 95)
+		}
+		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	}
+	writeImage(res)
+}
+
+
+// Terminates if the loaded bias, dark and flat frames differ in size
+func checkCalibrationSizes() {
+	var first *nl.FITSImage
+	for _, f:=range []*nl.FITSImage{state.BiasF, state.DarkF, state.FlatF} {
+		if f==nil { continue }
+		if first!=nil && !nl.EqualInt32Slice(first.Naxisn, f.Naxisn) {
+			nl.LogFatal("Error: bias, dark and flat files differ in size")
+		}
+		first=f
+	}
+}
+
+
+// Parses the frame rejection rules flag. Rules on PSF metrics need a PSF model
+func rejectionRules() []nl.RejectionRule {
+	rules, err:=nl.ParseRejectionRules(*reject)
+	if err!=nil { nl.LogFatal(err) }
+	if nl.RulesNeedPSF(rules) && psfModel()==nl.PSFNone { nl.LogFatal("Error: rejection rules on fwhm or ecc need -psf") }
+	return rules
+}
+
+
+// Parses the stacking weight formula flag, and checks the weight mode has the data it needs
+func weightFormula() *nl.Formula {
+	var formula *nl.Formula
+	if *stWeightFormula!="" {
+		var err error
+		formula, err=nl.ParseFormula(*stWeightFormula, nl.WeightVariables)
+		if err!=nil { nl.LogFatal(err) }
+	}
+	mode:=nl.WeightMode(*stWeight)
+	if mode<nl.WMNone || mode>nl.WMFormula { nl.LogFatalf("Error: unknown stacking weight mode %d\n", mode) }
+	if mode==nl.WMFormula && formula==nil { nl.LogFatal("Error: stWeight 6 needs -stWeightFormula") }
+	if nl.WeightNeedsPSF(mode, formula) && psfModel()==nl.PSFNone { nl.LogFatal("Error: PSF signal, fwhm and ecc weights need -psf") }
+	return formula
+}
+
+
+// Parses the PSF model flag
+func psfModel() nl.PSFModel {
+	m, err:=nl.ParsePSFModel(*psf)
+	if err!=nil { nl.LogFatal(err) }
+	return m
+}
+
+
+// Parses the overscan mode if flagged
+func parseOverscanMode() {
+	var err error
+	state.Overscan, err=nl.ParseOverscanMode(*overscan)
+	if err!=nil { nl.LogFatal(err) }
+}
+
+
+// Opens the calibration library if flagged
+func openCalibrationLibrary() {
+	if *calib=="" { return }
+	var err error
+	state.Library, err=nl.OpenCalibrationLibrary(*calib, float32(*calibTemp), float32(*calibExp))
+	if err!=nil { nl.LogFatalf("Error opening calibration library: %s\n", err) }
+}
+
+
+// Loads the defect map if flagged
+func loadDefectMap() {
+	if *defects=="" { return }
+	var err error
+	state.Defects, err=nl.LoadDefectMap(*defects)
+	if err!=nil { nl.LogFatalf("Error loading defect map: %s\n", err) }
+	nl.LogPrintf("Loaded %v from %s\n", state.Defects, *defects)
 }
 
 
@@ -306,10 +521,22 @@ func cmdStack(args []string, batchPattern string) {
 	// The stack of stacks
 	var stack *nl.FITSImage = nil
 	var stackFrames int64 = 0
+	var stackWeight float32 = 0
 	var stackNoise  float32 = 0
 
-    // Load dark and flat in parallel if flagged
-    sem   :=make(chan bool, 2) // limit parallelism to 2
+	parseOverscanMode()
+	if *stWeightFormula!="" && *stWeight==0 { *stWeight=int64(nl.WMFormula) }
+	rejectionRules()  // validate before preprocessing
+	weightFormula()
+
+    // Load bias, dark and flat in parallel if flagged
+    sem   :=make(chan bool, 3) // limit parallelism to 3
+    if *bias!="" { 
+		go func() { 
+			state.BiasF=nl.LoadBias(*bias) 
+			sem <- true
+		}() 
+	}
     if *dark!="" { 
 		go func() { 
 			state.DarkF=nl.LoadDark(*dark) 
@@ -322,16 +549,18 @@ func cmdStack(args []string, batchPattern string) {
 			sem <- true
 		}() 
 	}
+    if *bias!="" {   // wait for goroutine to finish
+		<- sem
+	}
     if *dark!="" {   // wait for goroutine to finish
 		<- sem
 	}
     if *flat!="" {   // wait for goroutine to finish
 		<- sem
 	}
-
-	if state.DarkF!=nil && state.FlatF!=nil && !nl.EqualInt32Slice(state.DarkF.Naxisn, state.FlatF.Naxisn) {
-		nl.LogFatal("Error: flat and dark files differ in size")
-	}
+	checkCalibrationSizes()
+	openCalibrationLibrary()
+	loadDefectMap()
 
 	// Glob file name wildcards
 	fileNames:=globFilenameWildcards(args)
@@ -339,7 +568,13 @@ func cmdStack(args []string, batchPattern string) {
 		nl.LogFatal("Error: no input files")
 	}
 	// Split input into required number of randomized batches, given the permissible amount of memory
-	numBatches, batchSize, overallIDs, overallFileNames, imageLevelParallelism:=nl.PrepareBatches(fileNames, *stMemory, state.DarkF, state.FlatF)
+	numBatches, batchSize, overallIDs, overallFileNames, imageLevelParallelism:=nl.PrepareBatches(fileNames, *stMemory, state.BiasF, state.DarkF, state.FlatF, state.Library)
+
+	// With several batches, grade and weigh all frames of the session up front, so limits and weights do not depend on the batch
+	var survey *sessionSurvey
+	if numBatches>1 && (len(rejectionRules())>0 || qualityWeights()) {
+		survey=surveySession(overallIDs, overallFileNames, batchSize, imageLevelParallelism)
+	}
 
 	// Process each batch. The first batch sets the reference image, and if solving for sigLow/High also those. 
 	// They are then reused in subsequent batches
@@ -354,13 +589,14 @@ func cmdStack(args []string, batchPattern string) {
 		ids      :=overallIDs      [batchStartOffset:batchEndOffset]
 		fileNames:=overallFileNames[batchStartOffset:batchEndOffset]
 		nl.LogPrintf("\nStarting batch %d of %d with %d images: %v...\n", b, numBatches, len(ids), ids)
+		if numBatches>1 { history.Batch(b, numBatches) }
 
 		// Stack the files in this batch
-		batch, avgNoise :=(*nl.FITSImage)(nil), float32(0)
-		batch, refFrame, sigLow, sigHigh, avgNoise=stackBatch(ids, fileNames, refFrame, sigLow, sigHigh, imageLevelParallelism)
+		batch, avgNoise, batchWeight :=(*nl.FITSImage)(nil), float32(0), float32(0)
+		batch, refFrame, sigLow, sigHigh, avgNoise, batchWeight=stackBatch(ids, fileNames, refFrame, sigLow, sigHigh, survey, imageLevelParallelism)
 
 		// Find stars in the newly stacked batch and report out on them
-		batch.Stars, _, batch.HFR=nl.FindStars(batch.Data, batch.Naxisn[0], batch.Stats.Location, batch.Stats.Scale, 
+		batch.Stars, _, batch.HFR=nl.FindStars(batch.Luminance(), batch.Naxisn[0], batch.Stats.Location, batch.Stats.Scale, 
 			float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
 		nl.LogPrintf("Batch %d stack: Stars %d HFR %.2f Exposure %gs %v\n", b, len(batch.Stars), batch.HFR, batch.Exposure, batch.Stats)
 
@@ -378,7 +614,9 @@ func cmdStack(args []string, batchPattern string) {
 
 		// Update stack of stacks
 		if numBatches>1 {
-			stack=nl.StackIncremental(stack, batch, float32(batchFrames))
+			nl.LogPrintf("Batch %d stacking weight %.4g\n", b, batchWeight)
+			stack=nl.StackIncremental(stack, batch, batchWeight)
+			stackWeight+=batchWeight
 			stackFrames+=batchFrames
 			stackNoise +=batch.Stats.Noise*float32(batchFrames)
 		} else {
@@ -392,19 +630,29 @@ func cmdStack(args []string, batchPattern string) {
 
 	// Free more memory
 	refFrame=nil  // all other primary frames already freed after stacking
+	if state.BiasF!=nil { state.BiasF=nil }
 	if state.DarkF!=nil { state.DarkF=nil }
+	if state.Library!=nil { state.Library=nil }
+	if state.Defects!=nil { state.Defects=nil }
 	if state.FlatF!=nil { state.FlatF=nil }
 	debug.FreeOSMemory()
 
 	if numBatches>1 {
 		// Finalize stack of stacks
-		err:=nl.StackIncrementalFinalize(stack, float32(stackFrames))
+		err:=nl.StackIncrementalFinalize(stack, stackWeight)
 		if err!=nil { nl.LogPrintf("Error calculating extended stats: %s\n", err) }
 
 		// Find stars in newly stacked image and report out on them
-		stack.Stars, _, stack.HFR=nl.FindStars(stack.Data, stack.Naxisn[0], stack.Stats.Location, stack.Stats.Scale, 
+		stack.Stars, _, stack.HFR=nl.FindStars(stack.Luminance(), stack.Naxisn[0], stack.Stats.Location, stack.Stats.Scale, 
 			float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
 		nl.LogPrintf("Overall stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
+		if m:=psfModel(); m!=nl.PSFNone {
+			scale:=float32(*pixelScale)
+			if scale==0 { scale=nl.PixelScale(&stack.Header) }
+			stack.PSFs=nl.FitPSFs(stack.Luminance(), stack.Naxisn[0], stack.Stars, m, int32(*starRadius), int32(*psfStars))
+			stack.PSF=nl.SummarizePSFs(stack.PSFs, m, scale)
+			nl.LogPrintf("Overall stack: %v\n", stack.PSF)
+		}
 
 		avgNoise:=stackNoise/float32(stackFrames)
 		expectedNoise:=avgNoise/float32(math.Sqrt(float64(numBatches)))
@@ -419,20 +667,85 @@ func cmdStack(args []string, batchPattern string) {
 	}
 
     // write out results, then free memory for the overall stack
+	addHistory(&stack.Header, "stack", fileNames)
 	err:=stack.WriteFile(*out)
 	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	stack=nil
 }
 
+// Whether stacking weights are calculated from per-frame quality metrics before post-processing
+func qualityWeights() bool {
+	wm:=nl.WeightMode(*stWeight)
+	return wm!=nl.WMNone && wm!=nl.WMNoise
+}
+
+// Frame grades and weights gathered across all batches of a session before stacking
+type sessionSurvey struct {
+	Qualities map[int]nl.FrameQuality  // Quality and rejection reasons by frame ID
+	RefStars  int32                    // Star count of the frame with most stars, which star ratios refer to
+	Weights   map[int]float32          // Quality weights by frame ID, nil unless weighting by quality
+	MaxWeight float32                  // Largest weight of an accepted frame, which weights are normalized by
+}
+
+// Preprocesses all frames of the session batch by batch, without writing any outputs, and grades and weighs them together.
+// Only the quality metrics and weights are kept, the pixel data is freed after each batch
+func surveySession(ids []int, fileNames []string, batchSize int64, imageLevelParallelism int32) *sessionSurvey {
+	rules, formula, wm:=rejectionRules(), weightFormula(), nl.WeightMode(*stWeight)
+	nl.LogPrintf("\nGrading %d frames across the session with rules %v and stWeight %d:\n", len(fileNames), rules, wm)
+	qualities:=[]nl.FrameQuality{}
+	weights:=map[int]float32(nil)
+	if qualityWeights() { weights=map[int]float32{} }
+	for from:=int64(0); from<int64(len(fileNames)); from+=batchSize {
+		to:=from+batchSize
+		if to>int64(len(fileNames)) { to=int64(len(fileNames)) }
+		lights:=preProcessBatch(ids[from:to], fileNames[from:to], "", "", "", imageLevelParallelism)
+		for _, l:=range lights {
+			if l==nil { continue }
+			qualities=append(qualities, nl.MeasureQuality(l))
+			if weights!=nil {
+				w, err:=nl.FrameWeight(l, wm, formula)
+				if err!=nil { nl.LogFatalf("%d: Error: %s\n", l.ID, err) }
+				weights[l.ID]=w
+			}
+		}
+		lights=nil
+		debug.FreeOSMemory()
+	}
+	nl.ApplyRejectionRules(qualities, 0, rules)
+
+	survey:=&sessionSurvey{Qualities:map[int]nl.FrameQuality{}, Weights:weights}
+	for _, q:=range qualities { 
+		survey.Qualities[q.ID]=q
+		if q.Stars>survey.RefStars { survey.RefStars=q.Stars }
+		if w:=weights[q.ID]; !q.Rejected() && w>survey.MaxWeight { survey.MaxWeight=w }
+	}
+	if weights!=nil && survey.MaxWeight<=0 { nl.LogFatal("Error: all stacking weights are zero") }
+	return survey
+}
+
+// Preprocesses a batch of light frames with the calibration frames and settings from the command line
+func preProcessBatch(ids []int, fileNames []string, starsPattern, backPattern, prePattern string, imageLevelParallelism int32) []*nl.FITSImage {
+	lights:=nl.PreProcessLights(ids, fileNames, state.BiasF, state.DarkF, state.FlatF, state.Library, *darkOpt, state.Defects, state.Overscan, float32(*pedestal), *debayer, *debayerMode, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), 
+		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), psfModel(), int32(*psfStars), float32(*pixelScale), starsPattern, int32(*backGrid), float32(*backSigma), int32(*backClip), backPattern, prePattern, imageLevelParallelism)
+	debug.FreeOSMemory()					
+	return lights
+}
+
 // Stack a given batch of files, using the reference provided, or selecting a reference frame if nil.
-// Returns the stack for the batch, and the reference frame
-func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, sigHigh float32, imageLevelParallelism int32) (stack, refFrameOut *nl.FITSImage, sigLowOut, sigHighOut, avgNoise float32) {
+// If a session survey is given, frames are rejected by their session-wide grades, and weights normalized across the session. 
+// Returns the stack for the batch, the reference frame, and the sum of stacking weights for combining batches
+func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, sigHigh float32, survey *sessionSurvey, imageLevelParallelism int32) (stack, refFrameOut *nl.FITSImage, sigLowOut, sigHighOut, avgNoise, weightSum float32) {
 	// Preprocess light frames (subtract dark, divide flat, remove bad pixels, detect stars and HFR)
-	nl.LogPrintf("\nPreprocessing %d frames with dark=%d flat=%d debayer=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
-		len(fileNames), btoi(state.DarkF!=nil), btoi(state.FlatF!=nil), *debayer, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
-	lights:=nl.PreProcessLights(ids, fileNames, state.DarkF, state.FlatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), 
-		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
-	debug.FreeOSMemory()					
+	nl.LogPrintf("\nPreprocessing %d frames with bias=%d dark=%d darkOpt=%t flat=%d debayer=%s debayerMode=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
+		len(fileNames), btoi(state.BiasF!=nil), btoi(state.DarkF!=nil), *darkOpt, btoi(state.FlatF!=nil), *debayer, *debayerMode, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
+	lights:=preProcessBatch(ids, fileNames, *stars, *back, *pre, imageLevelParallelism)
+
+	// Record frames which could not be loaded or preprocessed
+	for i:=0; i<len(lights); i+=1 {
+		if lights[i]==nil {
+			history.FrameRejected(ids[i], "preprocessing failed")
+		}
+	}
 
 	// Remove nils from lights, in case of read errors
 	o:=0
@@ -444,6 +757,41 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 	}
 	lights=lights[:o]
 
+	// Grade frames and reject those violating the quality rules
+	if rules:=rejectionRules(); len(rules)>0 {
+		var qualities []nl.FrameQuality
+		if survey!=nil {
+			nl.LogPrintf("\nApplying session grades with rules %v to %d frames:\n", rules, len(lights))
+			qualities=make([]nl.FrameQuality, len(lights))
+			for i, l:=range lights {
+				q, ok:=survey.Qualities[l.ID]
+				if !ok { // failed during the survey, but loaded now. Grade against the session reference
+					single:=[]nl.FrameQuality{nl.MeasureQuality(l)}
+					nl.ApplyRejectionRules(single, survey.RefStars, rules)
+					q=single[0]
+				}
+				qualities[i]=q
+			}
+		} else {
+			nl.LogPrintf("\nGrading %d frames with rules %v:\n", len(lights), rules)
+			qualities=nl.GradeFrames(lights, refFrame, rules)
+		}
+		o=0
+		for i, q:=range qualities {
+			nl.LogPrintf("%d: %v\n", q.ID, &q)
+			if q.Rejected() {
+				history.FrameRejected(q.ID, q.Reasons...)
+				continue
+			}
+			lights[o]=lights[i]
+			o++
+		}
+		nl.LogPrintf("Rejected %d of %d frames by quality\n", len(lights)-o, len(lights))
+		for i:=o; i<len(lights); i++ { lights[i]=nil }
+		lights=lights[:o]
+		if len(lights)==0 { nl.LogFatal("Error: all frames rejected by quality rules") }
+	}
+
 	avgNoise=float32(0)
 	for _,l:=range lights {
 		avgNoise+=l.Stats.Noise
@@ -457,15 +805,40 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 		refFrame, refFrameScore=nl.SelectReferenceFrame(lights, nl.RefSelMode(*refSelMode))
 		if refFrame==nil { panic("Reference frame for alignment and normalization not found.") }
 		nl.LogPrintf("Using frame %d as reference. Score %.4g, %v.\n", refFrame.ID, refFrameScore, refFrame.Stats)
+		history.Reference(refFrame.ID, refFrameScore)
+	}
+
+	// Calculate quality weights for stacking before post-processing normalizes the histograms
+	frameWeights:=map[int]float32(nil)
+	if qualityWeights() {
+		wm, formula:=nl.WeightMode(*stWeight), weightFormula()
+		frameWeights=map[int]float32{}
+		for _, l:=range lights {
+			w, ok:=float32(0), false
+			if survey!=nil && survey.Weights!=nil { w, ok=survey.Weights[l.ID] }
+			if !ok {
+				var err error
+				w, err=nl.FrameWeight(l, wm, formula)
+				if err!=nil { nl.LogFatalf("%d: Error: %s\n", l.ID, err) }
+			}
+			frameWeights[l.ID]=w
+		}
 	}
 
 	// Post-process all light frames (align, normalize)
 	nl.LogPrintf("\nPostprocessing %d frames with align=%d alignK=%d alignT=%.3f normHist=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
 		         len(lights), *align, *alignK, *alignT, *normHist, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
+	preLights:=append([]*nl.FITSImage(nil), lights...)
 	nl.PostProcessLights(refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, 
 	                     float32(*usmSigma), float32(*usmGain), float32(*usmThresh), *post, imageLevelParallelism)
 	debug.FreeOSMemory()					
 
+	// Record per-frame alignment outcomes. Transform and residual are kept on the frames before projection
+	for i, l:=range preLights {
+		history.FrameAligned(l, lights[i]!=nil)
+	}
+	preLights=nil
+
 	// Remove nils from lights again, in case of alignment errors
 	o=0
 	for i:=0; i<len(lights); i+=1 {
@@ -476,13 +849,12 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 	}
 	lights=lights[:o]
 
-	// Prepare weights for stacking, using 1/noise. 
+	// Prepare weights for stacking, from the quality weights or using 1/noise
 	weights:=[]float32(nil)
-	if (*stWeight)==1 { // exposure weighted stacking
+	if frameWeights!=nil { // exposure or quality weighted stacking
 		weights =make([]float32, len(lights))
 		for i:=0; i<len(lights); i+=1 {
-			if lights[i].Exposure==0 { nl.LogFatalf("%d: Missing exposure information for exposure-weighted stacking", lights[i].ID) }
-			weights[i]=lights[i].Exposure
+			weights[i]=frameWeights[lights[i].ID]
 		}
 	} else if (*stWeight)==2 { // noise weighted stacking
 		minNoise, maxNoise:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
@@ -493,45 +865,190 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 		}		
 		weights =make([]float32, len(lights))
 		for i:=0; i<len(lights); i+=1 {
-			lights[i].Stats.Noise=nl.EstimateNoise(lights[i].Data, lights[i].Naxisn[0])
+			lights[i].Stats.Noise=nl.EstimateNoise(lights[i].Luminance(), lights[i].Naxisn[0])
 			weights[i]=1/(1+4*(lights[i].Stats.Noise-minNoise)/(maxNoise-minNoise))
 		}
 	}
 
+	weightSum=float32(len(lights))
+	if weights!=nil {
+		if survey!=nil && survey.MaxWeight>0 {
+			for i:=range weights { weights[i]/=survey.MaxWeight }  // normalized across the session
+		} else if err:=nl.NormalizeWeights(weights); err!=nil { nl.LogFatal(err) }
+		for i, w:=range weights {
+			nl.LogPrintf("%d: Stacking weight %.4g\n", lights[i].ID, w)
+			history.FrameWeight(lights[i].ID, w)
+		}
+		if m:=nl.StackMode(*stMode); m==nl.StMedian || m==nl.StLinearFit {
+			nl.LogPrintf("Warning: stacking mode %d ignores weights\n", m)
+		} else {
+			weightSum=0
+			for _, w:=range weights { weightSum+=w }
+		}
+	}
+
 	refFrameLoc:=float32(0)
 	if refFrame!=nil && refFrame.Stats!=nil {
 		refFrameLoc=refFrame.Stats.Location
 	}
 
 	// Stack the post-processed lights 
+	usedSigLow, usedSigHigh:=float32(0), float32(0)
+	clipLow, clipHigh:=int32(-1), int32(-1)
 	if sigLow>=0 && sigHigh>=0 {
 		// Use sigma bounds from prior batch for stacking
 		nl.LogPrintf("\nStacking %d frames with mode %d stWeight %d and sigLow %.2f sigHigh %.2f from prior batch\n", len(lights), *stMode, *stWeight, sigLow, sigHigh)
 		var err error
-		stack, _, _, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, sigLow, sigHigh)
+		stack, clipLow, clipHigh, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, sigLow, sigHigh)
 		if err!=nil { nl.LogFatal(err.Error()) }
+		usedSigLow, usedSigHigh=sigLow, sigHigh
 	} else if *stSigLow>=0 && *stSigHigh>=0 {
 		// Use given sigma bounds for stacking
 		nl.LogPrintf("\nStacking %d frames with mode %d stWeight %d stSigLow %.2f stSigHigh %.2f\n", len(lights), *stMode, *stWeight, *stSigLow, *stSigHigh)
 		var err error
-		stack, _, _, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stSigLow), float32(*stSigHigh))
+		stack, clipLow, clipHigh, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stSigLow), float32(*stSigHigh))
 		if err!=nil { nl.LogFatal(err.Error()) }
+		usedSigLow, usedSigHigh=float32(*stSigLow), float32(*stSigHigh)
 	} else {
 		// Find sigma bounds based on desired clipping percentages
 		nl.LogPrintf("\nFinding sigmas for stacking %d frames into %s with mode %d stWeight %d to achieve stClipLow/high %.2f%%/%.2f%%\n", len(lights), *out, *stMode, *stWeight, *stClipPercLow, *stClipPercHigh )
 		var err error
-		stack, _, _, sigLow, sigHigh, err=nl.FindSigmasAndStack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stClipPercLow), float32(*stClipPercHigh))
+		stack, clipLow, clipHigh, sigLow, sigHigh, err=nl.FindSigmasAndStack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stClipPercLow), float32(*stClipPercHigh))
 		if err!=nil { nl.LogFatal(err.Error()) }
+		usedSigLow, usedSigHigh=sigLow, sigHigh
+	}
+	history.Stacked(len(lights), nl.StackMode(*stMode), nl.WeightMode(*stWeight), usedSigLow, usedSigHigh)
+	if clipLow>=0 && clipHigh>=0 {
+		history.Clipped(clipLow, clipHigh, len(stack.Data)*len(lights))
+	}
+
+	// Carry over observation metadata from the reference frame, or the first frame if there is none
+	if refFrame!=nil {
+		stack.Header=refFrame.Header.Clone()
+	} else if len(lights)>0 {
+		stack.Header=lights[0].Header.Clone()
 	}
 
 	// Free memory
 	lights=nil
 	debug.FreeOSMemory()
 
-	return stack, refFrame, sigLow, sigHigh, avgNoise
+	return stack, refFrame, sigLow, sigHigh, avgNoise, weightSum
+}
+
+
+// Build a master calibration frame from bias, dark or flat frames. Frames are stacked without
+// star detection, alignment or histogram normalization, using rejection defaults for the frame type
+func cmdMaster(args []string) {
+	if len(args)<2 { nl.LogFatal("Need a master type of bias, dark or flat, and input files") }
+	mt, err:=nl.ParseMasterType(args[0])
+	if err!=nil { nl.LogFatal(err) }
+
+	parseOverscanMode()
+
+    // Load bias and dark if flagged, for subtraction from darks or flats
+    if *bias!="" { state.BiasF=nl.LoadBias(*bias) }
+    if *dark!="" { state.DarkF=nl.LoadDark(*dark) }
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args[1:])
+	if len(fileNames)==0 { nl.LogFatal("Error: no input files") }
+
+	// Select stacking mode and sigmas for the frame type, unless given
+	mode, sigLow, sigHigh:=mt.StackDefaults(len(fileNames))
+	if nl.StackMode(*stMode)!=nl.StAuto { mode=nl.StackMode(*stMode) }
+	if *stSigLow>=0 && *stSigHigh>=0 { sigLow, sigHigh=float32(*stSigLow), float32(*stSigHigh) }
+
+	// Split input into required number of batches, given the permissible amount of memory
+	numBatches, batchSize, overallIDs, overallFileNames, imageLevelParallelism:=nl.PrepareBatches(fileNames, *stMemory, state.BiasF, state.DarkF, nil, nil)
+
+	var master *nl.FITSImage
+	summary:=nl.MasterSummary{}
+	for b:=int64(0); b<numBatches; b++ {
+		batchStartOffset:= b   *batchSize
+		batchEndOffset  :=(b+1)*batchSize
+		if batchEndOffset>int64(len(fileNames)) { batchEndOffset=int64(len(fileNames)) }
+		ids      :=overallIDs      [batchStartOffset:batchEndOffset]
+		fileNames:=overallFileNames[batchStartOffset:batchEndOffset]
+		nl.LogPrintf("\nLoading %d %s frames of batch %d of %d with bias=%d dark=%d:\n", len(ids), mt, b, numBatches, btoi(state.BiasF!=nil), btoi(state.DarkF!=nil))
+		frames:=nl.LoadCalibrationFrames(ids, fileNames, mt, state.BiasF, state.DarkF, state.Overscan, imageLevelParallelism)
+		if len(frames)==0 { nl.LogFatal("Error: no frames could be loaded") }
+		summary.Add(frames)
+
+		nl.LogPrintf("\nStacking %d %s frames with mode %d sigLow %.2f sigHigh %.2f\n", len(frames), mt, mode, sigLow, sigHigh)
+		batch, err:=nl.StackMaster(frames, mode, sigLow, sigHigh)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		nl.LogPrintf("Batch %d %s: %v\n", b, mt, batch.Stats)
+		if numBatches>1 {
+			master=nl.StackIncremental(master, batch, float32(len(frames)))
+		} else {
+			master=batch
+		}
+		frames, batch=nil, nil
+		debug.FreeOSMemory()
+	}
+	if numBatches>1 {
+		err=nl.StackIncrementalFinalize(master, float32(summary.Frames))
+		if err!=nil { nl.LogPrintf("Error calculating extended stats: %s\n", err) }
+	}
+	state.BiasF, state.DarkF=nil, nil
+
+	summary.Apply(master, mt)
+	history.Add("master %s from %d frames with mode %d sigLow %.3f sigHigh %.3f", mt, summary.Frames, mode, sigLow, sigHigh)
+	nl.LogPrintf("Master %s from %d frames, exposure %gs: %v\n", mt, summary.Frames, master.Exposure, master.Stats)
+
+	addHistory(&master.Header, "master", fileNames)
+	err=master.WriteFile(*out)
+	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	master=nil
 }
 
 
+// Build a defect map of hot, cold and optionally defective column and row pixels from a master dark,
+// or from many lights where defects must be present in at least half of the frames
+func cmdDefects(args []string) {
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)==0 { nl.LogFatal("Error: no input files") }
+
+	parseOverscanMode()
+	nl.LogPrintf("\nDetecting defects in %d frames with debayer=%s cfa=%s bpSigLow=%.2f bpSigHigh=%.2f defectLines=%.2f:\n", 
+		len(fileNames), *debayer, *cfa, *bpSigLow, *bpSigHigh, *defectLines)
+	maps:=make([]*nl.DefectMap, len(fileNames))
+	sem :=make(chan bool, runtime.NumCPU())
+	for id, fileName:=range fileNames {
+		sem <- true
+		go func(id int, fileName string) {
+			defer func() { <-sem }()
+			f:=nl.NewFITSImage()
+			err:=f.ReadFile(fileName)
+			if err!=nil { nl.LogPrintf("%d: Error: %s\n", id, err); return }
+			if state.Overscan!=nil {
+				if _, _, err=f.ApplyOverscan(state.Overscan); err!=nil { nl.LogPrintf("%d: Error: %s\n", id, err); return }
+			}
+			if f.NumPlanes()>1 { nl.LogPrintf("%d: Error: defect maps need monochrome or color filter array data\n", id); return }
+			cfaPattern:=""
+			if *debayer!="" { cfaPattern=nl.SelectCFA(*cfa, &f.Header, f.Naxisn[1]) }
+			maps[id], err=nl.BuildDefectMap(f.Data, f.Naxisn[0], cfaPattern, float32(*bpSigLow), float32(*bpSigHigh), float32(*defectLines))
+			if err!=nil { nl.LogPrintf("%d: Error: %s\n", id, err); return }
+			nl.LogPrintf("%d: Found %v\n", id, maps[id])
+		}(id, fileName)
+	}
+	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
+		sem <- true
+	}
+
+	valid:=[]*nl.DefectMap{}
+	for _, m:=range maps {
+		if m!=nil { valid=append(valid, m) }
+	}
+	d, err:=nl.MergeDefectMaps(valid, 0.5)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	nl.LogPrintf("Merged %d frames into %v, %.3f%% of all pixels\n", len(valid), d, 100*float32(d.NumDefects())/float32(d.Width*d.Height))
+
+	err=d.WriteFile(*out)
+	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
 func cmdStretch(args []string) {
 	fileNames:=globFilenameWildcards(args)
 	if len(fileNames)!=1 {
@@ -546,11 +1063,11 @@ func cmdStretch(args []string) {
 	if err!=nil { 
 		nl.LogFatalf("Error reading FITS file %s", fileNames[0])
 	}
-	f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+	f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 	if err!=nil { 
 		nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) 
 	}
-	f.Stars, _, f.HFR=nl.FindStars(f.Data, f.Naxisn[0], f.Stats.Location, f.Stats.Scale, float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
+	f.Stars, _, f.HFR=nl.FindStars(f.Luminance(), f.Naxisn[0], f.Stats.Location, f.Stats.Scale, float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
 	nl.LogPrintf("%d: Stars %d HFR %.3g %v\n", f.ID, len(f.Stars), f.HFR, f.Stats)
 
 	// perform the stretch
@@ -561,11 +1078,11 @@ func cmdStretch(args []string) {
 	if (*alignTo)!="" && (*alignTo)!=f.FileName {
 		// load alignment reference image, calculate stats and find stars
 		alignRef:=nl.LoadAlignTo(*alignTo)
-		alignRef.Stats, err=nl.CalcExtendedStats(alignRef.Data, alignRef.Naxisn[0])
+		alignRef.Stats, err=nl.CalcExtendedStats(alignRef.Luminance(), alignRef.Naxisn[0])
 		if err!=nil { 
 			nl.LogFatalf("%d: Calculating stats: %s", alignRef.ID, err) 
 		}
-		alignRef.Stars, _, alignRef.HFR=nl.FindStars(alignRef.Data, alignRef.Naxisn[0], alignRef.Stats.Location, alignRef.Stats.Scale, float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
+		alignRef.Stars, _, alignRef.HFR=nl.FindStars(alignRef.Luminance(), alignRef.Naxisn[0], alignRef.Stats.Location, alignRef.Stats.Scale, float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nil)
 		nl.LogPrintf("%d: Stars %d HFR %.3g %v\n", alignRef.ID, len(alignRef.Stars), alignRef.HFR, alignRef.Stats)
 
 		if *stars!="" {
@@ -588,7 +1105,8 @@ func cmdStretch(args []string) {
 		// Project image into reference frame
 		f, err= f.Project(aligner.Naxisn, trans, outOfBounds)
 		if err!=nil { nl.LogFatalf("%d: Projection error: %s", f.ID, err) }
-		f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+		history.Add("aligned to %s, residual %.4g, transform %v", *alignTo, residual, trans)
+		f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) }
 	}
 
@@ -596,19 +1114,21 @@ func cmdStretch(args []string) {
 
 	// apply unsharp masking, if requested
 	if *usmGain>0 {
-		f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) }
 		absThresh:=f.Stats.Location + f.Stats.Scale*float32(*usmThresh)
 		nl.LogPrintf("%d: Unsharp masking with sigma %.3g gain %.3g thresh %.3g absThresh %.3g\n", f.ID, float32(*usmSigma), float32(*usmGain), float32(*usmThresh), absThresh)
 		kernel:=nl.GaussianKernel1D(float32(*usmSigma))
 		nl.LogPrintf("Unsharp masking kernel sigma %.2f size %d: %v\n", *usmSigma, len(kernel), kernel)
-		f.Data=nl.UnsharpMask(f.Data, int(f.Naxisn[0]), float32(*usmSigma), float32(*usmGain), f.Stats.Min, f.Stats.Max, absThresh)
+		for p:=int32(0); p<f.NumPlanes(); p++ {
+			copy(f.Plane(p), nl.UnsharpMask(f.Plane(p), int(f.Naxisn[0]), float32(*usmSigma), float32(*usmGain), f.Stats.Min, f.Stats.Max, absThresh))
+		}
 	}
 
 	// Optionally adjust midtones
 	if (*midtone)!=0 {
 		nl.LogPrintf("Applying midtone correction with midtone=%.2f%% x scale and black=location - %.2f%% x scale\n", *midtone, *midBlack)
-		f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) }
 		absMid:=float32(*midtone)*f.Stats.Scale
 		absBlack:=f.Stats.Location - float32(*midBlack)*f.Stats.Scale
@@ -624,7 +1144,7 @@ func cmdStretch(args []string) {
 
 	// Optionally adjust gamma post peak
 	if (*ppGamma)!=1 {
-		f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) }
 		from:=f.Stats.Location+float32(*ppSigma)*f.Stats.Scale
 		to  :=float32(1.0)
@@ -635,7 +1155,7 @@ func cmdStretch(args []string) {
 	// Optionally scale histogram peak
 	if (*scaleBlack)!=0 {
 	 	targetBlack:=float32((*scaleBlack)/100.0)
-		f.Stats, err=nl.CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats, err=nl.CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { nl.LogFatalf("%d: Calculating stats: %s", f.ID, err) }
 		nl.LogPrintf("Location %.2f%% and scale %.2f%%: ", f.Stats.Location*100, f.Stats.Scale*100)
 		if f.Stats.Location>targetBlack {
@@ -648,13 +1168,19 @@ func cmdStretch(args []string) {
 
     // write out results, then free memory for the overall stack
 	nl.LogPrintf("Writing FITS to %s ...\n", *out)
+	addHistory(&f.Header, "stretch", fileNames)
 	err=f.WriteFile(*out)
 	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	if (*jpg)!="" {
 		nl.LogPrintf("Writing JPG to %s ...\n", *jpg)
-		f.WriteMonoJPGToFile(*jpg, 95)
+		if f.NumPlanes()==3 {
+			err=f.WriteJPGToFile(*jpg, 95)
+		} else {
+			err=f.WriteMonoJPGToFile(*jpg, 95)
+		}
 		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	}
+	writeImage(f)
 	f=nil
 }
 
@@ -667,27 +1193,37 @@ func cmdRGB(args []string) {
 
 	// Glob file name wildcards
 	fileNames:=globFilenameWildcards(args)
-	if len(fileNames)!=3 {
-		nl.LogFatal("Need exactly three input files to perform a RGB combination")
+	if len(fileNames)!=3 && len(fileNames)!=1 {
+		nl.LogFatal("Need exactly three input files, or one RGB data cube, to perform a RGB combination")
 	}
-	ids:=[]int{0,1,2}
+	ids:=[]int{0,1,2}[:len(fileNames)]
 
 	// Read files and detect stars
 	imageLevelParallelism:=int32(runtime.GOMAXPROCS(0))
 	if imageLevelParallelism>3 { imageLevelParallelism=3 }
 	nl.LogPrintf("\nReading color channels and detecting stars:\n")
-	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
-		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
+	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, nil, nil, false, nil, nil, 0, *debayer, *debayerMode, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nl.PSFNone, 0, 0, *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
 
 	// Pick reference frame
 	var refFrame *nl.FITSImage
 	var refFrameScore float32
 
+	if len(lights)==1 {
+		// single RGB cube, e.g. from one-shot color stacking. Channels are aligned already
+		refFrame=lights[0]
+		if refFrame==nil || refFrame.NumPlanes()!=3 { nl.LogFatal("Need a data cube with three color planes to perform a RGB combination") }
+		var err error
+		lights, err=refFrame.SplitPlanes()
+		if err!=nil { nl.LogFatalf("Error splitting color planes: %s\n", err) }
+		nl.LogPrintf("Split data cube into %d color channels.\n\n", len(lights))
+	} else {
 	//if (*align)!=0 || (*normHist)!=0 {
 		refFrame, refFrameScore=nl.SelectReferenceFrame(lights, nl.RefSelMode(*refSelMode))
 		if refFrame==nil { panic("Reference channel for alignment not found.") }
 		nl.LogPrintf("Using channel %d with score %.4g as reference for alignment and normalization.\n\n", refFrame.ID, refFrameScore)
 	//}
+	}
 
 /*
 	// Post-process all channels (align, normalize)
@@ -702,6 +1238,7 @@ func cmdRGB(args []string) {
 	// Combine RGB channels
 	nl.LogPrintf("\nCombining color channels...\n")
 	rgb:=nl.CombineRGB(lights, refFrame)
+	addHistory(&rgb.Header, "rgb", fileNames)
 
 	postProcessAndSaveRGBComposite(&rgb, nil)
 	rgb.Data=nil
@@ -725,8 +1262,8 @@ func cmdLRGB(args []string, applyLuminance bool) {
 	imageLevelParallelism:=int32(runtime.GOMAXPROCS(0))
 	if imageLevelParallelism>4 { imageLevelParallelism=4 }
 	nl.LogPrintf("\nReading color channels and detecting stars:\n")
-	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
-		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
+	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, nil, nil, false, nil, nil, 0, *debayer, *debayerMode, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), float32(*starInOut), int32(*starRadius), nl.PSFNone, 0, 0, *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
 
 	var refFrame, histoRef *nl.FITSImage
 	if (*align)!=0 {
@@ -770,6 +1307,11 @@ func cmdLRGB(args []string, applyLuminance bool) {
 	// Combine RGB channels
 	nl.LogPrintf("\nCombining color channels...\n")
 	rgb:=nl.CombineRGB(lights[1:], lights[0])
+	if applyLuminance {
+		addHistory(&rgb.Header, "lrgb", fileNames)
+	} else {
+		addHistory(&rgb.Header, "argb", fileNames)
+	}
 
 	if applyLuminance {
 		postProcessAndSaveRGBComposite(&rgb, lights[0])
@@ -911,6 +1453,30 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 		rgb.WriteJPGToFile(*jpg, 95)
 		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	}
+	writeImage(rgb)
+}
+
+
+// Write 16-bit PNG or 16/32-bit TIFF of the output image if flagged. Format is selected by flag or file suffix
+func writeImage(f *nl.FITSImage) {
+	if (*img)=="" { return }
+	format:=*imgFormat
+	if format=="" {
+		switch strings.ToLower(filepath.Ext(*img)) {
+		case ".png":          format="png16"
+		case ".tif", ".tiff": format="tiff16"
+		default:              nl.LogFatalf("Cannot select image format from suffix of %s\n", *img)
+		}
+	}
+	nl.LogPrintf("Writing %s to %s ...\n", format, *img)
+	var err error
+	switch format {
+	case "png16":  err=f.WritePNGToFile(*img)
+	case "tiff16": err=f.WriteTIFFToFile(*img, false)
+	case "tiff32": err=f.WriteTIFFToFile(*img, true)
+	default:       nl.LogFatalf("Unknown image format %s\n", format)
+	}
+	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 }
 
 
@@ -926,14 +1492,38 @@ func autoBalanceColors(rgb *nl.FITSImage) {
 }
 
 
+// Append processing provenance to the given header as HISTORY entries: nightlight version, command, 
+// all effective flag values, input files, and the outcomes recorded during processing
+func addHistory(h *nl.FITSHeader, cmd string, fileNames []string) {
+	h.AddProvenance("nightlight "+version, cmd, flag.CommandLine, fileNames, history)
+}
+
+
 // Turn filename wildcards into list of light frame files
 func globFilenameWildcards(args []string) []string {
 	if len(args)<1 { nl.LogFatal("No frames to process.") }
 	fileNames:=[]string{}
 	for _, pattern := range args {
+		// a trailing bracket is a character class if the whole pattern matches files,
+		// else keep HDU selectors like [1] out of the glob
+		hdu:=""
 		matches, err := filepath.Glob(pattern)
+		if err!=nil || len(matches)==0 {
+			pattern, hdu=nl.SplitHDUSuffix(pattern)
+			matches, err=filepath.Glob(pattern)
+		}
 		if err!=nil { nl.LogFatal(err) }
-		fileNames=append(fileNames, matches...)
+		for _, match:=range matches {
+			// expand SER videos into their individual frames
+			if hdu=="" && strings.ToLower(filepath.Ext(match))==".ser" {
+				frames, err:=nl.SERFrameNames(match)
+				if err!=nil { nl.LogFatal(err) }
+				fileNames=append(fileNames, frames...)
+				continue
+			}
+			if hdu!="" { match+="["+hdu+"]" }
+			fileNames=append(fileNames, match)
+		}
 	}
 	nl.LogPrintf("Found %d frames:\n", len(fileNames))
 	for i, fileName :=range fileNames {
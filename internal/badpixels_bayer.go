@@ -38,7 +38,12 @@ func CosmeticCorrectionBayer(data []float32, width int32, debayer, cfa string, s
 		return CosmeticCorrectionBayerGreen(median, data, width, xOffset, yOffset, sigmaLow, sigmaHigh), nil
 	case "B","b":
 		return CosmeticCorrectionBayerRedOrBlue(median, data, width, xOffset+1, yOffset+1, sigmaLow, sigmaHigh), nil
-	default:      
+	case "RGB","rgb":
+		numRemoved =CosmeticCorrectionBayerRedOrBlue(median, data, width, xOffset+0, yOffset+0, sigmaLow, sigmaHigh)
+		numRemoved+=CosmeticCorrectionBayerGreen    (median, data, width, xOffset,   yOffset,   sigmaLow, sigmaHigh)
+		numRemoved+=CosmeticCorrectionBayerRedOrBlue(median, data, width, xOffset+1, yOffset+1, sigmaLow, sigmaHigh)
+		return numRemoved, nil
+	default:
 		return 0, errors.New("Unknown debayering value " + debayer)
 	}
 }
@@ -24,26 +24,29 @@ import (
 )
 
 
-// Split input into required number of randomized batches, given the permissible amount of memory
-func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage) (numBatches, batchSize int64, ids []int, shuffledFileNames []string, imageLevelParallelism int32) {
+// Split input into required number of randomized batches, given the permissible amount of memory.
+// Masters cached by the calibration library, if any, count against the memory
+func PrepareBatches(fileNames []string, stMemory int64, biasF, darkF, flatF *FITSImage, lib *CalibrationLibrary) (numBatches, batchSize int64, ids []int, shuffledFileNames []string, imageLevelParallelism int32) {
 	numFrames:=int64(len(fileNames))
-	width, height:=int64(0), int64(0)
-	if darkF!=nil {
-		width, height=int64(darkF.Naxisn[0]), int64(darkF.Naxisn[1])
+	width, height, planes:=int64(0), int64(0), int64(1)
+	if biasF!=nil {
+		width, height, planes=int64(biasF.Naxisn[0]), int64(biasF.Naxisn[1]), int64(biasF.NumPlanes())
+	} else if darkF!=nil {
+		width, height, planes=int64(darkF.Naxisn[0]), int64(darkF.Naxisn[1]), int64(darkF.NumPlanes())
 	}  else if flatF!=nil {
-		width, height=int64(flatF.Naxisn[0]), int64(flatF.Naxisn[1])
+		width, height, planes=int64(flatF.Naxisn[0]), int64(flatF.Naxisn[1]), int64(flatF.NumPlanes())
 	} else {
 		LogPrintf("\nEstimating memory needs for %d images from %s:\n", numFrames, fileNames[0])
 		first:=NewFITSImage()
 		first.ReadFile(fileNames[0])
-		width, height=int64(first.Naxisn[0]), int64(first.Naxisn[1])
+		width, height, planes=int64(first.Naxisn[0]), int64(first.Naxisn[1]), int64(first.NumPlanes())
 	}
-	pixels:=width*height
+	pixels:=width*height*planes
 	mPixels:=float32(width)*float32(height)*1e-6
 	bytes:=pixels*4
 	mib:=bytes/1024/1024
-	LogPrintf("%d images of %dx%d pixels (%.1f MPixels), which each take %d MiB in-memory as floating point.\n", 
-	           numFrames, width, height, mPixels, mib)
+	LogPrintf("%d images of %dx%dx%d pixels (%.1f MPixels), which each take %d MiB in-memory as floating point.\n", 
+	           numFrames, width, height, planes, mPixels, mib)
 
 	availableFrames:=(int64(stMemory)*1024*1024)/bytes // rounding down
 	imageLevelParallelism=int32(runtime.GOMAXPROCS(0))
@@ -52,11 +55,13 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 	// Calculate batch sizes for preprocessing
 	for ; imageLevelParallelism>=1; imageLevelParallelism-- {
 		// Besides the lights in the current batch, we need one temp frame per thread,
-		// the optional dark and flat, the reference frame from batch 0 (if >1 batches), 
-		// and the stack of stacks (if >1 bacthes) 
+		// the optional bias, dark and flat, the masters cached by the calibration library,
+		// the reference frame from batch 0 (if >1 batches), and the stack of stacks (if >1 bacthes) 
 		batchSize=availableFrames - int64(imageLevelParallelism)
+		if biasF!=nil { batchSize-- }
 		if darkF!=nil { batchSize-- }
 		if flatF!=nil { batchSize-- }
+		if lib!=nil { batchSize-=int64(lib.CacheSize) }
 		if batchSize<2 { continue }
 
 		// correct for multi-batch memory requirements 
@@ -93,4 +98,4 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 		}
 	}
 	return numBatches, batchSize, perm, fileNames, imageLevelParallelism
-}
\ No newline at end of file
+}
\ No newline at end of file
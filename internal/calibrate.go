@@ -0,0 +1,110 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+
+// Subtracts bias and scaled dark current from light data in place, i.e. light-=bias+scale*(dark-bias).
+// The bias may be nil, in which case the dark is scaled as a whole
+func SubtractScaledDark(light, bias, dark []float32, scale float32) {
+	if bias==nil {
+		for i, d:=range dark { light[i]-=scale*d }
+		return
+	}
+	for i, d:=range dark {
+		b:=bias[i]
+		light[i]-=b+scale*(d-b)
+	}
+}
+
+
+// Finds the dark scale factor in [0, maxScale] which minimizes the noise of the calibrated light, via golden section search.
+// Noise is estimated on a central crop sampled at every second pixel, so all samples share one color of a filter array
+func OptimizeDarkScale(light, bias, dark []float32, width int32, maxScale float32) float32 {
+	// extract central crop with stride 2
+	height:=int32(len(light))/width
+	cw, ch:=width/2, height/2
+	if cw>512 { cw=512 }
+	if ch>512 { ch=512 }
+	x0, y0:=((width-2*cw)/2)&^1, ((height-2*ch)/2)&^1
+	l, d:=make([]float32, cw*ch), make([]float32, cw*ch)
+	for y:=int32(0); y<ch; y++ {
+		for x:=int32(0); x<cw; x++ {
+			src:=(y0+2*y)*width+x0+2*x
+			b:=float32(0)
+			if bias!=nil { b=bias[src] }
+			l[y*cw+x], d[y*cw+x]=light[src]-b, dark[src]-b
+		}
+	}
+
+	tmp:=make([]float32, len(l))
+	noise:=func(scale float32) float32 {
+		for i, ld:=range l { tmp[i]=ld-scale*d[i] }
+		return EstimateNoise(tmp, cw)
+	}
+
+	invPhi:=float32((math.Sqrt(5)-1)/2)
+	a, b:=float32(0), maxScale
+	c, e:=b-invPhi*(b-a), a+invPhi*(b-a)
+	nc, ne:=noise(c), noise(e)
+	for i:=0; i<40 && b-a>1e-4*maxScale; i++ {
+		if nc<ne {
+			b, e, ne=e, c, nc
+			c=b-invPhi*(b-a)
+			nc=noise(c)
+		} else {
+			a, c, nc=c, e, ne
+			e=a+invPhi*(b-a)
+			ne=noise(e)
+		}
+	}
+	return (a+b)/2
+}
+
+
+// Header values compared between lights and calibration frames of each type
+var calibrationKeys=map[string][]string{
+	"bias": {"GAIN", "OFFSET", "XBINNING", "YBINNING"},
+	"dark": {"CCD-TEMP", "GAIN", "OFFSET", "XBINNING", "YBINNING"},
+	"flat": {"XBINNING", "YBINNING"},
+}
+
+// Tolerance for sensor temperature differences between lights and calibration frames, in degrees Celsius
+const calibrationTempTolerance=1
+
+// Logs a warning for each header value of the light which differs from the given calibration frame
+func warnCalibrationMismatch(id int, light, calib *FITSImage, name string) {
+	mismatches:=[]string{}
+	for _, key:=range calibrationKeys[name] {
+		lv, lok:=light.Header.floatValue(key)
+		cv, cok:=calib.Header.floatValue(key)
+		if !lok || !cok { continue }
+		tolerance:=float32(0)
+		if key=="CCD-TEMP" { tolerance=calibrationTempTolerance }
+		if float32(math.Abs(float64(lv-cv)))>tolerance {
+			mismatches=append(mismatches, fmt.Sprintf("%s %g vs %g", key, lv, cv))
+		}
+	}
+	if len(mismatches)>0 {
+		LogPrintf("%d: Warning: light and %s differ in %s\n", id, name, strings.Join(mismatches, ", "))
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSubtractScaledDark(t *testing.T) {
+	light:=[]float32{700, 1600}
+	bias :=[]float32{500,  500}
+	dark :=[]float32{600, 5500}
+	SubtractScaledDark(light, bias, dark, 0.2)
+	for i, w:=range []float32{180, 100} {
+		if light[i]!=w { t.Errorf("light[%d]=%f; want %f", i, light[i], w) }
+	}
+}
+
+func TestOptimizeDarkScale(t *testing.T) {
+	width, height:=int32(64), int32(64)
+	light, bias, dark:=make([]float32, width*height), make([]float32, width*height), make([]float32, width*height)
+	seed:=uint32(1)
+	for i:=range light {
+		current:=float32(1)
+		if i%37==0 { current=200 }  // hot pixels
+		seed=seed*1664525+1013904223
+		light[i]=500+0.25*300*current+100+float32(seed>>24)/16
+		bias[i]=500
+		dark[i]=500+300*current
+	}
+	scale:=OptimizeDarkScale(light, bias, dark, width, 2)
+	if math.Abs(float64(scale-0.25))>0.01 { t.Errorf("scale=%f; want 0.25", scale) }
+}
@@ -19,6 +19,7 @@ package internal
 import (
 	"errors"
 	"math"
+	"strings"
 )
 
 
@@ -37,6 +38,143 @@ func getOffsets(cfa string) (xOffset, yOffset int32, err error) {
 	}
 }
 
+// Returns the given color filter array pattern in upper case if not empty, else the pattern from the header,
+// defaulting to RGGB
+func SelectCFA(cfa string, h *FITSHeader, height int32) string {
+	if cfa=strings.ToUpper(cfa); cfa!="" { return cfa }
+	if cfa=HeaderCFA(h, height); cfa!="" { return cfa }
+	return "RGGB"
+}
+
+// Returns the color filter array pattern of the image data from the header, or empty if none is given.
+// BAYERPAT describes the pattern in top-down row order. XBAYROFF and YBAYROFF give the offset of the image 
+// on the sensor, e.g. for regions of interest. Bottom-up row order starts with the last row of the pattern
+func HeaderCFA(h *FITSHeader, height int32) string {
+	pattern:=strings.ToUpper(strings.TrimSpace(h.Strings["BAYERPAT"]))
+	if _, _, err:=getOffsets(pattern); err!=nil { return "" }
+	xOffset, yOffset:=int(h.intValue("XBAYROFF")), int(h.intValue("YBAYROFF"))
+	if strings.ToUpper(strings.TrimSpace(h.Strings["ROWORDER"]))=="BOTTOM-UP" { yOffset+=int(height)-1 }
+	return shiftCFAPattern(pattern, xOffset, yOffset)
+}
+
+// Shifts a 2x2 color filter array pattern for an image cropped at the given offsets
+func shiftCFAPattern(pattern string, x, y int) string {
+	if x&1==1 { pattern=string([]byte{pattern[1], pattern[0], pattern[3], pattern[2]}) }
+	if y&1==1 { pattern=pattern[2:]+pattern[:2] }
+	return pattern
+}
+
+// Debayer the given color channel with the given algorithm, one of bilinear, vng, ahd or super. 
+// All but bilinear interpolate all three channels in one pass. Superpixel mode halves the resolution
+func Debayer(data []float32, width int32, debayer, cfa, mode string) (res []float32, adjWidth int32, err error) {
+	if mode=="bilinear" || mode=="" { return DebayerBilinear(data, width, debayer, cfa) }
+	rgb, adjWidth, err:=DebayerRGB(data, width, cfa, mode)
+	if err!=nil { return nil, 0, err }
+	planeSize:=len(rgb)/3
+	var plane int
+	switch(debayer) {
+	case "R","r": plane=0
+	case "G","g": plane=1
+	case "B","b": plane=2
+	default:      return nil, 0, errors.New("Unknown debayering value " + debayer)
+	}
+	// copy the channel, so the other two planes can be freed
+	res=make([]float32, planeSize)
+	copy(res, rgb[plane*planeSize:(plane+1)*planeSize])
+	return res, adjWidth, nil
+}
+
+// Debayer all three color channels with the given algorithm, one of bilinear, vng, ahd or super.
+// Returns planar RGB data. Ignores the last column and row in odd-sized images, like bilinear debayering
+func DebayerRGB(data []float32, width int32, cfa, mode string) (rgb []float32, adjWidth int32, err error) {
+	xOffset, yOffset, err:=getOffsets(cfa)
+	if err!=nil { return nil, 0, err }
+	raw, adjWidth, adjHeight:=cropRGGB(data, width, xOffset, yOffset)
+
+	switch mode {
+	case "bilinear", "": rgb=DebayerBilinearRGB(raw, adjWidth, adjHeight)
+	case "vng":          rgb=DebayerVNG(raw, adjWidth, adjHeight)
+	case "ahd":          rgb=DebayerAHD(raw, adjWidth, adjHeight)
+	case "super":        
+		rgb=DebayerSuperpixel(raw, adjWidth, adjHeight)
+		adjWidth/=2
+	default:             return nil, 0, errors.New("Unknown debayering mode "+mode)
+	}
+	return rgb, adjWidth, nil
+}
+
+// Copies the color filter array data starting at the given offsets into a new array with even width and height,
+// so the result has an RGGB pattern
+func cropRGGB(data []float32, width, xOffset, yOffset int32) (raw []float32, adjWidth, adjHeight int32) {
+	height   :=int32(len(data))/width
+	adjWidth  =(width-xOffset)  & ^1
+	adjHeight =(height-yOffset) & ^1
+	raw       =make([]float32, int(adjWidth)*int(adjHeight))
+	for row:=int32(0); row<adjHeight; row++ {
+		copy(raw[row*adjWidth:(row+1)*adjWidth], data[(row+yOffset)*width+xOffset:])
+	}
+	return raw, adjWidth, adjHeight
+}
+
+// Returns the color index 0=R, 1=G, 2=B of the given position in RGGB data
+func rggbColor(x, y int32) int {
+	return int(x&1 + y&1)
+}
+
+// Superpixel debayering of RGGB data with even width and height. Each 2x2 block becomes one pixel,
+// with the average of both greens. Returns planar RGB data of half the width and height
+func DebayerSuperpixel(raw []float32, width, height int32) (rgb []float32) {
+	w, h:=width/2, height/2
+	rgb=make([]float32, 3*int(w*h))
+	r, g, b:=rgb[:w*h], rgb[w*h:2*w*h], rgb[2*w*h:]
+	for y:=int32(0); y<h; y++ {
+		for x:=int32(0); x<w; x++ {
+			src:=2*y*width+2*x
+			r[y*w+x]=raw[src]
+			g[y*w+x]=0.5*(raw[src+1]+raw[src+width])
+			b[y*w+x]=raw[src+width+1]
+		}
+	}
+	return rgb
+}
+
+// Bilinear debayering of all three channels of RGGB data. Each missing color is the average of the 
+// nearest pixels of that color in the 3x3 neighborhood, clamped at the edges. Returns planar RGB data
+func DebayerBilinearRGB(raw []float32, width, height int32) (rgb []float32) {
+	size:=width*height
+	rgb=make([]float32, 3*size)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			bilinearRGBAt(rgb, raw, width, height, x, y)
+		}
+	}
+	return rgb
+}
+
+// Sets all three colors of the given pixel in planar RGB data with bilinear interpolation from RGGB data
+func bilinearRGBAt(rgb, raw []float32, width, height, x, y int32) {
+	size:=width*height
+	var sums [3]float32
+	var counts [3]int
+	own:=rggbColor(x, y)
+	for dy:=int32(-1); dy<=1; dy++ {
+		for dx:=int32(-1); dx<=1; dx++ {
+			xx, yy:=x+dx, y+dy
+			if xx<0 || yy<0 || xx>=width || yy>=height { continue }
+			c:=rggbColor(xx, yy)
+			// green is interpolated from the direct neighbors only
+			if c==1 && own!=1 && dx!=0 && dy!=0 { continue }
+			sums[c]+=raw[yy*width+xx]
+			counts[c]++
+		}
+	}
+	for c:=0; c<3; c++ {
+		v:=raw[y*width+x]
+		if c!=own { v=sums[c]/float32(counts[c]) }
+		rgb[int32(c)*size+y*width+x]=v
+	}
+}
+
 // Perform bilinear debayering, allocating a new resulting picture
 func DebayerBilinear(data []float32, width int32, debayer, cfa string) (res []float32, adjWidth int32, err error) {
 	// translate CFA type to offsets
@@ -0,0 +1,175 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+)
+
+// Debayering with adaptive homogeneity-directed interpolation (AHD), following Hirakawa and Parks,
+// "Adaptive homogeneity-directed demosaicing algorithm", 2005. Two full color images are interpolated
+// along rows and along columns. For each pixel, the one with more homogeneous neighbors in CIELab 
+// space is chosen, which avoids zipper artifacts and color fringes along edges.
+
+
+// Debayer RGGB data with even width and height using AHD. Returns planar RGB data
+func DebayerAHD(raw []float32, width, height int32) (rgb []float32) {
+	size:=width*height
+
+	// interpolate horizontally and vertically, and convert to CIELab
+	scale:=float32(0)
+	for _, v:=range raw {
+		if v>scale { scale=v }
+	}
+	if scale>0 { scale=1/scale }
+	var dirs, labs [2][]float32
+	for dir:=0; dir<2; dir++ {
+		dirs[dir]=ahdInterpolate(raw, width, height, dir==1)
+		labs[dir]=ahdToLab(dirs[dir], scale)
+	}
+
+	// count homogeneous neighbors of each pixel in both directions
+	var homo [2][]uint8
+	homo[0], homo[1]=make([]uint8, size), make([]uint8, size)
+	neighbors:=[]int32{-1, 1, -width, width}
+	for y:=int32(1); y<height-1; y++ {
+		for x:=int32(1); x<width-1; x++ {
+			i:=y*width+x
+			var lDiff, abDiff [2][4]float32
+			for dir:=0; dir<2; dir++ {
+				l, a, b:=labs[dir][:size], labs[dir][size:2*size], labs[dir][2*size:]
+				for k, n:=range neighbors {
+					dl:=l[i]-l[i+n]
+					if dl<0 { dl=-dl }
+					da, db:=a[i]-a[i+n], b[i]-b[i+n]
+					lDiff[dir][k], abDiff[dir][k]=dl, da*da+db*db
+				}
+			}
+			// thresholds from the smaller variation across the interpolation direction
+			lEps :=ahdMin(ahdMax(lDiff [0][0], lDiff [0][1]), ahdMax(lDiff [1][2], lDiff [1][3]))
+			abEps:=ahdMin(ahdMax(abDiff[0][0], abDiff[0][1]), ahdMax(abDiff[1][2], abDiff[1][3]))
+			for dir:=0; dir<2; dir++ {
+				for k:=range neighbors {
+					if lDiff[dir][k]<=lEps && abDiff[dir][k]<=abEps { homo[dir][i]++ }
+				}
+			}
+		}
+	}
+
+	// choose the direction with more homogeneity in the 3x3 neighborhood, or average if equal
+	rgb=make([]float32, 3*size)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			var hm [2]int
+			for yy:=y-1; yy<=y+1; yy++ {
+				for xx:=x-1; xx<=x+1; xx++ {
+					if xx<0 || yy<0 || xx>=width || yy>=height { continue }
+					hm[0]+=int(homo[0][yy*width+xx])
+					hm[1]+=int(homo[1][yy*width+xx])
+				}
+			}
+			i:=y*width+x
+			for c:=int32(0); c<3; c++ {
+				j:=c*size+i
+				switch {
+				case hm[0]>hm[1]: rgb[j]=dirs[0][j]
+				case hm[0]<hm[1]: rgb[j]=dirs[1][j]
+				default:          rgb[j]=0.5*(dirs[0][j]+dirs[1][j])
+				}
+			}
+		}
+	}
+	return rgb
+}
+
+// Interpolates RGGB data along rows or columns into planar RGB. Green is estimated from the two green neighbors
+// in the given direction with a correction from the second derivative of the known color, clamped to the neighbors.
+// Red and blue are interpolated from their color differences to green
+func ahdInterpolate(raw []float32, width, height int32, vertical bool) (img []float32) {
+	size:=width*height
+	img=make([]float32, 3*size)
+	g:=img[size:2*size]
+	step, pos, length:=int32(1), func(x, y int32) int32 { return x }, width
+	if vertical { step, pos, length=width, func(x, y int32) int32 { return y }, height }
+
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			i:=y*width+x
+			if rggbColor(x, y)==1 { g[i]=raw[i]; continue }
+			p:=pos(x, y)
+			if p<2 || p>=length-2 {
+				// at the edges, use the one or two neighbors available in this direction
+				if p==0 { g[i]=raw[i+step] } else if p==length-1 { g[i]=raw[i-step] } else { g[i]=0.5*(raw[i-step]+raw[i+step]) }
+				continue
+			}
+			g1, g2:=raw[i-step], raw[i+step]
+			est:=0.5*(g1+g2) + 0.25*(2*raw[i]-raw[i-2*step]-raw[i+2*step])
+			lo, hi:=ahdMin(g1, g2), ahdMax(g1, g2)
+			if est<lo { est=lo } else if est>hi { est=hi }
+			g[i]=est
+		}
+	}
+
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			i:=y*width+x
+			own:=rggbColor(x, y)
+			for _, c:=range []int{0, 2} {
+				if c==own { img[int32(c)*size+i]=raw[i]; continue }
+				sum, n:=float32(0), 0
+				for yy:=y-1; yy<=y+1; yy++ {
+					for xx:=x-1; xx<=x+1; xx++ {
+						if xx<0 || yy<0 || xx>=width || yy>=height || rggbColor(xx, yy)!=c { continue }
+						j:=yy*width+xx
+						sum+=raw[j]-g[j]
+						n++
+					}
+				}
+				img[int32(c)*size+i]=g[i]+sum/float32(n)
+			}
+		}
+	}
+	return img
+}
+
+// Converts planar linear RGB data with the given scale to [0,1] into planar CIELab, assuming sRGB primaries and D65 white
+func ahdToLab(rgb []float32, scale float32) (lab []float32) {
+	size:=len(rgb)/3
+	lab=make([]float32, len(rgb))
+	f:=func(t float64) float64 {
+		if t>0.008856 { return math.Cbrt(t) }
+		return 7.787*t + 16.0/116.0
+	}
+	for i:=0; i<size; i++ {
+		r, g, b:=float64(rgb[i]*scale), float64(rgb[size+i]*scale), float64(rgb[2*size+i]*scale)
+		fx:=f((0.4124*r + 0.3576*g + 0.1805*b)/0.95047)
+		fy:=f( 0.2126*r + 0.7152*g + 0.0722*b)
+		fz:=f((0.0193*r + 0.1192*g + 0.9505*b)/1.08883)
+		lab[i], lab[size+i], lab[2*size+i]=float32(116*fy-16), float32(500*(fx-fy)), float32(200*(fy-fz))
+	}
+	return lab
+}
+
+func ahdMin(a, b float32) float32 {
+	if a<b { return a }
+	return b
+}
+
+func ahdMax(a, b float32) float32 {
+	if a>b { return a }
+	return b
+}
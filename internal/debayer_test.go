@@ -84,3 +84,109 @@ func TestDebayerBilinearRGGBToBlue(t *testing.T) {
 	}
 }
 
+func TestShiftCFAPattern(t *testing.T) {
+	tests:=[]struct{ x, y int; want string }{ {0, 0, "RGGB"}, {1, 0, "GRBG"}, {0, 1, "GBRG"}, {3, 5, "BGGR"}, {-1, 0, "GRBG"} }
+	for _, test:=range tests {
+		if got:=shiftCFAPattern("RGGB", test.x, test.y); got!=test.want { t.Errorf("shift(%d,%d)=%s; want %s", test.x, test.y, got, test.want) }
+	}
+}
+
+func TestHeaderCFA(t *testing.T) {
+	tests:=[]struct{ pattern, rowOrder string; xOff, yOff int32; height int32; want string }{
+		{ "",     "",          0, 0, 100, ""     },
+		{ "RGGB", "",          0, 0, 100, "RGGB" },
+		{ "RGGB", "TOP-DOWN",  1, 0, 100, "GRBG" },
+		{ "rggb", "TOP-DOWN",  0, 1, 100, "GBRG" },
+		{ "RGGB", "BOTTOM-UP", 0, 0, 100, "GBRG" },
+		{ "RGGB", "BOTTOM-UP", 0, 0, 101, "RGGB" },
+		{ "GRBG", "BOTTOM-UP", 1, 1, 100, "RGGB" },
+		{ "CYYM", "",          0, 0, 100, ""     },
+	}
+	for i, test:=range tests {
+		h:=NewFITSHeader()
+		if test.pattern!="" { h.SetString("BAYERPAT", test.pattern, "") }
+		if test.rowOrder!="" { h.SetString("ROWORDER", test.rowOrder, "") }
+		if test.xOff!=0 { h.SetInt("XBAYROFF", test.xOff, "") }
+		if test.yOff!=0 { h.SetFloat("YBAYROFF", float32(test.yOff), "") }
+		if got:=HeaderCFA(&h, test.height); got!=test.want { t.Errorf("%d: HeaderCFA=%s; want %s", i, got, test.want) }
+	}
+}
+
+// Creates RGGB data of the given size from a function giving the true color of each pixel
+func testCFA(width, height int32, color func(x, y int32) [3]float32) (raw, rgb []float32) {
+	size:=width*height
+	raw, rgb=make([]float32, size), make([]float32, 3*size)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			c:=color(x, y)
+			raw[y*width+x]=c[rggbColor(x, y)]
+			for i:=int32(0); i<3; i++ { rgb[i*size+y*width+x]=c[i] }
+		}
+	}
+	return raw, rgb
+}
+
+func TestDebayerRGBConstantColor(t *testing.T) {
+	width, height:=int32(12), int32(10)
+	raw, want:=testCFA(width, height, func(x, y int32) [3]float32 { return [3]float32{10, 20, 30} })
+	for _, mode:=range []string{"bilinear", "vng", "ahd"} {
+		rgb, adjWidth, err:=DebayerRGB(raw, width, "RGGB", mode)
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", mode, err) }
+		if adjWidth!=width || len(rgb)!=len(want) { t.Fatalf("%s: adjWidth=%d len=%d; want %d %d", mode, adjWidth, len(rgb), width, len(want)) }
+		for i:=range rgb {
+			if rgb[i]!=want[i] { t.Errorf("%s: rgb[%d]=%f; want %f", mode, i, rgb[i], want[i]); break }
+		}
+	}
+}
+
+func TestDebayerSuperpixel(t *testing.T) {
+	// GRBG data, where the first column is skipped to start with red
+	width:=int32(5)
+	data:=[]float32{ 9, 1, 2, 5, 6,
+	                 9, 3, 4, 7, 8,
+	                 9, 2, 2, 2, 2,
+	                 9, 2, 9, 2, 1 }
+	rgb, adjWidth, err:=DebayerRGB(data, width, "GRBG", "super")
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if adjWidth!=2 || len(rgb)!=3*4 { t.Fatalf("adjWidth=%d len=%d; want 2 12", adjWidth, len(rgb)) }
+	want:=[]float32{1, 5, 2, 2,  2.5, 6.5, 2, 2,  4, 8, 9, 1}
+	for i:=range want {
+		if rgb[i]!=want[i] { t.Errorf("rgb[%d]=%f; want %f", i, rgb[i], want[i]) }
+	}
+}
+
+func TestDebayerEdge(t *testing.T) {
+	// gray image with a sharp vertical edge. Edge-directed algorithms should produce less color error than bilinear
+	width, height:=int32(16), int32(16)
+	raw, want:=testCFA(width, height, func(x, y int32) [3]float32 {
+		if x<7 { return [3]float32{100, 100, 100} }
+		return [3]float32{1000, 1000, 1000}
+	})
+	sqErrs:=map[string]float32{}
+	for _, mode:=range []string{"bilinear", "vng", "ahd"} {
+		rgb, _, err:=DebayerRGB(raw, width, "RGGB", mode)
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", mode, err) }
+		sum:=float32(0)
+		for i:=range rgb {
+			d:=rgb[i]-want[i]
+			sum+=d*d
+		}
+		sqErrs[mode]=sum
+	}
+	if sqErrs["vng"]>=sqErrs["bilinear"] { t.Errorf("vng error=%f; want less than bilinear %f", sqErrs["vng"], sqErrs["bilinear"]) }
+	if sqErrs["ahd"]>=sqErrs["bilinear"] { t.Errorf("ahd error=%f; want less than bilinear %f", sqErrs["ahd"], sqErrs["bilinear"]) }
+}
+
+func TestDebayerChannel(t *testing.T) {
+	width, height:=int32(8), int32(6)
+	raw, want:=testCFA(width, height, func(x, y int32) [3]float32 { return [3]float32{1, 2, 3} })
+	for _, mode:=range []string{"vng", "ahd", "super"} {
+		res, adjWidth, err:=Debayer(raw, width, "B", "RGGB", mode)
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", mode, err) }
+		if mode=="super" && (adjWidth!=width/2 || len(res)!=len(want)/12) { t.Errorf("%s: adjWidth=%d len=%d", mode, adjWidth, len(res)) }
+		for i:=range res {
+			if res[i]!=3 { t.Errorf("%s: res[%d]=%f; want 3", mode, i, res[i]); break }
+		}
+	}
+	if _, _, err:=Debayer(raw, width, "B", "RGGB", "foo"); err==nil { t.Errorf("err=nil; want unknown mode") }
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+// Debayering with variable number of gradients (VNG), following Chang, Cheung and Pang, 
+// "Color filter array recovery using a threshold-based variable number of gradients", 1999.
+// For each pixel, gradients in eight directions are estimated from the 5x5 neighborhood. 
+// Color differences are averaged over all directions with gradients below a threshold, 
+// so interpolation follows edges instead of crossing them.
+
+
+// A pair of positions relative to the center pixel whose absolute difference contributes to a gradient
+type vngPair struct {
+	x1, y1, x2, y2 int32
+	weight         float32
+}
+
+// Gradient pairs for the north and north-east directions, for red or blue centers and for green centers.
+// The other directions are obtained by rotation, which keeps the pairs on matching colors
+var vngNorthPairs=[]vngPair{
+	{0,-1, 0,1, 1}, {0,-2, 0,0, 1}, {-1,-1, -1,1, 0.5}, {1,-1, 1,1, 0.5}, {-1,-2, -1,0, 0.5}, {1,-2, 1,0, 0.5},
+}
+var vngNorthEastPairsRB=[]vngPair{
+	{1,-1, -1,1, 1}, {2,-2, 0,0, 1}, {0,-1, -1,0, 0.5}, {1,0, 0,1, 0.5}, {1,-2, 0,-1, 0.5}, {2,-1, 1,0, 0.5},
+}
+var vngNorthEastPairsG=[]vngPair{
+	{1,-1, -1,1, 1}, {2,-2, 0,0, 1}, {0,-1, -2,1, 0.5}, {1,0, -1,2, 0.5},
+}
+
+// Debayer RGGB data with even width and height using VNG. Pixels within two of the border use bilinear 
+// interpolation. Returns planar RGB data
+func DebayerVNG(raw []float32, width, height int32) (rgb []float32) {
+	size:=width*height
+	rgb=make([]float32, 3*size)
+
+	// precompute rotated pairs and color sampling positions for the eight directions, clockwise from north
+	var pairsRB, pairsG [8][]vngPair
+	var samples [8][][2]int32
+	for d:=0; d<8; d++ {
+		rot:=d/2
+		if d%2==0 {
+			pairsRB[d]=rotateVNGPairs(vngNorthPairs, rot)
+			pairsG [d]=pairsRB[d]
+			// the 3x3 block centered one step from the pixel in this direction, plus two steps ahead
+			for _, p:=range [][2]int32{{0,0},{-1,0},{1,0},{0,-1},{-1,-1},{1,-1},{0,-2},{-1,-2},{1,-2}} {
+				samples[d]=append(samples[d], rotateVNG(p[0], p[1], rot))
+			}
+		} else {
+			pairsRB[d]=rotateVNGPairs(vngNorthEastPairsRB, rot)
+			pairsG [d]=rotateVNGPairs(vngNorthEastPairsG,  rot)
+			for _, p:=range [][2]int32{{0,0},{1,-1},{2,-2},{1,0},{0,-1},{2,-1},{1,-2}} {
+				samples[d]=append(samples[d], rotateVNG(p[0], p[1], rot))
+			}
+		}
+	}
+
+	var grads [8]float32
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			if x<2 || y<2 || x>=width-2 || y>=height-2 {
+				bilinearRGBAt(rgb, raw, width, height, x, y)
+				continue
+			}
+			center:=y*width+x
+			own:=rggbColor(x, y)
+			pairs:=&pairsRB
+			if own==1 { pairs=&pairsG }
+
+			// gradients and threshold
+			min, max:=float32(0), float32(0)
+			for d:=0; d<8; d++ {
+				g:=float32(0)
+				for _, p:=range pairs[d] {
+					diff:=raw[center+p.y1*width+p.x1]-raw[center+p.y2*width+p.x2]
+					if diff<0 { diff=-diff }
+					g+=p.weight*diff
+				}
+				grads[d]=g
+				if d==0 || g<min { min=g }
+				if d==0 || g>max { max=g }
+			}
+			threshold:=1.5*min + 0.5*(max-min)
+
+			// sum of average colors in the directions below the threshold
+			var sums [3]float32
+			n:=float32(0)
+			for d:=0; d<8; d++ {
+				if grads[d]>threshold { continue }
+				n++
+				var dirSums [3]float32
+				var counts [3]int
+				for _, s:=range samples[d] {
+					c:=rggbColor(x+s[0], y+s[1])
+					dirSums[c]+=raw[center+s[1]*width+s[0]]
+					counts[c]++
+				}
+				for c:=0; c<3; c++ { sums[c]+=dirSums[c]/float32(counts[c]) }
+			}
+
+			// missing colors from the color differences to the known one
+			v:=raw[center]
+			for c:=0; c<3; c++ {
+				res:=v
+				if c!=own { res=v+(sums[c]-sums[own])/n }
+				rgb[int32(c)*size+center]=res
+			}
+		}
+	}
+	return rgb
+}
+
+// Rotates the given relative position clockwise by the given number of quarter turns
+func rotateVNG(x, y int32, quarterTurns int) [2]int32 {
+	for i:=0; i<quarterTurns; i++ { x, y=-y, x }
+	return [2]int32{x, y}
+}
+
+// Rotates all pairs clockwise by the given number of quarter turns
+func rotateVNGPairs(pairs []vngPair, quarterTurns int) (res []vngPair) {
+	for _, p:=range pairs {
+		a, b:=rotateVNG(p.x1, p.y1, quarterTurns), rotateVNG(p.x2, p.y2, quarterTurns)
+		res=append(res, vngPair{a[0], a[1], b[0], b[1], p.weight})
+	}
+	return res
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// A map of defective sensor pixels, columns and rows. Built once from a master dark or from many lights,
+// and applied to every light instead of re-detecting outliers statistically
+type DefectMap struct {
+	Width   int32
+	Height  int32
+	Pixels  []int32   // Indices of defective pixels outside defective columns and rows, in ascending order
+	Columns []int32   // X coordinates of defective columns, in ascending order
+	Rows    []int32   // Y coordinates of defective rows, in ascending order
+}
+
+
+// Detects defective pixels in the given sensor data, e.g. a master dark. Pixels are defective if they deviate from their
+// local median by more than the given sigmas. Color filter array data is compared within each color, unless cfa is empty.
+// If lineSigma is positive, columns and rows whose median deviates from those of the other lines by more than lineSigma are defective
+func BuildDefectMap(data []float32, width int32, cfa string, sigmaLow, sigmaHigh, lineSigma float32) (d *DefectMap, err error) {
+	height:=int32(len(data))/width
+	d=&DefectMap{Width:width, Height:height}
+
+	if lineSigma>0 {
+		d.Columns=defectiveLines(data, width, height, 1, width, lineSigma)
+		d.Rows   =defectiveLines(data, width, height, width, 1, lineSigma)
+	}
+
+	var bpm []int32
+	if cfa=="" {
+		bpm, _=BadPixelMap(data, width, sigmaLow, sigmaHigh)
+	} else {
+		// find the pixels cosmetic correction would change
+		tmp:=append([]float32(nil), data...)
+		_, err=CosmeticCorrectionBayer(tmp, width, "RGB", cfa, sigmaLow, sigmaHigh)
+		if err!=nil { return nil, err }
+		for i, v:=range tmp {
+			if v!=data[i] { bpm=append(bpm, int32(i)) }
+		}
+	}
+	d.Pixels=d.outsideLines(bpm)
+	return d, nil
+}
+
+// Returns the coordinates of lines whose median deviates from the median of all lines of the same parity by more
+// than sigma robust standard deviations. Lines start every lineStep elements, and have elements every pixelStep
+func defectiveLines(data []float32, width, height int32, lineStep, pixelStep int32, sigma float32) (lines []int32) {
+	numLines, lineLen:=width, height
+	if lineStep==width { numLines, lineLen=height, width }
+
+	medians:=make([]float32, numLines)
+	buf:=make([]float32, lineLen)
+	for l:=int32(0); l<numLines; l++ {
+		for i:=int32(0); i<lineLen; i++ { buf[i]=data[l*lineStep+i*pixelStep] }
+		medians[l]=QSelectMedianFloat32(buf)
+	}
+
+	// compare each line with the others of the same parity, as color filter arrays alternate colors
+	for parity:=int32(0); parity<2; parity++ {
+		same:=[]float32{}
+		for l:=parity; l<numLines; l+=2 { same=append(same, medians[l]) }
+		if len(same)<3 { continue }
+		loc:=QSelectMedianFloat32(append([]float32(nil), same...))
+		for i, m:=range same { same[i]=float32(math.Abs(float64(m-loc))) }
+		scale:=1.4826*QSelectMedianFloat32(same)
+		if scale==0 { continue }
+		for l:=parity; l<numLines; l+=2 {
+			if float32(math.Abs(float64(medians[l]-loc)))>sigma*scale { lines=append(lines, l) }
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i]<lines[j] })
+	return lines
+}
+
+// Returns the given pixel indices outside of defective columns and rows, in ascending order
+func (d *DefectMap) outsideLines(indices []int32) (pixels []int32) {
+	cols, rows:=map[int32]bool{}, map[int32]bool{}
+	for _, c:=range d.Columns { cols[c]=true }
+	for _, r:=range d.Rows    { rows[r]=true }
+	for _, i:=range indices {
+		if !cols[i%d.Width] && !rows[i/d.Width] { pixels=append(pixels, i) }
+	}
+	sort.Slice(pixels, func(i, j int) bool { return pixels[i]<pixels[j] })
+	return pixels
+}
+
+
+// Merges defect maps built from many lights. Keeps defects present in at least the given fraction of maps,
+// so stars and cosmic ray hits which move or vanish between frames are dropped
+func MergeDefectMaps(maps []*DefectMap, minFraction float32) (d *DefectMap, err error) {
+	if len(maps)==0 { return nil, errors.New("no defect maps to merge") }
+	d=&DefectMap{Width:maps[0].Width, Height:maps[0].Height}
+	minCount:=int(math.Ceil(float64(minFraction*float32(len(maps)))))
+	if minCount<1 { minCount=1 }
+
+	pixels, cols, rows:=map[int32]int{}, map[int32]int{}, map[int32]int{}
+	for _, m:=range maps {
+		if m.Width!=d.Width || m.Height!=d.Height { return nil, errors.New("defect maps differ in size") }
+		for _, p:=range m.Pixels  { pixels[p]++ }
+		for _, c:=range m.Columns { cols[c]++ }
+		for _, r:=range m.Rows    { rows[r]++ }
+	}
+	d.Columns, d.Rows=frequentKeys(cols, minCount), frequentKeys(rows, minCount)
+	d.Pixels=d.outsideLines(frequentKeys(pixels, minCount))
+	return d, nil
+}
+
+// Returns the keys with at least the given count, in ascending order
+func frequentKeys(counts map[int32]int, minCount int) (keys []int32) {
+	for k, c:=range counts {
+		if c>=minCount { keys=append(keys, k) }
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i]<keys[j] })
+	return keys
+}
+
+
+// Corrects the defects in the given data. Defective pixels are replaced with the median of their neighborhood, then defective
+// columns and rows are interpolated from their neighbors of the same color. Color filter array data is corrected within 
+// each color, unless cfa is empty
+func (d *DefectMap) Apply(data []float32, width int32, cfa string) error {
+	if width!=d.Width || int32(len(data))/width!=d.Height { return errors.New("image size differs from defect map size") }
+	step:=int32(1)
+	xOffset, yOffset:=int32(0), int32(0)
+	if cfa!="" {
+		var err error
+		xOffset, yOffset, err=getOffsets(cfa)
+		if err!=nil { return err }
+		step=2
+	}
+
+	if cfa=="" {
+		MedianFilterSparse(data, d.Pixels, CreateMask(width, 1.5))
+	} else {
+		medianFilterBayerSparse(data, width, d.Pixels, xOffset, yOffset)
+	}
+
+	d.interpolateLines(data, d.Columns, 1, width, d.Width, d.Height, step)
+	d.interpolateLines(data, d.Rows, width, 1, d.Height, d.Width, step)
+	return nil
+}
+
+// Replaces the given lines with the average of the nearest good lines of the same color on either side.
+// Lines start every lineStep elements, have elements every pixelStep, and there are numLines lines of lineLen each
+func (d *DefectMap) interpolateLines(data []float32, lines []int32, lineStep, pixelStep, numLines, lineLen, step int32) {
+	bad:=map[int32]bool{}
+	for _, l:=range lines { bad[l]=true }
+	for _, l:=range lines {
+		left, right:=l-step, l+step
+		for left>=0 && bad[left] { left-=step }
+		for right<numLines && bad[right] { right+=step }
+		for i:=int32(0); i<lineLen; i++ {
+			sum, num:=float32(0), 0
+			if left>=0        { sum+=data[left *lineStep+i*pixelStep]; num++ }
+			if right<numLines { sum+=data[right*lineStep+i*pixelStep]; num++ }
+			if num>0 { data[l*lineStep+i*pixelStep]=sum/float32(num) }
+		}
+	}
+}
+
+// Replaces the given pixels of color filter array data with the median of their neighbors of the same color,
+// using the neighborhoods of MedianFilterBayerRedOrBlue and MedianFilterBayerGreen
+func medianFilterBayerSparse(data []float32, width int32, indices []int32, xOffset, yOffset int32) {
+	height:=int32(len(data))/width
+	tmp:=make([]float32, 9)
+	for _, index:=range indices {
+		x, y:=index%width, index/width
+		numGathered:=0
+		if (x-xOffset+y-yOffset)&1!=0 {
+			for _, o:=range gOffsets {
+				nx, ny:=x+o.X, y+o.Y
+				if nx<0 || nx>=width || ny<0 || ny>=height { continue }
+				tmp[numGathered]=data[ny*width+nx]
+				numGathered++
+			}
+		} else {
+			for ny:=y-2; ny<=y+2; ny+=2 {
+				if ny<0 || ny>=height { continue }
+				for nx:=x-2; nx<=x+2; nx+=2 {
+					if nx<0 || nx>=width { continue }
+					tmp[numGathered]=data[ny*width+nx]
+					numGathered++
+				}
+			}
+		}
+		data[index]=MedianFloat32(tmp[:numGathered])
+	}
+}
+
+
+// Returns the number of defective pixels, including those in defective columns and rows
+func (d *DefectMap) NumDefects() int {
+	return len(d.Pixels)+len(d.Columns)*int(d.Height)+len(d.Rows)*int(d.Width)-len(d.Columns)*len(d.Rows)
+}
+
+func (d *DefectMap) String() string {
+	return fmt.Sprintf("%dx%d defect map with %d pixels, %d columns and %d rows", d.Width, d.Height, len(d.Pixels), len(d.Columns), len(d.Rows))
+}
+
+
+// Writes the defect map to the given file. Files with .txt suffix get a text list of coordinates, 
+// other files a FITS mask which is one for defective pixels and zero otherwise
+func (d *DefectMap) WriteFile(fileName string) error {
+	if strings.ToLower(path.Ext(fileName))==".txt" { return d.writeText(fileName) }
+
+	mask:=NewFITSImage()
+	mask.Bitpix, mask.Naxisn, mask.Pixels=-32, []int32{d.Width, d.Height}, d.Width*d.Height
+	mask.Data=make([]float32, mask.Pixels)
+	for _, p:=range d.Pixels { mask.Data[p]=1 }
+	for _, c:=range d.Columns {
+		for y:=int32(0); y<d.Height; y++ { mask.Data[y*d.Width+c]=1 }
+	}
+	for _, r:=range d.Rows {
+		for x:=int32(0); x<d.Width; x++ { mask.Data[r*d.Width+x]=1 }
+	}
+	mask.Header.SetString("IMAGETYP", "Defect Map", "Type of image")
+	return mask.WriteFile(fileName)
+}
+
+// Writes the defect map as text, with the image size followed by one defective pixel, column or row per line
+func (d *DefectMap) writeText(fileName string) error {
+	f, err:=os.Create(fileName)
+	if err!=nil { return err }
+	defer f.Close()
+	w:=bufio.NewWriter(f)
+	fmt.Fprintf(w, "# nightlight defect map: size width height, pixel x y, column x, row y\n")
+	fmt.Fprintf(w, "size %d %d\n", d.Width, d.Height)
+	for _, c:=range d.Columns { fmt.Fprintf(w, "column %d\n", c) }
+	for _, r:=range d.Rows    { fmt.Fprintf(w, "row %d\n", r) }
+	for _, p:=range d.Pixels  { fmt.Fprintf(w, "pixel %d %d\n", p%d.Width, p/d.Width) }
+	return w.Flush()
+}
+
+
+// Reads a defect map from a text list of coordinates with .txt suffix, or from a FITS mask.
+// Fully defective columns and rows of a mask are recognized as such
+func LoadDefectMap(fileName string) (d *DefectMap, err error) {
+	if strings.ToLower(path.Ext(fileName))==".txt" { return readDefectText(fileName) }
+
+	mask:=NewFITSImage()
+	err=mask.ReadFile(fileName)
+	if err!=nil { return nil, err }
+	if len(mask.Naxisn)!=2 { return nil, errors.New("defect mask must be a two-dimensional image") }
+	d=&DefectMap{Width:mask.Naxisn[0], Height:mask.Naxisn[1]}
+
+	for x:=int32(0); x<d.Width; x++ {
+		full:=true
+		for y:=int32(0); y<d.Height && full; y++ { full=mask.Data[y*d.Width+x]!=0 }
+		if full { d.Columns=append(d.Columns, x) }
+	}
+	for y:=int32(0); y<d.Height; y++ {
+		full:=true
+		for x:=int32(0); x<d.Width && full; x++ { full=mask.Data[y*d.Width+x]!=0 }
+		if full { d.Rows=append(d.Rows, y) }
+	}
+	bpm:=[]int32{}
+	for i, v:=range mask.Data {
+		if v!=0 { bpm=append(bpm, int32(i)) }
+	}
+	d.Pixels=d.outsideLines(bpm)
+	return d, nil
+}
+
+func readDefectText(fileName string) (d *DefectMap, err error) {
+	f, err:=os.Open(fileName)
+	if err!=nil { return nil, err }
+	defer f.Close()
+
+	d=&DefectMap{}
+	pixels:=[]int32{}
+	scanner:=bufio.NewScanner(f)
+	for lineNo:=1; scanner.Scan(); lineNo++ {
+		fields:=strings.Fields(scanner.Text())
+		if len(fields)==0 || strings.HasPrefix(fields[0], "#") { continue }
+		values:=make([]int32, len(fields)-1)
+		for i, field:=range fields[1:] {
+			v, err:=strconv.ParseInt(field, 10, 32)
+			if err!=nil { return nil, errors.New(fmt.Sprintf("%s:%d: invalid number %s", fileName, lineNo, field)) }
+			values[i]=int32(v)
+		}
+		switch {
+		case fields[0]=="size"   && len(values)==2: d.Width, d.Height=values[0], values[1]
+		case fields[0]=="column" && len(values)==1: d.Columns=append(d.Columns, values[0])
+		case fields[0]=="row"    && len(values)==1: d.Rows=append(d.Rows, values[0])
+		case fields[0]=="pixel"  && len(values)==2: 
+			if values[0]<0 || values[0]>=d.Width { return nil, errors.New(fmt.Sprintf("%s:%d: pixel outside size", fileName, lineNo)) }
+			pixels=append(pixels, values[1]*d.Width+values[0])
+		default: 
+			return nil, errors.New(fmt.Sprintf("%s:%d: invalid line '%s'", fileName, lineNo, scanner.Text()))
+		}
+	}
+	if err:=scanner.Err(); err!=nil { return nil, err }
+	if d.Width<=0 || d.Height<=0 { return nil, errors.New(fileName + ": missing size") }
+
+	for _, c:=range d.Columns { if c<0 || c>=d.Width  { return nil, errors.New(fmt.Sprintf("%s: column %d out of range", fileName, c)) } }
+	for _, r:=range d.Rows    { if r<0 || r>=d.Height { return nil, errors.New(fmt.Sprintf("%s: row %d out of range", fileName, r)) } }
+	for _, p:=range pixels    { if p<0 || p>=d.Width*d.Height { return nil, errors.New(fmt.Sprintf("%s: pixel %d,%d out of range", fileName, p%d.Width, p/d.Width)) } }
+	sort.Slice(d.Columns, func(i, j int) bool { return d.Columns[i]<d.Columns[j] })
+	sort.Slice(d.Rows,    func(i, j int) bool { return d.Rows[i]<d.Rows[j] })
+	d.Pixels=d.outsideLines(pixels)
+	return d, nil
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDefectMap(t *testing.T) {
+	width, height:=int32(32), int32(32)
+	data:=make([]float32, width*height)
+	seed:=uint32(7)
+	for i:=range data {
+		seed=seed*1664525+1013904223
+		data[i]=100+float32(seed>>24)/64
+	}
+	hot:=10*width+10
+	data[hot]=5000
+	for y:=int32(0); y<height; y++ { data[y*width+21]+=50 }  // bad column
+
+	d, err:=BuildDefectMap(data, width, "RGGB", 3, 5, 5)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if len(d.Columns)!=1 || d.Columns[0]!=21 { t.Errorf("Columns=%v; want [21]", d.Columns) }
+	found:=false
+	for _, p:=range d.Pixels { found=found || p==hot }
+	if !found { t.Errorf("Pixels=%v; want to contain %d", d.Pixels, hot) }
+
+	f, err:=ioutil.TempFile("", "defects*.txt")
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	f.Close()
+	defer os.Remove(f.Name())
+	if err:=d.WriteFile(f.Name()); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	loaded, err:=LoadDefectMap(f.Name())
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if loaded.String()!=d.String() { t.Errorf("loaded %v; want %v", loaded, d) }
+
+	if err:=loaded.Apply(data, width, "RGGB"); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if data[hot]>200 { t.Errorf("data[hot]=%f; want <200", data[hot]) }
+	if v:=data[5*width+21]; v>150 { t.Errorf("column value=%f; want <150", v) }
+}
@@ -18,6 +18,7 @@ package internal
 
 import (
 	"math"
+	"strconv"
 )
 
 // A FITS image. 
@@ -31,16 +32,21 @@ type FITSImage struct {
 	Bitpix int32         // Bits per pixel value from the header. Positive values are integral, negative floating.
 	Bzero  float32 		 // Zero offset. True pixel value is Bzero + Data[i]. 
 						 // Helps implement unsigned values with signed data types.
+	Bscale float32       // Scale factor. True pixel value is Bzero + Bscale*Data[i]. 
+						 // Only relevant while reading, data values are scaled afterwards.
 	Naxisn []int32 		 // Axis dimensions. Most quickly varying dimension first (i.e. X,Y)
 	Pixels int32 		 // Number of pixels in the image. Product of Naxisn[]
 
 	Data   []float32     // The image data
+	CFA    string        // Color filter array pattern the data was debayered from, if any
 
 	Exposure float32     // Image exposure in seconds
 
 	Stats  *BasicStats   // Basic image statistics: min, mean, max
 	Stars  []Star        // Star detections
 	HFR    float32       // Half-flux radius of the star detections
+	PSFs   []PSF         // Point spread functions fitted to the brightest stars, if any
+	PSF    *PSFStats     // Summary of the point spread functions, if any
 
 	Trans    Transform2D // Transformation to reference frame
 	Residual float32     // Residual error from the above transformation 
@@ -53,30 +59,226 @@ func NewFITSImage() FITSImage {
 	}
 }
 
+// Returns the number of image planes. This is NAXIS3 for data cubes like RGB images, and 1 for monochrome images
+func (f *FITSImage) NumPlanes() int32 {
+	if len(f.Naxisn)<3 { return 1 }
+	return f.Naxisn[2]
+}
+
+// Returns the data of the given image plane as a subslice, so modifications apply to the image
+func (f *FITSImage) Plane(i int32) []float32 {
+	l:=int32(len(f.Data))/f.NumPlanes()
+	return f.Data[i*l:(i+1)*l]
+}
+
+// Returns a luminance proxy for statistics and star detection. This is the image data itself
+// for monochrome images, and the average across all planes for data cubes
+func (f *FITSImage) Luminance() []float32 {
+	planes:=f.NumPlanes()
+	if planes==1 { return f.Data }
+	l:=int32(len(f.Data))/planes
+	lum:=make([]float32, l)
+	for p:=int32(0); p<planes; p++ {
+		for i, d:=range f.Data[p*l:(p+1)*l] { lum[i]+=d }
+	}
+	factor:=1/float32(planes)
+	for i, d:=range lum { lum[i]=d*factor }
+	return lum
+}
+
+// Splits a data cube into one monochrome image per plane, for example to separate the color channels
+// of a one-shot color stack. Planes share the data of the cube and get their own statistics.
+// The exposure time is split evenly, so recombining the planes preserves the total
+func (f *FITSImage) SplitPlanes() (planes []*FITSImage, err error) {
+	num:=f.NumPlanes()
+	planes=make([]*FITSImage, num)
+	for p:=int32(0); p<num; p++ {
+		plane:=&FITSImage{
+			ID      :f.ID,
+			FileName:f.FileName,
+			Header  :f.Header.Clone(),
+			Bitpix  :f.Bitpix,
+			Bzero   :f.Bzero,
+			Bscale  :f.Bscale,
+			Naxisn  :[]int32{f.Naxisn[0], f.Naxisn[1]},
+			Data    :f.Plane(p),
+			CFA     :f.CFA,
+			Exposure:f.Exposure/float32(num),
+			Stars   :f.Stars,
+			HFR     :f.HFR,
+			PSFs    :f.PSFs,
+			PSF     :f.PSF,
+			Trans   :f.Trans,
+			Residual:f.Residual,
+		}
+		plane.Pixels=int32(len(plane.Data))
+		plane.Stats, err=CalcExtendedStats(plane.Data, plane.Naxisn[0])
+		if err!=nil { return nil, err }
+		planes[p]=plane
+	}
+	return planes, nil
+}
+
 // FITS header data
 type FITSHeader struct {
-	Bools    map[string]bool
-	Ints     map[string]int32
-	Floats   map[string]float32
-	Strings  map[string]string
-	Dates    map[string]string
-	Comments []string
-	History  []string
-	End      bool
-	Length   int32
+	Bools       map[string]bool
+	Ints        map[string]int32
+	Floats      map[string]float64   // Kept at double precision, so timing and astrometry values like JD survive a round trip
+	Strings     map[string]string
+	Dates       map[string]string
+	Complexes   map[string]complex64
+	Keys        []string          // All value keys in order of appearance, for writing them back out
+	KeyComments map[string]string // Comments trailing the value of a key, if any
+	Comments    []string
+	History     []string
+	End         bool
+	Length      int32
 }
 
 // Creates a FITS header initialized with empty maps and arrays
 func NewFITSHeader() FITSHeader {
 	return FITSHeader{
-		Bools:   make(map[string]bool), 
-		Ints:    make(map[string]int32),
-		Floats:  make(map[string]float32),
-		Strings: make(map[string]string),
-		Dates:   make(map[string]string),
-		Comments:make([]string,0),
-		History: make([]string,0),
-		End:     false,
+		Bools:      make(map[string]bool),
+		Ints:       make(map[string]int32),
+		Floats:     make(map[string]float64),
+		Strings:    make(map[string]string),
+		Dates:      make(map[string]string),
+		Complexes:  make(map[string]complex64),
+		Keys:       make([]string,0),
+		KeyComments:make(map[string]string),
+		Comments:   make([]string,0),
+		History:    make([]string,0),
+		End:        false,
+	}
+}
+
+// Creates a deep copy of the FITS header, so the copy can be modified independently
+func (h *FITSHeader) Clone() FITSHeader {
+	c:=NewFITSHeader()
+	for k,v:=range h.Bools       { c.Bools[k]=v }
+	for k,v:=range h.Ints        { c.Ints[k]=v }
+	for k,v:=range h.Floats      { c.Floats[k]=v }
+	for k,v:=range h.Strings     { c.Strings[k]=v }
+	for k,v:=range h.Dates       { c.Dates[k]=v }
+	for k,v:=range h.Complexes   { c.Complexes[k]=v }
+	for k,v:=range h.KeyComments { c.KeyComments[k]=v }
+	c.Keys    =append(c.Keys,     h.Keys...)
+	c.Comments=append(c.Comments, h.Comments...)
+	c.History =append(c.History,  h.History...)
+	c.End, c.Length=h.End, h.Length
+	return c
+}
+
+// Returns true if the header contains a value for the given key
+func (h *FITSHeader) Has(key string) bool {
+	if _, ok:=h.Bools  [key]; ok { return true }
+	if _, ok:=h.Ints   [key]; ok { return true }
+	if _, ok:=h.Floats [key]; ok { return true }
+	if _, ok:=h.Strings[key]; ok { return true }
+	if _, ok:=h.Dates  [key]; ok { return true }
+	if _, ok:=h.Complexes[key]; ok { return true }
+	return false
+}
+
+// Removes the given key and its value from the header
+func (h *FITSHeader) Delete(key string) {
+	delete(h.Bools,   key)
+	delete(h.Ints,    key)
+	delete(h.Floats,  key)
+	delete(h.Strings, key)
+	delete(h.Dates,   key)
+	delete(h.Complexes, key)
+	delete(h.KeyComments, key)
+	for i, k:=range h.Keys {
+		if k==key {
+			h.Keys=append(h.Keys[:i], h.Keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Prepares the header for setting a new value for the given key. Removes any old value,
+// possibly of a different type, while keeping the position of the key. Appends new keys at the end.
+func (h *FITSHeader) prepareSet(key, comment string) {
+	if h.Has(key) {
+		delete(h.Bools,   key)
+		delete(h.Ints,    key)
+		delete(h.Floats,  key)
+		delete(h.Strings, key)
+		delete(h.Dates,   key)
+		delete(h.Complexes, key)
+	} else {
+		h.Keys=append(h.Keys, key)
+	}
+	if comment!="" {
+		h.KeyComments[key]=comment
+	}
+}
+
+// Sets a boolean value in the header, keeping the position of existing keys
+func (h *FITSHeader) SetBool(key string, value bool, comment string) {
+	h.prepareSet(key, comment)
+	h.Bools[key]=value
+}
+
+// Sets an integer value in the header, keeping the position of existing keys
+func (h *FITSHeader) SetInt(key string, value int32, comment string) {
+	h.prepareSet(key, comment)
+	h.Ints[key]=value
+}
+
+// Sets a floating point value in the header, keeping the position of existing keys.
+// Stores the shortest decimal representation of the value, so it is written without spurious digits
+func (h *FITSHeader) SetFloat(key string, value float32, comment string) {
+	v, _:=strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	h.SetFloat64(key, v, comment)
+}
+
+// Sets a double precision floating point value in the header, keeping the position of existing keys
+func (h *FITSHeader) SetFloat64(key string, value float64, comment string) {
+	h.prepareSet(key, comment)
+	h.Floats[key]=value
+}
+
+// Sets a string value in the header, keeping the position of existing keys
+func (h *FITSHeader) SetString(key string, value string, comment string) {
+	h.prepareSet(key, comment)
+	h.Strings[key]=value
+}
+
+// Sets a date value in the header, keeping the position of existing keys
+func (h *FITSHeader) SetDate(key string, value string, comment string) {
+	h.prepareSet(key, comment)
+	h.Dates[key]=value
+}
+
+// Returns an integer or floating point value from the header as integer, or zero if not present
+func (h *FITSHeader) intValue(key string) int32 {
+	if v, ok:=h.Ints[key];   ok { return v }
+	if v, ok:=h.Floats[key]; ok { return int32(v) }
+	return 0
+}
+
+// Returns a numeric header value as float, and whether it is present
+func (h *FITSHeader) floatValue(key string) (float32, bool) {
+	if v, ok:=h.Floats[key]; ok { return float32(v), true }
+	if v, ok:=h.Ints[key];   ok { return float32(v), true }
+	return 0, false
+}
+
+// Adds all values from the primary header which are not present in this extension header,
+// following the FITS INHERIT convention. Structural keys are never inherited
+func (h *FITSHeader) inherit(primary *FITSHeader) {
+	for _, key:=range primary.Keys {
+		if isStructuralKey(key) || h.Has(key) { continue }
+		if v, ok:=primary.Bools[key];     ok { h.Bools[key]=v }
+		if v, ok:=primary.Ints[key];      ok { h.Ints[key]=v }
+		if v, ok:=primary.Floats[key];    ok { h.Floats[key]=v }
+		if v, ok:=primary.Strings[key];   ok { h.Strings[key]=v }
+		if v, ok:=primary.Dates[key];     ok { h.Dates[key]=v }
+		if v, ok:=primary.Complexes[key]; ok { h.Complexes[key]=v }
+		if c, ok:=primary.KeyComments[key]; ok { h.KeyComments[key]=c }
+		h.Keys=append(h.Keys, key)
 	}
 }
 
@@ -100,7 +302,12 @@ func CombineRGB(chans []*FITSImage, ref *FITSImage) FITSImage {
 		Stars :[]Star{},
 		HFR   :0,
 	}
-	if ref!=nil { rgb.Stars, rgb.HFR=ref.Stars, ref.HFR }
+	if ref!=nil { 
+		rgb.Stars, rgb.HFR=ref.Stars, ref.HFR 
+		rgb.Header=ref.Header.Clone()
+	} else {
+		rgb.Header=chans[0].Header.Clone()
+	}
 
 	copy(rgb.Naxisn, chans[0].Naxisn)
 	rgb.Naxisn[len(chans[0].Naxisn)]=int32(len(chans))
@@ -224,17 +431,14 @@ func medianStarIntensity(data []float32, width int32, stars []Star) float32 {
 // Apply NxN binning to source image and return new resulting image
 func BinNxN(src *FITSImage, n int32) FITSImage {
 	// calculate binned image size
-	binnedPixels:=int32(1)
-	binnedNaxisn:=make([]int32, len(src.Naxisn))
-	for i,originalN:=range(src.Naxisn) {
-		binnedN:=originalN/n
-		binnedNaxisn[i]=binnedN
-		binnedPixels*=binnedN
-	}
+	binnedNaxisn:=append([]int32(nil), src.Naxisn...)
+	binnedNaxisn[0], binnedNaxisn[1]=src.Naxisn[0]/n, src.Naxisn[1]/n
+	binnedPlaneSize:=binnedNaxisn[0]*binnedNaxisn[1]
+	binnedPixels:=binnedPlaneSize*src.NumPlanes()
 
 	// created binned image header
 	binned:=FITSImage{
-		Header:NewFITSHeader(),
+		Header:src.Header.Clone(),
 		Bitpix:-32,
 		Bzero :0,
 		Naxisn:binnedNaxisn,
@@ -242,24 +446,31 @@ func BinNxN(src *FITSImage, n int32) FITSImage {
 		Data  :make([]float32,int(binnedPixels)),
 		Exposure: src.Exposure,
 		ID    :src.ID,
+		FileName:src.FileName,
+	}
+	for _, key:=range []string{"XBINNING", "YBINNING"} {
+		if b, ok:=binned.Header.Ints[key]; ok { binned.Header.SetInt(key, b*n, "") }
 	}
 
-	// calculate binned image pixel values
+	// calculate binned image pixel values, plane by plane
 	// FIXME: pretty inefficient?
 	normalizer:=1.0/float32(n*n)
-	for y:=int32(0); y<binnedNaxisn[1]; y++ {
-		for x:=int32(0); x<binnedNaxisn[0]; x++ {
-			sum:=float32(0)
-			for yoff:=int32(0); yoff<n; yoff++ {
-				for xoff:=int32(0); xoff<n; xoff++ {
-					origPos:=(y*n+yoff)*src.Naxisn[0] + (x*n+xoff)
-					sum+=src.Data[origPos]
+	for p:=int32(0); p<src.NumPlanes(); p++ {
+		srcData, binnedData:=src.Plane(p), binned.Plane(p)
+		for y:=int32(0); y<binnedNaxisn[1]; y++ {
+			for x:=int32(0); x<binnedNaxisn[0]; x++ {
+				sum:=float32(0)
+				for yoff:=int32(0); yoff<n; yoff++ {
+					for xoff:=int32(0); xoff<n; xoff++ {
+						origPos:=(y*n+yoff)*src.Naxisn[0] + (x*n+xoff)
+						sum+=srcData[origPos]
+					}
 				}
-			}
-			avg:=sum*normalizer
-			binnedPos:=y*binned.Naxisn[0] + x
-			binned.Data[binnedPos]=avg
-		}		
+				avg:=sum*normalizer
+				binnedPos:=y*binned.Naxisn[0] + x
+				binnedData[binnedPos]=avg
+			}		
+		}
 	}
 
 	return binned
@@ -285,13 +496,14 @@ func (f* FITSImage) FillCircle(xc,yc,r,color float32) {
 // Show stars detected on the source image as circles in a new resulting image
 func ShowStars(src *FITSImage, hfrMultiple float32) FITSImage {
 	// created new image header
+	pixels:=src.Naxisn[0]*src.Naxisn[1]
 	res:=FITSImage{
 		Header:NewFITSHeader(),
 		Bitpix:-32,
 		Bzero :0,
-		Naxisn:src.Naxisn,
-		Pixels:src.Pixels,
-		Data  :make([]float32,int(src.Pixels)),
+		Naxisn:[]int32{src.Naxisn[0], src.Naxisn[1]},
+		Pixels:pixels,
+		Data  :make([]float32,int(pixels)),
 	}
 
 	for _,s:=range(src.Stars) {
@@ -0,0 +1,132 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Writes the image to a buffer and reads it back
+func roundTripFITS(t *testing.T, f *FITSImage) (g *FITSImage, header string) {
+	var b bytes.Buffer
+	if err:=f.Write(&b); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	r:=NewFITSImage()
+	if err:=r.Read(bytes.NewReader(b.Bytes())); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	return &r, b.String()
+}
+
+func TestHeaderKeyOrderAndComments(t *testing.T) {
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels, f.Data=[]int32{2, 2}, 4, []float32{1, 2, 3, 4}
+	h:=&f.Header
+	h.SetString("OBJECT",  "M 42",  "Name of the object")
+	h.SetInt   ("GAIN",    139,     "")
+	h.SetBool  ("FLIPPED", false,   "Meridian flip")
+	h.SetFloat ("XPIXSZ",  3.76,    "[um] Pixel size")
+	h.SetInt   ("GAIN",    120,     "Sensor gain")  // keeps its position
+	h.Comments=append(h.Comments, "A comment")
+	h.History =append(h.History,  "Some history")
+
+	g, _:=roundTripFITS(t, &f)
+	gh:=&g.Header
+	keys:=[]string{}
+	for _, k:=range gh.Keys {
+		if !isStructuralKey(k) { keys=append(keys, k) }
+	}
+	if got, want:=strings.Join(keys, ","), "OBJECT,GAIN,FLIPPED,XPIXSZ"; got!=want { t.Errorf("Keys=%s; want %s", got, want) }
+	for _, k:=range h.Keys {
+		if gh.KeyComments[k]!=h.KeyComments[k] { t.Errorf("KeyComments[%s]='%s'; want '%s'", k, gh.KeyComments[k], h.KeyComments[k]) }
+	}
+	if gh.Strings["OBJECT"]!="M 42" || gh.Ints["GAIN"]!=120 || gh.Bools["FLIPPED"] || gh.Floats["XPIXSZ"]!=3.76 {
+		t.Errorf("values %v %v %v %v; want M 42, 120, false, 3.76", gh.Strings["OBJECT"], gh.Ints["GAIN"], gh.Bools["FLIPPED"], gh.Floats["XPIXSZ"])
+	}
+	if len(gh.Comments)!=1 || gh.Comments[0]!="A comment" { t.Errorf("Comments=%v; want [A comment]", gh.Comments) }
+	if len(gh.History )!=1 || gh.History [0]!="Some history" { t.Errorf("History=%v; want [Some history]", gh.History) }
+}
+
+func TestHeaderFloatPrecision(t *testing.T) {
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels, f.Data=[]int32{4}, 4, []float32{0, 1, 2, 3}
+	f.Header.SetFloat64("JD",      2459123.51234567, "Julian date")
+	f.Header.SetFloat64("MJD-OBS", 59123.01234567,   "Modified Julian date")
+	f.Header.SetFloat  ("PEDESTAL", 0.1, "")
+
+	g, header:=roundTripFITS(t, &f)
+	if v:=g.Header.Floats["JD"]; v!=2459123.51234567 { t.Errorf("JD=%.8f; want 2459123.51234567", v) }
+	if v:=g.Header.Floats["MJD-OBS"]; v!=59123.01234567 { t.Errorf("MJD-OBS=%.8f; want 59123.01234567", v) }
+	for _, want:=range []string{"JD      =     2459123.51234567 / Julian date", "MJD-OBS =       59123.01234567 / Modified Julian date", "PEDESTAL=                  0.1"} {
+		if !strings.Contains(header, want) { t.Errorf("header lacks card '%s'", want) }
+	}
+}
+
+func TestColorCubePlanes(t *testing.T) {
+	cube:=NewFITSImage()
+	cube.Naxisn, cube.Pixels=[]int32{4, 2, 3}, 24
+	cube.Data=[]float32{
+		 1,  1,  2,  2,     1,  1,  2,  2,    // red
+		 4,  4,  8,  8,     4,  4,  8,  8,    // green
+		 7,  7, 14, 14,     7,  7, 14, 14,    // blue
+	}
+	if p:=cube.NumPlanes(); p!=3 { t.Errorf("NumPlanes()=%d; want 3", p) }
+
+	lum:=cube.Luminance()
+	wantLum:=[]float32{4, 4, 8, 8, 4, 4, 8, 8}
+	for i, w:=range wantLum {
+		if lum[i]!=w { t.Errorf("Luminance()[%d]=%f; want %f", i, lum[i], w) }
+	}
+
+	binned:=BinNxN(&cube, 2)
+	if !EqualInt32Slice(binned.Naxisn, []int32{2, 1, 3}) { t.Errorf("binned Naxisn=%v; want [2 1 3]", binned.Naxisn) }
+	wantBinned:=[]float32{1, 2, 4, 8, 7, 14}
+	for i, w:=range wantBinned {
+		if binned.Data[i]!=w { t.Errorf("binned Data[%d]=%f; want %f", i, binned.Data[i], w) }
+	}
+
+	shifted, err:=cube.Project([]int32{4, 2}, Transform2D{1, 0, 1, 0, 1, 0}, -1)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if !EqualInt32Slice(shifted.Naxisn, []int32{4, 2, 3}) { t.Errorf("projected Naxisn=%v; want [4 2 3]", shifted.Naxisn) }
+	for p, w:=range []float32{1, 4, 7} {
+		if v:=shifted.Plane(int32(p))[2]; v!=w { t.Errorf("projected plane %d [2]=%f; want %f", p, v, w) }
+	}
+}
+
+func TestSplitPlanes(t *testing.T) {
+	cube:=NewFITSImage()
+	cube.Naxisn, cube.Pixels, cube.Exposure=[]int32{4, 2, 3}, 24, 300
+	cube.Data=[]float32{
+		 1,  1,  2,  2,     1,  1,  2,  3,    // red
+		 4,  4,  8,  8,     4,  4,  8,  8,    // green
+		 7,  7, 14, 14,     7,  7, 14, 14,    // blue
+	}
+
+	planes, err:=cube.SplitPlanes()
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if len(planes)!=3 { t.Fatalf("len(planes)=%d; want 3", len(planes)) }
+	for p, w:=range []float32{1, 4, 7} {
+		pl:=planes[p]
+		if !EqualInt32Slice(pl.Naxisn, []int32{4, 2}) { t.Errorf("plane %d Naxisn=%v; want [4 2]", p, pl.Naxisn) }
+		if pl.Pixels!=8 { t.Errorf("plane %d Pixels=%d; want 8", p, pl.Pixels) }
+		if pl.Stats.Min!=w { t.Errorf("plane %d Stats.Min=%f; want %f", p, pl.Stats.Min, w) }
+		if pl.Exposure!=100 { t.Errorf("plane %d Exposure=%f; want 100", p, pl.Exposure) }
+	}
+
+	rgb:=CombineRGB(planes, &cube)
+	if rgb.Exposure!=300 { t.Errorf("combined Exposure=%f; want 300", rgb.Exposure) }
+	if !EqualInt32Slice(rgb.Naxisn, cube.Naxisn) { t.Errorf("combined Naxisn=%v; want %v", rgb.Naxisn, cube.Naxisn) }
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+
+// An arithmetic formula over named variables, like snr^2*stars/hfr. Supports numbers, variables, 
+// the operators + - * / ^, parentheses and the functions sqrt, log, exp and abs
+type Formula struct {
+	Text      string
+	Variables []string      // Variables used by the formula, in order of first appearance
+	eval      func(vars map[string]float64) float64
+}
+
+// Parses a formula, restricting variables to the given names
+func ParseFormula(text string, names []string) (f *Formula, err error) {
+	p:=&formulaParser{text:text, names:names}
+	f=&Formula{Text:text, Variables:[]string{}}
+	p.formula=f
+	f.eval, err=p.parseSum()
+	if err!=nil { return nil, err }
+	if p.skipSpace(); p.pos<len(p.text) { return nil, errors.New("Unexpected '"+p.text[p.pos:]+"' in formula "+text) }
+	return f, nil
+}
+
+// Evaluates the formula with the given variable values. Missing variables are zero
+func (f *Formula) Eval(vars map[string]float64) float64 {
+	return f.eval(vars)
+}
+
+// Whether the formula uses the given variable
+func (f *Formula) Uses(name string) bool {
+	for _, v:=range f.Variables {
+		if v==name { return true }
+	}
+	return false
+}
+
+func (f *Formula) String() string {
+	return f.Text
+}
+
+
+// Recursive descent parser for formulas
+type formulaParser struct {
+	text    string
+	pos     int
+	names   []string
+	formula *Formula
+}
+
+type formulaFunc func(vars map[string]float64) float64
+
+func (p *formulaParser) skipSpace() {
+	for p.pos<len(p.text) && p.text[p.pos]==' ' { p.pos++ }
+}
+
+// Parses a sum or difference of products
+func (p *formulaParser) parseSum() (formulaFunc, error) {
+	left, err:=p.parseProduct()
+	if err!=nil { return nil, err }
+	for p.skipSpace(); p.pos<len(p.text) && (p.text[p.pos]=='+' || p.text[p.pos]=='-'); p.skipSpace() {
+		op:=p.text[p.pos]
+		p.pos++
+		right, err:=p.parseProduct()
+		if err!=nil { return nil, err }
+		l:=left
+		if op=='+' {
+			left=func(v map[string]float64) float64 { return l(v)+right(v) }
+		} else {
+			left=func(v map[string]float64) float64 { return l(v)-right(v) }
+		}
+	}
+	return left, nil
+}
+
+// Parses a product or quotient of powers
+func (p *formulaParser) parseProduct() (formulaFunc, error) {
+	left, err:=p.parsePower()
+	if err!=nil { return nil, err }
+	for p.skipSpace(); p.pos<len(p.text) && (p.text[p.pos]=='*' || p.text[p.pos]=='/'); p.skipSpace() {
+		op:=p.text[p.pos]
+		p.pos++
+		right, err:=p.parsePower()
+		if err!=nil { return nil, err }
+		l:=left
+		if op=='*' {
+			left=func(v map[string]float64) float64 { return l(v)*right(v) }
+		} else {
+			left=func(v map[string]float64) float64 { return l(v)/right(v) }
+		}
+	}
+	return left, nil
+}
+
+// Parses a power, which is right associative
+func (p *formulaParser) parsePower() (formulaFunc, error) {
+	base, err:=p.parseUnary()
+	if err!=nil { return nil, err }
+	if p.skipSpace(); p.pos<len(p.text) && p.text[p.pos]=='^' {
+		p.pos++
+		exp, err:=p.parsePower()
+		if err!=nil { return nil, err }
+		return func(v map[string]float64) float64 { return math.Pow(base(v), exp(v)) }, nil
+	}
+	return base, nil
+}
+
+// Parses a negation, number, variable, function call or parenthesized sum
+func (p *formulaParser) parseUnary() (formulaFunc, error) {
+	p.skipSpace()
+	if p.pos>=len(p.text) { return nil, errors.New("Unexpected end of formula "+p.text) }
+	c:=p.text[p.pos]
+	switch {
+	case c=='-':
+		p.pos++
+		inner, err:=p.parsePower()  // so -x^2 is -(x^2)
+		if err!=nil { return nil, err }
+		return func(v map[string]float64) float64 { return -inner(v) }, nil
+
+	case c=='(':
+		p.pos++
+		inner, err:=p.parseSum()
+		if err!=nil { return nil, err }
+		if p.skipSpace(); p.pos>=len(p.text) || p.text[p.pos]!=')' { return nil, errors.New("Missing ) in formula "+p.text) }
+		p.pos++
+		return inner, nil
+
+	case c=='.' || (c>='0' && c<='9'):
+		start:=p.pos
+		for p.pos<len(p.text) && (p.text[p.pos]=='.' || (p.text[p.pos]>='0' && p.text[p.pos]<='9')) { p.pos++ }
+		if p.pos<len(p.text) && (p.text[p.pos]=='e' || p.text[p.pos]=='E') {
+			p.pos++
+			if p.pos<len(p.text) && (p.text[p.pos]=='+' || p.text[p.pos]=='-') { p.pos++ }
+			for p.pos<len(p.text) && p.text[p.pos]>='0' && p.text[p.pos]<='9' { p.pos++ }
+		}
+		value, err:=strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err!=nil { return nil, errors.New("Invalid number "+p.text[start:p.pos]+" in formula "+p.text) }
+		return func(v map[string]float64) float64 { return value }, nil
+
+	case unicode.IsLetter(rune(c)):
+		start:=p.pos
+		for p.pos<len(p.text) && (unicode.IsLetter(rune(p.text[p.pos])) || unicode.IsDigit(rune(p.text[p.pos]))) { p.pos++ }
+		name:=strings.ToLower(p.text[start:p.pos])
+		if p.skipSpace(); p.pos<len(p.text) && p.text[p.pos]=='(' {
+			fn, ok:=formulaFunctions[name]
+			if !ok { return nil, errors.New("Unknown function "+name+" in formula "+p.text) }
+			arg, err:=p.parseUnary()
+			if err!=nil { return nil, err }
+			return func(v map[string]float64) float64 { return fn(arg(v)) }, nil
+		}
+		known:=false
+		for _, n:=range p.names {
+			if n==name { known=true }
+		}
+		if !known { return nil, errors.New("Unknown variable "+name+" in formula "+p.text+", use one of "+strings.Join(p.names, ", ")) }
+		if !p.formula.Uses(name) { p.formula.Variables=append(p.formula.Variables, name) }
+		return func(v map[string]float64) float64 { return v[name] }, nil
+	}
+	return nil, errors.New("Unexpected '"+p.text[p.pos:]+"' in formula "+p.text)
+}
+
+var formulaFunctions=map[string]func(float64) float64{
+	"sqrt": math.Sqrt,
+	"log":  math.Log,
+	"exp":  math.Exp,
+	"abs":  math.Abs,
+}
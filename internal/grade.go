@@ -0,0 +1,202 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+
+// Per-frame quality metric for grading subframes
+type QualityMetric int
+const (
+	QMStars QualityMetric = iota  // Star count relative to the reference frame
+	QMHFR                         // Average half-flux radius in pixels
+	QMFWHM                        // Median PSF full width at half maximum in pixels
+	QMEcc                         // Median PSF eccentricity
+	QMBackground                  // Background level, i.e. location of the histogram peak
+	QMNoise                       // Noise estimate
+)
+
+var qualityMetricNames=[]string{"stars", "hfr", "fwhm", "ecc", "back", "noise"}
+
+func (m QualityMetric) String() string {
+	if m<0 || int(m)>=len(qualityMetricNames) { return "unknown" }
+	return qualityMetricNames[m]
+}
+
+// Whether the metric is derived from fitted point spread functions
+func (m QualityMetric) NeedsPSF() bool {
+	return m==QMFWHM || m==QMEcc
+}
+
+
+// A rule rejecting frames whose metric is above or below a limit. The limit is absolute, or with Sigma a multiple of
+// the standard deviation from the median across all frames graded together
+type RejectionRule struct {
+	Metric QualityMetric
+	Above  bool     // Reject values above the limit, else below
+	Limit  float32
+	Sigma  bool     // Limit is in standard deviations from the median
+}
+
+// Parses comma-separated rejection rules like stars<0.5,fwhm>4.5,back>3sigma. Metrics are stars, hfr, fwhm, ecc, back and noise
+func ParseRejectionRules(s string) (rules []RejectionRule, err error) {
+	rules=[]RejectionRule{}
+	for _, r:=range strings.Split(s, ",") {
+		r=strings.ToLower(strings.TrimSpace(r))
+		if r=="" { continue }
+		pos:=strings.IndexAny(r, "<>")
+		if pos<0 { return nil, errors.New("Missing < or > in rejection rule "+r) }
+		rule:=RejectionRule{Metric:-1, Above:r[pos]=='>'}
+		name:=strings.TrimSpace(r[:pos])
+		for i, n:=range qualityMetricNames {
+			if n==name { rule.Metric=QualityMetric(i) }
+		}
+		if rule.Metric<0 { return nil, errors.New("Unknown quality metric "+name) }
+		limit:=strings.TrimSpace(r[pos+1:])
+		if strings.HasSuffix(limit, "sigma") { rule.Sigma, limit=true, strings.TrimSpace(strings.TrimSuffix(limit, "sigma")) }
+		v, err:=strconv.ParseFloat(limit, 32)
+		if err!=nil { return nil, errors.New("Invalid limit in rejection rule "+r) }
+		rule.Limit=float32(v)
+		rules=append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r RejectionRule) String() string {
+	op:="<"
+	if r.Above { op=">" }
+	res:=fmt.Sprintf("%s%s%g", r.Metric, op, r.Limit)
+	if r.Sigma { res+="sigma" }
+	return res
+}
+
+// Whether any of the rules needs fitted point spread functions
+func RulesNeedPSF(rules []RejectionRule) bool {
+	for _, r:=range rules {
+		if r.Metric.NeedsPSF() { return true }
+	}
+	return false
+}
+
+
+// Quality metrics of a frame, and the reasons for its rejection, if any
+type FrameQuality struct {
+	ID           int
+	Stars        int32
+	StarRatio    float32   // Star count relative to the reference frame
+	HFR          float32
+	FWHM         float32   // Zero if no PSF was fitted
+	Eccentricity float32   // Zero if no PSF was fitted
+	Background   float32
+	Noise        float32
+	Reasons      []string  // Why the frame was rejected. Empty if accepted
+}
+
+// Returns the value of the given metric, and whether it is available
+func (q *FrameQuality) Value(m QualityMetric) (float32, bool) {
+	switch m {
+	case QMStars:      return q.StarRatio, true
+	case QMHFR:        return q.HFR, q.Stars>0
+	case QMFWHM:       return q.FWHM, q.FWHM>0
+	case QMEcc:        return q.Eccentricity, q.FWHM>0
+	case QMBackground: return q.Background, true
+	case QMNoise:      return q.Noise, true
+	}
+	return 0, false
+}
+
+func (q *FrameQuality) Rejected() bool {
+	return len(q.Reasons)>0
+}
+
+func (q *FrameQuality) String() string {
+	res:=fmt.Sprintf("stars %d (%.2f) HFR %.3g", q.Stars, q.StarRatio, q.HFR)
+	if q.FWHM>0 { res+=fmt.Sprintf(" FWHM %.3g ecc %.3g", q.FWHM, q.Eccentricity) }
+	res+=fmt.Sprintf(" back %.4g noise %.4g", q.Background, q.Noise)
+	if q.Rejected() { return res+", rejected: "+strings.Join(q.Reasons, ", ") }
+	return res+", accepted"
+}
+
+
+// Measures the quality of the given frames and applies the rejection rules. Star counts are relative to the reference frame
+// if given, else to the frame with most stars. Sigma rules use the median and 1.4826 times the median absolute deviation 
+// across the frames with the metric available, and are skipped for fewer than three such frames
+func GradeFrames(lights []*FITSImage, ref *FITSImage, rules []RejectionRule) (qualities []FrameQuality) {
+	refStars:=int32(0)
+	if ref!=nil { refStars=int32(len(ref.Stars)) }
+	qualities=make([]FrameQuality, len(lights))
+	for i, l:=range lights { qualities[i]=MeasureQuality(l) }
+	ApplyRejectionRules(qualities, refStars, rules)
+	return qualities
+}
+
+// Measures the quality metrics of a preprocessed frame. The star ratio is set when applying the rejection rules
+func MeasureQuality(l *FITSImage) FrameQuality {
+	q:=FrameQuality{ID:l.ID, Stars:int32(len(l.Stars)), HFR:l.HFR, Background:l.Stats.Location, Noise:l.Stats.Noise, Reasons:[]string{}}
+	if l.PSF!=nil && l.PSF.Stars>0 { q.FWHM, q.Eccentricity=l.PSF.FWHM, l.PSF.Eccentricity }
+	return q
+}
+
+// Applies the rejection rules to the measured qualities, recording the reasons for rejection. Star counts are relative
+// to the given reference star count if positive, else to the frame with most stars. Grading all frames of a session 
+// together keeps limits consistent across stacking batches
+func ApplyRejectionRules(qualities []FrameQuality, refStars int32, rules []RejectionRule) {
+	if refStars<=0 {
+		for i:=range qualities {
+			if qualities[i].Stars>refStars { refStars=qualities[i].Stars }
+		}
+	}
+	for i:=range qualities {
+		if refStars>0 { qualities[i].StarRatio=float32(qualities[i].Stars)/float32(refStars) }
+	}
+
+	for _, r:=range rules {
+		median, sigma:=float32(0), float32(0)
+		if r.Sigma {
+			values:=[]float32{}
+			for i:=range qualities {
+				if v, ok:=qualities[i].Value(r.Metric); ok { values=append(values, v) }
+			}
+			if len(values)<3 { continue }
+			median=QSelectMedianFloat32(values)
+			for j, v:=range values { values[j]=float32(math.Abs(float64(v-median))) }
+			sigma=1.4826*QSelectMedianFloat32(values)
+			if sigma==0 { continue }
+		}
+		for i:=range qualities {
+			q:=&qualities[i]
+			v, ok:=q.Value(r.Metric)
+			if !ok { continue }
+			if r.Sigma {
+				dev:=(v-median)/sigma
+				if (r.Above && dev>r.Limit) || (!r.Above && dev < -r.Limit) {
+					dir:="above"
+					if !r.Above { dir="below" }
+					q.Reasons=append(q.Reasons, fmt.Sprintf("%s %.4g is %.2f sigma %s median %.4g", r.Metric, v, math.Abs(float64(dev)), dir, median))
+				}
+			} else if (r.Above && v>r.Limit) || (!r.Above && v<r.Limit) {
+				q.Reasons=append(q.Reasons, fmt.Sprintf("%s %.4g violates %v", r.Metric, v, r))
+			}
+		}
+	}
+}
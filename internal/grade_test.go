@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestParseRejectionRules(t *testing.T) {
+	rules, err:=ParseRejectionRules("stars<0.5, FWHM>4.5,back>3sigma")
+	if err!=nil { t.Fatalf("err=%s", err) }
+	if len(rules)!=3 { t.Fatalf("len(rules)=%d; want 3", len(rules)) }
+	want:=[]RejectionRule{{QMStars, false, 0.5, false}, {QMFWHM, true, 4.5, false}, {QMBackground, true, 3, true}}
+	for i, r:=range rules {
+		if r!=want[i] { t.Errorf("rules[%d]=%v; want %v", i, r, want[i]) }
+	}
+	if !RulesNeedPSF(rules) { t.Errorf("RulesNeedPSF=false; want true") }
+	for _, s:=range []string{"stars", "clouds<3", "hfr>x"} {
+		if _, err:=ParseRejectionRules(s); err==nil { t.Errorf("%s: err=nil; want error", s) }
+	}
+}
+
+func TestGradeFrames(t *testing.T) {
+	lights:=make([]*FITSImage, 6)
+	for i:=range lights {
+		lights[i]=&FITSImage{ID:i, Stars:make([]Star, 100), HFR:2+0.01*float32(i), Stats:&BasicStats{Location:1000+float32(i), Noise:10}}
+	}
+	lights[2].Stars=lights[2].Stars[:30]    // clouds
+	lights[4].Stats.Location=1500           // dew or moonlight
+
+	rules, _:=ParseRejectionRules("stars<0.5,back>3sigma,hfr>2.045")
+	qualities:=GradeFrames(lights, nil, rules)
+	for i, q:=range qualities {
+		want:=i==2 || i==4 || i==5
+		if q.Rejected()!=want { t.Errorf("frame %d rejected=%t; want %t, %v", i, q.Rejected(), want, &q) }
+	}
+	if q:=qualities[2]; q.StarRatio!=0.3 || len(q.Reasons)!=1 { t.Errorf("frame 2: ratio %f reasons %v; want 0.3 and one reason", q.StarRatio, q.Reasons) }
+}
+
+func TestApplyRejectionRules(t *testing.T) {
+	qualities:=make([]FrameQuality, 6)
+	for i:=range qualities {
+		l:=&FITSImage{ID:i, Stars:make([]Star, 100), HFR:2, Stats:&BasicStats{Location:1000+float32(i%3), Noise:10}}
+		if i==4 { l.Stars=l.Stars[:30] }
+		qualities[i]=MeasureQuality(l)
+	}
+
+	// Measured in separate batches, graded across the session against a given reference
+	rules, _:=ParseRejectionRules("stars<0.5")
+	ApplyRejectionRules(qualities, 80, rules)
+	for i, q:=range qualities {
+		want:=i==4
+		if q.Rejected()!=want { t.Errorf("frame %d rejected=%t; want %t, %v", i, q.Rejected(), want, &q) }
+	}
+	if r:=qualities[0].StarRatio; r!=1.25 { t.Errorf("StarRatio=%f; want 1.25", r) }
+}
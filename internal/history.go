@@ -0,0 +1,92 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+
+// Processing events of a run, recorded as HISTORY cards of the output file
+type History []string
+
+// Records a processing event
+func (h *History) Add(format string, args ...interface{}) {
+	*h=append(*h, fmt.Sprintf(format, args...))
+}
+
+// Records the start of a stacking batch
+func (h *History) Batch(b, numBatches int64) {
+	h.Add("batch %d of %d", b, numBatches)
+}
+
+// Records the reference frame for alignment and normalization
+func (h *History) Reference(id int, score float32) {
+	h.Add("reference frame %d, score %.4g", id, score)
+}
+
+// Records a frame rejected before stacking, with the reasons
+func (h *History) FrameRejected(id int, reasons ...string) {
+	h.Add("frame %d: rejected, %s", id, strings.Join(reasons, ", "))
+}
+
+// Records the alignment outcome of a frame, with the transform and residual kept on the frame
+func (h *History) FrameAligned(l *FITSImage, accepted bool) {
+	outcome:="accepted"
+	if !accepted { outcome="rejected" }
+	h.Add("frame %d: %s, residual %.4g, transform %v", l.ID, outcome, l.Residual, l.Trans)
+}
+
+// Records the stacking weight of a frame
+func (h *History) FrameWeight(id int, weight float32) {
+	h.Add("frame %d: weight %.4g", id, weight)
+}
+
+// Records the stacking parameters and the sigma bounds used
+func (h *History) Stacked(frames int, mode StackMode, weights WeightMode, sigLow, sigHigh float32) {
+	h.Add("stacked %d frames with mode %d stWeight %d sigLow %.3f sigHigh %.3f", frames, mode, weights, sigLow, sigHigh)
+}
+
+// Records the number of values clipped low and high while stacking, out of the given total
+func (h *History) Clipped(clipLow, clipHigh int32, values int) {
+	v:=float32(values)
+	h.Add("clipped low %d (%.2f%%) high %d (%.2f%%)", clipLow, float32(clipLow)*100/v, clipHigh, float32(clipHigh)*100/v)
+}
+
+
+// Records the provenance of an output as HISTORY cards: program and command, the effective values of all flags,
+// the input files and the processing events. Flags are grouped into lines which fit one card. Longer entries
+// are continued on further cards when writing
+func (hdr *FITSHeader) AddProvenance(program, cmd string, flags *flag.FlagSet, fileNames []string, events History) {
+	hdr.History=append(hdr.History, fmt.Sprintf("%s %s", program, cmd))
+	line:="flags"
+	flags.VisitAll(func(f *flag.Flag) {
+		item:=fmt.Sprintf(" -%s=%s", f.Name, f.Value.String())
+		if len(line)+len(item)>72 && line!="flags" {
+			hdr.History=append(hdr.History, line)
+			line="flags"
+		}
+		line+=item
+	})
+	hdr.History=append(hdr.History, line)
+	for i, fileName:=range fileNames {
+		hdr.History=append(hdr.History, fmt.Sprintf("input %d: %s", i, fileName))
+	}
+	hdr.History=append(hdr.History, events...)
+}
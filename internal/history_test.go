@@ -0,0 +1,85 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestAddProvenance(t *testing.T) {
+	flags:=flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("stMode", 5, "")
+	flags.Float64("stSigLow", -1, "")
+	flags.String("reject", "", "")
+	flags.String("out", "", "")
+	long:="stars<0.5,fwhm>4.5,ecc>0.6,back>3sigma,noise>3sigma,hfr>2.5sigma,fwhm>2sigma"
+	if err:=flags.Parse([]string{"-reject", long, "-out", "stack.fits"}); err!=nil { t.Fatal(err) }
+
+	var events History
+	events.Batch(0, 2)
+	events.Reference(3, 12.5)
+	events.FrameRejected(1, "preprocessing failed")
+	events.FrameRejected(2, "stars 12 violates stars<0.5", "back 1408 is 4.2 sigma above median 1008")
+	l:=&FITSImage{ID:3, Residual:0.125, Trans:IdentityTransform2D()}
+	events.FrameAligned(l, true)
+	l=&FITSImage{ID:4, Residual:2.5, Trans:IdentityTransform2D()}
+	events.FrameAligned(l, false)
+	events.FrameWeight(3, 0.75)
+	events.Stacked(2, StSigma, WMSNR, 2.5, 3)
+	events.Clipped(10, 30, 1000)
+
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels, f.Data=[]int32{2}, 2, []float32{1, 2}
+	f.Header.AddProvenance("nightlight 0.2.5", "stack", flags, []string{"light1.fits", "light2.fits"}, events)
+	var b bytes.Buffer
+	if err:=f.Write(&b); err!=nil { t.Fatalf("err=%s; want nil", err) }
+
+	// every HISTORY card fits, and the long flag value continues on the next card
+	cards:=[]string{}
+	header:=b.String()
+	for i:=0; i+80<=len(header); i+=80 {
+		if card:=header[i:i+80]; strings.HasPrefix(card, "HISTORY ") { cards=append(cards, strings.TrimRight(card[8:], " ")) }
+	}
+	trans:=IdentityTransform2D().String()
+	entries:=[]string{
+		"nightlight 0.2.5 stack",
+		"flags -out=stack.fits",
+		"flags -reject="+long,
+		"flags -stMode=5 -stSigLow=-1",
+		"input 0: light1.fits",
+		"input 1: light2.fits",
+		"batch 0 of 2",
+		"reference frame 3, score 12.5",
+		"frame 1: rejected, preprocessing failed",
+		"frame 2: rejected, stars 12 violates stars<0.5, back 1408 is 4.2 sigma above median 1008",
+		"frame 3: accepted, residual 0.125, transform "+trans,
+		"frame 4: rejected, residual 2.5, transform "+trans,
+		"frame 3: weight 0.75",
+		"stacked 2 frames with mode 2 stWeight 4 sigLow 2.500 sigHigh 3.000",
+		"clipped low 10 (1.00%) high 30 (3.00%)",
+	}
+	want:=[]string{}
+	for _, e:=range entries {
+		for len(e)>72 { want, e=append(want, strings.TrimRight(e[:72], " ")), e[72:] }
+		want=append(want, e)
+	}
+	if got, w:=strings.Join(cards, "\n"), strings.Join(want, "\n"); got!=w { t.Errorf("HISTORY cards\n%s\nwant\n%s", got, w) }
+	if len(cards)!=19 { t.Errorf("%d HISTORY cards; want 19 with three continued", len(cards)) }
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+
+// Star metrics in one cell of a grid across the sensor
+type FieldCell struct {
+	Stars        int32     // Number of stars in the cell
+	Value        float32   // Median FWHM or HFR in pixels, NaN if there are no stars
+	Eccentricity float32   // Median eccentricity, zero without fitted PSFs
+	Angle        float32   // Average position angle of the major axis in degrees, weighted by eccentricity
+}
+
+// Field-dependent star metrics, for diagnosing sensor tilt, field curvature and coma.
+// Left, right, top and bottom refer to the image as stored, with the first row on top
+type FieldAnalysis struct {
+	Metric       string       // FWHM with fitted PSFs, else HFR
+	Width        int32        // Image width in pixels
+	Height       int32        // Image height in pixels
+	Cols         int32        // Grid columns
+	Rows         int32        // Grid rows
+	Cells        []FieldCell  // Grid cells in row-major order
+	Regions      []FieldCell  // 3x3 regions in row-major order, i.e. top left corner first and center fifth
+	CornerSpread float32      // Largest minus smallest corner value
+	CenterToEdge float32      // Average of the outer regions minus the center
+	TiltX        float32      // Change of the metric from center to right edge, from a fit across the field
+	TiltY        float32      // Change of the metric from center to bottom edge
+	Curvature    float32      // Radial change of the metric from center to edge midpoints
+	Radial       float32      // Orientation of elongated stars in the outer field, from 1 for radial to -1 for tangential
+}
+
+// A star sample for field analysis
+type fieldSample struct {
+	x, y, value, ecc, angle float32
+}
+
+// Analyzes the stars of the given image over a grid with the given number of columns and rows. Uses the FWHM, 
+// eccentricity and angle of fitted PSFs if available, else the HFR of the detected stars
+func AnalyzeField(f *FITSImage, cols, rows int32) *FieldAnalysis {
+	a:=&FieldAnalysis{Metric:"HFR", Width:f.Naxisn[0], Height:f.Naxisn[1], Cols:cols, Rows:rows}
+	samples:=[]fieldSample{}
+	if len(f.PSFs)>0 {
+		a.Metric="FWHM"
+		for i:=range f.PSFs {
+			p:=&f.PSFs[i]
+			samples=append(samples, fieldSample{p.X, p.Y, p.FWHM(), p.Eccentricity(), p.Angle})
+		}
+	} else {
+		for _, s:=range f.Stars {
+			samples=append(samples, fieldSample{s.X, s.Y, s.HFR, 0, 0})
+		}
+	}
+
+	a.Cells  =binFieldSamples(samples, a.Width, a.Height, cols, rows)
+	a.Regions=binFieldSamples(samples, a.Width, a.Height, 3, 3)
+
+	// corner spread and center to edge difference from the 3x3 regions
+	corners:=[]float32{}
+	for _, i:=range []int{0, 2, 6, 8} {
+		if v:=a.Regions[i].Value; !math.IsNaN(float64(v)) { corners=append(corners, v) }
+	}
+	if len(corners)>1 {
+		min, max:=corners[0], corners[0]
+		for _, c:=range corners {
+			if c<min { min=c }
+			if c>max { max=c }
+		}
+		a.CornerSpread=max-min
+	}
+	sum, num:=float32(0), 0
+	for i, r:=range a.Regions {
+		if i!=4 && !math.IsNaN(float64(r.Value)) { sum+=r.Value; num++ }
+	}
+	if center:=a.Regions[4].Value; num>0 && !math.IsNaN(float64(center)) { a.CenterToEdge=sum/float32(num)-center }
+
+	// fit value = c0 + c1*u + c2*v + c3*(u^2+v^2) over normalized coordinates u, v in [-1,1]
+	if len(samples)>=8 {
+		m:=make([][]float64, 4)
+		for r:=range m { m[r]=make([]float64, 5) }
+		for _, s:=range samples {
+			u, v:=2*float64(s.x)/float64(a.Width)-1, 2*float64(s.y)/float64(a.Height)-1
+			terms:=[]float64{1, u, v, u*u+v*v}
+			for r:=0; r<4; r++ {
+				for c:=0; c<4; c++ { m[r][c]+=terms[r]*terms[c] }
+				m[r][4]+=terms[r]*float64(s.value)
+			}
+		}
+		coeffs:=solveLinearSystem(m)
+		a.TiltX, a.TiltY, a.Curvature=float32(coeffs[1]), float32(coeffs[2]), float32(coeffs[3])
+	}
+
+	// orientation of elongation relative to the direction from the image center in the outer field
+	weighted, weights:=0.0, 0.0
+	for _, s:=range samples {
+		dx, dy:=float64(s.x)-float64(a.Width)/2, float64(s.y)-float64(a.Height)/2
+		if 4*(dx*dx/float64(a.Width*a.Width)+dy*dy/float64(a.Height*a.Height))<0.25 { continue }
+		diff:=float64(s.angle)*math.Pi/180-math.Atan2(dy, dx)
+		weighted+=float64(s.ecc)*math.Cos(2*diff)
+		weights +=float64(s.ecc)
+	}
+	if weights>0 { a.Radial=float32(weighted/weights) }
+	return a
+}
+
+// Bins the samples into a grid and calculates median values per cell
+func binFieldSamples(samples []fieldSample, width, height, cols, rows int32) (cells []FieldCell) {
+	bins:=make([][]fieldSample, cols*rows)
+	for _, s:=range samples {
+		cx, cy:=int32(s.x*float32(cols)/float32(width)), int32(s.y*float32(rows)/float32(height))
+		if cx<0 || cy<0 || cx>=cols || cy>=rows { continue }
+		bins[cy*cols+cx]=append(bins[cy*cols+cx], s)
+	}
+
+	cells=make([]FieldCell, len(bins))
+	for i, bin:=range bins {
+		c:=FieldCell{Stars:int32(len(bin)), Value:float32(math.NaN())}
+		if len(bin)>0 {
+			values, eccs:=make([]float32, len(bin)), make([]float32, len(bin))
+			sumSin, sumCos:=0.0, 0.0
+			for j, s:=range bin {
+				values[j], eccs[j]=s.value, s.ecc
+				sin, cos:=math.Sincos(float64(s.angle)*math.Pi/90)
+				sumSin+=float64(s.ecc)*sin
+				sumCos+=float64(s.ecc)*cos
+			}
+			c.Value, c.Eccentricity=QSelectMedianFloat32(values), QSelectMedianFloat32(eccs)
+			angle:=math.Atan2(sumSin, sumCos)*90/math.Pi
+			if angle<0 { angle+=180 }
+			c.Angle=float32(angle)
+		}
+		cells[i]=c
+	}
+	return cells
+}
+
+// Names of the eight directions by angle in image coordinates, starting at the right and turning towards the bottom
+var fieldDirections=[]string{"right", "bottom right", "bottom", "bottom left", "left", "top left", "top", "top right"}
+
+// Formats v as a percentage of the reference value, or n/a if v is not finite or the reference is not finite and positive
+func percentOf(v, ref float32) string {
+	if !(ref>0) || math.IsInf(float64(ref), 1) || math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) { return "n/a" }
+	return fmt.Sprintf("%.1f%%", 100*v/ref)
+}
+
+// Formats v with the given format, or n/a padded to the same width if v is not finite
+func formatFinite(format string, v float32) string {
+	s:=fmt.Sprintf(format, v)
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) { return fmt.Sprintf("%*s", len(s), "n/a") }
+	return s
+}
+
+func (a *FieldAnalysis) String() string {
+	b:=&strings.Builder{}
+	fmt.Fprintf(b, "%s by 3x3 region, in pixels with star counts:\n", a.Metric)
+	for r:=0; r<3; r++ {
+		for c:=0; c<3; c++ {
+			cell:=a.Regions[r*3+c]
+			fmt.Fprintf(b, "  %s (%4d)", formatFinite("%6.3g", cell.Value), cell.Stars)
+		}
+		b.WriteString("\n")
+	}
+	if a.Metric=="FWHM" {
+		b.WriteString("Eccentricity and angle by 3x3 region:\n")
+		for r:=0; r<3; r++ {
+			for c:=0; c<3; c++ {
+				cell:=a.Regions[r*3+c]
+				if cell.Stars==0 { fmt.Fprintf(b, "  %5s %5s ", "n/a", "n/a"); continue }  // no stars to measure
+				fmt.Fprintf(b, "  %5.2f %5.1f°", cell.Eccentricity, cell.Angle)
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	center:=a.Regions[4].Value
+	fmt.Fprintf(b, "Corner to corner: %s px (%s of center)\n", formatFinite("%.3g", a.CornerSpread), percentOf(a.CornerSpread, center))
+	fmt.Fprintf(b, "Center to edge:   %s px (%s of center)\n", formatFinite("%+.3g", a.CenterToEdge), percentOf(a.CenterToEdge, center))
+	tilt:=math.Hypot(float64(a.TiltX), float64(a.TiltY))
+	angle:=math.Atan2(float64(a.TiltY), float64(a.TiltX))*180/math.Pi
+	if angle<0 { angle+=360 }
+	if math.IsNaN(tilt) || math.IsInf(tilt, 0) {
+		b.WriteString("Tilt:             n/a\n")
+	} else {
+		fmt.Fprintf(b, "Tilt:             %s grows %.3g px from center to edge towards the %s (angle %.0f°)\n", 
+			a.Metric, tilt, fieldDirections[int(angle/45+0.5)%8], angle)
+	}
+	if c:=float64(a.Curvature); math.IsNaN(c) || math.IsInf(c, 0) {
+		b.WriteString("Curvature:        n/a\n")
+	} else {
+		shape:="edges softer than center"
+		if a.Curvature<0 { shape="center softer than edges" }
+		fmt.Fprintf(b, "Curvature:        %+.3g px from center to edge, %s\n", a.Curvature, shape)
+	}
+	if a.Metric=="FWHM" {
+		orient:="no preferred orientation"
+		if a.Radial>0.3 { orient="radial, e.g. coma or sagittal curvature" } else if a.Radial < -0.3 { orient="tangential, e.g. astigmatism or tangential curvature" }
+		fmt.Fprintf(b, "Outer field elongation: %+.2f, %s\n", a.Radial, orient)
+	}
+	return b.String()
+}
+
+
+// Renders the grid metric as false color heat map of the given width, interpolated bilinearly between cell centers
+// from blue for the smallest to red for the largest value. With PSFs, white ticks show eccentricity and angle per cell
+func (a *FieldAnalysis) RenderHeatMap(width int32) *FITSImage {
+	height:=int32(float32(width)*float32(a.Height)/float32(a.Width)+0.5)
+	values:=make([]float32, len(a.Cells))
+	for i, c:=range a.Cells { values[i]=c.Value }
+	fillEmptyCells(values, a.Cols, a.Rows)
+	min, max:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, v:=range values {
+		if v<min { min=v }
+		if v>max { max=v }
+	}
+	if !(max>min) { max=min+1 }
+
+	f:=NewFITSImage()
+	f.Bitpix, f.Bscale=-32, 1
+	f.Naxisn=[]int32{width, height, 3}
+	f.Pixels=width*height*3
+	f.Data=make([]float32, f.Pixels)
+	size:=width*height
+	for y:=int32(0); y<height; y++ {
+		gy:=(float32(y)+0.5)*float32(a.Rows)/float32(height)-0.5
+		for x:=int32(0); x<width; x++ {
+			gx:=(float32(x)+0.5)*float32(a.Cols)/float32(width)-0.5
+			v:=(bilinearGrid(values, a.Cols, a.Rows, gx, gy)-min)/(max-min)
+			r, g, b:=heatColor(v)
+			i:=y*width+x
+			f.Data[i], f.Data[i+size], f.Data[i+2*size]=r, g, b
+		}
+	}
+
+	// eccentricity ticks along the major axis, full cell size at eccentricity one
+	if a.Metric=="FWHM" {
+		cw, ch:=float32(width)/float32(a.Cols), float32(height)/float32(a.Rows)
+		for i, c:=range a.Cells {
+			if c.Stars==0 { continue }
+			cx, cy:=(float32(int32(i)%a.Cols)+0.5)*cw, (float32(int32(i)/a.Cols)+0.5)*ch
+			length:=0.45*c.Eccentricity*float32(math.Min(float64(cw), float64(ch)))
+			sin, cos:=math.Sincos(float64(c.Angle)*math.Pi/180)
+			for t:=-length; t<=length; t+=0.5 {
+				x, y:=int32(cx+t*float32(cos)), int32(cy+t*float32(sin))
+				if x<0 || y<0 || x>=width || y>=height { continue }
+				for p:=int32(0); p<3; p++ { f.Data[p*size+y*width+x]=1 }
+			}
+		}
+	}
+	f.Header.SetString("IMAGETYP", "Field Map", "Type of image")
+	f.Header.SetFloat("FMAPMIN", min, "[px] Smallest "+a.Metric+", shown blue")
+	f.Header.SetFloat("FMAPMAX", max, "[px] Largest "+a.Metric+", shown red")
+	return &f
+}
+
+// Replaces NaN cells with the average of their valid neighbors, repeatedly until all are filled
+func fillEmptyCells(values []float32, cols, rows int32) {
+	for pass:=int32(0); pass<cols+rows; pass++ {
+		changed, missing:=false, false
+		next:=append([]float32(nil), values...)
+		for i, v:=range values {
+			if !math.IsNaN(float64(v)) { continue }
+			x, y:=int32(i)%cols, int32(i)/cols
+			sum, num:=float32(0), 0
+			for dy:=int32(-1); dy<=1; dy++ {
+				for dx:=int32(-1); dx<=1; dx++ {
+					nx, ny:=x+dx, y+dy
+					if nx<0 || ny<0 || nx>=cols || ny>=rows { continue }
+					if n:=values[ny*cols+nx]; !math.IsNaN(float64(n)) { sum+=n; num++ }
+				}
+			}
+			if num>0 { next[i]=sum/float32(num); changed=true } else { missing=true }
+		}
+		copy(values, next)
+		if !missing || !changed { break }
+	}
+	for i, v:=range values {
+		if math.IsNaN(float64(v)) { values[i]=0 }
+	}
+}
+
+// Interpolates the grid bilinearly at the given fractional cell coordinates, clamping at the borders
+func bilinearGrid(values []float32, cols, rows int32, gx, gy float32) float32 {
+	clamp:=func(v float32, n int32) float32 {
+		if v<0 { return 0 }
+		if v>float32(n-1) { return float32(n-1) }
+		return v
+	}
+	gx, gy=clamp(gx, cols), clamp(gy, rows)
+	x0, y0:=int32(gx), int32(gy)
+	x1, y1:=x0+1, y0+1
+	if x1>=cols { x1=x0 }
+	if y1>=rows { y1=y0 }
+	fx, fy:=gx-float32(x0), gy-float32(y0)
+	top   :=values[y0*cols+x0]*(1-fx)+values[y0*cols+x1]*fx
+	bottom:=values[y1*cols+x0]*(1-fx)+values[y1*cols+x1]*fx
+	return top*(1-fy)+bottom*fy
+}
+
+// Maps a value in [0,1] to a blue, cyan, green, yellow, red color ramp
+func heatColor(v float32) (r, g, b float32) {
+	if v<0 { v=0 } else if v>1 { v=1 }
+	switch {
+	case v<0.25: return 0, 4*v, 1
+	case v<0.5:  return 0, 1, 1-4*(v-0.25)
+	case v<0.75: return 4*(v-0.5), 1, 0
+	}
+	return 1, 1-4*(v-0.75), 0
+}
+
+
+// Assembles crops of the four corners, four edge midpoints and the center into a 3x3 mosaic, as in an aberration 
+// inspector. Crops are squares of the given size, separated by gaps. The result is stretched for display to [0,1]
+func (f *FITSImage) AberrationMosaic(size, gap int32) *FITSImage {
+	width, height, planes:=f.Naxisn[0], f.Naxisn[1], f.NumPlanes()
+	if size>width/3  { size=width/3 }
+	if size>height/3 { size=height/3 }
+	mw:=3*size+2*gap
+
+	m:=NewFITSImage()
+	m.Bitpix, m.Bscale=-32, 1
+	m.Naxisn=[]int32{mw, mw}
+	if planes>1 { m.Naxisn=append(m.Naxisn, planes) }
+	m.Pixels=mw*mw*planes
+	m.Data=make([]float32, m.Pixels)
+
+	// stretch with black point below the background and background at a quarter of the range
+	stats:=f.Stats
+	if stats==nil { stats, _=CalcExtendedStats(f.Luminance(), width) }
+	black:=stats.Location-2.8*stats.Scale
+	if black<stats.Min { black=stats.Min }
+	white:=stats.Max
+	if !(white>black) { white=black+1 }
+	bg, target:=(stats.Location-black)/(white-black), float32(0.25)
+	mid:=float32(0.5)
+	if bg>0 && bg<target { mid=bg*(target-1)/(2*target*bg-target-bg) }
+
+	for p:=int32(0); p<planes; p++ {
+		src, dest:=f.Plane(p), m.Data[p*mw*mw:(p+1)*mw*mw]
+		for i:=range dest { dest[i]=1 }  // white gaps
+		for r:=int32(0); r<3; r++ {
+			sy:=[]int32{0, (height-size)/2, height-size}[r]
+			for c:=int32(0); c<3; c++ {
+				sx:=[]int32{0, (width-size)/2, width-size}[c]
+				for y:=int32(0); y<size; y++ {
+					for x:=int32(0); x<size; x++ {
+						v:=(src[(sy+y)*width+sx+x]-black)/(white-black)
+						if v<0 { v=0 } else if v>1 { v=1 }
+						v=v*(mid-1)/((2*mid-1)*v-mid)
+						dest[(r*(size+gap)+y)*mw+c*(size+gap)+x]=v
+					}
+				}
+			}
+		}
+	}
+	m.Header.SetString("IMAGETYP", "Aberration Mosaic", "Type of image")
+	return &m
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeField(t *testing.T) {
+	// FWHM 3 px at the center, growing 1 px towards the right edge and 0.5 px towards all edges, 
+	// with stars elongated radially away from the center
+	width, height:=int32(1000), int32(600)
+	f:=NewFITSImage()
+	f.Naxisn=[]int32{width, height}
+	for y:=float32(10); y<float32(height); y+=20 {
+		for x:=float32(10); x<float32(width); x+=20 {
+			u, v:=2*x/float32(width)-1, 2*y/float32(height)-1
+			fwhm:=3+u+0.5*(u*u+v*v)
+			angle:=float32(math.Atan2(float64(y)-float64(height)/2, float64(x)-float64(width)/2)*180/math.Pi)
+			if angle<0 { angle+=180 }
+			f.PSFs=append(f.PSFs, PSF{X:x, Y:y, FWHMMajor:fwhm*1.1, FWHMMinor:fwhm/1.1, Angle:angle})
+		}
+	}
+
+	a:=AnalyzeField(&f, 5, 5)
+	if a.Metric!="FWHM" { t.Errorf("metric=%s; want FWHM", a.Metric) }
+	if len(a.Cells)!=25 || a.Cells[0].Stars!=60 { t.Errorf("cells=%d stars=%d; want 25, 60", len(a.Cells), a.Cells[0].Stars) }
+	if math.Abs(float64(a.TiltX-1))>0.01 || math.Abs(float64(a.TiltY))>0.01 { t.Errorf("tilt=%f,%f; want 1,0", a.TiltX, a.TiltY) }
+	if math.Abs(float64(a.Curvature-0.5))>0.01 { t.Errorf("curvature=%f; want 0.5", a.Curvature) }
+	if a.Regions[2].Value<=a.Regions[0].Value || a.CornerSpread<=0 || a.CenterToEdge<=0 { 
+		t.Errorf("corners=%f,%f spread=%f centerToEdge=%f; want right softer", a.Regions[0].Value, a.Regions[2].Value, a.CornerSpread, a.CenterToEdge) 
+	}
+	if a.Radial<0.99 { t.Errorf("radial=%f; want 1", a.Radial) }
+
+	m:=a.RenderHeatMap(200)
+	if m.Naxisn[0]!=200 || m.Naxisn[1]!=120 || m.Naxisn[2]!=3 { t.Errorf("heat map size=%v; want [200 120 3]", m.Naxisn) }
+	if r, b:=m.Data[60*200+195], m.Data[2*200*120+60*200+5]; r<0.9 || b<0.9 { t.Errorf("red=%f blue=%f; want right edge red, left edge blue", r, b) }
+}
+
+func TestFieldAnalysisStringWithoutCenter(t *testing.T) {
+	nan:=float32(math.NaN())
+	a:=&FieldAnalysis{Metric:"HFR", Regions:make([]FieldCell, 9), CornerSpread:nan, CenterToEdge:nan, TiltX:nan, TiltY:nan, Curvature:nan}
+	for i:=range a.Regions { a.Regions[i].Value=nan }
+	s:=a.String()
+	if strings.Contains(s, "NaN") || strings.Contains(s, "Inf") { t.Errorf("String()=%q; want no NaN or Inf", s) }
+	if strings.Count(s, "n/a")!=15 { t.Errorf("String()=%q; want 15 n/a", s) }
+
+	a.Regions[4].Value, a.CornerSpread=0, 1
+	if s:=a.String(); !strings.Contains(s, "(n/a of center)") { t.Errorf("String()=%q; want n/a for zero center", s) }
+}
+
+func TestFieldAnalysisStringEmptyCorner(t *testing.T) {
+	// stars everywhere except in the top left region
+	f:=NewFITSImage()
+	f.Naxisn=[]int32{600, 600}
+	for y:=float32(10); y<600; y+=20 {
+		for x:=float32(10); x<600; x+=20 {
+			if x<200 && y<200 { continue }
+			f.PSFs=append(f.PSFs, PSF{X:x, Y:y, FWHMMajor:3.3, FWHMMinor:2.7, Angle:45})
+		}
+	}
+	a:=AnalyzeField(&f, 6, 6)
+	if a.Regions[0].Stars!=0 || !math.IsNaN(float64(a.Regions[0].Value)) { t.Fatalf("top left stars=%d value=%f; want 0 and NaN", a.Regions[0].Stars, a.Regions[0].Value) }
+	lines:=strings.Split(a.String(), "\n")
+	if s:=strings.Join(lines, "\n"); strings.Contains(s, "NaN") { t.Errorf("String()=%q; want no NaN", s) }
+	if !strings.HasPrefix(lines[1], "     n/a (   0)") { t.Errorf("region line '%s'; want n/a for the empty corner", lines[1]) }
+	if !strings.HasPrefix(lines[5], "    n/a   n/a ") { t.Errorf("eccentricity line '%s'; want n/a for the empty corner", lines[5]) }
+}
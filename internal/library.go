@@ -0,0 +1,278 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+// A master calibration frame in the library, indexed by its header metadata
+type LibraryMaster struct {
+	FileName string
+	Type     MasterType
+	Naxisn   []int32     // Image dimensions
+	Header   FITSHeader  // Header values used for matching
+	Exposure float32     // Exposure time in seconds
+
+	image    *FITSImage  // Image data, loaded on first use and released when evicted from the cache
+	lastUse  int64       // Sequence number of the last use, for evicting the least recently used master
+	loadLock sync.Mutex  // Serializes loading of this master, so it is read from disk only once
+}
+
+// A directory of master bias, dark and flat frames, selected per light by matching header metadata
+type CalibrationLibrary struct {
+	Masters       []*LibraryMaster
+	TempTolerance float32  // Maximum sensor temperature difference for darks and bias, in degrees Celsius
+	ExpTolerance  float32  // Maximum relative exposure difference for darks, unless a bias allows scaling
+	CacheSize     int      // Maximum number of masters kept in memory
+
+	uses          int64       // Counter of master uses, for least recently used eviction
+	cacheLock     sync.Mutex  // Protects the cached images and use counters
+}
+
+// Default number of library masters kept in memory, enough for one bias, dark and flat for each of two setups
+const LibraryCacheSize=6
+
+// Header values which must agree between lights and masters of each type, if both have them
+var libraryKeys=map[MasterType][]string{
+	MTBias: {"GAIN", "OFFSET", "XBINNING", "YBINNING"},
+	MTDark: {"GAIN", "OFFSET", "XBINNING", "YBINNING"},
+	MTFlat: {"XBINNING", "YBINNING"},
+}
+
+// File suffixes considered for the calibration library
+var librarySuffixes=[]string{".fits", ".fit", ".fts", ".fz", ".gz", ".gzip", ".xisf"}
+
+
+// Indexes all master frames in the given directory by their IMAGETYP, EXPTIME, CCD-TEMP, GAIN, OFFSET, 
+// XBINNING, YBINNING and FILTER header values. Files of other image types are skipped
+func OpenCalibrationLibrary(dir string, tempTolerance, expTolerance float32) (lib *CalibrationLibrary, err error) {
+	entries, err:=ioutil.ReadDir(dir)
+	if err!=nil { return nil, err }
+	lib=&CalibrationLibrary{TempTolerance:tempTolerance, ExpTolerance:expTolerance, CacheSize:LibraryCacheSize}
+	counts:=make([]int, 3)
+	for _, e:=range entries {
+		if e.IsDir() || !hasLibrarySuffix(e.Name()) { continue }
+		fileName:=filepath.Join(dir, e.Name())
+		h, naxisn, err:=readHeaderOnly(fileName)
+		if err!=nil { 
+			LogPrintf("Warning: skipping calibration library file %s: %s\n", fileName, err)
+			continue 
+		}
+		mt, ok:=parseImageType(h.Strings["IMAGETYP"])
+		if !ok { continue }
+		lib.Masters=append(lib.Masters, &LibraryMaster{FileName:fileName, Type:mt, Naxisn:naxisn, Header:h, Exposure:h.exposure()})
+		counts[mt]++
+	}
+	LogPrintf("Calibration library %s has %d bias, %d dark and %d flat masters\n", dir, counts[MTBias], counts[MTDark], counts[MTFlat])
+	return lib, nil
+}
+
+func hasLibrarySuffix(fileName string) bool {
+	ext:=strings.ToLower(path.Ext(fileName))
+	for _, s:=range librarySuffixes {
+		if ext==s { return true }
+	}
+	return false
+}
+
+// Determines the master type from an IMAGETYP header value, e.g. Bias Frame, MASTER DARK or Flat Field.
+// Dark flats are not indexed, as they apply to flats and not to lights
+func parseImageType(imageType string) (mt MasterType, ok bool) {
+	t:=strings.ToLower(imageType)
+	isDark, isFlat:=strings.Contains(t, "dark"), strings.Contains(t, "flat")
+	switch {
+	case isDark && isFlat:                   return MTBias, false
+	case isDark:                             return MTDark, true
+	case isFlat:                             return MTFlat, true
+	case strings.Contains(t, "bias"):        return MTBias, true
+	case strings.Contains(t, "offset"):      return MTBias, true
+	}
+	return MTBias, false
+}
+
+// Reads the header and image dimensions of the image in the given file. For FITS files, 
+// the image data is skipped. Other formats are read in full
+func readHeaderOnly(fileName string) (h FITSHeader, naxisn []int32, err error) {
+	if strings.ToLower(path.Ext(fileName))==".xisf" {
+		f:=NewFITSImage()
+		err=f.ReadFile(fileName)
+		return f.Header, f.Naxisn, err
+	}
+	file, r, err:=openFITSFile(fileName)
+	if err!=nil { return h, nil, err }
+	defer file.Close()
+
+	primary:=FITSHeader{}
+	for index:=0; ; index++ {
+		h=NewFITSHeader()
+		err=h.read(r)
+		if err==io.EOF && index>0 { return h, nil, errors.New("No HDU with image data found") }
+		if err!=nil { return h, nil, err }
+		if index==0 { primary=h }
+		if h.matchesHDU(index, "") {
+			if index>0 && h.Bools["INHERIT"] { h.inherit(&primary) }
+			prefix:=""
+			if h.isCompressedImage() { prefix="Z" }
+			naxisn=make([]int32, h.Ints[prefix+"NAXIS"])
+			for i:=range naxisn {
+				naxisn[i]=h.Ints[prefix+"NAXIS"+strconv.FormatInt(int64(i+1),10)]
+			}
+			return h, naxisn, nil
+		}
+		_, err=io.CopyN(ioutil.Discard, r, h.dataSize())
+		if err!=nil { return h, nil, err }
+	}
+}
+
+
+// Returns the best-matching master of the given type for the light, or nil if none matches.
+// With scaleDark, darks of any exposure match, else only those within the exposure tolerance.
+// Closer temperatures and exposures are preferred, then masters combined from more frames
+func (lib *CalibrationLibrary) Match(light *FITSImage, mt MasterType, scaleDark bool) *LibraryMaster {
+	candidates:=[]*LibraryMaster{}
+	scores:=map[*LibraryMaster]float64{}
+	for _, m:=range lib.Masters {
+		if m.Type!=mt || !EqualInt32Slice(m.Naxisn, light.Naxisn) || !m.agrees(light, libraryKeys[mt]) { continue }
+		score:=float64(0)
+
+		if mt==MTFlat {
+			lf, mf:=strings.TrimSpace(light.Header.Strings["FILTER"]), strings.TrimSpace(m.Header.Strings["FILTER"])
+			if lf!="" && mf!="" && !strings.EqualFold(lf, mf) { continue }
+		} else {
+			lt, lok:=light.Header.floatValue("CCD-TEMP")
+			ct, cok:=m.Header.floatValue("CCD-TEMP")
+			if lok && cok {
+				diff:=math.Abs(float64(lt-ct))
+				if diff>float64(lib.TempTolerance) { continue }
+				score+=diff
+			}
+		}
+
+		if mt==MTDark && light.Exposure>0 && m.Exposure>0 {
+			diff:=math.Abs(math.Log(float64(light.Exposure/m.Exposure)))
+			if !scaleDark && diff>math.Log1p(float64(lib.ExpTolerance)) { continue }
+			score+=10*diff
+		}
+
+		candidates=append(candidates, m)
+		scores[m]=score
+	}
+	if len(candidates)==0 { return nil }
+	sort.SliceStable(candidates, func(i, j int) bool {
+		si, sj:=scores[candidates[i]], scores[candidates[j]]
+		if si!=sj { return si<sj }
+		return candidates[i].Header.intValue("NCOMBINE")>candidates[j].Header.intValue("NCOMBINE")
+	})
+	return candidates[0]
+}
+
+// Returns true if the master agrees with the light in all given header values present in both
+func (m *LibraryMaster) agrees(light *FITSImage, keys []string) bool {
+	for _, key:=range keys {
+		lv, lok:=light.Header.floatValue(key)
+		mv, mok:=m.Header.floatValue(key)
+		if lok && mok && lv!=mv { return false }
+	}
+	return true
+}
+
+// Returns the image data of the master, loading it on first use. Only loads of the same master wait for each other.
+// Keeps at most CacheSize masters in memory, releasing the least recently used ones
+func (lib *CalibrationLibrary) Load(m *LibraryMaster) (*FITSImage, error) {
+	m.loadLock.Lock()
+	defer m.loadLock.Unlock()
+	if f:=lib.cached(m); f!=nil { return f, nil }
+
+	f, err:=LoadAndCalcStats(m.FileName, -5)
+	if err!=nil { return nil, err }
+	LogPrintf("%s %s %dx%d stats: %v\n", m.Type, m.FileName, f.Naxisn[0], f.Naxisn[1], f.Stats)
+
+	lib.cacheLock.Lock()
+	defer lib.cacheLock.Unlock()
+	m.image=f
+	lib.uses++
+	m.lastUse=lib.uses
+	lib.evict()
+	return f, nil
+}
+
+// Returns the cached image data of the master and marks it as used, or nil if it is not loaded
+func (lib *CalibrationLibrary) cached(m *LibraryMaster) *FITSImage {
+	lib.cacheLock.Lock()
+	defer lib.cacheLock.Unlock()
+	if m.image!=nil {
+		lib.uses++
+		m.lastUse=lib.uses
+	}
+	return m.image
+}
+
+// Releases the least recently used masters until at most CacheSize are loaded. Must hold the cache lock
+func (lib *CalibrationLibrary) evict() {
+	for {
+		loaded, oldest:=0, (*LibraryMaster)(nil)
+		for _, m:=range lib.Masters {
+			if m.image==nil { continue }
+			loaded++
+			if oldest==nil || m.lastUse<oldest.lastUse { oldest=m }
+		}
+		if loaded<=lib.CacheSize || oldest==nil { return }
+		oldest.image=nil
+	}
+}
+
+// Fills in the bias, dark and flat for the light from the library, where not given explicitly, and logs the selection.
+// Darks of other exposure times match if a bias is available for scaling them
+func (lib *CalibrationLibrary) Select(light *FITSImage, biasF, darkF, flatF *FITSImage) (bias, dark, flat *FITSImage, err error) {
+	bias, dark, flat=biasF, darkF, flatF
+	selected:=[]string{}
+	load:=func(mt MasterType, scaleDark bool) (*FITSImage, error) {
+		m:=lib.Match(light, mt, scaleDark)
+		if m==nil { 
+			selected=append(selected, fmt.Sprintf("no %s", mt))
+			return nil, nil 
+		}
+		selected=append(selected, fmt.Sprintf("%s %s", mt, m.FileName))
+		return lib.Load(m)
+	}
+	if bias==nil {
+		bias, err=load(MTBias, false)
+		if err!=nil { return nil, nil, nil, err }
+	}
+	if dark==nil {
+		dark, err=load(MTDark, bias!=nil)
+		if err!=nil { return nil, nil, nil, err }
+	}
+	if flat==nil {
+		flat, err=load(MTFlat, false)
+		if err!=nil { return nil, nil, nil, err }
+	}
+	if len(selected)>0 { LogPrintf("%d: Calibration library selected %s\n", light.ID, strings.Join(selected, ", ")) }
+	return bias, dark, flat, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLibraryMaster(name string, mt MasterType, exposure, temp float32, filter string) *LibraryMaster {
+	m:=&LibraryMaster{FileName:name, Type:mt, Naxisn:[]int32{4, 4}, Header:NewFITSHeader(), Exposure:exposure}
+	m.Header.SetFloat("CCD-TEMP", temp, "")
+	m.Header.SetInt("XBINNING", 1, "")
+	if filter!="" { m.Header.SetString("FILTER", filter, "") }
+	return m
+}
+
+func TestCalibrationLibraryMatch(t *testing.T) {
+	lib:=&CalibrationLibrary{TempTolerance:2, ExpTolerance:0.1}
+	lib.Masters=[]*LibraryMaster{
+		testLibraryMaster("dark300m10", MTDark, 300, -10, ""),
+		testLibraryMaster("dark120m10", MTDark, 120, -10, ""),
+		testLibraryMaster("dark300m20", MTDark, 300, -20, ""),
+		testLibraryMaster("flatHa",     MTFlat,   2, -10, "Ha"),
+		testLibraryMaster("flatO3",     MTFlat,   2, -10, "OIII"),
+	}
+	light:=NewFITSImage()
+	light.Naxisn, light.Exposure=[]int32{4, 4}, 300
+	light.Header.SetFloat("CCD-TEMP", -11, "")
+	light.Header.SetInt("XBINNING", 1, "")
+	light.Header.SetString("FILTER", "OIII", "")
+
+	if m:=lib.Match(&light, MTDark, false); m==nil || m.FileName!="dark300m10" { t.Errorf("dark=%v; want dark300m10", m) }
+	if m:=lib.Match(&light, MTFlat, false); m==nil || m.FileName!="flatO3" { t.Errorf("flat=%v; want flatO3", m) }
+	if m:=lib.Match(&light, MTBias, false); m!=nil { t.Errorf("bias=%v; want nil", m) }
+
+	light.Exposure=180
+	if m:=lib.Match(&light, MTDark, false); m!=nil { t.Errorf("dark for 180s without scaling=%v; want nil", m) }
+	if m:=lib.Match(&light, MTDark, true); m==nil || m.FileName!="dark120m10" { t.Errorf("dark for 180s with scaling=%v; want dark120m10", m) }
+
+	light.Header.SetInt("XBINNING", 2, "")
+	if m:=lib.Match(&light, MTFlat, false); m!=nil { t.Errorf("flat for binning 2=%v; want nil", m) }
+
+	for imageType, want:=range map[string]MasterType{"Bias Frame":MTBias, "MASTER DARK":MTDark, "Flat Field":MTFlat} {
+		if mt, ok:=parseImageType(imageType); !ok || mt!=want { t.Errorf("parseImageType(%s)=%v,%t; want %v,true", imageType, mt, ok, want) }
+	}
+	if _, ok:=parseImageType("Dark Flat"); ok { t.Errorf("parseImageType(Dark Flat) ok=true; want false") }
+}
+
+func TestCalibrationLibraryCache(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "library")
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	defer os.RemoveAll(dir)
+
+	lib:=&CalibrationLibrary{CacheSize:2}
+	for _, name:=range []string{"a.fits", "b.fits", "c.fits"} {
+		f:=NewFITSImage()
+		f.Bitpix, f.Bscale=-32, 1
+		f.Naxisn, f.Pixels, f.Data=[]int32{4, 4}, 16, make([]float32, 16)
+		fileName:=filepath.Join(dir, name)
+		if err:=f.WriteFile(fileName); err!=nil { t.Fatalf("err=%s; want nil", err) }
+		lib.Masters=append(lib.Masters, &LibraryMaster{FileName:fileName, Type:MTDark})
+	}
+	a, b, c:=lib.Masters[0], lib.Masters[1], lib.Masters[2]
+	for _, m:=range []*LibraryMaster{a, b, a, c} {
+		if _, err:=lib.Load(m); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	}
+	if a.image==nil || b.image!=nil || c.image==nil { t.Errorf("loaded a=%t b=%t c=%t; want true false true", a.image!=nil, b.image!=nil, c.image!=nil) }
+}
@@ -0,0 +1,250 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Decoding of lossless JPEG (ITU T.81 process 14) as used for compressed raw data in DNG and CR2 files.
+
+const ljpegLookupBits=9   // Huffman codes up to this length are decoded with a single table lookup
+
+
+// A Huffman table for decoding the magnitude categories of differences
+type ljpegHuffman struct {
+	lookup  [1<<ljpegLookupBits]uint16  // for short codes, code length in high byte and value in low byte, or zero
+	maxCode [17]int32                   // largest code of each length, or -1
+	valPtr  [17]int32                   // index of the first value of each length in values
+	minCode [17]int32                   // smallest code of each length
+	values  []byte
+}
+
+// A component of the lossless JPEG frame
+type ljpegComponent struct {
+	id    byte
+	table int
+}
+
+// Decodes a lossless JPEG stream. Returns the samples in row-major order, with the components of each pixel interleaved,
+// along with the number of samples per row, the number of rows and the sample precision in bits
+func ljpegDecode(data []byte) (samples []uint16, width, height, precision int, err error) {
+	var tables [4]*ljpegHuffman
+	var comps []ljpegComponent
+	restartInterval:=0
+
+	pos:=0
+	for {
+		if pos+4>len(data) || data[pos]!=0xFF { return nil, 0, 0, 0, errors.New("Invalid lossless JPEG marker") }
+		marker:=data[pos+1]
+		pos+=2
+		if marker==0xD8 { continue } // start of image has no length
+		segLen:=int(data[pos])<<8 | int(data[pos+1])
+		if segLen<2 || pos+segLen>len(data) { return nil, 0, 0, 0, errors.New("Lossless JPEG segment truncated") }
+		seg:=data[pos+2:pos+segLen]
+		pos+=segLen
+
+		switch marker {
+		case 0xC4: // define Huffman tables
+			for len(seg)>=17 {
+				id:=int(seg[0]&3)
+				n:=0
+				for _, c:=range seg[1:17] { n+=int(c) }
+				if 17+n>len(seg) { return nil, 0, 0, 0, errors.New("Lossless JPEG Huffman table truncated") }
+				tables[id]=newLJPEGHuffman(seg[1:17], seg[17:17+n])
+				seg=seg[17+n:]
+			}
+		case 0xC3: // start of lossless frame
+			if len(seg)<6 { return nil, 0, 0, 0, errors.New("Lossless JPEG frame header truncated") }
+			precision=int(seg[0])
+			height=int(seg[1])<<8 | int(seg[2])
+			width =int(seg[3])<<8 | int(seg[4])
+			comps =make([]ljpegComponent, int(seg[5]))
+			if len(comps)<1 || len(comps)>4 || len(seg)<6+3*len(comps) { return nil, 0, 0, 0, errors.New("Invalid lossless JPEG frame header") }
+			for i:=range comps { comps[i].id=seg[6+3*i] }
+		case 0xC0, 0xC1, 0xC2, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+			return nil, 0, 0, 0, errors.New("Unsupported JPEG process, only lossless is supported")
+		case 0xDD: // define restart interval
+			if len(seg)>=2 { restartInterval=int(seg[0])<<8 | int(seg[1]) }
+		case 0xDA: // start of scan, followed by entropy coded data
+			if comps==nil { return nil, 0, 0, 0, errors.New("Lossless JPEG scan without frame header") }
+			if len(seg)<1+2*int(seg[0])+3 || int(seg[0])!=len(comps) { return nil, 0, 0, 0, errors.New("Unsupported lossless JPEG scan header") }
+			for i:=range comps {
+				if seg[1+2*i]!=comps[i].id { return nil, 0, 0, 0, errors.New("Unsupported lossless JPEG component order") }
+				comps[i].table=int(seg[2+2*i]>>4)&3
+				if tables[comps[i].table]==nil { return nil, 0, 0, 0, errors.New("Missing lossless JPEG Huffman table") }
+			}
+			predictor:=int(seg[1+2*len(comps)])
+			pointTransform:=uint(seg[3+2*len(comps)]&15)
+			samples, err=ljpegDecodeScan(data[pos:], tables, comps, width, height, precision, predictor, pointTransform, restartInterval)
+			return samples, width*len(comps), height, precision, err
+		}
+	}
+}
+
+// Decodes the entropy coded data of a scan with the given frame parameters
+func ljpegDecodeScan(data []byte, tables [4]*ljpegHuffman, comps []ljpegComponent, width, height, precision, predictor int, 
+	                 pointTransform uint, restartInterval int) (samples []uint16, err error) {
+	if predictor<1 || predictor>7 { return nil, errors.New(fmt.Sprintf("Unsupported lossless JPEG predictor %d", predictor)) }
+	if restartInterval>0 && restartInterval%width!=0 { return nil, errors.New("Unsupported lossless JPEG restart interval") }
+	nc:=len(comps)
+	rowLen:=width*nc
+	samples=make([]uint16, rowLen*height)
+	initial:=1<<uint(precision-int(pointTransform)-1)
+	r:=ljpegBitReader{data:data}
+
+	firstRow:=0 // first row of the current restart interval
+	for row:=0; row<height; row++ {
+		if restartInterval>0 && row>0 && (row*width)%restartInterval==0 {
+			err=r.restart()
+			if err!=nil { return nil, err }
+			firstRow=row
+		}
+		cur:=samples[row*rowLen:(row+1)*rowLen]
+		var prev []uint16
+		if row>0 { prev=samples[(row-1)*rowLen:row*rowLen] }
+		for col:=0; col<width; col++ {
+			for c:=0; c<nc; c++ {
+				diff, err:=r.decodeDiff(tables[comps[c].table])
+				if err!=nil { return nil, err }
+				i:=col*nc+c
+				var pred int
+				if row==firstRow {
+					if col==0 { pred=initial } else { pred=int(cur[i-nc]) }
+				} else if col==0 {
+					pred=int(prev[i])
+				} else {
+					ra, rb, rc:=int(cur[i-nc]), int(prev[i]), int(prev[i-nc])
+					switch predictor {
+					case 1: pred=ra
+					case 2: pred=rb
+					case 3: pred=rc
+					case 4: pred=ra+rb-rc
+					case 5: pred=ra+((rb-rc)>>1)
+					case 6: pred=rb+((ra-rc)>>1)
+					case 7: pred=(ra+rb)>>1
+					}
+				}
+				cur[i]=uint16(pred+diff)
+			}
+		}
+	}
+	if pointTransform>0 {
+		for i:=range samples { samples[i]<<=pointTransform }
+	}
+	return samples, nil
+}
+
+
+// Creates a Huffman table from the number of codes of each length 1-16 and the values in code order
+func newLJPEGHuffman(counts []byte, values []byte) *ljpegHuffman {
+	h:=&ljpegHuffman{values:values}
+	code, k:=int32(0), int32(0)
+	for l:=1; l<=16; l++ {
+		n:=int32(counts[l-1])
+		h.valPtr[l], h.minCode[l], h.maxCode[l]=k, code, code+n-1
+		if n==0 { h.maxCode[l]=-1 }
+		for j:=int32(0); j<n; j++ {
+			if l<=ljpegLookupBits {
+				// all table entries with this code as prefix decode to the same value
+				shift:=uint(ljpegLookupBits-l)
+				for e:=(code+j)<<shift; e<(code+j+1)<<shift; e++ {
+					h.lookup[e]=uint16(l)<<8 | uint16(values[k+j])
+				}
+			}
+		}
+		k+=n
+		code=(code+n)<<1
+	}
+	return h
+}
+
+
+// Reads bits from entropy coded JPEG data, removing stuffed zero bytes after 0xFF
+type ljpegBitReader struct {
+	data   []byte
+	pos    int      // position of the next byte to read
+	acc    uint64   // bits read, left aligned
+	n      uint     // number of valid bits in acc
+	marker bool     // a marker was reached, further reads return zero bits
+}
+
+// Fills the accumulator with at least 32 bits
+func (r *ljpegBitReader) fill() {
+	for r.n<=56 {
+		c:=byte(0)
+		if !r.marker && r.pos<len(r.data) {
+			c=r.data[r.pos]
+			if c==0xFF {
+				if r.pos+1<len(r.data) && r.data[r.pos+1]==0 {
+					r.pos+=2
+				} else {
+					r.marker, c=true, 0
+				}
+			} else {
+				r.pos++
+			}
+		}
+		r.acc|=uint64(c)<<(56-r.n)
+		r.n+=8
+	}
+}
+
+// Reads the given number of bits, up to 16
+func (r *ljpegBitReader) read(numBits uint) int {
+	if r.n<numBits { r.fill() }
+	v:=int(r.acc>>(64-numBits))
+	r.acc<<=numBits
+	r.n-=numBits
+	return v
+}
+
+// Decodes a Huffman coded magnitude category and the following bits into a signed difference
+func (r *ljpegBitReader) decodeDiff(h *ljpegHuffman) (int, error) {
+	if r.n<32 { r.fill() }
+	var ssss int
+	if e:=h.lookup[r.acc>>(64-ljpegLookupBits)]; e!=0 {
+		r.acc<<=e>>8
+		r.n-=uint(e>>8)
+		ssss=int(e&0xFF)
+	} else {
+		code:=int32(r.read(ljpegLookupBits))
+		l:=ljpegLookupBits
+		for ; l<=16 && code>h.maxCode[l]; l++ { code=code<<1 | int32(r.read(1)) }
+		if l>16 { return 0, errors.New("Invalid lossless JPEG Huffman code") }
+		ssss=int(h.values[h.valPtr[l]+code-h.minCode[l]])
+	}
+
+	switch {
+	case ssss==0:  return 0, nil
+	case ssss==16: return 32768, nil
+	case ssss>16:  return 0, errors.New("Invalid lossless JPEG difference category")
+	}
+	v:=r.read(uint(ssss))
+	if v<1<<uint(ssss-1) { v-=1<<uint(ssss)-1 } // negative differences have a leading zero bit
+	return v, nil
+}
+
+// Skips to the data after the next restart marker, discarding buffered bits
+func (r *ljpegBitReader) restart() error {
+	for r.pos+1<len(r.data) && !(r.data[r.pos]==0xFF && r.data[r.pos+1]>=0xD0 && r.data[r.pos+1]<=0xD7) { r.pos++ }
+	if r.pos+1>=len(r.data) { return errors.New("Lossless JPEG restart marker missing") }
+	r.pos+=2
+	r.acc, r.n, r.marker=0, 0, false
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// LZ4 block compression and decompression, as used by XISF. Works on raw blocks without the LZ4 frame format.
+
+const (
+	lz4MinMatch     = 4        // minimum match length
+	lz4LastLiterals = 5        // the last bytes of a block are always literals
+	lz4MFLimit      = 12       // matches must start at least this many bytes before the end of the block
+	lz4MaxOffset    = 65535    // maximum distance of a match
+	lz4HashBits     = 16       // size of the hash table for finding matches
+)
+
+
+// Decompresses an LZ4 block into the given destination buffer, which must have the uncompressed size
+func lz4Decompress(src, dst []byte) error {
+	s, d:=0, 0
+	for s<len(src) {
+		// literal length, in the high nibble of the token plus extension bytes
+		token:=src[s]
+		s++
+		litLen, err:=lz4ReadLength(src, &s, int(token>>4))
+		if err!=nil { return err }
+		if s+litLen>len(src) || d+litLen>len(dst) { return errors.New("LZ4 literals out of bounds") }
+		d+=copy(dst[d:], src[s:s+litLen])
+		s+=litLen
+		if s==len(src) { break } // last sequence has literals only
+
+		// match offset and length, in the low nibble of the token plus extension bytes
+		if s+2>len(src) { return errors.New("LZ4 data truncated") }
+		offset:=int(binary.LittleEndian.Uint16(src[s:]))
+		s+=2
+		matchLen, err:=lz4ReadLength(src, &s, int(token&15))
+		if err!=nil { return err }
+		matchLen+=lz4MinMatch
+		if offset==0 || offset>d || d+matchLen>len(dst) { return errors.New("LZ4 match out of bounds") }
+		for i:=0; i<matchLen; i++ { dst[d+i]=dst[d-offset+i] } // byte by byte, as matches may overlap
+		d+=matchLen
+	}
+	if d!=len(dst) { return errors.New("LZ4 uncompressed size mismatch") }
+	return nil
+}
+
+// Reads a length from an LZ4 token nibble. Values of 15 are extended by subsequent bytes, as long as these are 255
+func lz4ReadLength(src []byte, s *int, length int) (int, error) {
+	if length<15 { return length, nil }
+	for {
+		if *s>=len(src) { return 0, errors.New("LZ4 data truncated") }
+		b:=src[*s]
+		*s++
+		length+=int(b)
+		if b!=255 { return length, nil }
+	}
+}
+
+
+// Compresses the given data into an LZ4 block, using a greedy search for matches
+func lz4Compress(src []byte) []byte {
+	dst:=make([]byte, 0, len(src)/2+16)
+	table:=make([]int32, 1<<lz4HashBits)
+	for i:=range table { table[i]=-1 }
+	hash:=func(i int) uint32 { return (binary.LittleEndian.Uint32(src[i:])*2654435761)>>(32-lz4HashBits) }
+
+	anchor:=0
+	for i:=0; i+lz4MFLimit<=len(src); {
+		h:=hash(i)
+		ref:=int(table[h])
+		table[h]=int32(i)
+		if ref<0 || i-ref>lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:])!=binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		// extend match, keeping the last literals
+		matchLen:=lz4MinMatch
+		for i+matchLen<len(src)-lz4LastLiterals && src[ref+matchLen]==src[i+matchLen] { matchLen++ }
+
+		dst=lz4AppendSequence(dst, src[anchor:i], i-ref, matchLen)
+		i+=matchLen
+		anchor=i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// Appends a sequence of literals and a match to the compressed block. A match length of zero writes literals only
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litNibble, matchNibble:=len(literals), matchLen-lz4MinMatch
+	if litNibble>15 { litNibble=15 }
+	if matchLen==0 { matchNibble=0 } else if matchNibble>15 { matchNibble=15 }
+	dst=append(dst, byte(litNibble<<4|matchNibble))
+	dst=lz4AppendLength(dst, len(literals))
+	dst=append(dst, literals...)
+	if matchLen==0 { return dst }
+	dst=append(dst, byte(offset), byte(offset>>8))
+	return lz4AppendLength(dst, matchLen-lz4MinMatch)
+}
+
+// Appends the extension bytes for lengths of 15 and above
+func lz4AppendLength(dst []byte, length int) []byte {
+	if length<15 { return dst }
+	for length-=15; length>=255; length-=255 { dst=append(dst, 255) }
+	return append(dst, byte(length))
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+
+// Type of master calibration frame
+type MasterType int
+const (
+	MTBias MasterType = iota  // Bias frames at minimum exposure
+	MTDark                    // Dark frames at light exposure and temperature
+	MTFlat                    // Flat fields, normalized before combination
+)
+
+// Parses a master type from its name, one of bias, dark or flat
+func ParseMasterType(s string) (MasterType, error) {
+	switch strings.ToLower(s) {
+	case "bias": return MTBias, nil
+	case "dark": return MTDark, nil
+	case "flat": return MTFlat, nil
+	}
+	return MTBias, errors.New("Unknown master frame type '" + s + "', must be one of bias, dark or flat")
+}
+
+func (mt MasterType) String() string {
+	switch mt {
+	case MTBias: return "bias"
+	case MTDark: return "dark"
+	case MTFlat: return "flat"
+	}
+	return fmt.Sprintf("MasterType(%d)", int(mt))
+}
+
+// Returns the IMAGETYP header value for the master type, as written by common capture software
+func (mt MasterType) ImageType() string {
+	switch mt {
+	case MTDark: return "Dark Frame"
+	case MTFlat: return "Flat Field"
+	}
+	return "Bias Frame"
+}
+
+// Returns the default stacking mode and sigma bounds for combining the given number of frames.
+// Few frames are median combined, more frames are sigma clipped. Darks clip more aggressively on
+// the high side to remove cosmic ray hits, while hot pixels are consistent across frames and kept
+func (mt MasterType) StackDefaults(numFrames int) (mode StackMode, sigLow, sigHigh float32) {
+	if numFrames>=15 {
+		mode=StWinsorSigma
+	} else if numFrames>=6 {
+		mode=StSigma
+	} else {
+		mode=StMedian
+	}
+	if mt==MTDark { return mode, 4, 3 }
+	return mode, 3, 3
+}
+
+
+// Loads a calibration frame, applies the overscan mode and subtracts the bias and dark frames, if given. Darks which 
+// still contain the bias already remove it, so the bias is only subtracted separately for bias-subtracted darks. 
+// Darks with the bias subtracted are marked with BIASSUB. Flats are normalized to a location of one, so flats 
+// of differing brightness combine well
+func LoadCalibrationFrame(id int, fileName string, mt MasterType, biasF, darkF *FITSImage, overscan *OverscanMode) (f *FITSImage, err error) {
+	theF:=NewFITSImage()
+	f=&theF
+	f.ID=id
+	err=f.ReadFile(fileName)
+	if err!=nil { return nil, err }
+
+	if overscan!=nil {
+		if _, _, err=f.ApplyOverscan(overscan); err!=nil { return nil, err }
+	}
+	if biasF!=nil && (darkF==nil || darkF.IsBiasSubtracted()) {
+		if !EqualInt32Slice(biasF.Naxisn, f.Naxisn) { return nil, errors.New("frame size differs from bias size") }
+		Subtract(f.Data, f.Data, biasF.Data)
+		if mt==MTDark { f.Header.SetBool("BIASSUB", true, "Bias has been subtracted") }
+	}
+	if darkF!=nil {
+		if !EqualInt32Slice(darkF.Naxisn, f.Naxisn) { return nil, errors.New("frame size differs from dark size") }
+		Subtract(f.Data, f.Data, darkF.Data)
+	}
+
+	f.Stats, err=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
+	if err!=nil { return nil, err }
+	if mt==MTFlat {
+		loc:=f.Stats.Location
+		if loc<=0 { return nil, errors.New(fmt.Sprintf("flat has non-positive location %.4g", loc)) }
+		factor:=1/loc
+		for i, d:=range f.Data { f.Data[i]=d*factor }
+		f.Stats, err=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
+		if err!=nil { return nil, err }
+		LogPrintf("%d: Normalized by location %.4g, %v\n", id, loc, f.Stats)
+	} else {
+		LogPrintf("%d: %v\n", id, f.Stats)
+	}
+	return f, nil
+}
+
+
+// Returns true if the image is a dark frame with the bias already subtracted, as marked by BIASSUB
+func (f *FITSImage) IsBiasSubtracted() bool {
+	return f.Header.Bools["BIASSUB"]
+}
+
+
+// Loads the given calibration frames in parallel. Frames which fail to load are logged and omitted
+func LoadCalibrationFrames(ids []int, fileNames []string, mt MasterType, biasF, darkF *FITSImage, overscan *OverscanMode, imageLevelParallelism int32) (frames []*FITSImage) {
+	frames=make([]*FITSImage, len(fileNames))
+	sem   :=make(chan bool, imageLevelParallelism)
+	for i, fileName:=range fileNames {
+		sem <- true
+		go func(i int, id int, fileName string) {
+			defer func() { <-sem }()
+			f, err:=LoadCalibrationFrame(id, fileName, mt, biasF, darkF, overscan)
+			if err!=nil {
+				LogPrintf("%d: Error: %s\n", id, err.Error())
+			} else {
+				frames[i]=f
+			}
+		}(i, ids[i], fileName)
+	}
+	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
+		sem <- true
+	}
+
+	o:=0
+	for _, f:=range frames {
+		if f!=nil { frames[o]=f; o++ }
+	}
+	return frames[:o]
+}
+
+
+// Summary of the frames combined into a master, for its header values.
+// Accumulates across batches when the frames do not fit into memory at once
+type MasterSummary struct {
+	Frames      int32    // Number of frames combined
+	ExposureSum float32  // Sum of exposure times in seconds
+	TempSum     float32  // Sum of sensor temperatures in degrees Celsius
+	TempFrames  int32    // Number of frames with a sensor temperature
+}
+
+// Adds the given frames to the summary
+func (s *MasterSummary) Add(frames []*FITSImage) {
+	for _, f:=range frames {
+		s.Frames++
+		s.ExposureSum+=f.Exposure
+		if t, ok:=f.Header.floatValue("CCD-TEMP"); ok {
+			s.TempSum+=t
+			s.TempFrames++
+		}
+	}
+}
+
+// Sets the master exposure to the average of the frames, and the IMAGETYP, NCOMBINE, EXPTIME and CCD-TEMP header values
+func (s *MasterSummary) Apply(master *FITSImage, mt MasterType) {
+	h:=&master.Header
+	h.SetString("IMAGETYP", mt.ImageType(), "Type of image")
+	h.SetInt("NCOMBINE", s.Frames, "Number of frames combined")
+	master.Exposure=0
+	if s.Frames>0 { master.Exposure=s.ExposureSum/float32(s.Frames) }
+	h.Delete("EXPOSURE")
+	h.SetFloat("EXPTIME", master.Exposure, "[s] Average exposure duration")
+	if s.TempFrames>0 {
+		h.SetFloat("CCD-TEMP", s.TempSum/float32(s.TempFrames), "[C] Average sensor temperature")
+	}
+}
+
+
+// Stacks calibration frames into a master with the given mode and sigma bounds. 
+// Header values are taken from the first frame, see MasterSummary for the master-specific ones
+func StackMaster(frames []*FITSImage, mode StackMode, sigLow, sigHigh float32) (master *FITSImage, err error) {
+	if len(frames)==0 { return nil, errors.New("no calibration frames to stack") }
+	refMedian:=frames[0].Stats.Location
+	master, _, _, err=Stack(frames, mode, nil, refMedian, sigLow, sigHigh)
+	if err!=nil { return nil, err }
+	master.Header=frames[0].Header.Clone()
+	return master, nil
+}
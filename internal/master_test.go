@@ -0,0 +1,94 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStackMaster(t *testing.T) {
+	frames:=make([]*FITSImage, 3)
+	for i:=range frames {
+		f:=NewFITSImage()
+		f.Naxisn, f.Pixels, f.Exposure=[]int32{4, 2}, 8, float32(60+30*i)
+		f.Data=[]float32{10, 10, 10, 10, 10, 10, 10, 10}
+		f.Stats=CalcBasicStats(f.Data)
+		f.Header.SetFloat("EXPTIME", f.Exposure, "")
+		if i<2 { f.Header.SetInt("CCD-TEMP", int32(-10-2*i), "") }
+		frames[i]=&f
+	}
+	frames[1].Data[3]=1000 // cosmic ray hit
+
+	mode, _, _:=MTDark.StackDefaults(len(frames))
+	master, err:=StackMaster(frames, mode, 4, 3)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if master.Data[3]!=10 { t.Errorf("Data[3]=%f; want 10", master.Data[3]) }
+
+	summary:=MasterSummary{}
+	summary.Add(frames)
+	summary.Apply(master, MTDark)
+	if v:=master.Header.Strings["IMAGETYP"]; v!="Dark Frame" { t.Errorf("IMAGETYP=%s; want Dark Frame", v) }
+	if v:=master.Header.Ints["NCOMBINE"]; v!=3 { t.Errorf("NCOMBINE=%d; want 3", v) }
+	if master.Exposure!=90 { t.Errorf("Exposure=%f; want 90", master.Exposure) }
+	if v:=master.Header.Floats["CCD-TEMP"]; v!=-11 { t.Errorf("CCD-TEMP=%f; want -11", v) }
+
+	if _, err:=ParseMasterType("light"); err==nil { t.Errorf("ParseMasterType(light) err=nil; want error") }
+}
+
+func TestLoadCalibrationFrame(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "master")
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	defer os.RemoveAll(dir)
+
+	// bias of 100, dark current of 5 and a flat of about 1000 with a 1% pattern
+	width, height:=int32(16), int32(16)
+	newFrame:=func(value func(i int) float32) *FITSImage {
+		f:=NewFITSImage()
+		f.Bitpix, f.Bscale=-32, 1
+		f.Naxisn, f.Pixels, f.Data=[]int32{width, height}, width*height, make([]float32, width*height)
+		for i:=range f.Data { f.Data[i]=value(i) }
+		return &f
+	}
+	pattern:=func(i int) float32 { return 1+0.01*float32(i%7-3) }
+	bias:=newFrame(func(i int) float32 { return 100 })
+	darkName, flatName:=filepath.Join(dir, "dark.fits"), filepath.Join(dir, "flat.fits")
+	if err:=newFrame(func(i int) float32 { return 105 }).WriteFile(darkName); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if err:=newFrame(func(i int) float32 { return 105+1000*pattern(i) }).WriteFile(flatName); err!=nil { t.Fatalf("err=%s; want nil", err) }
+
+	dark, err:=LoadCalibrationFrame(0, darkName, MTDark, nil, nil, nil)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if dark.Data[0]!=105 || dark.IsBiasSubtracted() { t.Errorf("dark=%f BIASSUB=%t; want 105 false", dark.Data[0], dark.IsBiasSubtracted()) }
+	darkSub, err:=LoadCalibrationFrame(1, darkName, MTDark, bias, nil, nil)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if darkSub.Data[0]!=5 || !darkSub.IsBiasSubtracted() { t.Errorf("dark=%f BIASSUB=%t; want 5 true", darkSub.Data[0], darkSub.IsBiasSubtracted()) }
+
+	// flats calibrated with a dark containing the bias, or with a bias and a bias-subtracted dark, must agree
+	for _, darkF:=range []*FITSImage{dark, darkSub} {
+		flat, err:=LoadCalibrationFrame(2, flatName, MTFlat, bias, darkF, nil)
+		if err!=nil { t.Fatalf("err=%s; want nil", err) }
+		for i, d:=range flat.Data {
+			if math.Abs(float64(d-pattern(i)))>1e-4 {
+				t.Errorf("flat[%d]=%f; want %f", i, d, pattern(i))
+				break
+			}
+		}
+	}
+}
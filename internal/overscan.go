@@ -0,0 +1,255 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+
+// Overscan correction mode. The overscan level is measured as the median of each line of the BIASSEC region
+// along its long side, i.e. per row for overscan columns and per column for overscan rows
+type OverscanMode struct {
+	Name     string  // Mode name as given on the command line
+	Subtract bool    // Subtract the overscan level, else only trim
+	PerLine  bool    // Subtract the level of each line as measured
+	Degree   int32   // Otherwise, subtract a polynomial of this degree fitted to the line levels
+}
+
+// Parses an overscan mode: trim to only trim to the data section, row to subtract the level line by line,
+// mean for a constant level, or polyN for a polynomial of degree N. Returns nil for the empty string
+func ParseOverscanMode(s string) (*OverscanMode, error) {
+	s=strings.ToLower(s)
+	switch {
+	case s=="":     return nil, nil
+	case s=="trim": return &OverscanMode{Name:s}, nil
+	case s=="row":  return &OverscanMode{Name:s, Subtract:true, PerLine:true}, nil
+	case s=="mean": return &OverscanMode{Name:s, Subtract:true, Degree:0}, nil
+	case strings.HasPrefix(s, "poly"):
+		d, err:=strconv.Atoi(s[4:])
+		if err!=nil || d<0 || d>9 { return nil, errors.New("Invalid overscan polynomial degree "+s[4:]) }
+		return &OverscanMode{Name:s, Subtract:true, Degree:int32(d)}, nil
+	}
+	return nil, errors.New("Unknown overscan mode "+s)
+}
+
+func (m *OverscanMode) String() string {
+	return m.Name
+}
+
+
+// A rectangular image section with zero-based, exclusive upper bounds
+type Section struct {
+	X0, X1, Y0, Y1 int32
+}
+
+// Parses a FITS image section like [1:2048,1:1024], with one-based inclusive bounds in either order,
+// and checks it lies within an image of the given size
+func ParseSection(s string, width, height int32) (sec Section, err error) {
+	t:=strings.TrimSpace(s)
+	if !strings.HasPrefix(t, "[") || !strings.HasSuffix(t, "]") { return sec, errors.New("Invalid image section "+s) }
+	axes:=strings.Split(t[1:len(t)-1], ",")
+	if len(axes)!=2 { return sec, errors.New("Invalid image section "+s) }
+	var bounds [4]int32
+	for i, axis:=range axes {
+		r:=strings.Split(axis, ":")
+		if len(r)!=2 { return sec, errors.New("Invalid image section "+s) }
+		for j, v:=range r {
+			n, err:=strconv.Atoi(strings.TrimSpace(v))
+			if err!=nil { return sec, errors.New("Invalid image section "+s) }
+			bounds[2*i+j]=int32(n)
+		}
+		if bounds[2*i]>bounds[2*i+1] { bounds[2*i], bounds[2*i+1]=bounds[2*i+1], bounds[2*i] }
+	}
+	sec=Section{bounds[0]-1, bounds[1], bounds[2]-1, bounds[3]}
+	if sec.X0<0 || sec.Y0<0 || sec.X1>width || sec.Y1>height {
+		return sec, errors.New(fmt.Sprintf("Image section %s exceeds image size %dx%d", s, width, height))
+	}
+	return sec, nil
+}
+
+func (s Section) Width()  int32 { return s.X1-s.X0 }
+func (s Section) Height() int32 { return s.Y1-s.Y0 }
+
+
+// Subtracts the overscan level given by the BIASSEC header value with the given mode, and trims the image to 
+// TRIMSEC or DATASEC if present. Section keywords are removed from the header afterwards, Bayer offsets adjusted
+// for the trim, and the average level subtracted recorded as OVERSCAN. Returns the average level and whether the image was trimmed
+func (f *FITSImage) ApplyOverscan(mode *OverscanMode) (level float32, trimmed bool, err error) {
+	if len(f.Naxisn)<2 { return 0, false, errors.New("overscan needs a two-dimensional image") }
+	width, height:=f.Naxisn[0], f.Naxisn[1]
+
+	if mode.Subtract {
+		biasSec, ok:=f.Header.Strings["BIASSEC"]
+		if !ok { return 0, false, errors.New("missing BIASSEC header for overscan") }
+		sec, err:=ParseSection(biasSec, width, height)
+		if err!=nil { return 0, false, err }
+		for p:=int32(0); p<f.NumPlanes(); p++ {
+			level+=subtractOverscan(f.Plane(p), width, sec, mode)
+		}
+		level/=float32(f.NumPlanes())
+		f.Header.SetFloat("OVERSCAN", level, "Average overscan level subtracted")
+	}
+
+	trimSec, ok:=f.Header.Strings["TRIMSEC"]
+	if !ok { trimSec, ok=f.Header.Strings["DATASEC"] }
+	if ok {
+		sec, err:=ParseSection(trimSec, width, height)
+		if err!=nil { return 0, false, err }
+		f.trim(sec)
+		trimmed=true
+	}
+	for _, key:=range []string{"BIASSEC", "DATASEC", "TRIMSEC"} { f.Header.Delete(key) }
+	return level, trimmed, nil
+}
+
+// Measures the overscan level in the given section line by line, and subtracts it from the entire image plane.
+// Returns the average level subtracted
+func subtractOverscan(data []float32, width int32, sec Section, mode *OverscanMode) (average float32) {
+	height:=int32(len(data))/width
+	perRow:=sec.Width()<=sec.Height()
+	n, first, length:=height, sec.Y0, sec.Height()
+	if !perRow { n, first, length=width, sec.X0, sec.Width() }
+
+	// measure the median of each overscan line
+	measured:=make([]float32, length)
+	buffer  :=make([]float32, sec.Width()*sec.Height()/length)
+	for i:=int32(0); i<length; i++ {
+		buffer=buffer[:0]
+		if perRow {
+			buffer=append(buffer, data[(sec.Y0+i)*width+sec.X0 : (sec.Y0+i)*width+sec.X1]...)
+		} else {
+			for y:=sec.Y0; y<sec.Y1; y++ { buffer=append(buffer, data[y*width+sec.X0+i]) }
+		}
+		measured[i]=QSelectMedianFloat32(buffer)
+	}
+
+	// determine the level for each line of the image, extending measured levels to lines outside the section
+	levels:=make([]float32, n)
+	if mode.PerLine {
+		for i:=int32(0); i<n; i++ {
+			j:=i-first
+			if j<0 { j=0 } else if j>=length { j=length-1 }
+			levels[i]=measured[j]
+		}
+	} else {
+		ts, ys:=make([]float64, length), make([]float64, length)
+		for i:=int32(0); i<length; i++ { ts[i], ys[i]=normalizedPosition(first+i, n), float64(measured[i]) }
+		coeffs:=fitPolynomial(ts, ys, int(mode.Degree))
+		for i:=int32(0); i<n; i++ { levels[i]=float32(evalPolynomial(coeffs, normalizedPosition(i, n))) }
+	}
+
+	// subtract the levels
+	sum:=float64(0)
+	for i, l:=range levels {
+		sum+=float64(l)
+		if perRow {
+			row:=data[int32(i)*width:int32(i+1)*width]
+			for x:=range row { row[x]-=l }
+		} else {
+			for y:=int32(0); y<height; y++ { data[y*width+int32(i)]-=l }
+		}
+	}
+	return float32(sum/float64(n))
+}
+
+// Maps line i of n to the interval [-1,1], for a well-conditioned polynomial fit
+func normalizedPosition(i, n int32) float64 {
+	if n<=1 { return 0 }
+	return 2*float64(i)/float64(n-1)-1
+}
+
+// Fits a polynomial of the given degree to the points with least squares, and returns its coefficients in
+// ascending order. The degree is reduced if there are too few points
+func fitPolynomial(ts, ys []float64, degree int) (coeffs []float64) {
+	if degree>=len(ts) { degree=len(ts)-1 }
+	if degree<0 { return []float64{0} }
+	n:=degree+1
+
+	// set up normal equations as augmented matrix
+	m:=make([][]float64, n)
+	for r:=range m { m[r]=make([]float64, n+1) }
+	for i, t:=range ts {
+		pows:=make([]float64, 2*n)
+		pows[0]=1
+		for k:=1; k<len(pows); k++ { pows[k]=pows[k-1]*t }
+		for r:=0; r<n; r++ {
+			for c:=0; c<n; c++ { m[r][c]+=pows[r+c] }
+			m[r][n]+=pows[r]*ys[i]
+		}
+	}
+
+	return solveLinearSystem(m)
+}
+
+// Solves the linear system given as n x n+1 augmented matrix with Gaussian elimination and partial pivoting.
+// Modifies the matrix. Unknowns of singular systems are zero
+func solveLinearSystem(m [][]float64) (xs []float64) {
+	n:=len(m)
+	for c:=0; c<n; c++ {
+		pivot:=c
+		for r:=c+1; r<n; r++ {
+			if math.Abs(m[r][c])>math.Abs(m[pivot][c]) { pivot=r }
+		}
+		m[c], m[pivot]=m[pivot], m[c]
+		if m[c][c]==0 { continue }
+		for r:=c+1; r<n; r++ {
+			f:=m[r][c]/m[c][c]
+			for k:=c; k<=n; k++ { m[r][k]-=f*m[c][k] }
+		}
+	}
+	xs=make([]float64, n)
+	for r:=n-1; r>=0; r-- {
+		sum:=m[r][n]
+		for k:=r+1; k<n; k++ { sum-=m[r][k]*xs[k] }
+		if m[r][r]!=0 { xs[r]=sum/m[r][r] }
+	}
+	return xs
+}
+
+// Evaluates a polynomial with coefficients in ascending order at t
+func evalPolynomial(coeffs []float64, t float64) (res float64) {
+	for i:=len(coeffs)-1; i>=0; i-- { res=res*t+coeffs[i] }
+	return res
+}
+
+// Trims the image to the given section, adjusting the Bayer offsets in the header so the color filter array pattern is kept
+func (f *FITSImage) trim(sec Section) {
+	width, height:=f.Naxisn[0], f.Naxisn[1]
+	planes:=f.NumPlanes()
+	w, h:=sec.Width(), sec.Height()
+	data:=make([]float32, w*h*planes)
+	for p:=int32(0); p<planes; p++ {
+		src, dest:=f.Plane(p), data[p*w*h:(p+1)*w*h]
+		for y:=int32(0); y<h; y++ {
+			copy(dest[y*w:(y+1)*w], src[(sec.Y0+y)*width+sec.X0 : (sec.Y0+y)*width+sec.X1])
+		}
+	}
+	f.Data, f.Pixels=data, w*h*planes
+	f.Naxisn[0], f.Naxisn[1]=w, h
+
+	if f.Header.Has("BAYERPAT") {
+		yOffset:=sec.Y0
+		if strings.ToUpper(strings.TrimSpace(f.Header.Strings["ROWORDER"]))=="BOTTOM-UP" { yOffset=height-sec.Y1 }
+		f.Header.SetInt("XBAYROFF", f.Header.intValue("XBAYROFF")+sec.X0, "X offset of Bayer array")
+		f.Header.SetInt("YBAYROFF", f.Header.intValue("YBAYROFF")+yOffset, "Y offset of Bayer array")
+	}
+}
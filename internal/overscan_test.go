@@ -0,0 +1,63 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSection(t *testing.T) {
+	sec, err:=ParseSection("[ 33:2, 1:16 ]", 40, 16)
+	if err!=nil { t.Fatalf("err=%s", err) }
+	if sec!=(Section{1, 33, 0, 16}) { t.Errorf("sec=%v; want {1 33 0 16}", sec) }
+	if _, err=ParseSection("[1:41,1:16]", 40, 16); err==nil { t.Errorf("err=nil; want section exceeding image") }
+	if _, err=ParseSection("1:40,1:16", 40, 16); err==nil { t.Errorf("err=nil; want invalid section") }
+}
+
+func TestApplyOverscan(t *testing.T) {
+	// 16 data columns followed by 4 overscan columns, with a level rising linearly over the rows
+	width, height:=int32(20), int32(8)
+	for _, name:=range []string{"row", "poly1"} {
+		f:=NewFITSImage()
+		f.Naxisn=[]int32{width, height}
+		f.Pixels=width*height
+		f.Data=make([]float32, f.Pixels)
+		for y:=int32(0); y<height; y++ {
+			for x:=int32(0); x<width; x++ {
+				v:=float32(100+10*y)
+				if x<16 { v+=50 }
+				f.Data[y*width+x]=v
+			}
+		}
+		f.Header.SetString("BIASSEC",  "[17:20,1:8]", "")
+		f.Header.SetString("DATASEC",  "[1:16,1:8]",  "")
+		f.Header.SetString("BAYERPAT", "RGGB",        "")
+		mode, err:=ParseOverscanMode(name)
+		if err!=nil { t.Fatalf("err=%s", err) }
+		level, trimmed, err:=f.ApplyOverscan(mode)
+		if err!=nil { t.Fatalf("err=%s", err) }
+		if !trimmed || f.Naxisn[0]!=16 || f.Naxisn[1]!=8 || len(f.Data)!=16*8 { t.Errorf("%s: size %v; want [16 8]", name, f.Naxisn) }
+		if math.Abs(float64(level-135))>1e-3 { t.Errorf("%s: level=%f; want 135", name, level) }
+		for i, d:=range f.Data {
+			if math.Abs(float64(d-50))>1e-3 { t.Errorf("%s: data[%d]=%f; want 50", name, i, d); break }
+		}
+		if f.Header.Has("BIASSEC") || f.Header.Has("DATASEC") { t.Errorf("%s: section keys not removed", name) }
+	}
+
+	if _, err:=ParseOverscanMode("poly12"); err==nil { t.Errorf("err=nil; want invalid degree") }
+}
@@ -100,7 +100,7 @@ func postProcessLight(aligner *Aligner, histoRef, light *FITSImage, alignThresho
 		case HNMLocBlack:
 	    	light.ShiftBlackToMove(light.Stats.Location, histoRef.Stats.Location)
 	    	var err error
-	    	light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
+	    	light.Stats, err=CalcExtendedStats(light.Luminance(), light.Naxisn[0])
 	    	if err!=nil { return nil, err }
 			LogPrintf("%d: %s\n", light.ID, light.Stats)
 	}
@@ -128,11 +128,11 @@ func postProcessLight(aligner *Aligner, histoRef, light *FITSImage, alignThresho
 
 		// Determine alignment of the image to the reference frame
 		trans, residual := aligner.Align(light.Naxisn, light.Stars, light.ID)
+		light.Trans, light.Residual=trans, residual
 		if residual>alignThreshold {
 			msg:=fmt.Sprintf("%d:Skipping image as residual %g is above limit %g", light.ID, residual, alignThreshold)
 			return nil, errors.New(msg)
 		} 
-		light.Trans, light.Residual=trans, residual
 		LogPrintf("%d: Transform %v; oob %.3g residual %.3g\n", light.ID, light.Trans, outOfBounds, light.Residual)
 
 		// Project image into reference frame
@@ -142,11 +142,13 @@ func postProcessLight(aligner *Aligner, histoRef, light *FITSImage, alignThresho
 
 	// apply unsharp masking, if requested
 	if usmGain>0 {
-		light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
+		light.Stats, err=CalcExtendedStats(light.Luminance(), light.Naxisn[0])
 		if err!=nil { return nil, err }
 		absThresh:=light.Stats.Location + light.Stats.Scale*usmThresh
 		LogPrintf("%d: Unsharp masking with sigma %.3g gain %.3g thresh %.3g absThresh %.3g\n", light.ID, usmSigma, usmGain, usmThresh, absThresh)
-		light.Data=UnsharpMask(light.Data, int(light.Naxisn[0]), usmSigma, usmGain, light.Stats.Min, light.Stats.Max, absThresh)
+		for p:=int32(0); p<light.NumPlanes(); p++ {
+			copy(light.Plane(p), UnsharpMask(light.Plane(p), int(light.Naxisn[0]), usmSigma, usmGain, light.Stats.Min, light.Stats.Max, absThresh))
+		}
 		light.Stats=CalcBasicStats(light.Data)
 	}
 
@@ -19,6 +19,7 @@ package internal
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 
@@ -30,10 +31,22 @@ func LoadAndCalcStats(fileName string, id int) (f *FITSImage, err error) {
 	err=f.ReadFile(fileName)
 	if err!=nil { return nil, err }
 	f.Stats=CalcBasicStats(f.Data)
-	f.Stats.Noise=EstimateNoise(f.Data, f.Naxisn[0])
+	f.Stats.Noise=EstimateNoise(f.Luminance(), f.Naxisn[0])
 	return f, nil
 }
 
+// Load bias frame from FITS file
+func LoadBias(fileName string) *FITSImage {
+	f, err:=LoadAndCalcStats(fileName, -4)
+	if err!=nil { panic(err.Error()) }
+
+	LogPrintf("%s %s %dx%d stats: %v\n", "bias", fileName, f.Naxisn[0], f.Naxisn[1], f.Stats)
+	if f.Stats.StdDev<1e-8 {
+		LogPrintf("Warnining: bias file may be degenerate\n")
+	}
+	return f
+}
+
 // Load dark frame from FITS file
 func LoadDark(fileName string) *FITSImage {
 	f, err:=LoadAndCalcStats(fileName, -1)
@@ -74,7 +87,7 @@ func LoadAlignTo(fileName string) *FITSImage {
 
 
 // Preprocess all light frames with given global settings, limiting concurrency to the number of available CPUs
-func PreProcessLights(ids []int, fileNames []string, darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, starSig, starBpSig, starInOut float32, starRadius int32, starsShow string, backGrid int32, backSigma float32, backClip int32, backPattern, preprocessedPattern string, imageLevelParallelism int32) (lights []*FITSImage) {
+func PreProcessLights(ids []int, fileNames []string, biasF, darkF, flatF *FITSImage, lib *CalibrationLibrary, darkOpt bool, defects *DefectMap, overscan *OverscanMode, pedestal float32, debayer, debayerMode, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, starSig, starBpSig, starInOut float32, starRadius int32, psfModel PSFModel, psfStars int32, pixelScale float32, starsShow string, backGrid int32, backSigma float32, backClip int32, backPattern, preprocessedPattern string, imageLevelParallelism int32) (lights []*FITSImage) {
 	//LogPrintf("CSV Id,%s\n", (&BasicStats{}).ToCSVHeader())
 
 	lights =make([]*FITSImage, len(fileNames))
@@ -84,7 +97,7 @@ func PreProcessLights(ids []int, fileNames []string, darkF, flatF *FITSImage, de
 		sem <- true 
 		go func(i int, id int, fileName string) {
 			defer func() { <-sem }()
-			lightP, err:=PreProcessLight(id, fileName, darkF, flatF, debayer, cfa, binning, normRange, bpSigLow, bpSigHigh, starSig, starBpSig, starInOut, starRadius, backGrid, backSigma, backClip, backPattern)
+			lightP, err:=PreProcessLight(id, fileName, biasF, darkF, flatF, lib, darkOpt, defects, overscan, pedestal, debayer, debayerMode, cfa, binning, normRange, bpSigLow, bpSigHigh, starSig, starBpSig, starInOut, starRadius, psfModel, psfStars, pixelScale, backGrid, backSigma, backClip, backPattern)
 			if err!=nil {
 				LogPrintf("%d: Error: %s\n", id, err.Error())
 			} else {
@@ -104,29 +117,104 @@ func PreProcessLights(ids []int, fileNames []string, darkF, flatF *FITSImage, de
 	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
 		sem <- true
 	}
+	warnCFAMismatch(lights)
 	return lights	
 }
 
+// Logs a warning if the given frames were debayered from different color filter array patterns
+func warnCFAMismatch(lights []*FITSImage) {
+	counts:=map[string]int{}
+	for _, l:=range lights {
+		if l!=nil && l.CFA!="" { counts[l.CFA]++ }
+	}
+	if len(counts)<=1 { return }
+	patterns:=[]string{}
+	for _, cfa:=range []string{"RGGB", "GRBG", "GBRG", "BGGR"} {
+		if n:=counts[cfa]; n>0 { patterns=append(patterns, fmt.Sprintf("%s %d", cfa, n)) }
+	}
+	LogPrintf("Warning: frames have different Bayer patterns (%s). Check headers or set -cfa\n", strings.Join(patterns, ", "))
+}
+
 // Preprocess a single light frame with given settings.
-// Pre-processing includes loading, basic statistics, dark subtraction, flat division, 
-// bad pixel removal, star detection and HFR calculation.
-func PreProcessLight(id int, fileName string, darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, 
-	starSig, starBpSig, starInOut float32, starRadius int32, backGrid int32, backSigma float32, backClip int32, backPattern string) (lightP *FITSImage, err error) {
+// Pre-processing includes loading, overscan subtraction and trimming, selection of calibration frames from the library if given,
+// basic statistics, bias and dark subtraction, flat division, pedestal, defect map correction, 
+// bad pixel removal, star detection, HFR calculation and optional PSF fitting. Color data cubes are processed
+// plane by plane, with statistics and star detection on their luminance.
+func PreProcessLight(id int, fileName string, biasF, darkF, flatF *FITSImage, lib *CalibrationLibrary, darkOpt bool, defects *DefectMap, overscan *OverscanMode, pedestal float32, debayer, debayerMode, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, 
+	starSig, starBpSig, starInOut float32, starRadius int32, psfModel PSFModel, psfStars int32, pixelScale float32, backGrid int32, backSigma float32, backClip int32, backPattern string) (lightP *FITSImage, err error) {
 	// Load light frame
 	light:=NewFITSImage()
 	light.ID=id
 	err=light.ReadFile(fileName)
 	if err!=nil { return nil, err }
 
+	// subtract overscan and trim to the data section if flagged
+	if overscan!=nil {
+		level, trimmed, err:=light.ApplyOverscan(overscan)
+		if err!=nil { return nil, err }
+		if overscan.Subtract { LogPrintf("%d: Subtracted overscan level %.4g with mode %s\n", id, level, overscan) }
+		if trimmed { LogPrintf("%d: Trimmed to data section %dx%d\n", id, light.Naxisn[0], light.Naxisn[1]) }
+	}
+
+	// remember the sensor width, to derive the pixel scale after debayering or binning
+	sensorWidth:=light.Naxisn[0]
+
+	// determine the color filter array pattern from the header, unless given
+	if debayer!="" { light.CFA=SelectCFA(cfa, &light.Header, light.Naxisn[1]) }
+
+	// select bias, dark and flat from the calibration library for this light, unless given
+	if lib!=nil {
+		biasF, darkF, flatF, err=lib.Select(&light, biasF, darkF, flatF)
+		if err!=nil { return nil, err }
+	}
+
 	//light.Stats=aim.CalcBasicStats(light.Data)
 	//LogPrintf("%d: Light %v %d bpp, %v\n", id, light.Naxisn, light.Bitpix, light.Stats)
 
-	// apply dark frame if available
+	// apply bias and dark frames if available. With a bias, the dark current is scaled by exposure time or optimized
+	var biasData []float32
+	if biasF!=nil && biasF.Pixels>0 {
+		if !EqualInt32Slice(biasF.Naxisn, light.Naxisn) {
+			return nil, errors.New("light size differs from bias size")
+		}
+		warnCalibrationMismatch(id, &light, biasF, "bias")
+		biasData=biasF.Data
+	}
 	if darkF!=nil && darkF.Pixels>0 {
 		if !EqualInt32Slice(darkF.Naxisn, light.Naxisn) {
 			return nil, errors.New("light size differs from dark size")
 		}
-		Subtract(light.Data, light.Data, darkF.Data)
+		warnCalibrationMismatch(id, &light, darkF, "dark")
+
+		// bias contained in the dark, which is nil for bias-subtracted darks
+		darkBias:=biasData
+		if darkF.IsBiasSubtracted() {
+			if biasData!=nil {
+				Subtract(light.Data, light.Data, biasData)
+			} else {
+				LogPrintf("%d: Warning: dark is bias-subtracted, use -bias to remove the offset from the light\n", id)
+			}
+			darkBias=nil
+		}
+
+		ratio:=float32(1)
+		if light.Exposure>0 && darkF.Exposure>0 { ratio=light.Exposure/darkF.Exposure }
+		scale:=float32(1)
+		if darkOpt && biasData==nil {
+			LogPrintf("%d: Warning: optimizing the dark scale needs a bias to separate the offset from the dark current, using scale 1\n", id)
+		} else if darkOpt {
+			maxScale:=2*ratio
+			if maxScale<2 { maxScale=2 }
+			scale=OptimizeDarkScale(light.Data, darkBias, darkF.Data, light.Naxisn[0], maxScale)
+			LogPrintf("%d: Optimized dark scale %.4g, exposure ratio %.4g\n", id, scale, ratio)
+		} else if biasData!=nil {
+			scale=ratio
+		} else if ratio!=1 {
+			LogPrintf("%d: Warning: light exposure %gs differs from dark exposure %gs, use -bias to scale the dark\n", id, light.Exposure, darkF.Exposure)
+		}
+		SubtractScaledDark(light.Data, darkBias, darkF.Data, scale)
+	} else if biasData!=nil {
+		Subtract(light.Data, light.Data, biasData)
 	}
 
 	// apply flat frame if available
@@ -134,22 +222,43 @@ func PreProcessLight(id int, fileName string, darkF, flatF *FITSImage, debayer,
 		if !EqualInt32Slice(flatF.Naxisn, light.Naxisn) {
 			return nil, errors.New("light size differs from flat size")
 		}
+		warnCalibrationMismatch(id, &light, flatF, "flat")
 		Divide(light.Data, light.Data, flatF.Data, flatF.Stats.Max)
 	}
 
+	// add pedestal so calibrated data stays positive
+	if pedestal!=0 {
+		for i:=range light.Data { light.Data[i]+=pedestal }
+		light.Header.SetFloat("PEDESTAL", pedestal, "Offset added after calibration")
+	}
+
+	// correct known defects if a defect map is given
+	if defects!=nil {
+		for p:=int32(0); p<light.NumPlanes(); p++ {
+			err=defects.Apply(light.Plane(p), light.Naxisn[0], light.CFA)
+			if err!=nil { return nil, err }
+		}
+		LogPrintf("%d: Corrected %d pixels, %d columns and %d rows from defect map\n", id, len(defects.Pixels), len(defects.Columns), len(defects.Rows))
+	}
+
 	// remove bad pixels if flagged
 	var medianDiffStats *BasicStats
 	if bpSigLow!=0 && bpSigHigh!=0 {
 		if debayer=="" {
-			var bpm []int32
-			bpm, medianDiffStats=BadPixelMap(light.Data, light.Naxisn[0], bpSigLow, bpSigHigh)
+			numRemoved:=0
 			mask:=CreateMask(light.Naxisn[0], 1.5)
-			MedianFilterSparse(light.Data, bpm, mask)
+			for p:=int32(0); p<light.NumPlanes(); p++ {
+				var bpm []int32
+				bpm, medianDiffStats=BadPixelMap(light.Plane(p), light.Naxisn[0], bpSigLow, bpSigHigh)
+				MedianFilterSparse(light.Plane(p), bpm, mask)
+				numRemoved+=len(bpm)
+				bpm=nil
+			}
+			if light.NumPlanes()>1 { medianDiffStats=nil } // not valid for the luminance proxy
 			LogPrintf("%d: Removed %d bad pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
-				id, len(bpm), 100.0*float32(len(bpm))/float32(light.Pixels), bpSigLow, bpSigHigh)
-			bpm=nil
+				id, numRemoved, 100.0*float32(numRemoved)/float32(light.Pixels), bpSigLow, bpSigHigh)
 		} else {
-			numRemoved,err:=CosmeticCorrectionBayer(light.Data, light.Naxisn[0], debayer, cfa, bpSigLow, bpSigHigh)
+			numRemoved,err:=CosmeticCorrectionBayer(light.Data, light.Naxisn[0], debayer, light.CFA, bpSigLow, bpSigHigh)
 			if err!=nil { return nil, err }
 			LogPrintf("%d: Removed %d bad bayer pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
 				id, numRemoved, 100.0*float32(numRemoved)/float32(light.Pixels), bpSigLow, bpSigHigh)
@@ -158,11 +267,23 @@ func PreProcessLight(id int, fileName string, darkF, flatF *FITSImage, debayer,
 
 	// debayer color filter array data if desired
 	if debayer!="" {
-		light.Data, light.Naxisn[0], err=DebayerBilinear(light.Data, light.Naxisn[0], debayer, cfa)
+		if light.NumPlanes()>1 { return nil, errors.New("cannot debayer a color image") }
+		planes:=int32(1)
+		if strings.ToUpper(debayer)=="RGB" {
+			// all three channels into a data cube, aligned and stacked together via the luminance proxy
+			light.Data, light.Naxisn[0], err=DebayerRGB(light.Data, light.Naxisn[0], light.CFA, debayerMode)
+			planes=3
+		} else {
+			light.Data, light.Naxisn[0], err=Debayer(light.Data, light.Naxisn[0], debayer, light.CFA, debayerMode)
+		}
 		if err!=nil { return nil, err }
 		light.Pixels=int32(len(light.Data))
-		light.Naxisn[1]=light.Pixels/light.Naxisn[0]
-		LogPrintf("%d: Debayered channel %s from cfa %s, new size %dx%d\n", id, debayer, cfa, light.Naxisn[0], light.Naxisn[1])
+		light.Naxisn[1]=light.Pixels/planes/light.Naxisn[0]
+		if planes>1 { light.Naxisn=append(light.Naxisn[:2], planes) }
+		for _, key:=range []string{"BAYERPAT", "XBAYROFF", "YBAYROFF"} {
+			light.Header.Delete(key)  // data is no longer a color filter array
+		}
+		LogPrintf("%d: Debayered channel %s from cfa %s with %s, new size %dx%d\n", id, debayer, light.CFA, debayerMode, light.Naxisn[0], light.Naxisn[1])
 	}
 
 	// apply binning if desired
@@ -173,41 +294,60 @@ func PreProcessLight(id int, fileName string, darkF, flatF *FITSImage, debayer,
 
 	// automatic background extraction, if desired
 	if backGrid>0 {
-		bg:=NewBackground(light.Data, light.Naxisn[0], backGrid, backSigma, backClip)
-		LogPrintf("%d: %s\n", id, bg)
-
-		if backPattern=="" {
-			bg.Subtract(light.Data)
-		} else { 
-			bgImage:=bg.Render()
-			bgFits:=FITSImage{
+		var bgFits *FITSImage
+		if backPattern!="" {
+			bgFits=&FITSImage{
 				Header:NewFITSHeader(),
 				Bitpix:-32,
 				Bzero :0,
 				Naxisn:light.Naxisn,
 				Pixels:light.Pixels,
-				Data  :bgImage,
+				Data  :make([]float32, len(light.Data)),
 			}
+		}
+		for p:=int32(0); p<light.NumPlanes(); p++ {
+			bg:=NewBackground(light.Plane(p), light.Naxisn[0], backGrid, backSigma, backClip)
+			LogPrintf("%d: %s\n", id, bg)
+
+			if backPattern=="" {
+				bg.Subtract(light.Plane(p))
+			} else { 
+				bgImage:=bgFits.Plane(p)
+				copy(bgImage, bg.Render())
+				Subtract(light.Plane(p), light.Plane(p), bgImage)
+			}
+		}
+		if bgFits!=nil {
 			err=bgFits.WriteFile(fmt.Sprintf("back%02d.fits", id))
 			if err!=nil { LogFatalf("Error writing file: %s\n", err) }
-			Subtract(light.Data, light.Data, bgImage)
-			bgFits.Data, bgImage=nil, nil
+			bgFits.Data=nil
 		}
 
 		// re-do stats and star detection
-		light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
+		lum:=light.Luminance()
+		light.Stats, err=CalcExtendedStats(lum, light.Naxisn[0])
 		if err!=nil { return nil, err }
-		light.Stars, _, light.HFR=FindStars(light.Data, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starInOut, starRadius, medianDiffStats)
+		light.Stars, _, light.HFR=FindStars(lum, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starInOut, starRadius, medianDiffStats)
 		LogPrintf("%d: Stars %d HFR %.3g %v\n", id, len(light.Stars), light.HFR, light.Stats)
 	}
 
 	// calculate stats and find stars
-	light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
+	lum:=light.Luminance()
+	light.Stats, err=CalcExtendedStats(lum, light.Naxisn[0])
 	if err!=nil { return nil, err }
-	light.Stars, _, light.HFR=FindStars(light.Data, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starInOut, starRadius, medianDiffStats)
+	light.Stars, _, light.HFR=FindStars(lum, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starInOut, starRadius, medianDiffStats)
 	LogPrintf("%d: Stars %d HFR %.3g %v\n", id, len(light.Stars), light.HFR, light.Stats)
 	//LogPrintf("CSV %d,%s\n", id, light.Stats.ToCSVLine())
 
+	// fit point spread functions to the brightest stars if desired
+	if psfModel!=PSFNone {
+		if pixelScale==0 { pixelScale=PixelScale(&light.Header) }
+		pixelScale*=float32(sensorWidth)/float32(light.Naxisn[0])
+		light.PSFs=FitPSFs(lum, light.Naxisn[0], light.Stars, psfModel, starRadius, psfStars)
+		light.PSF=SummarizePSFs(light.PSFs, psfModel, pixelScale)
+		LogPrintf("%d: %v\n", id, light.PSF)
+	}
+
 	// Normalize value range if desired
 	if normRange>0 {
 		if light.Stats.Min==light.Stats.Max {
@@ -20,7 +20,7 @@ import (
 	"math"
 )
 
-// Projects an image into a new coordinate system with the given transformation.
+// Projects an image into a new coordinate system with the given transformation. Data cubes are projected plane by plane.
 // Fills in missing pixels with the given out of bounds value. Uses bilinear interpolation for now.
 func (img *FITSImage) Project(destNaxisn []int32, trans Transform2D, outOfBounds float32) (res *FITSImage, err error) {
 	// Invert transformation so we can sample from the target coordinate system PoV
@@ -29,13 +29,15 @@ func (img *FITSImage) Project(destNaxisn []int32, trans Transform2D, outOfBounds
 
 	// Create new FITS image for the result
 	destWidth:=destNaxisn[0]
-	destPixels:=destNaxisn[0]*destNaxisn[1]
+	destPlaneSize:=destNaxisn[0]*destNaxisn[1]
+	destPixels:=destPlaneSize*img.NumPlanes()
 	res=&FITSImage{
 		ID    : img.ID,
-		Header: NewFITSHeader(),
+		FileName: img.FileName,
+		Header: img.Header.Clone(),
 		Bitpix: -32,
 		Bzero : 0,
-		Naxisn: []int32{destNaxisn[0], destNaxisn[1]},
+		Naxisn: append([]int32{destNaxisn[0], destNaxisn[1]}, img.Naxisn[2:]...),
 		Pixels: destPixels,
 		Data:   make([]float32,int(destPixels)),
 		Exposure: img.Exposure,
@@ -43,40 +45,42 @@ func (img *FITSImage) Project(destNaxisn []int32, trans Transform2D, outOfBounds
 	}
 
 	// Resample image from the target coordinate system PoV
-	d:=img.Data
 	origWidth:=img.Naxisn[0]
+	for p:=int32(0); p<img.NumPlanes(); p++ {
+		d, dest:=img.Plane(p), res.Data[p*destPlaneSize:(p+1)*destPlaneSize]
 
-	for row:=int32(0); row<destNaxisn[1]; row++ {
-		for col:=int32(0); col<destWidth; col++ {
-			pt:=Point2D{float32(col), float32(row)}
-			proj:=invTrans.Apply(pt)
+		for row:=int32(0); row<destNaxisn[1]; row++ {
+			for col:=int32(0); col<destWidth; col++ {
+				pt:=Point2D{float32(col), float32(row)}
+				proj:=invTrans.Apply(pt)
 
-			// perform bilinear interpolation
-			xl, yl:=int32(math.Floor(float64(proj.X))), int32(math.Floor(float64(proj.Y)))
-			xh, yh:=xl+1,               yl+1
-			xr, yr:=proj.X-float32(xl), proj.Y-float32(yl)
+				// perform bilinear interpolation
+				xl, yl:=int32(math.Floor(float64(proj.X))), int32(math.Floor(float64(proj.Y)))
+				xh, yh:=xl+1,               yl+1
+				xr, yr:=proj.X-float32(xl), proj.Y-float32(yl)
 
-			if xl<0 || xh>=origWidth || yl<0 || yh>=img.Naxisn[1] {
-   				// Replace out of bounds values with not a number.
-   				// Stacking will exclude NaNs. Note, however, that
-   				// other operations will fail miserably. Including
-   				// all partitioning and sorting-based operations 
-   				// like median, because IEEE NaN does not compare
-   				// equal to itself.  
-   				res.Data[col + row*destWidth]=outOfBounds
-   				continue 
-			}
+				if xl<0 || xh>=origWidth || yl<0 || yh>=img.Naxisn[1] {
+	   				// Replace out of bounds values with not a number.
+	   				// Stacking will exclude NaNs. Note, however, that
+	   				// other operations will fail miserably. Including
+	   				// all partitioning and sorting-based operations 
+	   				// like median, because IEEE NaN does not compare
+	   				// equal to itself.  
+	   				dest[col + row*destWidth]=outOfBounds
+	   				continue 
+				}
 
-			xlyl:=xl+yl*origWidth
-			xhyl:=xlyl+1         // xh+yl*origWidth
-			xlyh:=xlyl+origWidth // xl+yh*origWidth
-			xhyh:=xhyl+origWidth // xh+yh*origWidth
+				xlyl:=xl+yl*origWidth
+				xhyl:=xlyl+1         // xh+yl*origWidth
+				xlyh:=xlyl+origWidth // xl+yh*origWidth
+				xhyh:=xhyl+origWidth // xh+yh*origWidth
 
-			vyl  :=d[xlyl]*(1-xr) + d[xhyl]*xr
-			vyh  :=d[xlyh]*(1-xr) + d[xhyh]*xr
-			v    :=vyl    *(1-yr) + vyh    *yr
+				vyl  :=d[xlyl]*(1-xr) + d[xhyl]*xr
+				vyh  :=d[xlyh]*(1-xr) + d[xhyh]*xr
+				v    :=vyl    *(1-yr) + vyh    *yr
 
-			res.Data[col + row*destWidth]=v
+				dest[col + row*destWidth]=v
+			}
 		}
 	}
 	res.Stats=CalcBasicStats(res.Data)
@@ -0,0 +1,34 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestProjectCopiesHeader(t *testing.T) {
+	img:=NewFITSImage()
+	img.Naxisn, img.Pixels, img.Data=[]int32{2, 2}, 4, []float32{1, 2, 3, 4}
+	img.Header.SetString("OBJECT", "M 42", "")
+
+	res, err:=img.Project(img.Naxisn, IdentityTransform2D(), 0)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	res.Header.SetString("OBJECT", "M 43", "")
+	res.Header.History=append(res.Header.History, "projected")
+	if v:=img.Header.Strings["OBJECT"]; v!="M 42" { t.Errorf("source OBJECT=%s; want M 42", v) }
+	if len(img.Header.History)!=0 { t.Errorf("source History=%v; want empty", img.Header.History) }
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"gonum.org/v1/gonum/optimize"
+)
+
+
+// Point spread function model for star profile fitting
+type PSFModel int
+const (
+	PSFNone     PSFModel = iota
+	PSFGaussian
+	PSFMoffat
+)
+
+// Parses a point spread function model, one of gaussian or moffat, or blank for none
+func ParsePSFModel(s string) (PSFModel, error) {
+	switch strings.ToLower(s) {
+	case "":         return PSFNone,     nil
+	case "gaussian": return PSFGaussian, nil
+	case "moffat":   return PSFMoffat,   nil
+	}
+	return PSFNone, errors.New("Unknown PSF model "+s)
+}
+
+func (m PSFModel) String() string {
+	switch m {
+	case PSFGaussian: return "gaussian"
+	case PSFMoffat:   return "moffat"
+	}
+	return "none"
+}
+
+
+// An elliptical point spread function fitted to a star
+type PSF struct {
+	X, Y       float32   // Center position in pixels
+	Background float32   // Local background level
+	Peak       float32   // Peak amplitude above background
+	FWHMMajor  float32   // Full width at half maximum along the major axis, in pixels
+	FWHMMinor  float32   // Full width at half maximum along the minor axis, in pixels
+	Angle      float32   // Position angle of the major axis in degrees, counterclockwise from the x axis in [0,180)
+	Beta       float32   // Moffat beta parameter, zero for Gaussians
+	Residual   float32   // Root mean square residual of the fit, relative to the peak
+}
+
+// Returns the full width at half maximum as geometric mean of both axes, in pixels
+func (p *PSF) FWHM() float32 {
+	return float32(math.Sqrt(float64(p.FWHMMajor*p.FWHMMinor)))
+}
+
+// Returns the eccentricity of the half maximum ellipse, from 0 for round to 1 for a line
+func (p *PSF) Eccentricity() float32 {
+	r:=p.FWHMMinor/p.FWHMMajor
+	return float32(math.Sqrt(float64(1-r*r)))
+}
+
+// Returns the elongation, the ratio of major to minor axis
+func (p *PSF) Elongation() float32 {
+	return p.FWHMMajor/p.FWHMMinor
+}
+
+// Returns the flux under the fitted profile above the background
+func (p *PSF) Flux() float32 {
+	if p.Beta==0 { return p.Peak*p.FWHMMajor*p.FWHMMinor*math.Pi/(4*math.Ln2) }
+	b:=float64(p.Beta)
+	k:=4*(math.Pow(2, 1/b)-1)  // FWHM^2 per alpha^2
+	return float32(float64(p.Peak)*math.Pi*float64(p.FWHMMajor*p.FWHMMinor)/(k*(b-1)))
+}
+
+
+// Fits point spread functions of the given model to the brightest stars, up to maxStars. Stars are expected in descending
+// order of brightness, as returned by FindStars. Stars where the fit fails or is implausible are omitted
+func FitPSFs(data []float32, width int32, stars []Star, model PSFModel, radius int32, maxStars int32) (psfs []PSF) {
+	psfs=[]PSF{}
+	for _, s:=range stars {
+		if maxStars>0 && int32(len(psfs))>=maxStars { break }
+		psf, err:=FitPSF(data, width, s, model, radius)
+		if err==nil { psfs=append(psfs, psf) }
+	}
+	return psfs
+}
+
+// Fits an elliptical Gaussian or Moffat profile to the given star with a Nelder-Mead optimizer. The fitting box 
+// extends four half-flux radii around the star, limited to the given radius
+func FitPSF(data []float32, width int32, s Star, model PSFModel, radius int32) (psf PSF, err error) {
+	height:=int32(len(data))/width
+	r:=int32(math.Ceil(float64(4*s.HFR)))
+	if r<3 { r=3 }
+	if r>radius && radius>=3 { r=radius }
+	cx, cy:=int32(s.X+0.5), int32(s.Y+0.5)
+	if cx-r<0 || cy-r<0 || cx+r>=width || cy+r>=height { return psf, errors.New("star too close to the border") }
+
+	// gather the box, normalized to the initial background and amplitude estimates for a well-scaled objective
+	n:=2*r+1
+	values:=make([]float64, n*n)
+	minV, maxV:=float64(math.MaxFloat32), float64(-math.MaxFloat32)
+	for y:=int32(0); y<n; y++ {
+		for x:=int32(0); x<n; x++ {
+			v:=float64(data[(cy-r+y)*width+cx-r+x])
+			values[y*n+x]=v
+			if v<minV { minV=v }
+			if v>maxV { maxV=v }
+		}
+	}
+	if maxV<=minV { return psf, errors.New("flat star profile") }
+	scale:=maxV-minV
+	for i, v:=range values { values[i]=(v-minV)/scale }
+
+	// initial parameters: background, amplitude, center, log widths, angle, and for Moffat log(beta-1)
+	sigma:=float64(s.HFR)/1.1774
+	if sigma<0.5 { sigma=0.5 }
+	x0:=[]float64{0, 1, float64(s.X-float32(cx-r)), float64(s.Y-float32(cy-r)), math.Log(sigma), math.Log(sigma), 0}
+	if model==PSFMoffat {
+		beta:=2.5
+		alpha:=2.3548*sigma/(2*math.Sqrt(math.Pow(2, 1/beta)-1))
+		x0[4], x0[5]=math.Log(alpha), math.Log(alpha)
+		x0=append(x0, math.Log(beta-1))
+	}
+
+	problem:=optimize.Problem{
+		Func:func(p []float64) float64 {
+			sum:=0.0
+			for y:=int32(0); y<n; y++ {
+				for x:=int32(0); x<n; x++ {
+					d:=evalPSF(model, p, float64(x), float64(y))-values[y*n+x]
+					sum+=d*d
+				}
+			}
+			return sum
+		},
+	}
+	result, err:=optimize.Minimize(problem, x0, &optimize.Settings{FuncEvaluations:4000}, &optimize.NelderMead{})
+	if err!=nil { return psf, err }
+	p:=result.X
+
+	// convert the widths to FWHM along major and minor axis
+	wx, wy, angle:=math.Exp(p[4]), math.Exp(p[5]), p[6]
+	if wx<wy { wx, wy, angle=wy, wx, angle+math.Pi/2 }
+	angle=math.Mod(angle*180/math.Pi, 180)
+	if angle<0 { angle+=180 }
+	factor:=2*math.Sqrt(2*math.Ln2)
+	if model==PSFMoffat {
+		psf.Beta=float32(moffatBeta(p[7]))
+		factor=2*math.Sqrt(math.Pow(2, 1/float64(psf.Beta))-1)
+	}
+	psf.X, psf.Y=float32(p[2])+float32(cx-r), float32(p[3])+float32(cy-r)
+	psf.Background=float32(p[0]*scale+minV)
+	psf.Peak=float32(p[1]*scale)
+	psf.FWHMMajor, psf.FWHMMinor=float32(wx*factor), float32(wy*factor)
+	psf.Angle=float32(angle)
+	psf.Residual=float32(math.Sqrt(result.F/float64(n*n))/p[1])
+
+	// plausibility checks
+	if math.IsNaN(result.F) || p[1]<=0 { return psf, errors.New("invalid fit") }
+	if dx, dy:=psf.X-s.X, psf.Y-s.Y; dx*dx+dy*dy>float32(r*r)/4 { return psf, errors.New("fit center drifted") }
+	if psf.FWHMMinor<0.5 || psf.FWHMMajor>float32(2*n) { return psf, errors.New("implausible fit width") }
+	return psf, nil
+}
+
+// Returns the Moffat beta for the given fit parameter, limited to (1,50]. Large betas approach a Gaussian
+func moffatBeta(p float64) float64 {
+	if p>math.Log(49) { p=math.Log(49) }
+	return 1+math.Exp(p)
+}
+
+// Evaluates the normalized PSF model with the given parameters at x, y
+func evalPSF(model PSFModel, p []float64, x, y float64) float64 {
+	dx, dy:=x-p[2], y-p[3]
+	sin, cos:=math.Sincos(p[6])
+	u, v:=(dx*cos+dy*sin)*math.Exp(-p[4]), (-dx*sin+dy*cos)*math.Exp(-p[5])
+	rr:=u*u+v*v
+	if model==PSFMoffat { return p[0]+p[1]*math.Pow(1+rr, -moffatBeta(p[7])) }
+	return p[0]+p[1]*math.Exp(-0.5*rr)
+}
+
+
+// Summary of the point spread functions fitted to the stars of an image
+type PSFStats struct {
+	Model        PSFModel
+	Stars        int32     // Number of stars fitted
+	FWHM         float32   // Median full width at half maximum, in pixels
+	FWHMArcsec   float32   // Median full width at half maximum in arc seconds, if the pixel scale is known
+	Eccentricity float32   // Median eccentricity
+	Elongation   float32   // Median ratio of major to minor axis
+	Angle        float32   // Average position angle of the major axis in degrees, in [0,180)
+	Background   float32   // Median local background
+	Peak         float32   // Median peak amplitude above background
+	Beta         float32   // Median Moffat beta parameter, zero for Gaussians
+}
+
+// Summarizes the given fits with medians. The position angle is averaged as an axis, weighted by eccentricity,
+// so round stars with arbitrary angles do not dilute it. A pixel scale in arc seconds per pixel of zero leaves FWHMArcsec empty
+func SummarizePSFs(psfs []PSF, model PSFModel, pixelScale float32) *PSFStats {
+	s:=&PSFStats{Model:model, Stars:int32(len(psfs))}
+	if len(psfs)==0 { return s }
+	median:=func(f func(p *PSF) float32) float32 {
+		vs:=make([]float32, len(psfs))
+		for i:=range psfs { vs[i]=f(&psfs[i]) }
+		sort.Slice(vs, func(i, j int) bool { return vs[i]<vs[j] })
+		if len(vs)%2==1 { return vs[len(vs)/2] }
+		return 0.5*(vs[len(vs)/2-1]+vs[len(vs)/2])
+	}
+	s.FWHM        =median(func(p *PSF) float32 { return p.FWHM() })
+	s.Eccentricity=median(func(p *PSF) float32 { return p.Eccentricity() })
+	s.Elongation  =median(func(p *PSF) float32 { return p.Elongation() })
+	s.Background  =median(func(p *PSF) float32 { return p.Background })
+	s.Peak        =median(func(p *PSF) float32 { return p.Peak })
+	s.Beta        =median(func(p *PSF) float32 { return p.Beta })
+	if pixelScale>0 { s.FWHMArcsec=s.FWHM*pixelScale }
+
+	sumSin, sumCos:=0.0, 0.0
+	for i:=range psfs {
+		e:=float64(psfs[i].Eccentricity())
+		sin, cos:=math.Sincos(float64(psfs[i].Angle)*math.Pi/90)
+		sumSin+=e*sin
+		sumCos+=e*cos
+	}
+	angle:=math.Atan2(sumSin, sumCos)*90/math.Pi
+	if angle<0 { angle+=180 }
+	s.Angle=float32(angle)
+	return s
+}
+
+func (s *PSFStats) String() string {
+	res:=fmt.Sprintf("PSF %s stars %d FWHM %.3gpx", s.Model, s.Stars, s.FWHM)
+	if s.FWHMArcsec>0 { res+=fmt.Sprintf(" %.3g\"", s.FWHMArcsec) }
+	res+=fmt.Sprintf(" ecc %.3g elong %.3g angle %.1f bg %.4g peak %.4g", s.Eccentricity, s.Elongation, s.Angle, s.Background, s.Peak)
+	if s.Model==PSFMoffat { res+=fmt.Sprintf(" beta %.3g", s.Beta) }
+	return res
+}
+
+
+// Returns the pixel scale in arc seconds per pixel from the PIXSCALE or SCALE header values, 
+// or from the pixel size XPIXSZ in microns and focal length FOCALLEN in millimeters. Returns zero if unknown
+func PixelScale(h *FITSHeader) float32 {
+	for _, key:=range []string{"PIXSCALE", "SCALE"} {
+		if v, ok:=h.floatValue(key); ok && v>0 { return v }
+	}
+	size, ok1:=h.floatValue("XPIXSZ")
+	focal, ok2:=h.floatValue("FOCALLEN")
+	if ok1 && ok2 && size>0 && focal>0 { return 206.265*size/focal }
+	return 0
+}
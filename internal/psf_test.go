@@ -0,0 +1,53 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitPSF(t *testing.T) {
+	width, height:=int32(64), int32(64)
+	for _, model:=range []PSFModel{PSFGaussian, PSFMoffat} {
+		// elliptical star with FWHM 6 and 4 pixels, major axis at 30 degrees, on a background of 100
+		p:=[]float64{100, 1000, 31.3, 32.6, 0, 0, 30*math.Pi/180}
+		factor:=2*math.Sqrt(2*math.Ln2)
+		if model==PSFMoffat {
+			p=append(p, math.Log(3-1))
+			factor=2*math.Sqrt(math.Pow(2, 1.0/3)-1)
+		}
+		p[4], p[5]=math.Log(6/factor), math.Log(4/factor)
+		data:=make([]float32, width*height)
+		for y:=int32(0); y<height; y++ {
+			for x:=int32(0); x<width; x++ { data[y*width+x]=float32(evalPSF(model, p, float64(x), float64(y))) }
+		}
+		star:=Star{Index:32*width+31, X:31, Y:33, HFR:2.5}
+
+		psf, err:=FitPSF(data, width, star, model, 16)
+		if err!=nil { t.Fatalf("%s: err=%s", model, err) }
+		if math.Abs(float64(psf.X-31.3))>0.01 || math.Abs(float64(psf.Y-32.6))>0.01 { t.Errorf("%s: center=%f,%f; want 31.3,32.6", model, psf.X, psf.Y) }
+		if math.Abs(float64(psf.FWHMMajor-6))>0.05 || math.Abs(float64(psf.FWHMMinor-4))>0.05 { t.Errorf("%s: FWHM=%f,%f; want 6,4", model, psf.FWHMMajor, psf.FWHMMinor) }
+		if math.Abs(float64(psf.Angle-30))>0.5 { t.Errorf("%s: angle=%f; want 30", model, psf.Angle) }
+		if math.Abs(float64(psf.Background-100))>1 || math.Abs(float64(psf.Peak-1000))>5 { t.Errorf("%s: background=%f peak=%f; want 100, 1000", model, psf.Background, psf.Peak) }
+		if model==PSFMoffat && math.Abs(float64(psf.Beta-3))>0.05 { t.Errorf("beta=%f; want 3", psf.Beta) }
+		if want:=float32(math.Sqrt(1-4.0/9)); math.Abs(float64(psf.Eccentricity()-want))>0.01 { t.Errorf("%s: eccentricity=%f; want %f", model, psf.Eccentricity(), want) }
+
+		stats:=SummarizePSFs([]PSF{psf}, model, 2)
+		if math.Abs(float64(stats.FWHMArcsec-2*psf.FWHM()))>1e-4 { t.Errorf("%s: FWHMArcsec=%f; want %f", model, stats.FWHMArcsec, 2*psf.FWHM()) }
+	}
+}
@@ -0,0 +1,544 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// Reading of the undemosaiced color filter array data from camera raw files based on TIFF:
+// DNG, Canon CR2, Nikon NEF and Sony ARW. Supports uncompressed and lossless JPEG data, 
+// and Sony ARW2 compression. Nikon compressed NEF is not supported; convert those files to DNG.
+
+
+// TIFF tags used for raw files
+const (
+	rawTagNewSubfileType  = 254
+	rawTagWidth           = 256
+	rawTagHeight          = 257
+	rawTagBitsPerSample   = 258
+	rawTagCompression     = 259
+	rawTagPhotometric     = 262
+	rawTagMake            = 271
+	rawTagModel           = 272
+	rawTagStripOffsets    = 273
+	rawTagRowsPerStrip    = 278
+	rawTagStripByteCounts = 279
+	rawTagTileWidth       = 322
+	rawTagTileLength      = 323
+	rawTagTileOffsets     = 324
+	rawTagTileByteCounts  = 325
+	rawTagSubIFDs         = 330
+	rawTagCFARepeatDim    = 33421
+	rawTagCFAPattern      = 33422
+	rawTagExposureTime    = 33434
+	rawTagExifIFD         = 34665
+	rawTagISO             = 34855
+	rawTagDateTimeOrig    = 36867
+	rawTagMakerNote       = 37500
+	rawTagExifCFAPattern  = 41730
+	rawTagBlackLevel      = 50714
+	rawTagWhiteLevel      = 50717
+	rawTagActiveArea      = 50829
+	rawTagCR2Slices       = 50752
+	rawTagSonyCurve       = 28688
+	rawTagSonyBlackLevel  = 29456
+	rawTagSonyWhiteLevel  = 30847
+
+	rawPhotometricCFA     = 32803
+	rawCompressionNone    = 1
+	rawCompressionOldJPEG = 6
+	rawCompressionLJPEG   = 7
+	rawCompressionSony    = 32767
+	rawCompressionNikon   = 34713
+)
+
+// Byte sizes of the TIFF field types
+var rawTypeSizes=[]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4}
+
+// A TIFF directory entry, with its value bytes
+type rawEntry struct {
+	typ   uint16
+	count int
+	data  []byte
+	pos   int      // position of the value in the file, for values larger than four bytes
+	order binary.ByteOrder
+}
+
+// A TIFF image file directory, mapping tags to entries
+type rawIFD map[uint16]*rawEntry
+
+// A parsed raw file, with all image file directories and the EXIF directory
+type rawFile struct {
+	data  []byte
+	order binary.ByteOrder
+	ifds  []rawIFD     // main chain first, then sub-IFDs in order of discovery
+	chain int          // number of directories in the main chain
+	exif  rawIFD
+}
+
+
+// Read the color filter array of a camera raw file. The data is cropped to the active area, and kept as raw values
+// including the black level. BAYERPAT holds the pattern of the cropped data, BLKLEVEL and DATAMAX the black and white levels
+func (fits *FITSImage) ReadRaw(fileName string) error {
+	data, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return err }
+	rf, err:=parseRawFile(data)
+	if err!=nil { return err }
+	ifd, isCR2:=rf.rawIFD()
+	if ifd==nil { return errors.New("No raw color filter array data found in "+fileName) }
+
+	samples, width, height, bits, err:=rf.decode(ifd, isCR2)
+	if err!=nil { return err }
+
+	// Camera specific metadata
+	h:=NewFITSHeader()
+	cameraMake, model:=rf.ifds[0].str(rawTagMake), rf.ifds[0].str(rawTagModel)
+	black, white:=0.0, float64(int(1)<<uint(bits)-1)
+	pattern:=rf.cfaPattern(ifd)
+	top, left, bottom, right:=0, 0, height, width
+	if v:=ifd.floats(rawTagBlackLevel); len(v)>0 { black=mean(v) } 
+	if v:=rf.floats(ifd, rawTagSonyBlackLevel); len(v)>0 { black=mean(v) }
+	if v:=ifd.floats(rawTagWhiteLevel); len(v)>0 { white=v[0] }
+	if v:=rf.floats(ifd, rawTagSonyWhiteLevel); len(v)>0 { white=v[0] }
+	if v:=ifd.floats(rawTagActiveArea); len(v)==4 { top, left, bottom, right=int(v[0]), int(v[1]), int(v[2]), int(v[3]) }
+	if strings.HasPrefix(cameraMake, "Canon") {
+		// sensor info gives the active area. Masked pixels on the left provide the black level
+		if mn:=rf.makerNote(0); mn!=nil {
+			if v:=mn.floats(0x00e0); len(v)>8 && int(v[7])<width && int(v[8])<height {
+				top, left, bottom, right=int(v[6]), int(v[5]), int(v[8])+1, int(v[7])+1
+				if left>4 { black=rawMeanArea(samples, width, top, 2, bottom, left-2) }
+			}
+		}
+		if pattern=="" { pattern="RGGB" }
+	} else if strings.HasPrefix(cameraMake, "NIKON") {
+		if mn:=rf.makerNote(10); mn!=nil {
+			if v:=mn.floats(0x003d); len(v)>0 { black=mean(v) }
+		}
+	}
+	if pattern=="" { return errors.New("Unsupported color filter array pattern in "+fileName) }
+	if top<0 || left<0 || bottom>height || right>width || top>=bottom || left>=right { 
+		return errors.New("Invalid active area in "+fileName) 
+	}
+	pattern=shiftCFAPattern(pattern, left, top)
+
+	// crop to the active area
+	fits.Naxisn=[]int32{int32(right-left), int32(bottom-top)}
+	fits.Pixels=fits.Naxisn[0]*fits.Naxisn[1]
+	fits.Bitpix, fits.Bzero, fits.Bscale=16, 0, 1
+	fits.Data=make([]float32, int(fits.Pixels))
+	for y:=top; y<bottom; y++ {
+		dest:=fits.Data[(y-top)*(right-left):]
+		for x, s:=range samples[y*width+left:y*width+right] { dest[x]=float32(s) }
+	}
+
+	h.SetString("BAYERPAT", pattern, "Bayer color filter array pattern")
+	h.SetString("ROWORDER", "TOP-DOWN", "Order of the rows in the image")
+	h.SetFloat("BLKLEVEL", float32(black), "Black level of the raw data")
+	h.SetFloat("DATAMAX", float32(white), "White level of the raw data")
+	if cameraMake!="" || model!="" { 
+		if !strings.HasPrefix(model, cameraMake) { model=strings.TrimSpace(cameraMake+" "+model) }
+		h.SetString("INSTRUME", model, "Camera") 
+	}
+	fits.Exposure=float32(rf.exifFloat(rawTagExposureTime))
+	if fits.Exposure>0 { h.SetFloat("EXPTIME", fits.Exposure, "[s] Exposure duration") }
+	if iso:=rf.exifFloat(rawTagISO); iso>0 { h.SetInt("ISOSPEED", int32(iso), "ISO speed") }
+	if d:=rf.exifString(rawTagDateTimeOrig); len(d)==19 {
+		// EXIF dates are local camera time without time zone
+		h.SetDate("DATE-LOC", strings.Replace(d[:10], ":", "-", -1)+"T"+d[11:], "Local time of exposure start")
+	}
+	fits.Header=h
+	return nil
+}
+
+
+// Parses the TIFF structure of a raw file, following the main chain of directories, sub-directories and EXIF
+func parseRawFile(data []byte) (rf *rawFile, err error) {
+	if len(data)<8 { return nil, errors.New("Not a valid raw file; header truncated") }
+	rf=&rawFile{data:data}
+	switch string(data[:4]) {
+	case "II*\x00": rf.order=binary.LittleEndian
+	case "MM\x00*": rf.order=binary.BigEndian
+	default:        return nil, errors.New("Not a TIFF based raw file")
+	}
+
+	// main chain of directories. Guard against loops with a maximum length
+	offset:=int(rf.order.Uint32(data[4:]))
+	for offset!=0 && len(rf.ifds)<16 {
+		ifd, next, err:=parseRawIFD(data, 0, offset, rf.order)
+		if err!=nil { return nil, err }
+		rf.ifds=append(rf.ifds, ifd)
+		offset=next
+	}
+	rf.chain=len(rf.ifds)
+	if rf.chain==0 { return nil, errors.New("No image file directory found") }
+
+	// sub-directories and EXIF
+	for i:=0; i<len(rf.ifds) && i<64; i++ {
+		for _, sub:=range rf.ifds[i].uints(rawTagSubIFDs) {
+			ifd, _, err:=parseRawIFD(data, 0, int(sub), rf.order)
+			if err==nil { rf.ifds=append(rf.ifds, ifd) }
+		}
+		if rf.exif==nil {
+			if v:=rf.ifds[i].uints(rawTagExifIFD); len(v)>0 {
+				rf.exif, _, _=parseRawIFD(data, 0, int(v[0]), rf.order)
+			}
+		}
+	}
+	return rf, nil
+}
+
+// Parses the image file directory at the given offset relative to base. Returns the directory and the offset of the next one
+func parseRawIFD(data []byte, base, offset int, order binary.ByteOrder) (ifd rawIFD, next int, err error) {
+	pos:=base+offset
+	if offset<=0 || pos+2>len(data) { return nil, 0, errors.New("Invalid image file directory offset") }
+	n:=int(order.Uint16(data[pos:]))
+	pos+=2
+	if pos+12*n+4>len(data) { return nil, 0, errors.New("Image file directory truncated") }
+	ifd=rawIFD{}
+	for i:=0; i<n; i++ {
+		e:=data[pos+12*i:]
+		tag, typ, count:=order.Uint16(e), order.Uint16(e[2:]), int(order.Uint32(e[4:]))
+		if int(typ)>=len(rawTypeSizes) || typ==0 || count<0 || count>len(data) { continue }
+		size:=rawTypeSizes[typ]*count
+		val, o:=e[8:12], pos+12*i+8
+		if size>4 {
+			o=base+int(order.Uint32(e[8:]))
+			if o<0 || o+size>len(data) { continue }
+			val=data[o:o+size]
+		}
+		ifd[tag]=&rawEntry{typ:typ, count:count, data:val[:size], pos:o, order:order}
+	}
+	return ifd, int(order.Uint32(data[pos+12*n:])), nil
+}
+
+// Returns the directory holding the raw color filter array data, and whether it is a Canon CR2 raw directory.
+// Picks the largest full resolution directory with CFA photometric interpretation
+func (rf *rawFile) rawIFD() (res rawIFD, isCR2 bool) {
+	best:=0
+	for _, ifd:=range rf.ifds {
+		if ifd.uint(rawTagPhotometric)!=rawPhotometricCFA || ifd.uint(rawTagNewSubfileType)&1!=0 { continue }
+		if size:=int(ifd.uint(rawTagWidth))*int(ifd.uint(rawTagHeight)); size>best { res, best=ifd, size }
+	}
+	if res!=nil { return res, false }
+
+	// CR2 files store the raw data as lossless JPEG in the fourth directory of the main chain
+	for i, ifd:=range rf.ifds[:rf.chain] {
+		if _, ok:=ifd[rawTagCR2Slices]; ok || (i==3 && ifd.uint(rawTagCompression)==rawCompressionOldJPEG && len(rf.data)>9 && string(rf.data[8:10])=="CR") {
+			return ifd, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the color filter array pattern of the raw directory, like RGGB, or empty if unavailable or not 2x2 RGB
+func (rf *rawFile) cfaPattern(ifd rawIFD) string {
+	var colors []byte
+	if e, ok:=ifd[rawTagCFAPattern]; ok {
+		if dim:=ifd.uints(rawTagCFARepeatDim); len(dim)==2 && (dim[0]!=2 || dim[1]!=2) { return "" }
+		colors=e.data
+	} else if e, ok:=rf.exif[rawTagExifCFAPattern]; ok && len(e.data)==8 {
+		// EXIF pattern is preceded by horizontal and vertical repeat, which can be in either byte order
+		if !(e.data[0]+e.data[1]==2 && e.data[2]+e.data[3]==2) { return "" }
+		colors=e.data[4:]
+	}
+	if len(colors)!=4 { return "" }
+	pattern:=""
+	for _, c:=range colors {
+		if c>2 { return "" }
+		pattern+=string("RGB"[c])
+	}
+	return pattern
+}
+
+// Returns the maker note directory, with the given offset of the embedded TIFF header, or zero if the 
+// maker note is a directory with offsets relative to the file. Returns nil if not found
+func (rf *rawFile) makerNote(headerOffset int) rawIFD {
+	e, ok:=rf.exif[rawTagMakerNote]
+	if !ok || len(e.data)<headerOffset+8 { return nil }
+	if headerOffset==0 {
+		ifd, _, err:=parseRawIFD(rf.data, 0, e.pos, rf.order)
+		if err!=nil { return nil }
+		return ifd
+	}
+	base:=e.pos+headerOffset
+	var order binary.ByteOrder
+	switch string(rf.data[base:base+4]) {
+	case "II*\x00": order=binary.LittleEndian
+	case "MM\x00*": order=binary.BigEndian
+	default:        return nil
+	}
+	ifd, _, err:=parseRawIFD(rf.data, base, int(order.Uint32(rf.data[base+4:])), order)
+	if err!=nil { return nil }
+	return ifd
+}
+
+// Returns the values of the given tag as floating point from the raw directory, or the first other directory 
+// which has it. Some cameras store raw metadata outside the raw directory
+func (rf *rawFile) floats(raw rawIFD, tag uint16) []float64 {
+	if v:=raw.floats(tag); v!=nil { return v }
+	for _, ifd:=range rf.ifds {
+		if v:=ifd.floats(tag); v!=nil { return v }
+	}
+	return nil
+}
+
+// Returns the first value of the given EXIF tag as floating point, or zero
+func (rf *rawFile) exifFloat(tag uint16) float64 {
+	for _, ifd:=range []rawIFD{rf.exif, rf.ifds[0]} {
+		if v:=ifd.floats(tag); len(v)>0 { return v[0] }
+	}
+	return 0
+}
+
+// Returns the given EXIF tag as string, or empty
+func (rf *rawFile) exifString(tag uint16) string {
+	if s:=rf.exif.str(tag); s!="" { return s }
+	return rf.ifds[0].str(tag)
+}
+
+
+// Returns the values of an integer entry, or nil if not present
+func (ifd rawIFD) uints(tag uint16) []uint32 {
+	e, ok:=ifd[tag]
+	if !ok { return nil }
+	res:=make([]uint32, e.count)
+	for i:=range res {
+		switch e.typ {
+		case 1, 6, 7: res[i]=uint32(e.data[i])
+		case 3, 8:    res[i]=uint32(e.order.Uint16(e.data[2*i:]))
+		case 4, 9, 13:res[i]=e.order.Uint32(e.data[4*i:])
+		default:      return nil
+		}
+	}
+	return res
+}
+
+// Returns the first value of an integer entry, or zero if not present
+func (ifd rawIFD) uint(tag uint16) uint32 {
+	if v:=ifd.uints(tag); len(v)>0 { return v[0] }
+	return 0
+}
+
+// Returns the values of a numeric entry as floating point, or nil if not present
+func (ifd rawIFD) floats(tag uint16) []float64 {
+	e, ok:=ifd[tag]
+	if !ok { return nil }
+	res:=make([]float64, e.count)
+	for i:=range res {
+		switch e.typ {
+		case 5:
+			num, den:=e.order.Uint32(e.data[8*i:]), e.order.Uint32(e.data[8*i+4:])
+			if den==0 { return nil }
+			res[i]=float64(num)/float64(den)
+		case 10:
+			num, den:=int32(e.order.Uint32(e.data[8*i:])), int32(e.order.Uint32(e.data[8*i+4:]))
+			if den==0 { return nil }
+			res[i]=float64(num)/float64(den)
+		case 8:  res[i]=float64(int16(e.order.Uint16(e.data[2*i:])))
+		case 9:  res[i]=float64(int32(e.order.Uint32(e.data[4*i:])))
+		case 11: res[i]=float64(math.Float32frombits(e.order.Uint32(e.data[4*i:])))
+		case 12: res[i]=math.Float64frombits(e.order.Uint64(e.data[8*i:]))
+		default:
+			v:=ifd.uints(tag)
+			if v==nil { return nil }
+			res[i]=float64(v[i])
+		}
+	}
+	return res
+}
+
+// Returns the value of a string entry without trailing zeros and blanks, or empty if not present
+func (ifd rawIFD) str(tag uint16) string {
+	e, ok:=ifd[tag]
+	if !ok || e.typ!=2 { return "" }
+	s:=string(e.data)
+	if i:=strings.IndexByte(s, 0); i>=0 { s=s[:i] }
+	return strings.TrimSpace(s)
+}
+
+
+// Decodes the raw samples of the given directory. Returns the samples with their dimensions and bits per sample
+func (rf *rawFile) decode(ifd rawIFD, isCR2 bool) (samples []uint16, width, height, bits int, err error) {
+	compression:=ifd.uint(rawTagCompression)
+	width, height, bits=int(ifd.uint(rawTagWidth)), int(ifd.uint(rawTagHeight)), int(ifd.uint(rawTagBitsPerSample))
+
+	// Data is stored in tiles, or in strips as tiles of full width
+	offsets, counts:=ifd.uints(rawTagTileOffsets), ifd.uints(rawTagTileByteCounts)
+	tileWidth, tileHeight:=int(ifd.uint(rawTagTileWidth)), int(ifd.uint(rawTagTileLength))
+	if offsets==nil {
+		offsets, counts=ifd.uints(rawTagStripOffsets), ifd.uints(rawTagStripByteCounts)
+		tileWidth, tileHeight=width, int(ifd.uint(rawTagRowsPerStrip))
+		if tileHeight==0 || tileHeight>height { tileHeight=height }
+	}
+	if len(offsets)==0 || len(offsets)!=len(counts) { return nil, 0, 0, 0, errors.New("Raw data location missing") }
+	chunks:=make([][]byte, len(offsets))
+	for i:=range chunks {
+		if int64(offsets[i])+int64(counts[i])>int64(len(rf.data)) { return nil, 0, 0, 0, errors.New("Raw data truncated") }
+		chunks[i]=rf.data[offsets[i]:offsets[i]+counts[i]]
+	}
+
+	if isCR2 { return decodeCR2(chunks[0], ifd.uints(rawTagCR2Slices)) }
+	if width<=0 || height<=0 || tileWidth<=0 || tileHeight<=0 { return nil, 0, 0, 0, errors.New("Invalid raw image dimensions") }
+
+	samples=make([]uint16, width*height)
+	tilesAcross:=(width+tileWidth-1)/tileWidth
+	for i, chunk:=range chunks {
+		var tile []uint16
+		tw:=tileWidth
+		switch compression {
+		case rawCompressionNone:
+			tile, err=rawUnpack(chunk, tileWidth, tileHeight, bits, rf.order)
+		case rawCompressionLJPEG:
+			tile, tw, _, _, err=ljpegDecode(chunk)
+		case rawCompressionSony:
+			if bits!=8 { return nil, 0, 0, 0, errors.New("Unsupported Sony raw compression") }
+			curve:=rf.floats(ifd, rawTagSonyCurve)
+			tile, err=decodeSonyARW2(chunk, tileWidth, tileHeight, curve)
+			bits=14
+		case rawCompressionNikon:
+			return nil, 0, 0, 0, errors.New("Compressed NEF is not supported, please convert to DNG")
+		default:
+			return nil, 0, 0, 0, errors.New(fmt.Sprintf("Unsupported raw compression %d", compression))
+		}
+		if err!=nil { return nil, 0, 0, 0, err }
+
+		// copy the tile into the image, clipping at the right and bottom edges
+		x0, y0:=(i%tilesAcross)*tileWidth, (i/tilesAcross)*tileHeight
+		for y:=0; y<tileHeight && y0+y<height && (y+1)*tw<=len(tile); y++ {
+			row:=tile[y*tw:y*tw+tw]
+			if x0+len(row)>width { row=row[:width-x0] }
+			copy(samples[(y0+y)*width+x0:], row)
+		}
+	}
+	return samples, width, height, bits, nil
+}
+
+// Unpacks uncompressed samples. Sample sizes of 8 and 16 bits are stored in whole bytes in file byte order,
+// other sizes are packed most significant bit first with rows starting on byte boundaries
+func rawUnpack(chunk []byte, width, height, bits int, order binary.ByteOrder) (samples []uint16, err error) {
+	samples=make([]uint16, width*height)
+	if len(chunk)>=2*len(samples) { bits=16 } // some cameras store fewer significant bits in 16-bit words
+	switch bits {
+	case 8:
+		if len(chunk)<len(samples) { return nil, errors.New("Raw data truncated") }
+		for i:=range samples { samples[i]=uint16(chunk[i]) }
+	case 16:
+		if len(chunk)<2*len(samples) { return nil, errors.New("Raw data truncated") }
+		for i:=range samples { samples[i]=order.Uint16(chunk[2*i:]) }
+	default:
+		if bits<1 || bits>16 { return nil, errors.New(fmt.Sprintf("Unsupported raw bits per sample %d", bits)) }
+		rowBytes:=(width*bits+7)/8
+		if len(chunk)<rowBytes*height { return nil, errors.New("Raw data truncated") }
+		for y:=0; y<height; y++ {
+			r:=bitReader{data:chunk[y*rowBytes:(y+1)*rowBytes]}
+			for x:=0; x<width; x++ {
+				v, err:=r.read(uint(bits))
+				if err!=nil { return nil, err }
+				samples[y*width+x]=uint16(v)
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Decodes the lossless JPEG data of a CR2 file. The image is split into vertical slices given as
+// number of slices, slice width and width of the last slice, which are stored one after the other
+func decodeCR2(chunk []byte, slices []uint32) (samples []uint16, width, height, bits int, err error) {
+	jpeg, width, height, bits, err:=ljpegDecode(chunk)
+	if err!=nil { return nil, 0, 0, 0, err }
+	if len(slices)!=3 || slices[0]==0 { return jpeg, width, height, bits, nil }
+
+	n, sw, lw:=int(slices[0]), int(slices[1]), int(slices[2])
+	if n*sw+lw!=width { return nil, 0, 0, 0, errors.New("Invalid CR2 slices") }
+	samples=make([]uint16, len(jpeg))
+	for i, v:=range jpeg {
+		slice:=i/(sw*height)
+		w:=sw
+		if slice>=n { slice, w=n, lw }
+		j:=i-slice*sw*height
+		samples[(j/w)*width + slice*sw + j%w]=v
+	}
+	return samples, width, height, bits, nil
+}
+
+// Decodes Sony ARW2 compressed data. Each block of 16 bytes holds 16 samples of the same color from every other column,
+// as 11-bit maximum and minimum, their 4-bit positions and 7-bit deltas. Values are linearized to 14 bits with the Sony curve
+func decodeSonyARW2(chunk []byte, width, height int, curvePoints []float64) (samples []uint16, err error) {
+	if len(chunk)<width*height { return nil, errors.New("Raw data truncated") }
+
+	// tone curve from up to 4 knots, doubling the slope after each one
+	curve:=make([]uint16, 0x4001)
+	for i:=range curve { curve[i]=uint16(i) }
+	knots:=[]int{0, 0, 0, 0, 0, 4095}
+	for i:=0; i<4 && i<len(curvePoints); i++ { knots[i+1]=int(curvePoints[i])>>2 & 0xfff }
+	for i:=0; i<5; i++ {
+		for j:=knots[i]+1; j<=knots[i+1]; j++ { curve[j]=curve[j-1]+uint16(1<<uint(i)) }
+	}
+
+	samples=make([]uint16, width*height)
+	var pix [16]int
+	block:=make([]byte, 17) // deltas are read in pairs of bytes, which may extend beyond the block
+	for y:=0; y<height; y++ {
+		row:=chunk[y*width:(y+1)*width]
+		for b:=0; b+32<=width; b+=32 {
+			for half:=0; half<2; half++ {
+				copy(block, row[b+16*half:b+16*half+16])
+				val:=binary.LittleEndian.Uint32(block)
+				max, min:=int(val&0x7ff), int(val>>11&0x7ff)
+				imax, imin:=int(val>>22&0x0f), int(val>>26&0x0f)
+				sh:=uint(0)
+				for sh<4 && 0x80<<sh<=max-min { sh++ }
+				bit:=30
+				for i:=range pix {
+					switch i {
+					case imax: pix[i]=max
+					case imin: pix[i]=min
+					default:
+						pix[i]=(int(binary.LittleEndian.Uint16(block[bit>>3:])>>uint(bit&7)&0x7f)<<sh)+min
+						if pix[i]>0x7ff { pix[i]=0x7ff }
+						bit+=7
+					}
+				}
+				for i, p:=range pix { samples[y*width+b+2*i+half]=curve[p<<1] }
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Returns the mean of the samples in the given area
+func rawMeanArea(samples []uint16, width, top, left, bottom, right int) float64 {
+	sum, n:=0.0, 0
+	for y:=top; y<bottom; y++ {
+		for _, s:=range samples[y*width+left:y*width+right] { sum+=float64(s); n++ }
+	}
+	if n==0 { return 0 }
+	return sum/float64(n)
+}
+
+// Returns the mean of the given values
+func mean(values []float64) float64 {
+	sum:=0.0
+	for _, v:=range values { sum+=v }
+	return sum/float64(len(values))
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Encodes samples as lossless JPEG with the given number of interleaved components, precision and predictor. 
+// Uses a single Huffman table with 5-bit codes for all difference categories
+func ljpegEncode(samples []uint16, width, height, comps, precision, predictor int) []byte {
+	out:=[]byte{0xFF, 0xD8, 0xFF, 0xC4, 0, 2+17+17, 0x00, 0, 0, 0, 0, 17, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	for v:=0; v<=16; v++ { out=append(out, byte(v)) }
+	out=append(out, 0xFF, 0xC3, 0, byte(8+3*comps), byte(precision), byte(height>>8), byte(height), byte(width>>8), byte(width), byte(comps))
+	for c:=0; c<comps; c++ { out=append(out, byte(c+1), 0x11, 0) }
+	out=append(out, 0xFF, 0xDA, 0, byte(6+2*comps), byte(comps))
+	for c:=0; c<comps; c++ { out=append(out, byte(c+1), 0x00) }
+	out=append(out, byte(predictor), 0, 0)
+
+	acc, n:=uint64(0), uint(0)
+	put:=func(v uint64, numBits uint) {
+		acc, n=acc<<numBits|v&(1<<numBits-1), n+numBits
+		for n>=8 {
+			n-=8
+			b:=byte(acc>>n)
+			out=append(out, b)
+			if b==0xFF { out=append(out, 0) }
+		}
+	}
+	rowLen:=width*comps
+	for row:=0; row<height; row++ {
+		for i:=0; i<rowLen; i++ {
+			var pred int
+			if row==0 {
+				if i<comps { pred=1<<uint(precision-1) } else { pred=int(samples[i-comps]) }
+			} else if i<comps {
+				pred=int(samples[(row-1)*rowLen+i])
+			} else {
+				ra, rb, rc:=int(samples[row*rowLen+i-comps]), int(samples[(row-1)*rowLen+i]), int(samples[(row-1)*rowLen+i-comps])
+				pred=[]int{0, ra, rb, rc, ra+rb-rc, ra+((rb-rc)>>1), rb+((ra-rc)>>1), (ra+rb)>>1}[predictor]
+			}
+			diff:=int(int16(uint16(int(samples[row*rowLen+i])-pred)))
+			if diff==-32768 { put(16, 5); continue }
+			abs:=diff
+			if abs<0 { abs=-abs }
+			ssss:=uint(bits.Len(uint(abs)))
+			put(uint64(ssss), 5)
+			if diff<0 { diff+=1<<ssss-1 }
+			put(uint64(diff), ssss)
+		}
+	}
+	if n>0 { put(1<<(8-n)-1, 8-n) }
+	return append(out, 0xFF, 0xD9)
+}
+
+func TestLJPEGDecode(t *testing.T) {
+	width, height, comps:=7, 5, 2
+	samples:=make([]uint16, width*height*comps)
+	for i:=range samples { samples[i]=uint16((i*7919)%4096) }
+	samples[3]=0
+	samples[4]=4095
+	for _, predictor:=range []int{1, 4, 6, 7} {
+		got, w, h, p, err:=ljpegDecode(ljpegEncode(samples, width, height, comps, 12, predictor))
+		if err!=nil { t.Fatalf("predictor %d: err=%s; want nil", predictor, err) }
+		if w!=width*comps || h!=height || p!=12 { t.Errorf("predictor %d: %dx%d %d bits; want %dx%d 12 bits", predictor, w, h, p, width*comps, height) }
+		for i:=range samples {
+			if got[i]!=samples[i] { t.Errorf("predictor %d: samples[%d]=%d; want %d", predictor, i, got[i], samples[i]); break }
+		}
+	}
+}
+
+func TestDecodeCR2Slices(t *testing.T) {
+	// two slices of width 2 and a last slice of width 1, stored one after the other
+	width, height:=5, 2
+	stored:=[]uint16{ 1, 2, 6, 7,  3, 4, 8, 9,  5, 10 }
+	got, w, h, _, err:=decodeCR2(ljpegEncode(stored, width, height, 1, 14, 1), []uint32{2, 2, 1})
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if w!=width || h!=height { t.Errorf("%dx%d; want %dx%d", w, h, width, height) }
+	for i, s:=range got {
+		if s!=uint16(i+1) { t.Errorf("samples[%d]=%d; want %d", i, s, i+1) }
+	}
+}
+
+func TestRawUnpackTruncated(t *testing.T) {
+	le:=binary.LittleEndian
+	samples, err:=rawUnpack([]byte{1, 0, 2, 0, 3, 0, 4, 0}, 2, 2, 16, le)
+	if err!=nil || len(samples)!=4 || samples[3]!=4 { t.Errorf("samples=%v err=%v; want [1 2 3 4] and nil", samples, err) }
+	for _, bits:=range []int{8, 12, 16} {
+		if _, err:=rawUnpack(make([]byte, 3), 2, 2, bits, le); err==nil { t.Errorf("%d bits: err=nil; want truncated", bits) }
+	}
+	if _, err:=rawUnpack(make([]byte, 7), 2, 2, 16, le); err==nil { t.Errorf("16 bits short strip: err=nil; want truncated") }
+}
+
+// A TIFF entry for writing test files
+type testTIFFEntry struct { tag, typ uint16; count uint32; data []byte }
+
+// Writes a little endian TIFF file with a single directory. Image data follows the header
+func writeTestTIFF(entries []testTIFFEntry, image []byte) []byte {
+	le:=binary.LittleEndian
+	out:=[]byte("II*\x00\x08\x00\x00\x00")
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag<entries[j].tag })
+	extra:=8+2+12*len(entries)+4
+	ifd:=make([]byte, 2+12*len(entries)+4)
+	le.PutUint16(ifd, uint16(len(entries)))
+	var values []byte
+	for i, e:=range entries {
+		le.PutUint16(ifd[2+12*i:], e.tag)
+		le.PutUint16(ifd[4+12*i:], e.typ)
+		le.PutUint32(ifd[6+12*i:], e.count)
+		if len(e.data)<=4 {
+			copy(ifd[10+12*i:], e.data)
+		} else {
+			le.PutUint32(ifd[10+12*i:], uint32(extra+len(values)))
+			values=append(values, e.data...)
+		}
+	}
+	out=append(append(out, ifd...), values...)
+	return append(out, image...)
+}
+
+func testLongs(values ...uint32) []byte {
+	b:=make([]byte, 4*len(values))
+	for i, v:=range values { binary.LittleEndian.PutUint32(b[4*i:], v) }
+	return b
+}
+
+func TestReadRawDNG(t *testing.T) {
+	// 4x3 uncompressed 16-bit CFA image in BGGR, with active area starting at column 1 and row 0
+	width, height:=4, 3
+	image:=make([]byte, 2*width*height)
+	for i:=0; i<width*height; i++ { binary.LittleEndian.PutUint16(image[2*i:], uint16(100+i)) }
+	entries:=[]testTIFFEntry{
+		{rawTagNewSubfileType, 4, 1, testLongs(0)},
+		{rawTagWidth, 4, 1, testLongs(uint32(width))},
+		{rawTagHeight, 4, 1, testLongs(uint32(height))},
+		{rawTagBitsPerSample, 3, 1, []byte{16, 0}},
+		{rawTagCompression, 3, 1, []byte{1, 0}},
+		{rawTagPhotometric, 3, 1, []byte{0x23, 0x80}},
+		{rawTagMake, 2, 6, []byte("Maker\x00")},
+		{rawTagRowsPerStrip, 4, 1, testLongs(uint32(height))},
+		{rawTagStripByteCounts, 4, 1, testLongs(uint32(len(image)))},
+		{rawTagCFARepeatDim, 3, 2, []byte{2, 0, 2, 0}},
+		{rawTagCFAPattern, 1, 4, []byte{2, 1, 1, 0}},
+		{rawTagExposureTime, 5, 1, testLongs(300, 10)},
+		{rawTagBlackLevel, 3, 1, []byte{64, 0}},
+		{rawTagWhiteLevel, 3, 1, []byte{0xff, 0x0f}},
+		{rawTagActiveArea, 3, 4, []byte{0, 0, 1, 0, 3, 0, 4, 0}},
+	}
+	// strip offset depends on the size of the header, so write twice
+	entries=append(entries, testTIFFEntry{rawTagStripOffsets, 4, 1, testLongs(0)})
+	data:=writeTestTIFF(entries, image)
+	for i:=range entries {
+		if entries[i].tag==rawTagStripOffsets { entries[i].data=testLongs(uint32(len(data)-len(image))) }
+	}
+	data=writeTestTIFF(entries, image)
+
+	f, err:=ioutil.TempFile("", "test*.dng")
+	if err!=nil { t.Fatal(err) }
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+
+	fits:=NewFITSImage()
+	if err:=fits.ReadFile(f.Name()); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if fits.Naxisn[0]!=3 || fits.Naxisn[1]!=3 { t.Errorf("Naxisn=%v; want [3 3]", fits.Naxisn) }
+	for i, want:=range []float32{101, 102, 103, 105, 106, 107, 109, 110, 111} {
+		if fits.Data[i]!=want { t.Errorf("Data[%d]=%f; want %f", i, fits.Data[i], want) }
+	}
+	if fits.Exposure!=30 { t.Errorf("Exposure=%f; want 30", fits.Exposure) }
+	if got:=fits.Header.Strings["BAYERPAT"]; got!="GBRG" { t.Errorf("BAYERPAT=%s; want GBRG", got) }
+	if got:=fits.Header.Floats["BLKLEVEL"]; got!=64 { t.Errorf("BLKLEVEL=%f; want 64", got) }
+	if got:=fits.Header.Floats["DATAMAX"]; got!=4095 { t.Errorf("DATAMAX=%f; want 4095", got) }
+	if got:=fits.Header.Strings["INSTRUME"]; got!="Maker" { t.Errorf("INSTRUME=%s; want Maker", got) }
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math" 
 	"os"
 	"path"
@@ -31,39 +32,191 @@ import (
 
 var reParser *regexp.Regexp=compileRE() // Regexp parser for FITS header lines
 
-// Read FITS data from the file with the given name. Decompresses gzip if .gz or gzip suffix is present
+// Read FITS data from the file with the given name. Decompresses gzip if .gz or gzip suffix is present.
+// An optional suffix like file.fits[1] or file.fits[SCI] selects the HDU by index or EXTNAME.
+// Reads XISF if .xisf suffix is present, where the optional suffix selects the image by index or id.
+// Reads a single frame if .ser suffix is present, where the optional suffix selects the frame by index.
+// Reads the color filter array of camera raw files with .dng, .cr2, .nef or .arw suffix
 func (fits *FITSImage) ReadFile(fileName string) error {
 	//LogPrintln("Reading from " + fileName + "..." )
-	f, err:=os.Open(fileName)
+	name, hdu:=SplitHDUSuffix(fileName)
+	switch strings.ToLower(path.Ext(name)) {
+	case ".ser":
+		fits.FileName=fileName
+		return fits.readSERFile(name, hdu)
+	case ".dng", ".cr2", ".nef", ".arw":
+		fits.FileName=fileName
+		return fits.ReadRaw(name)
+	}
+	f, r, err:=openFITSFile(name)
 	if err!=nil { return err }
 	defer f.Close()
 
-	var r io.Reader=f
+	fits.FileName=fileName
+	if strings.ToLower(path.Ext(name))==".xisf" { return fits.ReadXISF(r, hdu) }
+	return fits.ReadHDU(r, hdu)
+}
+
+
+// Opens the FITS file with the given name for reading. Decompresses gzip if .gz or .gzip suffix is present
+func openFITSFile(fileName string) (f *os.File, r io.Reader, err error) {
+	f, err=os.Open(fileName)
+	if err!=nil { return nil, nil, err }
+	r=f
 
 	// Decompress gzip if .gz or .gzip suffix is present
 	ext:=path.Ext(fileName)
 	lExt:=strings.ToLower(ext)
 	if lExt==".gz" || lExt==".gzip" {
 		r, err=gzip.NewReader(f)
-		if err!=nil { return err }
+		if err!=nil { f.Close(); return nil, nil, err }
 	} 
+	return f, r, nil
+}
 
-	fits.FileName=fileName
-	return fits.Read(r)
+
+// Splits an optional HDU selector suffix like [1] or [SCI] from the given file name. To tell selectors apart from
+// glob character classes like light[12], the name before the suffix must end in a FITS, XISF or SER suffix or exist 
+// as a file, and the full name must not exist as a file
+func SplitHDUSuffix(fileName string) (name, hdu string) {
+	i:=strings.LastIndex(fileName, "[")
+	if !strings.HasSuffix(fileName, "]") || i<0 || fileExists(fileName) { return fileName, "" }
+	name, hdu=fileName[:i], fileName[i+1:len(fileName)-1]
+	if hasLibrarySuffix(name) || strings.ToLower(path.Ext(name))==".ser" || fileExists(name) { return name, hdu }
+	return fileName, ""
+}
+
+// Returns true if a regular file with the given name exists
+func fileExists(fileName string) bool {
+	info, err:=os.Stat(fileName)
+	return err==nil && !info.IsDir()
 }
 
 
+// Read FITS data from the first HDU with image data
 func (fits *FITSImage) Read(f io.Reader) error {
-	err:=fits.Header.read(f)
-	if err!=nil { return err }
-	if(!fits.Header.Bools["SIMPLE"]) { return errors.New("Not a valid FITS file; SIMPLE=T missing in header.") }
+	return fits.ReadHDU(f, "")
+}
+
+
+// Read FITS data from the HDU selected by index or EXTNAME. The primary HDU has index 0.
+// An empty selector picks the first HDU with image data, as some cameras write an empty primary HDU
+func (fits *FITSImage) ReadHDU(f io.Reader, hdu string) error {
+	primary:=FITSHeader{}
+	for index:=0; ; index++ {
+		h:=NewFITSHeader()
+		err:=h.read(f)
+		if err==io.EOF && index>0 { 
+			if hdu=="" { return errors.New("No HDU with image data found") }
+			return errors.New("HDU "+hdu+" not found") 
+		}
+		if err!=nil { return err }
+		if index==0 {
+			if !h.Bools["SIMPLE"] { return errors.New("Not a valid FITS file; SIMPLE=T missing in header.") }
+			primary=h
+		}
+
+		if h.matchesHDU(index, hdu) {
+			if index>0 && h.Bools["INHERIT"] { h.inherit(&primary) }
+			fits.Header=h
+			if h.isCompressedImage() { return fits.readCompressedImage(f) }
+			if xt, ok:=h.Strings["XTENSION"]; ok && xt!="IMAGE" { 
+				return errors.New(fmt.Sprintf("HDU %d is a %s extension, not an image", index, xt)) 
+			}
+			fits.readHeaderValues()
+			return fits.readData(f)
+		}
 
+		// skip data of this HDU
+		_, err=io.CopyN(ioutil.Discard, f, h.dataSize())
+		if err!=nil { return err }
+	}
+}
+
+
+// Returns true if the HDU with this header and the given index matches the selector, 
+// which is an index, an EXTNAME, or empty for the first image HDU with data
+func (h *FITSHeader) matchesHDU(index int, hdu string) bool {
+	if hdu=="" {
+		xt, ok:=h.Strings["XTENSION"]
+		return (!ok || xt=="IMAGE" || h.isCompressedImage()) && h.Ints["NAXIS"]>0
+	}
+	if i, err:=strconv.Atoi(hdu); err==nil { return i==index }
+	return strings.EqualFold(h.Strings["EXTNAME"], hdu)
+}
+
+
+// Returns the size of the data following this header in bytes, padded to full FITS blocks
+func (h *FITSHeader) dataSize() int64 {
+	naxis:=h.Ints["NAXIS"]
+	if naxis==0 { return 0 }
+	size:=int64(1)
+	for i:=int32(1); i<=naxis; i++ {
+		size*=int64(h.Ints["NAXIS"+strconv.FormatInt(int64(i),10)])
+	}
+	if gcount, ok:=h.Ints["GCOUNT"]; ok {
+		size=int64(gcount)*(int64(h.Ints["PCOUNT"])+size)
+	}
+	bitpix:=int64(h.Ints["BITPIX"])
+	if bitpix<0 { bitpix=-bitpix }
+	size*=bitpix/8
+	return (size+int64(fitsBlockSize)-1)/int64(fitsBlockSize)*int64(fitsBlockSize)
+}
+
+
+// Description of a header data unit in a FITS file
+type HDUInfo struct {
+	Index   int      // Index of the HDU, 0 for the primary HDU
+	Type    string   // PRIMARY, the extension type like IMAGE or BINTABLE, or the compression of tile compressed images
+	ExtName string   // Extension name, if any
+	Bitpix  int32    // Bits per value
+	Naxisn  []int32  // Axis dimensions
+}
+
+// Lists all header data units in the FITS file with the given name 
+func ListHDUs(fileName string) (hdus []HDUInfo, err error) {
+	f, r, err:=openFITSFile(fileName)
+	if err!=nil { return nil, err }
+	defer f.Close()
+
+	for index:=0; ; index++ {
+		h:=NewFITSHeader()
+		err:=h.read(r)
+		if err==io.EOF && index>0 { return hdus, nil }
+		if err!=nil { return hdus, err }
+
+		info:=HDUInfo{Index:index, Type:"PRIMARY", ExtName:h.Strings["EXTNAME"], Bitpix:h.Ints["BITPIX"]}
+		if xt, ok:=h.Strings["XTENSION"]; ok { info.Type=xt }
+		prefix:="" 
+		if h.isCompressedImage() { 
+			info.Type, info.Bitpix, prefix=h.Strings["ZCMPTYPE"], h.Ints["ZBITPIX"], "Z"
+		}
+		info.Naxisn=make([]int32, h.Ints[prefix+"NAXIS"])
+		for i:=range info.Naxisn {
+			info.Naxisn[i]=h.Ints[prefix+"NAXIS"+strconv.FormatInt(int64(i+1),10)]
+		}
+		hdus=append(hdus, info)
+
+		_, err=io.CopyN(ioutil.Discard, r, h.dataSize())
+		if err!=nil { return hdus, err }
+	}
+}
+
+
+// Sets image properties like dimensions, offset, scale and exposure from the header values
+func (fits *FITSImage) readHeaderValues() {
 	fits.Bitpix=fits.Header.Ints["BITPIX"]
 	fits.Bzero =float32(0)
 	if val, ok:=fits.Header.Ints["BZERO"] ; ok {
 		fits.Bzero=float32(val)
 	} else if val, ok:=fits.Header.Floats["BZERO"] ; ok {
-		fits.Bzero=val
+		fits.Bzero=float32(val)
+	}
+	fits.Bscale=float32(1)
+	if val, ok:=fits.Header.Ints["BSCALE"] ; ok {
+		fits.Bscale=float32(val)
+	} else if val, ok:=fits.Header.Floats["BSCALE"] ; ok {
+		fits.Bscale=float32(val)
 	}
 	naxis     :=fits.Header.Ints["NAXIS"]
 	fits.Naxisn=make([]int32, naxis)
@@ -74,23 +227,30 @@ func (fits *FITSImage) Read(f io.Reader) error {
 		fits.Naxisn[i-1]=nai
 		fits.Pixels*=int32(nai)
 	}
-	if val, ok:=fits.Header.Ints["EXPOSURE"] ; ok {
-		fits.Exposure=float32(val)
-	} else if val, ok:=fits.Header.Floats["EXPOSURE"] ; ok {
-		fits.Exposure=val
-	} else 	if val, ok:=fits.Header.Ints["EXPTIME"] ; ok {
-		fits.Exposure=float32(val)
-	} else if val, ok:=fits.Header.Floats["EXPTIME"] ; ok {
-		fits.Exposure=val
-	}
+	fits.Exposure=fits.Header.exposure()
 
 	//LogPrintf("Found %dbpp image in %dD with dimensions %v, total %d pixels.\n", 
 	//		   fits.Bitpix, len(fits.Naxisn), fits.Naxisn, fits.Pixels)
-	return fits.readData(f)
 }
 
 
-// Read image data from file, convert to float32 data type, apply BZero offset and set BZero to 0 afterwards.
+// Returns the exposure duration in seconds from the EXPOSURE or EXPTIME header values, or zero if neither is present
+func (h *FITSHeader) exposure() float32 {
+	if val, ok:=h.Ints["EXPOSURE"] ; ok {
+		return float32(val)
+	} else if val, ok:=h.Floats["EXPOSURE"] ; ok {
+		return float32(val)
+	} else 	if val, ok:=h.Ints["EXPTIME"] ; ok {
+		return float32(val)
+	} else if val, ok:=h.Floats["EXPTIME"] ; ok {
+		return float32(val)
+	}
+	return 0
+}
+
+
+// Read image data from file, convert to float32 data type, apply BScale and BZero and reset them afterwards.
+// Integer values matching BLANK are converted to NaN.
 func (fits *FITSImage) readData(f io.Reader) (err error) {
 	switch fits.Bitpix {
 	case 8: 
@@ -122,11 +282,19 @@ func (fits *FITSImage) readData(f io.Reader) (err error) {
 }
 
 
+// Returns the integer value marking undefined pixels, if the header has one
+func (fits *FITSImage) blankValue() (blank int64, ok bool) {
+	val, ok:=fits.Header.Ints["BLANK"]
+	return int64(val), ok
+}
+
+
 const bufLen int=16*1024  // input buffer length for reading from file
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readInt8Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
+	blank, hasBlank:=fits.blankValue()
 	buf:=make([]byte,bufLen)
 
 	dataIndex:=0	
@@ -139,17 +307,22 @@ func (fits *FITSImage) readInt8Data(r io.Reader) error {
 		if err!=nil { return err }
 
 		for i, val:=range(buf[:bytesRead]) { 
-			fits.Data[dataIndex+i]=float32(val)+fits.Bzero
+			if hasBlank && int64(val)==blank {
+				fits.Data[dataIndex+i]=float32(math.NaN())
+			} else {
+				fits.Data[dataIndex+i]=float32(val)*fits.Bscale+fits.Bzero
+			}
 		}
 		dataIndex+=bytesRead
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readInt16Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
+	blank, hasBlank:=fits.blankValue()
 	buf     :=make([]byte,bufLen)
 
 	bytesPerValueShift:=uint(1)
@@ -168,7 +341,11 @@ func (fits *FITSImage) readInt16Data(r io.Reader) error {
 		availableBytes:=leftoverBytes+bytesRead
 		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
 			val:=int16((uint16(buf[i])<<8) | uint16(buf[i+1]))
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
+			if hasBlank && int64(val)==blank {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(math.NaN())
+			} else {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)*fits.Bscale+fits.Bzero
+			}
 		}
 		dataIndex   += availableBytes>>bytesPerValueShift
 		leftoverBytes= availableBytes& bytesPerValueMask
@@ -176,13 +353,14 @@ func (fits *FITSImage) readInt16Data(r io.Reader) error {
 			buf[i]=buf[availableBytes-leftoverBytes+i]
 		}
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readInt32Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
+	blank, hasBlank:=fits.blankValue()
 	buf     :=make([]byte,bufLen)
 
 	bytesPerValueShift:=uint(2)
@@ -201,7 +379,11 @@ func (fits *FITSImage) readInt32Data(r io.Reader) error {
 		availableBytes:=leftoverBytes+bytesRead
 		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
 			val:=int32((uint32(buf[i])<<24) | (uint32(buf[i+1])<<16) | (uint32(buf[i+2])<<8) | (uint32(buf[i+3])))
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
+			if hasBlank && int64(val)==blank {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(math.NaN())
+			} else {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)*fits.Bscale+fits.Bzero
+			}
 		}
 		dataIndex   += availableBytes>>bytesPerValueShift
 		leftoverBytes= availableBytes& bytesPerValueMask
@@ -209,13 +391,14 @@ func (fits *FITSImage) readInt32Data(r io.Reader) error {
 			buf[i]=buf[availableBytes-leftoverBytes+i]
 		}
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readInt64Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
+	blank, hasBlank:=fits.blankValue()
 	buf     :=make([]byte,bufLen)
 
 	bytesPerValueShift:=uint(3)
@@ -235,7 +418,11 @@ func (fits *FITSImage) readInt64Data(r io.Reader) error {
 		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
 			val:=int64((uint64(buf[i  ])<<56) | (uint64(buf[i+1])<<48) | (uint64(buf[i+2])<<40) | (uint64(buf[i+3])<<32) |
 			           (uint64(buf[i+4])<<24) | (uint64(buf[i+5])<<16) | (uint64(buf[i+6])<< 8) | (uint64(buf[i+7])    )   )
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
+			if hasBlank && int64(val)==blank {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(math.NaN())
+			} else {
+				fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)*fits.Bscale+fits.Bzero
+			}
 		}
 		dataIndex   += availableBytes>>bytesPerValueShift
 		leftoverBytes= availableBytes& bytesPerValueMask
@@ -243,11 +430,11 @@ func (fits *FITSImage) readInt64Data(r io.Reader) error {
 			buf[i]=buf[availableBytes-leftoverBytes+i]
 		}
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readFloat32Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
 	buf     :=make([]byte,bufLen)
@@ -273,7 +460,7 @@ func (fits *FITSImage) readFloat32Data(r io.Reader) error {
 			bits:=((uint32(buf[i]))<<24) | (uint32(buf[i+1])<<16) | (uint32(buf[i+2])<<8) | (uint32(buf[i+3]))
 			val:=math.Float32frombits(bits)
 			//LogPrintf("%d: %02x %02x %02x %02x = %08x =%f\n", i, buf[i], buf[i+1], buf[i+2], buf[i+3], bits, val)
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
+			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)*fits.Bscale+fits.Bzero
 		}
 		dataIndex   += availableBytes>>bytesPerValueShift
 		leftoverBytes= availableBytes& bytesPerValueMask
@@ -281,11 +468,11 @@ func (fits *FITSImage) readFloat32Data(r io.Reader) error {
 			buf[i]=buf[availableBytes-leftoverBytes+i]
 		}
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
+// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bscale and Bzero
 func (fits *FITSImage) readFloat64Data(r io.Reader) error {
 	fits.Data=make([]float32,int(fits.Pixels))
 	buf     :=make([]byte,bufLen)
@@ -308,7 +495,7 @@ func (fits *FITSImage) readFloat64Data(r io.Reader) error {
 			bits:=((uint64(buf[i  ])<<56) | (uint64(buf[i+1])<<48) | (uint64(buf[i+2])<<40) | (uint64(buf[i+3])<<32) |
 			       (uint64(buf[i+4])<<24) | (uint64(buf[i+5])<<16) | (uint64(buf[i+6])<< 8) | (uint64(buf[i+7])    )   )
 			val:=math.Float64frombits(bits)
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
+			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)*fits.Bscale+fits.Bzero
 		}
 		dataIndex   += availableBytes>>bytesPerValueShift
 		leftoverBytes= availableBytes& bytesPerValueMask
@@ -316,7 +503,7 @@ func (fits *FITSImage) readFloat64Data(r io.Reader) error {
 			buf[i]=buf[availableBytes-leftoverBytes+i]
 		}
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
 	return nil
 }
 
@@ -326,6 +513,7 @@ func (h *FITSHeader) read(r io.Reader) error {
 
 	myParser:=reParser.Copy() // better (thread-)safe for SubexpNames() than sorry
 
+	prevKey:=""
 	for h.Length=0; !h.End ; {
 		// read next header unit
 		bytesRead, err:=io.ReadFull(r, buf)
@@ -338,9 +526,10 @@ func (h *FITSHeader) read(r io.Reader) error {
 			subValues:=myParser.FindSubmatch(line)
 			if subValues==nil {
 				LogPrintf("Warning:Cannot parse '%s', ignoring\n",string(line))
+				prevKey=""
 			} else {
 				subNames:=myParser.SubexpNames()
-				h.readLine(subNames, subValues, lineNo)
+				prevKey=h.readLine(subNames, subValues, lineNo, prevKey)
 			}
 		}
 	}
@@ -348,8 +537,11 @@ func (h *FITSHeader) read(r io.Reader) error {
 }
 
 
-func (h *FITSHeader) readLine(subNames []string, subValues [][]byte, lineNo int) {
-	key:=""
+// Parses a header line into the header. Returns the key the line assigned a value to, which is needed 
+// to attach subsequent CONTINUE lines of long strings to the key given as prevKey 
+func (h *FITSHeader) readLine(subNames []string, subValues [][]byte, lineNo int, prevKey string) string {
+	key, isNew, continued:="", false, false
+	re:=float64(0)
 	// ignore index 0 which is the whole line
 	for i:=1; i<len(subNames); i++ {
 		if subValues[i]!=nil && len(subNames[i])==1 {
@@ -357,52 +549,98 @@ func (h *FITSHeader) readLine(subNames []string, subValues [][]byte, lineNo int)
 			case byte('E'): // end line
 				h.End=true 
 			case byte('H'): // history line
-				h.History=append(h.History, string(subValues[i]))
+				h.History=append(h.History, strings.TrimRight(string(subValues[i]), " "))
 			case byte('C'): // comment line
-				h.Comments=append(h.History, string(subValues[i]))
-			case byte('k'): // key
-				key=string(subValues[i])
+				h.Comments=append(h.Comments, strings.TrimRight(string(subValues[i]), " "))
+			case byte('k'): // key, with HIERARCH keys normalized to single spaces
+				key=strings.Join(strings.Fields(string(subValues[i])), " ")
+				isNew=!h.Has(key)
 			case byte('b'): // boolean
 				if len(subValues[i])>0 {
 					v:=subValues[i][0]
 					h.Bools[key]=v==byte('t') || v==byte('T')
 				}
-			case byte('i'): // int
+			case byte('i'): // int. Values beyond the int32 range are kept as floats
 				val, err:=strconv.ParseInt(string(subValues[i]),10,64)
-				if err==nil {
+				if err==nil && val>=math.MinInt32 && val<=math.MaxInt32 {
 					h.Ints[key]=int32(val)
+				} else if fval, err:=parseFITSFloat(subValues[i]); err==nil {
+					h.Floats[key]=fval
 				}
 			case byte('f'): // float
-				val, err:=strconv.ParseFloat(string(subValues[i]),64)
+				val, err:=parseFITSFloat(subValues[i])
 				if err==nil {
-					h.Floats[key]=float32(val)
+					h.Floats[key]=val
 				}
-			case byte('s'): // string
-				h.Strings[key]=string(subValues[i])
+			case byte('x'): // real part of a complex value
+				val, err:=parseFITSFloat(subValues[i])
+				if err==nil { re=val }
+			case byte('y'): // imaginary part of a complex value
+				val, err:=parseFITSFloat(subValues[i])
+				if err==nil {
+					h.Complexes[key]=complex(float32(re), float32(val))
+				}
+			case byte('s'): // string, or date in a string
+				val:=parseFITSString(subValues[i])
+				if reQuotedDate.MatchString(val) {
+					h.Dates[key]=val
+				} else {
+					h.Strings[key]=val
+				}
+			case byte('n'): // continuation of a long string from the previous line
+				prev, ok:=h.Strings[prevKey]
+				if !ok || !strings.HasSuffix(prev, "&") {
+					LogPrintf("%d:Warning:Ignoring CONTINUE without preceding long string\n", lineNo)
+					break
+				}
+				key, continued=prevKey, true
+				h.Strings[key]=prev[:len(prev)-1]+parseFITSString(subValues[i])
 			case byte('d'): // date
 				h.Dates[key]=string(subValues[i])
 			case byte('c'): // comment
-				// ignore value comments
+				if comment:=strings.TrimSpace(string(subValues[i])); comment!="" && key!="" {
+					if prevComment, ok:=h.KeyComments[key]; ok && continued {
+						comment=prevComment+" "+comment // comments on CONTINUE lines
+					}
+					h.KeyComments[key]=comment
+				}
 			default:
 				LogPrintf("%d:Warning:Unknown token '%s'\n", lineNo, string(c))
 			}
 		}
 	}
+	if isNew && h.Has(key) { h.Keys=append(h.Keys, key) }
+	return key
 }
 
+
+// Parses a FITS floating point number, which may use D as exponent character
+func parseFITSFloat(b []byte) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(string(b), "D", "E", 1), 64)
+}
+
+
+// Parses the inner part of a quoted FITS string. Unescapes double single quotes 
+// and removes trailing spaces, which are not significant
+func parseFITSString(b []byte) string {
+	return strings.TrimRight(strings.Replace(string(b), "''", "'", -1), " ")
+}
+
+
 func (h *FITSHeader) Print() {
 	fmt.Printf("Bools   : %v\n", h.Bools)
 	fmt.Printf("Ints    : %v\n", h.Ints)
 	fmt.Printf("Floats  : %v\n", h.Floats)
 	fmt.Printf("Strings : %v\n", h.Strings)
 	fmt.Printf("Dates   : %v\n", h.Dates)
+	fmt.Printf("Complex : %v\n", h.Complexes)
 	fmt.Printf("History : %v\n", h.History)
 	fmt.Printf("Comments: %v\n", h.Comments)
 	fmt.Printf("End     : %v\n", h.End)
 }
 
 
-// Build regexp parser for FITS header lines
+// Build regexp parser for FITS header lines, following the FITS 4.0 keyword value grammar
 func compileRE() *regexp.Regexp {
 	white   :="\\s+"
 	whiteOpt:="\\s*"
@@ -410,31 +648,40 @@ func compileRE() *regexp.Regexp {
 
 	hist    :="HISTORY"
 	rest    :=".*"
-	histLine:=hist + white +"(?P<H>"+ rest +")"
+	histLine:=hist + "(?:" + white +"(?P<H>"+ rest +"))?"
 
 	commKey :="COMMENT"
-	commLine:=commKey + white + "(?P<C>"+ rest +")" 
+	commLine:=commKey + "(?:" + white + "(?P<C>"+ rest +"))?" 
+	blankKeyLine:="        (?P<C>"+ rest +")" // commentary without keyword
 
 	end     :="(?P<E>END)"
 	endLine :=end + whiteOpt
 
-	key     :="(?P<k>[A-Z0-9_-]+)"
+	key     :="(?:HIERARCH"+ white +"(?P<k>[^=]*[^=\\s])|(?P<k>[A-Z0-9_-]+))" // HIERARCH as written by N.I.N.A., SharpCap, ESO
 	equals  :="="
 
 	boo     :="(?P<b>[TF])"
 	inte    :="(?P<i>[+-]?[0-9]+)"
-    floa    :="(?P<f>[+-]?[0-9]*\\.[0-9]*(?:[ED][-+]?[0-9]+)?)"
-    stri    :="'(?P<s>[^']*)'"
-    date    :="(?P<d>[0-9]{1,4}-?[012][0-9]-?[0123][0-9]T[012][0-9]:?[0-5][0-9]:?[0-5][0-9].?[0-9]*)" // FIXME: other variants possible, see ISO8601
-    val     :="(?:"+ boo +"|"+ inte +"|"+ floa +"|"+ stri +"|"+ date +")"
+	num     :="[+-]?(?:[0-9]+\\.?[0-9]*|\\.[0-9]+)(?:[ED][-+]?[0-9]+)?"
+	floa    :="(?P<f>[+-]?(?:[0-9]*\\.[0-9]*(?:[ED][-+]?[0-9]+)?|[0-9]+[ED][-+]?[0-9]+))"
+	cplx    :="\\("+ whiteOpt +"(?P<x>"+ num +")"+ whiteOpt +","+ whiteOpt +"(?P<y>"+ num +")"+ whiteOpt +"\\)"
+	stri    :="'(?P<s>(?:[^']|'')*)'"
+	date    :="(?P<d>"+ dateRE +")" // unquoted, not strictly FITS compliant
+	val     :="(?:"+ boo +"|"+ inte +"|"+ floa +"|"+ cplx +"|"+ stri +"|"+ date +")?" // value may be undefined
 
-    // missing: CONTINUE for strings
-    // missing: complex int: (nr, nr)
-    // missing: complex float: (nr, nr)
+	commOpt :="(?:/(?P<c>.*))?"
+	keyLine :=key + whiteOpt + equals + whiteOpt + val + whiteOpt + commOpt
 
-    commOpt :="(?:/(?P<c>.*))?"
-    keyLine :=key + whiteOpt + equals + whiteOpt + val + whiteOpt + commOpt
+	cont    :="CONTINUE"
+	contLine:=cont + whiteOpt + "'(?P<n>(?:[^']|'')*)'" + whiteOpt + commOpt // long string continuation
 
-    lineRe  :="^(?:" + whiteLine +"|"+ histLine +"|"+ commLine +"|"+ keyLine +"|"+ endLine +")$"
-    return regexp.MustCompile(lineRe)
+	lineRe  :="^(?:" + whiteLine +"|"+ histLine +"|"+ commLine +"|"+ keyLine +"|"+ contLine +"|"+ endLine +"|"+ blankKeyLine +")$"
+	return regexp.MustCompile(lineRe)
 }
+
+
+// ISO8601 date and time as used in FITS, optionally without separators
+const dateRE="[0-9]{4}-?[01][0-9]-?[0-3][0-9](?:T[012][0-9]:?[0-5][0-9]:?[0-6][0-9](?:\\.[0-9]*)?)?Z?"
+
+// Matches dates in quoted FITS strings: ISO8601 with separators, and the deprecated DD/MM/YY format
+var reQuotedDate=regexp.MustCompile("^(?:[0-9]{4}-[01][0-9]-[0-3][0-9](?:T[012][0-9]:[0-5][0-9]:[0-6][0-9](?:\\.[0-9]*)?)?Z?|[0-3][0-9]/[01][0-9]/[0-9]{2})$")
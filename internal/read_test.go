@@ -0,0 +1,228 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Header cards as written by N.I.N.A. and SharpCap, plus cards exercising the rest of the FITS 4.0 value grammar
+var realWorldHeader=[]string{
+	"SIMPLE  =                    T / C# FITS",
+	"BITPIX  =                   16 /",
+	"NAXIS   =                    2 / Dimensionality",
+	"NAXIS1  =                    4 /",
+	"NAXIS2  =                    2 /",
+	"BZERO   =                32768 /",
+	"EXTEND  =                    T / Extensions are permitted",
+	"IMAGETYP= 'LIGHT'              / Type of exposure",
+	"EXPOSURE=                 300. / [s] Exposure duration",
+	"DATE-LOC= '2020-09-18T22:51:47.925' / Time of observation (local)",
+	"DATE-OBS= '2020-09-18T20:51:47.925' / Time of observation (UTC)",
+	"DATE-END= '2020-09-18'",
+	"DATE    = '18/09/20'           / deprecated date format",
+	"XBINNING=                    1 / X axis binning factor",
+	"GAIN    =                  139 / Sensor gain",
+	"XPIXSZ  =                 3.76 / [um] Pixel X axis size",
+	"INSTRUME= 'ZWO ASI294MC Pro'   / Imaging instrument name",
+	"SET-TEMP=                 -10. / [degC] CCD temperature setpoint",
+	"CCD-TEMP=                -10.1 / [degC] CCD temperature",
+	"BAYERPAT= 'RGGB'               / Sensor Bayer pattern",
+	"OBJECT  = 'M 42'               / Name of the object of interest",
+	"OBSERVER= 'Patrick O''Brian'   / escaped quote",
+	"SWCREATE= 'N.I.N.A. 1.10.0.0 (x64)' / Software that created this file",
+	"ROWORDER= 'TOP-DOWN'           / FITS Image Orientation",
+	"HIERARCH NINA ROTATOR ANGLE = 123.5 / [deg] Rotator angle",
+	"HIERARCH SharpCap.Temperature = 'cooled to -10C' /",
+	"BIGINT  =           4294967296 / beyond int32 range",
+	"DFLOAT  =            1.234D+02 / D exponent",
+	"EFLOAT  =                 1E-3 / exponent without decimal point",
+	"CPLXINT =              (1, -2) / complex integer",
+	"CPLXFLT =   (1.5E3 , -2.25D-1) / complex float",
+	"UNDEF   =                      / undefined value",
+	"LONGSTR = 'This is a long string value which is continued over several car&'",
+	"CONTINUE  'ds using the OGIP long string convention, with ''quotes''&' / first",
+	"CONTINUE  '' / second",
+	"COMMENT   This is a comment",
+	"        Blank keyword commentary",
+	"HISTORY Processed with some software",
+	"END",
+}
+
+// Builds a FITS file from the given header cards and 16-bit data
+func buildFITS(cards []string, data []int16) []byte {
+	var b bytes.Buffer
+	for _, c:=range cards {
+		fmt.Fprintf(&b, "%-80s", c)
+	}
+	for b.Len()%fitsBlockSize!=0 { b.WriteByte(' ') }
+	for _, d:=range data {
+		b.WriteByte(byte(uint16(d)>>8))
+		b.WriteByte(byte(uint16(d)))
+	}
+	for b.Len()%fitsBlockSize!=0 { b.WriteByte(0) }
+	return b.Bytes()
+}
+
+func TestReadHeaderRealWorld(t *testing.T) {
+	f:=NewFITSImage()
+	err:=f.Read(bytes.NewReader(buildFITS(realWorldHeader, []int16{0, 1, 2, 3, -4, -5, -6, -7})))
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	h:=&f.Header
+
+	if f.Exposure!=300 { t.Errorf("Exposure=%f; want 300", f.Exposure) }
+	if f.Data[4]!=32768-4 { t.Errorf("Data[4]=%f; want %d", f.Data[4], 32768-4) }
+
+	wantStrings:=map[string]string{
+		"IMAGETYP":"LIGHT", "INSTRUME":"ZWO ASI294MC Pro", "OBSERVER":"Patrick O'Brian",
+		"SWCREATE":"N.I.N.A. 1.10.0.0 (x64)", "SharpCap.Temperature":"cooled to -10C",
+		"LONGSTR":"This is a long string value which is continued over several cards using the OGIP long string convention, with 'quotes'",
+	}
+	for k, want:=range wantStrings {
+		if got:=h.Strings[k]; got!=want { t.Errorf("Strings[%s]='%s'; want '%s'", k, got, want) }
+	}
+	wantDates:=map[string]string{
+		"DATE-LOC":"2020-09-18T22:51:47.925", "DATE-OBS":"2020-09-18T20:51:47.925", "DATE-END":"2020-09-18", "DATE":"18/09/20",
+	}
+	for k, want:=range wantDates {
+		if got:=h.Dates[k]; got!=want { t.Errorf("Dates[%s]='%s'; want '%s'", k, got, want) }
+	}
+	wantFloats:=map[string]float64{
+		"EXPOSURE":300, "XPIXSZ":3.76, "SET-TEMP":-10, "CCD-TEMP":-10.1, "NINA ROTATOR ANGLE":123.5,
+		"BIGINT":4294967296, "DFLOAT":123.4, "EFLOAT":0.001,
+	}
+	for k, want:=range wantFloats {
+		if got, ok:=h.Floats[k]; !ok || got!=want { t.Errorf("Floats[%s]=%g; want %g", k, got, want) }
+	}
+	if got:=h.Ints["GAIN"]; got!=139 { t.Errorf("Ints[GAIN]=%d; want 139", got) }
+	if got:=h.Complexes["CPLXINT"]; got!=complex(1, -2) { t.Errorf("Complexes[CPLXINT]=%v; want (1-2i)", got) }
+	if got:=h.Complexes["CPLXFLT"]; got!=complex(1500, -0.225) { t.Errorf("Complexes[CPLXFLT]=%v; want (1500-0.225i)", got) }
+	if h.Has("UNDEF") { t.Errorf("Has(UNDEF)=true; want false") }
+	if got:=h.KeyComments["LONGSTR"]; got!="first second" { t.Errorf("KeyComments[LONGSTR]='%s'; want 'first second'", got) }
+	if got:=h.KeyComments["OBSERVER"]; got!="escaped quote" { t.Errorf("KeyComments[OBSERVER]='%s'; want 'escaped quote'", got) }
+	if !equalStrings(h.Comments, []string{"This is a comment", "Blank keyword commentary"}) { t.Errorf("Comments=%v", h.Comments) }
+	if !equalStrings(h.History, []string{"Processed with some software"}) { t.Errorf("History=%v", h.History) }
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	f:=NewFITSImage()
+	err:=f.Read(bytes.NewReader(buildFITS(realWorldHeader, []int16{0, 1, 2, 3, -4, -5, -6, -7})))
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	f.Header.SetString("LONGQUOT", strings.Repeat("'", 100), "quotes across continuation boundaries")
+
+	var b bytes.Buffer
+	err=f.Write(&b)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if b.Len()%fitsBlockSize!=0 { t.Errorf("len=%d; want multiple of %d", b.Len(), fitsBlockSize) }
+
+	g:=NewFITSImage()
+	err=g.Read(bytes.NewReader(b.Bytes()))
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	for i:=range f.Data {
+		if g.Data[i]!=f.Data[i] { t.Errorf("Data[%d]=%f; want %f", i, g.Data[i], f.Data[i]) }
+	}
+
+	// Structural keys are rewritten from the image, so compare everything else
+	fh, gh:=&f.Header, &g.Header
+	for _, k:=range fh.Keys {
+		if isStructuralKey(k) { continue }
+		if !gh.Has(k) { t.Errorf("key %s missing after round trip", k); continue }
+		if fh.Bools[k]!=gh.Bools[k] || fh.Ints[k]!=gh.Ints[k] || fh.Floats[k]!=gh.Floats[k] || fh.Strings[k]!=gh.Strings[k] ||
+		   fh.Dates[k]!=gh.Dates[k] || fh.Complexes[k]!=gh.Complexes[k] {
+			t.Errorf("value of %s differs after round trip", k)
+		}
+		if fh.KeyComments[k]!=gh.KeyComments[k] { t.Errorf("KeyComments[%s]='%s'; want '%s'", k, gh.KeyComments[k], fh.KeyComments[k]) }
+	}
+	if !equalStrings(gh.Comments, fh.Comments) { t.Errorf("Comments=%v; want %v", gh.Comments, fh.Comments) }
+	if !equalStrings(gh.History,  fh.History ) { t.Errorf("History=%v; want %v", gh.History, fh.History) }
+}
+
+func TestReadBscaleBlank(t *testing.T) {
+	cards:=[]string{
+		"SIMPLE  =                    T",
+		"BITPIX  =                   16",
+		"NAXIS   =                    1",
+		"NAXIS1  =                    4",
+		"BZERO   =                 100.",
+		"BSCALE  =                  0.5",
+		"BLANK   =               -32768",
+		"END",
+	}
+	f:=NewFITSImage()
+	err:=f.Read(bytes.NewReader(buildFITS(cards, []int16{0, 10, -32768, -10})))
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	want:=[]float32{100, 105, 0, 95}
+	for i, w:=range want {
+		if i==2 {
+			if f.Data[i]==f.Data[i] { t.Errorf("Data[%d]=%f; want NaN", i, f.Data[i]) }
+		} else if f.Data[i]!=w { t.Errorf("Data[%d]=%f; want %f", i, f.Data[i], w) }
+	}
+	if f.Bzero!=0 || f.Bscale!=1 { t.Errorf("Bzero=%f Bscale=%f; want 0 1", f.Bzero, f.Bscale) }
+}
+
+func TestReadHDUs(t *testing.T) {
+	primary:=buildFITS([]string{
+		"SIMPLE  =                    T", "BITPIX  =                   16", "NAXIS   =                    0",
+		"EXTEND  =                    T", "INSTRUME= 'Camera'", "END",
+	}, nil)
+	ext1:=buildFITS([]string{
+		"XTENSION= 'IMAGE   '", "BITPIX  =                   16", "NAXIS   =                    1", "NAXIS1  =                    3",
+		"PCOUNT  =                    0", "GCOUNT  =                    1", "EXTNAME = 'RAW'", "INHERIT =                    T", "END",
+	}, []int16{1, 2, 3})
+	ext2:=buildFITS([]string{
+		"XTENSION= 'IMAGE   '", "BITPIX  =                   16", "NAXIS   =                    1", "NAXIS1  =                    2",
+		"PCOUNT  =                    0", "GCOUNT  =                    1", "EXTNAME = 'SCI'", "END",
+	}, []int16{7, 8})
+	file:=append(append(append([]byte{}, primary...), ext1...), ext2...)
+
+	tests:=[]struct{ hdu string; want []float32; inherited bool }{
+		{ "",    []float32{1, 2, 3}, true  },
+		{ "1",   []float32{1, 2, 3}, true  },
+		{ "SCI", []float32{7, 8},    false },
+		{ "2",   []float32{7, 8},    false },
+	}
+	for _, test:=range tests {
+		f:=NewFITSImage()
+		err:=f.ReadHDU(bytes.NewReader(file), test.hdu)
+		if err!=nil { t.Errorf("hdu %s: err=%s; want nil", test.hdu, err); continue }
+		if len(f.Data)!=len(test.want) { t.Errorf("hdu %s: len(Data)=%d; want %d", test.hdu, len(f.Data), len(test.want)); continue }
+		for i:=range test.want {
+			if f.Data[i]!=test.want[i] { t.Errorf("hdu %s: Data[%d]=%f; want %f", test.hdu, i, f.Data[i], test.want[i]) }
+		}
+		if f.Header.Has("INSTRUME")!=test.inherited { t.Errorf("hdu %s: Has(INSTRUME)=%v; want %v", test.hdu, !test.inherited, test.inherited) }
+	}
+
+	f:=NewFITSImage()
+	if err:=f.ReadHDU(bytes.NewReader(file), "3"); err==nil { t.Errorf("hdu 3: err=nil; want not found") }
+	if name, hdu:=SplitHDUSuffix("dir/img.fits.gz[SCI]"); name!="dir/img.fits.gz" || hdu!="SCI" { 
+		t.Errorf("SplitHDUSuffix=%s, %s; want dir/img.fits.gz, SCI", name, hdu) 
+	}
+	if name, hdu:=SplitHDUSuffix("light[12]"); name!="light[12]" || hdu!="" { 
+		t.Errorf("SplitHDUSuffix=%s, %s; want light[12], empty", name, hdu) 
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a)!=len(b) { return false }
+	for i:=range a {
+		if a[i]!=b[i] { return false }
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// Per-frame row of a session report
+type FrameReport struct {
+	ID           int       `json:"id"`
+	File         string    `json:"file"`
+	Time         string    `json:"time"`          // Observation start from DATE-OBS, if any
+	Filter       string    `json:"filter"`
+	Exposure     float32   `json:"exposure"`      // Exposure in seconds
+	Location     float32   `json:"location"`
+	Scale        float32   `json:"scale"`
+	Noise        float32   `json:"noise"`
+	Stars        int32     `json:"stars"`
+	HFR          float32   `json:"hfr"`
+	FWHM         float32   `json:"fwhm"`          // Median PSF FWHM in pixels, zero without PSF fitting
+	Eccentricity float32   `json:"eccentricity"`  // Median PSF eccentricity, zero without PSF fitting
+	Altitude     float32   `json:"altitude"`      // Object altitude in degrees from OBJCTALT, zero if unknown
+	Airmass      float32   `json:"airmass"`       // Airmass from AIRMASS, zero if unknown
+
+	time         time.Time
+}
+
+// Creates a report row for a preprocessed frame
+func NewFrameReport(f *FITSImage) FrameReport {
+	r:=FrameReport{ID:f.ID, File:f.FileName, Filter:strings.TrimSpace(f.Header.Strings["FILTER"]), Exposure:f.Exposure, 
+	               Stars:int32(len(f.Stars)), HFR:f.HFR}
+	if f.Stats!=nil { r.Location, r.Scale, r.Noise=f.Stats.Location, f.Stats.Scale, f.Stats.Noise }
+	if f.PSF!=nil   { r.FWHM, r.Eccentricity=f.PSF.FWHM, f.PSF.Eccentricity }
+	r.Altitude, _=f.Header.floatValue("OBJCTALT")
+	r.Airmass,  _=f.Header.floatValue("AIRMASS")
+	if t, ok:=f.Header.Dates["DATE-OBS"]; ok {
+		r.Time=t
+		r.time=parseFITSTime(t)
+	}
+	return r
+}
+
+// Parses a FITS date and time value, returning the zero time if it is not valid
+func parseFITSTime(s string) time.Time {
+	for _, layout:=range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err:=time.Parse(layout, strings.TrimSpace(s)); err==nil { return t }
+	}
+	return time.Time{}
+}
+
+// Sorts report rows by observation time if all rows have one, else by ID
+func SortFrameReports(rows []FrameReport) {
+	byTime:=true
+	for _, r:=range rows {
+		if r.time.IsZero() { byTime=false }
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if byTime { return rows[i].time.Before(rows[j].time) }
+		return rows[i].ID<rows[j].ID
+	})
+}
+
+
+// Writes a session report to the given file, in CSV, JSON or HTML format depending on its suffix
+func WriteReport(fileName string, rows []FrameReport) error {
+	f, err:=os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err!=nil { return err }
+	defer f.Close()
+
+	lower:=strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".csv"):  return WriteReportCSV(f, rows)
+	case strings.HasSuffix(lower, ".json"): return WriteReportJSON(f, rows)
+	case strings.HasSuffix(lower, ".html") || strings.HasSuffix(lower, ".htm"): return WriteReportHTML(f, rows)
+	}
+	return errors.New("Unknown report format for "+fileName+", use .csv, .json or .html")
+}
+
+var reportColumns=[]string{"ID", "File", "Time", "Filter", "Exposure", "Location", "Scale", "Noise", "Stars", "HFR", "FWHM", "Eccentricity", "Altitude", "Airmass"}
+
+// Returns the report row as strings, in the order of reportColumns
+func (r *FrameReport) fields() []string {
+	return []string{fmt.Sprintf("%d", r.ID), r.File, r.Time, r.Filter, fmt.Sprintf("%g", r.Exposure), 
+		fmt.Sprintf("%.6g", r.Location), fmt.Sprintf("%.6g", r.Scale), fmt.Sprintf("%.4g", r.Noise), fmt.Sprintf("%d", r.Stars), 
+		fmt.Sprintf("%.4g", r.HFR), fmt.Sprintf("%.4g", r.FWHM), fmt.Sprintf("%.4g", r.Eccentricity), 
+		fmt.Sprintf("%.4g", r.Altitude), fmt.Sprintf("%.4g", r.Airmass)}
+}
+
+// Writes the report rows as CSV with a header line
+func WriteReportCSV(w io.Writer, rows []FrameReport) error {
+	cw:=csv.NewWriter(w)
+	cw.Write(reportColumns)
+	for i:=range rows { cw.Write(rows[i].fields()) }
+	cw.Flush()
+	return cw.Error()
+}
+
+// Writes the report rows as a JSON array
+func WriteReportJSON(w io.Writer, rows []FrameReport) error {
+	enc:=json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+
+// A chart of one metric in the HTML report
+type reportChart struct {
+	Title string
+	Value func(r *FrameReport) float32
+}
+
+var reportCharts=[]reportChart{
+	{"Background location", func(r *FrameReport) float32 { return r.Location }},
+	{"Noise",               func(r *FrameReport) float32 { return r.Noise }},
+	{"Stars",               func(r *FrameReport) float32 { return float32(r.Stars) }},
+	{"HFR (pixels)",        func(r *FrameReport) float32 { return r.HFR }},
+	{"FWHM (pixels)",       func(r *FrameReport) float32 { return r.FWHM }},
+	{"Eccentricity",        func(r *FrameReport) float32 { return r.Eccentricity }},
+	{"Altitude (degrees)",  func(r *FrameReport) float32 { return r.Altitude }},
+}
+
+var reportColors=[]string{"#1f77b4", "#d62728", "#2ca02c", "#9467bd", "#ff7f0e", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// Writes a self-contained HTML report with one SVG chart per metric over time, one series per filter, 
+// followed by the table of all rows. Charts of metrics which are zero for all frames are omitted
+func WriteReportHTML(w io.Writer, rows []FrameReport) error {
+	// x axis in hours since the first frame if all frames have times, else frame ID
+	byTime:=len(rows)>0
+	for _, r:=range rows {
+		if r.time.IsZero() { byTime=false }
+	}
+	xs:=make([]float64, len(rows))
+	for i, r:=range rows {
+		if byTime { xs[i]=r.time.Sub(rows[0].time).Hours() } else { xs[i]=float64(r.ID) }
+	}
+	xLabel:="frame"
+	if byTime { xLabel="hours since "+rows[0].time.Format("2006-01-02 15:04:05")+" UTC" }
+
+	filters:=[]string{}
+	for _, r:=range rows {
+		found:=false
+		for _, f:=range filters { if f==r.Filter { found=true } }
+		if !found { filters=append(filters, r.Filter) }
+	}
+
+	b:=&strings.Builder{}
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Nightlight session report</title>\n")
+	b.WriteString("<style>body{font-family:sans-serif;margin:2em} svg{display:block;margin-bottom:1.5em} table{border-collapse:collapse;font-size:90%} td,th{border:1px solid #ccc;padding:2px 6px;text-align:right}</style>\n")
+	b.WriteString("</head><body>\n<h1>Nightlight session report</h1>\n")
+	fmt.Fprintf(b, "<p>%d frames", len(rows))
+	if byTime { fmt.Fprintf(b, " from %s to %s UTC", html.EscapeString(rows[0].Time), html.EscapeString(rows[len(rows)-1].Time)) }
+	b.WriteString("</p>\n<p>")
+	for i, f:=range filters {
+		name:=f
+		if name=="" { name="no filter" }
+		fmt.Fprintf(b, "<span style=\"color:%s\">&#9679; %s</span> ", reportColors[i%len(reportColors)], html.EscapeString(name))
+	}
+	b.WriteString("</p>\n")
+
+	for _, c:=range reportCharts {
+		writeReportChart(b, rows, xs, xLabel, filters, c)
+	}
+
+	b.WriteString("<table>\n<tr>")
+	for _, col:=range reportColumns { fmt.Fprintf(b, "<th>%s</th>", col) }
+	b.WriteString("</tr>\n")
+	for i:=range rows {
+		b.WriteString("<tr>")
+		for _, v:=range rows[i].fields() { fmt.Fprintf(b, "<td>%s</td>", html.EscapeString(v)) }
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</table>\n</body></html>\n")
+
+	_, err:=io.WriteString(w, b.String())
+	return err
+}
+
+// Writes an SVG line chart of the given metric, unless it is zero for all rows
+func writeReportChart(b *strings.Builder, rows []FrameReport, xs []float64, xLabel string, filters []string, c reportChart) {
+	const width, height, left, right, top, bottom=800.0, 200.0, 60.0, 10.0, 25.0, 35.0
+	minX, maxX, minY, maxY:=math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	nonZero:=false
+	for i:=range rows {
+		y:=float64(c.Value(&rows[i]))
+		if y!=0 { nonZero=true }
+		minX, maxX=math.Min(minX, xs[i]), math.Max(maxX, xs[i])
+		minY, maxY=math.Min(minY, y), math.Max(maxY, y)
+	}
+	if !nonZero { return }
+	if maxX==minX { minX, maxX=minX-1, maxX+1 }
+	if maxY==minY { minY, maxY=minY-1, maxY+1 }
+	px:=func(x float64) float64 { return left+(x-minX)/(maxX-minX)*(width-left-right) }
+	py:=func(y float64) float64 { return height-bottom-(y-minY)/(maxY-minY)*(height-top-bottom) }
+
+	fmt.Fprintf(b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%g\" height=\"%g\" font-size=\"11\">\n", width, height)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"15\" font-size=\"13\" font-weight=\"bold\">%s</text>\n", left, html.EscapeString(c.Title))
+	fmt.Fprintf(b, "<rect x=\"%g\" y=\"%g\" width=\"%g\" height=\"%g\" fill=\"none\" stroke=\"#999\"/>\n", left, top, width-left-right, height-top-bottom)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"%g\" text-anchor=\"end\">%.4g</text>\n", left-4, top+4, maxY)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"%g\" text-anchor=\"end\">%.4g</text>\n", left-4, height-bottom, minY)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"%g\">%.4g</text>\n", left, height-bottom+14, minX)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"%g\" text-anchor=\"end\">%.4g</text>\n", width-right, height-bottom+14, maxX)
+	fmt.Fprintf(b, "<text x=\"%g\" y=\"%g\" text-anchor=\"middle\">%s</text>\n", (width+left-right)/2, height-4, html.EscapeString(xLabel))
+
+	for fi, f:=range filters {
+		color:=reportColors[fi%len(reportColors)]
+		points:=[]string{}
+		for i:=range rows {
+			if rows[i].Filter!=f { continue }
+			x, y:=px(xs[i]), py(float64(c.Value(&rows[i])))
+			points=append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+			fmt.Fprintf(b, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"2.5\" fill=\"%s\"><title>%d %s: %.4g</title></circle>\n", 
+				x, y, color, rows[i].ID, html.EscapeString(rows[i].File), c.Value(&rows[i]))
+		}
+		if len(points)>1 {
+			fmt.Fprintf(b, "<polyline points=\"%s\" fill=\"none\" stroke=\"%s\" stroke-width=\"1\"/>\n", strings.Join(points, " "), color)
+		}
+	}
+	b.WriteString("</svg>\n")
+}
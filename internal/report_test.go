@@ -0,0 +1,54 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFrameReport(t *testing.T) {
+	rows:=make([]FrameReport, 2)
+	for i:=range rows {
+		f:=NewFITSImage()
+		f.ID, f.FileName, f.Exposure=1-i, "light.fits", 120
+		f.Stars, f.HFR=make([]Star, 10*(i+1)), 2.5
+		f.Stats=&BasicStats{Location:1000, Scale:20, Noise:5}
+		f.Header.SetString("FILTER", "Ha", "")
+		f.Header.SetDate("DATE-OBS", []string{"2020-09-18T21:00:00.5", "2020-09-18T20:00:00"}[i], "")
+		rows[i]=NewFrameReport(&f)
+	}
+	SortFrameReports(rows)
+	if rows[0].Stars!=20 { t.Errorf("rows[0].Stars=%d; want 20 from the earlier frame", rows[0].Stars) }
+
+	var b bytes.Buffer
+	if err:=WriteReportCSV(&b, rows); err!=nil { t.Fatalf("err=%s", err) }
+	lines:=strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines)!=3 { t.Fatalf("CSV lines=%d; want 3", len(lines)) }
+	if want:="0,light.fits,2020-09-18T20:00:00,Ha,120,1000,20,5,20,2.5,0,0,0,0"; lines[1]!=want { t.Errorf("CSV line=%s; want %s", lines[1], want) }
+
+	b.Reset()
+	if err:=WriteReportJSON(&b, rows); err!=nil { t.Fatalf("err=%s", err) }
+	var decoded []FrameReport
+	if err:=json.Unmarshal(b.Bytes(), &decoded); err!=nil || len(decoded)!=2 || decoded[1].Time!=rows[1].Time { t.Errorf("JSON=%s, err=%v", b.String(), err) }
+
+	b.Reset()
+	if err:=WriteReportHTML(&b, rows); err!=nil { t.Fatalf("err=%s", err) }
+	if n:=strings.Count(b.String(), "<svg"); n!=4 { t.Errorf("charts=%d; want 4 for the nonzero metrics", n) }
+}
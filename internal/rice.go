@@ -0,0 +1,212 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// Rice compression and decompression as used by the FITS tiled image compression convention.
+// Bitstream compatible with the reference implementation in CFITSIO, fits_rcomp() and fits_rdecomp().
+
+
+// Returns the Rice coding parameters for values with the given number of bytes:
+// the number of bits for coding the split position, its maximum value, and the bits per value
+func riceParams(bytePix int) (fsBits, fsMax, bBits uint, err error) {
+	switch bytePix {
+	case 1: return 3,  6,  8, nil
+	case 2: return 4, 14, 16, nil
+	case 4: return 5, 25, 32, nil
+	}
+	return 0, 0, 0, errors.New("Unsupported Rice BYTEPIX value")
+}
+
+
+// Compresses the given values with the Rice algorithm, using the given block size.
+// Values are truncated to the given number of bytes
+func riceCompress(values []int32, blockSize, bytePix int) ([]byte, error) {
+	fsBits, fsMax, bBits, err:=riceParams(bytePix)
+	if err!=nil { return nil, err }
+	if len(values)==0 { return []byte{}, nil }
+
+	// first value is written uncompressed
+	w:=bitWriter{buf:make([]byte, 0, len(values)*bytePix/2+16)}
+	lastPix:=values[0]
+	w.write(uint32(lastPix), bBits)
+
+	diffs:=make([]uint32, blockSize)
+	shift:=32-bBits
+	for i:=0; i<len(values); i+=blockSize {
+		block:=values[i:]
+		if len(block)>blockSize { block=block[:blockSize] }
+
+		// map signed differences of the block to non-negative values
+		pixelSum:=float64(0)
+		for j, v:=range block {
+			d:=((v-lastPix)<<shift)>>shift // wrap to the value size
+			diffs[j]=uint32((d<<1)^(d>>31))
+			pixelSum+=float64(diffs[j])
+			lastPix=v
+		}
+
+		// find optimal split position fs from the average difference
+		dpSum:=(pixelSum-float64(len(block)/2)-1)/float64(len(block))
+		if dpSum<0 { dpSum=0 }
+		pSum:=uint32(dpSum)>>1
+		fs:=uint(0)
+		for ; pSum>0; fs++ { pSum>>=1 }
+
+		if fs>=fsMax {
+			// high entropy: differences written without coding
+			w.write(uint32(fsMax+1), fsBits)
+			for _, d:=range diffs[:len(block)] { w.write(d, bBits) }
+		} else if fs==0 && pixelSum==0 {
+			// low entropy: all differences are zero
+			w.write(0, fsBits)
+		} else {
+			// high bits of each difference in unary, low fs bits as is
+			w.write(uint32(fs+1), fsBits)
+			for _, d:=range diffs[:len(block)] {
+				for top:=d>>fs; ; top-=32 {
+					if top<32 { w.write(1, uint(top)+1); break }
+					w.write(0, 32)
+				}
+				if fs>0 { w.write(d, fs) }
+			}
+		}
+	}
+	w.flush()
+	return w.buf, nil
+}
+
+
+// Decompresses Rice compressed data into the given values, using the given block size and bytes per value.
+// Single byte values are unsigned, larger values are signed
+func riceDecompress(data []byte, values []int32, blockSize, bytePix int) error {
+	fsBits, fsMax, bBits, err:=riceParams(bytePix)
+	if err!=nil { return err }
+	if len(values)==0 { return nil }
+
+	r:=bitReader{data:data}
+	first, err:=r.read(bBits)
+	if err!=nil { return err }
+	lastPix:=first
+
+	shift:=32-bBits
+	for i:=0; i<len(values); {
+		fsVal, err:=r.read(fsBits)
+		if err!=nil { return err }
+		fs:=int(fsVal)-1
+		end:=i+blockSize
+		if end>len(values) { end=len(values) }
+
+		for ; i<end; i++ {
+			var d uint32
+			if fs<0 {
+				// low entropy: all differences are zero
+				d=0
+			} else if uint(fs)==fsMax {
+				// high entropy: differences without coding
+				d, err=r.read(bBits)
+				if err!=nil { return err }
+			} else {
+				top, err:=r.readUnary()
+				if err!=nil { return err }
+				low:=uint32(0)
+				if fs>0 {
+					low, err=r.read(uint(fs))
+					if err!=nil { return err }
+				}
+				d=(top<<uint(fs)) | low
+			}
+			// undo mapping to non-negative values, and add to the previous value
+			if d&1==0 { d>>=1 } else { d=^(d>>1) }
+			lastPix+=d
+			if bytePix==1 {
+				values[i]=int32(uint8(lastPix))
+			} else {
+				values[i]=int32(lastPix<<shift)>>shift
+			}
+		}
+	}
+	return nil
+}
+
+
+// Writes values with a given number of bits into a byte buffer, most significant bit first
+type bitWriter struct {
+	buf  []byte
+	acc  uint64   // bits not yet written to the buffer
+	n    uint     // number of valid bits in acc, always less than 8 between calls
+}
+
+func (w *bitWriter) write(value uint32, numBits uint) {
+	w.acc=(w.acc<<numBits) | (uint64(value) & ((1<<numBits)-1))
+	w.n+=numBits
+	for w.n>=8 {
+		w.n-=8
+		w.buf=append(w.buf, byte(w.acc>>w.n))
+	}
+	w.acc&=(1<<w.n)-1
+}
+
+// Writes remaining bits, padding the last byte with zeros
+func (w *bitWriter) flush() {
+	if w.n>0 { w.write(0, 8-w.n) }
+}
+
+
+// Reads values with a given number of bits from a byte buffer, most significant bit first
+type bitReader struct {
+	data []byte
+	pos  int      // position of the next byte to read
+	acc  uint64   // bits read from data, but not yet consumed
+	n    uint     // number of valid bits in acc
+}
+
+func (r *bitReader) read(numBits uint) (uint32, error) {
+	for r.n<numBits {
+		if r.pos>=len(r.data) { return 0, errors.New("Compressed data truncated") }
+		r.acc=(r.acc<<8) | uint64(r.data[r.pos])
+		r.pos++
+		r.n+=8
+	}
+	r.n-=numBits
+	v:=uint32(r.acc>>r.n)
+	r.acc&=(1<<r.n)-1
+	return v, nil
+}
+
+// Reads a unary coded value, i.e. counts the number of zero bits before the next one bit
+func (r *bitReader) readUnary() (uint32, error) {
+	zeros:=uint32(0)
+	for {
+		if r.acc==0 {
+			zeros+=uint32(r.n)
+			if r.pos>=len(r.data) { return 0, errors.New("Compressed data truncated") }
+			r.acc, r.n=uint64(r.data[r.pos]), 8
+			r.pos++
+			continue
+		}
+		l:=uint(bits.Len64(r.acc))
+		zeros+=uint32(r.n-l)
+		r.n=l-1
+		r.acc&=(1<<r.n)-1
+		return zeros, nil
+	}
+}
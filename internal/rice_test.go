@@ -0,0 +1,54 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRiceRoundTrip(t *testing.T) {
+	rng:=rand.New(rand.NewSource(42))
+	for _, bytePix:=range []int{1, 2, 4} {
+		bits:=uint(8*bytePix)
+		// blocks of low entropy, moderate noise, and full-range noise
+		values:=make([]int32, 1000)
+		for i:=range values {
+			switch {
+			case i<100: values[i]=17
+			case i<600: values[i]=int32(100+rng.Intn(40))
+			default:    values[i]=int32(rng.Uint32()>>(32-bits))
+			}
+			if bytePix==2 { values[i]=int32(int16(values[i])) }
+		}
+
+		data, err:=riceCompress(values, riceBlockSize, bytePix)
+		if err!=nil { t.Fatalf("bytePix %d: err=%s; want nil", bytePix, err) }
+		res:=make([]int32, len(values))
+		err=riceDecompress(data, res, riceBlockSize, bytePix)
+		if err!=nil { t.Fatalf("bytePix %d: err=%s; want nil", bytePix, err) }
+		for i:=range values {
+			if res[i]!=values[i] { t.Errorf("bytePix %d: res[%d]=%d; want %d", bytePix, i, res[i], values[i]); break }
+		}
+	}
+}
+
+func TestFITSRandoms(t *testing.T) {
+	// the 10000th seed of the sequence is fixed by the FITS standard to 1043618065
+	want:=float32(1043618065.0/2147483647.0)
+	if fitsRandoms[numFITSRandoms-1]!=want { t.Errorf("fitsRandoms[%d]=%f; want %f", numFITSRandoms-1, fitsRandoms[numFITSRandoms-1], want) }
+}
@@ -0,0 +1,250 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading of SER video files as recorded for planetary and lunar imaging. 
+// Spec here: http://www.grischa-hahn.homepage.t-online.de/astro/ser/SER%20Doc%20V3b.pdf
+// Frames are read one at a time, so captures larger than memory can be processed.
+
+const serHeaderSize=178   // Size of the fixed SER file header in bytes
+
+// SER color IDs for the arrangement of samples in a frame
+const (
+	SERMono      = 0
+	SERBayerRGGB = 8
+	SERBayerGRBG = 9
+	SERBayerGBRG = 10
+	SERBayerBGGR = 11
+	SERRGB       = 100
+	SERBGR       = 101
+)
+
+// Bayer patterns of the SER color IDs, for the BAYERPAT header value
+var serBayerPatterns=map[int32]string{ SERBayerRGGB:"RGGB", SERBayerGRBG:"GRBG", SERBayerGBRG:"GBRG", SERBayerBGGR:"BGGR" }
+
+// A SER video file opened for reading frames
+type SERReader struct {
+	FileName   string
+	ColorID    int32      // arrangement of samples, see SER color IDs
+	Width      int32      // frame width in pixels
+	Height     int32      // frame height in pixels
+	Depth      int32      // significant bits per sample, 1-8 stored in one byte, 9-16 in two
+	Frames     int32      // number of frames
+	Observer   string
+	Instrument string
+	Telescope  string
+	StartUTC   time.Time  // start of the capture
+
+	file       *os.File
+	bigEndian  bool       // byte order of 16-bit samples
+	trailer    bool       // file has a trailer with per-frame timestamps
+	next       int32      // index of the next frame returned by Next()
+}
+
+
+// Opens a SER file and reads its header. Frame data is read on demand
+func OpenSER(fileName string) (r *SERReader, err error) {
+	f, err:=os.Open(fileName)
+	if err!=nil { return nil, err }
+	r=&SERReader{FileName:fileName, file:f}
+	err=r.readHeader()
+	if err!=nil { f.Close(); return nil, err }
+	return r, nil
+}
+
+// Closes the underlying file
+func (r *SERReader) Close() error {
+	return r.file.Close()
+}
+
+// Reads and validates the fixed file header
+func (r *SERReader) readHeader() error {
+	h:=make([]byte, serHeaderSize)
+	_, err:=r.file.ReadAt(h, 0)
+	if err!=nil { return errors.New("Not a valid SER file; header truncated") }
+	if string(h[:14])!="LUCAM-RECORDER" { return errors.New("Not a valid SER file; signature missing") }
+
+	le:=binary.LittleEndian
+	r.ColorID=int32(le.Uint32(h[18:]))
+	// The spec defines zero as big endian, but most capture software writes little endian 
+	// samples with a zero flag. Follow the common interpretation of other readers
+	r.bigEndian=le.Uint32(h[22:])!=0
+	r.Width =int32(le.Uint32(h[26:]))
+	r.Height=int32(le.Uint32(h[30:]))
+	r.Depth =int32(le.Uint32(h[34:]))
+	r.Frames=int32(le.Uint32(h[38:]))
+	r.Observer  =serString(h[42:82])
+	r.Instrument=serString(h[82:122])
+	r.Telescope =serString(h[122:162])
+	r.StartUTC  =serTime(int64(le.Uint64(h[170:])))
+
+	if r.ColorID!=SERMono && r.ColorID!=SERRGB && r.ColorID!=SERBGR && serBayerPatterns[r.ColorID]=="" {
+		return errors.New(fmt.Sprintf("Unsupported SER color ID %d", r.ColorID))
+	}
+	if r.Width<=0 || r.Height<=0 || r.Frames<0 { return errors.New("Invalid SER frame dimensions") }
+	if r.Depth<1 || r.Depth>16 { return errors.New(fmt.Sprintf("Unsupported SER pixel depth %d", r.Depth)) }
+
+	stat, err:=r.file.Stat()
+	if err!=nil { return err }
+	dataEnd:=serHeaderSize+int64(r.Frames)*r.frameSize()
+	if stat.Size()<dataEnd { return errors.New("SER file truncated") }
+	r.trailer=stat.Size()>=dataEnd+8*int64(r.Frames)
+	return nil
+}
+
+// Returns the number of color planes per frame
+func (r *SERReader) planes() int32 {
+	if r.ColorID==SERRGB || r.ColorID==SERBGR { return 3 }
+	return 1
+}
+
+// Returns the number of bytes per sample
+func (r *SERReader) bytesPerSample() int32 {
+	if r.Depth>8 { return 2 }
+	return 1
+}
+
+// Returns the size of a frame in bytes
+func (r *SERReader) frameSize() int64 {
+	return int64(r.Width)*int64(r.Height)*int64(r.planes())*int64(r.bytesPerSample())
+}
+
+
+// Returns the next frame, or io.EOF after the last one
+func (r *SERReader) Next() (*FITSImage, error) {
+	if r.next>=r.Frames { return nil, io.EOF }
+	f, err:=r.Frame(r.next)
+	r.next++
+	return f, err
+}
+
+// Returns the frame with the given index
+func (r *SERReader) Frame(i int32) (*FITSImage, error) {
+	f:=NewFITSImage()
+	f.FileName=fmt.Sprintf("%s[%d]", r.FileName, i)
+	err:=r.readFrame(&f, i)
+	if err!=nil { return nil, err }
+	return &f, nil
+}
+
+// Reads the frame with the given index into the image. Color frames become 3-axis RGB cubes, 
+// Bayer frames are left for debayering and carry their pattern in the BAYERPAT header value
+func (r *SERReader) readFrame(fits *FITSImage, i int32) error {
+	if i<0 || i>=r.Frames { return errors.New(fmt.Sprintf("SER frame %d out of range 0-%d", i, r.Frames-1)) }
+	buf:=make([]byte, r.frameSize())
+	_, err:=r.file.ReadAt(buf, serHeaderSize+int64(i)*r.frameSize())
+	if err!=nil { return err }
+
+	planes:=r.planes()
+	fits.Naxisn=[]int32{r.Width, r.Height}
+	if planes>1 { fits.Naxisn=append(fits.Naxisn, planes) }
+	fits.Pixels=r.Width*r.Height*planes
+	fits.Bitpix=8*r.bytesPerSample()
+	fits.Bzero, fits.Bscale=0, 1
+	fits.Data=make([]float32, int(fits.Pixels))
+
+	// convert interleaved samples into planes. BGR frames store the planes in reverse order
+	var order binary.ByteOrder=binary.LittleEndian
+	if r.bigEndian { order=binary.BigEndian }
+	planeSize:=int(r.Width*r.Height)
+	for src:=0; src<int(fits.Pixels); src++ {
+		plane:=src%int(planes)
+		if r.ColorID==SERBGR { plane=2-plane }
+		dest:=plane*planeSize + src/int(planes)
+		if r.Depth>8 {
+			fits.Data[dest]=float32(order.Uint16(buf[2*src:]))
+		} else {
+			fits.Data[dest]=float32(buf[src])
+		}
+	}
+
+	// header values
+	fits.Header=NewFITSHeader()
+	h:=&fits.Header
+	if r.Observer  !="" { h.SetString("OBSERVER", r.Observer,   "Observer") }
+	if r.Instrument!="" { h.SetString("INSTRUME", r.Instrument, "Camera") }
+	if r.Telescope !="" { h.SetString("TELESCOP", r.Telescope,  "Telescope") }
+	if pattern, ok:=serBayerPatterns[r.ColorID]; ok {
+		h.SetString("BAYERPAT", pattern, "Bayer color filter array pattern")
+		h.SetString("ROWORDER", "TOP-DOWN", "Order of the rows in the image")
+	}
+	h.SetInt("FRAME", i, "Frame index in the SER file")
+	if t:=r.timestamp(i); !t.IsZero() {
+		h.SetDate("DATE-OBS", t.Format("2006-01-02T15:04:05.0000000"), "UTC time of the frame")
+	}
+	return nil
+}
+
+// Returns the UTC timestamp of the given frame from the trailer, or the start of the capture if unavailable
+func (r *SERReader) timestamp(i int32) time.Time {
+	if r.trailer {
+		buf:=make([]byte, 8)
+		_, err:=r.file.ReadAt(buf, serHeaderSize+int64(r.Frames)*r.frameSize()+8*int64(i))
+		if t:=serTime(int64(binary.LittleEndian.Uint64(buf))); err==nil && !t.IsZero() { return t }
+	}
+	return r.StartUTC
+}
+
+// Converts a SER timestamp in 100ns ticks since the start of year 1 into a UTC time. Zero yields the zero time
+func serTime(ticks int64) time.Time {
+	if ticks<=0 { return time.Time{} }
+	const ticksToUnix=62135596800*10000000
+	ticks-=ticksToUnix
+	return time.Unix(ticks/10000000, (ticks%10000000)*100).UTC()
+}
+
+// Returns a fixed-size string field of the SER header, trimming zero bytes and blanks
+func serString(b []byte) string {
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+
+// Reads a single frame of a SER file. The frame is selected by index, or the first one if empty
+func (fits *FITSImage) readSERFile(fileName, frame string) error {
+	r, err:=OpenSER(fileName)
+	if err!=nil { return err }
+	defer r.Close()
+	i:=0
+	if frame!="" {
+		i, err=strconv.Atoi(frame)
+		if err!=nil { return errors.New("Invalid SER frame index "+frame) }
+	}
+	return r.readFrame(fits, int32(i))
+}
+
+// Returns file names selecting each frame of the given SER file, like capture.ser[0] to capture.ser[n-1]
+func SERFrameNames(fileName string) (names []string, err error) {
+	r, err:=OpenSER(fileName)
+	if err!=nil { return nil, err }
+	defer r.Close()
+	names=make([]string, r.Frames)
+	for i:=range names {
+		names[i]=fmt.Sprintf("%s[%d]", fileName, i)
+	}
+	return names, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Writes a SER file with the given header fields, samples and timestamps to a temporary file
+func writeTestSER(t *testing.T, colorID, depth, width, height, frames int, samples []byte, times []int64) string {
+	h:=make([]byte, serHeaderSize)
+	copy(h, "LUCAM-RECORDER")
+	for i, v:=range []int{colorID, 0, width, height, depth, frames} {
+		binary.LittleEndian.PutUint32(h[18+4*i:], uint32(v))
+	}
+	copy(h[82:], "TestCam")
+	data:=append(h, samples...)
+	for _, ts:=range times {
+		b:=make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(ts))
+		data=append(data, b...)
+	}
+	f, err:=ioutil.TempFile("", "test*.ser")
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	if _, err:=f.Write(data); err!=nil { t.Fatal(err) }
+	return f.Name()
+}
+
+func TestSERBayer16(t *testing.T) {
+	// two 2x2 frames with 16-bit little endian samples
+	samples:=[]byte{1,0, 2,0, 3,0, 4,1,  5,0, 6,0, 7,0, 8,1}
+	ts:=int64(637488816000000000) // 2021-02-14T06:40:00Z
+	name:=writeTestSER(t, SERBayerGRBG, 12, 2, 2, 2, samples, []int64{ts, ts+5000000})
+	defer os.Remove(name)
+
+	names, err:=SERFrameNames(name)
+	if err!=nil || len(names)!=2 || names[1]!=name+"[1]" { t.Fatalf("names=%v, err=%v; want 2 frames", names, err) }
+
+	f:=NewFITSImage()
+	if err:=f.ReadFile(names[1]); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	for i, want:=range []float32{5, 6, 7, 264} {
+		if f.Data[i]!=want { t.Errorf("Data[%d]=%f; want %f", i, f.Data[i], want) }
+	}
+	if len(f.Naxisn)!=2 || f.Bitpix!=16 { t.Errorf("Naxisn=%v Bitpix=%d; want [2 2] 16", f.Naxisn, f.Bitpix) }
+	if got:=f.Header.Strings["BAYERPAT"]; got!="GRBG" { t.Errorf("BAYERPAT=%s; want GRBG", got) }
+	if got:=f.Header.Strings["INSTRUME"]; got!="TestCam" { t.Errorf("INSTRUME=%s; want TestCam", got) }
+	if got, want:=f.Header.Dates["DATE-OBS"], "2021-02-14T06:40:00.5000000"; got!=want { t.Errorf("DATE-OBS=%s; want %s", got, want) }
+	if err:=f.ReadFile(name+"[2]"); err==nil { t.Errorf("err=nil; want frame out of range") }
+}
+
+func TestSERBGR8(t *testing.T) {
+	// one 2x1 frame with interleaved blue, green and red samples, without trailer
+	name:=writeTestSER(t, SERBGR, 8, 2, 1, 1, []byte{1, 2, 3, 4, 5, 6}, nil)
+	defer os.Remove(name)
+
+	r, err:=OpenSER(name)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	defer r.Close()
+	f, err:=r.Next()
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if len(f.Naxisn)!=3 || f.Naxisn[2]!=3 { t.Errorf("Naxisn=%v; want [2 1 3]", f.Naxisn) }
+	for i, want:=range []float32{3, 6, 2, 5, 1, 4} {
+		if f.Data[i]!=want { t.Errorf("Data[%d]=%f; want %f", i, f.Data[i], want) }
+	}
+	if f.Header.Has("DATE-OBS") { t.Errorf("DATE-OBS=%s; want none", f.Header.Dates["DATE-OBS"]) }
+	if _, err=r.Next(); err!=io.EOF { t.Errorf("err=%v; want EOF", err) }
+}
@@ -164,7 +164,7 @@ func Stack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, si
 		Residual: 0,
 	}
 
-	stack.Stats, err=CalcExtendedStats(data, lights[0].Naxisn[0])
+	stack.Stats, err=CalcExtendedStats(stack.Luminance(), lights[0].Naxisn[0])
 	if err!=nil { return nil, -1, -1, err }
 
 	if mode>=StSigma {
@@ -753,7 +753,7 @@ func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float
 func StackIncremental(stack, light *FITSImage, weight float32) *FITSImage {
 	if stack==nil {
 		stack=&FITSImage{
-			Header: NewFITSHeader(),
+			Header: light.Header.Clone(),
 			Bitpix: -32,
 			Bzero : 0,
 			Naxisn: append([]int32(nil), light.Naxisn...), // clone slice
@@ -780,6 +780,6 @@ func StackIncremental(stack, light *FITSImage, weight float32) *FITSImage {
 func StackIncrementalFinalize(stack *FITSImage, weightSum float32) (err error) {
 	factor:=1.0/weightSum
 	for i,d:=range stack.Data { stack.Data[i]=d*factor }
-	stack.Stats, err=CalcExtendedStats(stack.Data, stack.Naxisn[0])
+	stack.Stats, err=CalcExtendedStats(stack.Luminance(), stack.Naxisn[0])
 	return err
 }
\ No newline at end of file
@@ -21,6 +21,10 @@ import (
 )
 
 
+var BiasF *nl.FITSImage=nil
 var DarkF *nl.FITSImage=nil
 var FlatF *nl.FITSImage=nil
 var AlignF *nl.FITSImage=nil
+var Library *nl.CalibrationLibrary=nil
+var Defects *nl.DefectMap=nil
+var Overscan *nl.OverscanMode=nil
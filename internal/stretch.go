@@ -21,14 +21,18 @@ import (
 )
 
 func Stretch(f *FITSImage, autoLoc, autoScale, midtone, midBlack, gamma, ppGamma, ppSigma, scaleBlack float32) {
-	// Normalize value range before applying stretches
+	// Normalize value range before applying stretches. Data cubes are normalized jointly across all planes
+	if f.NumPlanes()>1 {
+		all:=CalcBasicStats(f.Data)
+		f.Stats.Min, f.Stats.Max=all.Min, all.Max
+	}
 	if f.Stats.Min==f.Stats.Max {
 		LogPrintf("%d: Warning: Image is of uniform intensity %.4g, skipping normalization\n", f.ID, f.Stats.Min)
 	} else {
 		LogPrintf("%d: Normalizing from [%.4g,%.4g] to [0,1]\n", f.ID, f.Stats.Min, f.Stats.Max)
     	f.Normalize()
     	var err error
-		f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats, err=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { LogFatal(err) }
 	}
 
@@ -42,7 +46,7 @@ func Stretch(f *FITSImage, autoLoc, autoScale, midtone, midBlack, gamma, ppGamma
     if midtone!=0 {
     	LogPrintf("Applying midtone correction with midtone=%.2f%% x scale and black=location - %.2f%% x scale\n", midtone, midBlack)
 
-		stats,err:=CalcExtendedStats(f.Data, f.Naxisn[0])
+		stats,err:=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { LogFatal(err) }
 		loc, scale:=stats.Location, stats.Scale
 		absMid:=float32(midtone)*scale
@@ -59,7 +63,7 @@ func Stretch(f *FITSImage, autoLoc, autoScale, midtone, midBlack, gamma, ppGamma
 
 	// Optionally adjust gamma post peak
     if ppGamma!=1 {
-		stats,err:=CalcExtendedStats(f.Data, f.Naxisn[0])
+		stats,err:=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { LogFatal(err) }
 		loc, scale:=stats.Location, stats.Scale
 
@@ -73,7 +77,7 @@ func Stretch(f *FITSImage, autoLoc, autoScale, midtone, midBlack, gamma, ppGamma
     if scaleBlack!=0 {
     	targetBlack:=float32(scaleBlack)/100.0
 
-		stats,err:=CalcExtendedStats(f.Data, f.Naxisn[0])
+		stats,err:=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { LogFatal(err) }
 		loc, scale:=stats.Location, stats.Scale
 		LogPrintf("Location %.2f%% and scale %.2f%%: ", loc*100, scale*100)
@@ -99,7 +103,7 @@ func StretchIterative(f *FITSImage, targetLoc, targetScale float32) {
 
 		// calculate basic image stats as a fast location and scale estimate
 		var err error
-		f.Stats,err=CalcExtendedStats(f.Data, f.Naxisn[0])
+		f.Stats,err=CalcExtendedStats(f.Luminance(), f.Naxisn[0])
 		if err!=nil { LogFatal(err) }
 		loc, scale:=f.Stats.Location, f.Stats.Scale
 
@@ -0,0 +1,649 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FITS tiled image compression convention, as written by fpack and CFITSIO. The image is split into tiles,
+// and each tile is compressed into a row of a binary table extension with ZIMAGE=T.
+
+// Ensures the warning about OutputFormat not applying to tile compressed outputs is logged only once
+var warnCompressedFormat sync.Once
+
+const riceBlockSize  =32           // Default block size for Rice compression
+const zNullValue     =-2147483647  // Quantized value representing undefined pixels
+const zZeroValue     =-2147483646  // Quantized value representing exact zeros with SUBTRACTIVE_DITHER_2
+
+// Quantization level for lossy compression of floating point data. The quantization step is the
+// estimated noise of each tile divided by this value, so higher values preserve more precision
+var FZQuantLevel float32 = 4
+
+// Header keys of the binary table and the compression convention, which do not apply to the uncompressed image
+var reCompressionKey=regexp.MustCompile("^(?:TTYPE|TFORM|TUNIT|TDIM|TNULL|TSCAL|TZERO|TDISP|ZNAXIS|ZTILE|ZNAME|ZVAL)[0-9]+$")
+var compressionKeys=map[string]bool{
+	"TFIELDS":true, "THEAP":true, "ZIMAGE":true, "ZCMPTYPE":true, "ZBITPIX":true, "ZNAXIS":true, "ZQUANTIZ":true,
+	"ZDITHER0":true, "ZBLANK":true, "ZSIMPLE":true, "ZTENSION":true, "ZEXTEND":true, "ZPCOUNT":true, "ZGCOUNT":true,
+	"ZHECKSUM":true, "ZDATASUM":true, "ZMASKCMP":true,
+}
+
+// Parameters of a tile compressed image
+type tileCompression struct {
+	cmpType   string   // Compression algorithm: RICE_1, GZIP_1, GZIP_2 or NOCOMPRESS
+	blockSize int      // Rice block size
+	bytePix   int      // Rice bytes per value
+	quantize  string   // Quantization method for floating point data
+	dither0   int      // Dithering seed
+	zBlank    int32    // Value for undefined pixels, if hasZBlank
+	hasZBlank bool
+	tile      []int32  // Tile dimensions
+}
+
+// A column of a binary table
+type binTableColumn struct {
+	typ      byte    // Data type, e.g. B for bytes or D for doubles
+	arrayTyp byte    // Element type for variable length arrays with type P or Q
+	offset   int     // Byte offset within the row
+}
+
+var reTForm=regexp.MustCompile("^([0-9]*)([LXBIJKAEDCMPQ])([LXBIJKAEDCM]?)")
+
+// Byte widths of binary table data types. X is counted in bits
+var binTableWidths=map[byte]int{ 'L':1, 'X':1, 'B':1, 'I':2, 'J':4, 'K':8, 'A':1, 'E':4, 'D':8, 'C':8, 'M':16, 'P':8, 'Q':16 }
+
+
+// Returns true if the header describes a tile compressed image
+func (h *FITSHeader) isCompressedImage() bool {
+	return h.Strings["XTENSION"]=="BINTABLE" && h.Bools["ZIMAGE"]
+}
+
+
+// Reads a tile compressed image from the binary table following the header
+func (fits *FITSImage) readCompressedImage(f io.Reader) error {
+	h:=&fits.Header
+
+	// read binary table and heap
+	buf:=make([]byte, h.dataSize())
+	_, err:=io.ReadFull(f, buf)
+	if err!=nil { return err }
+	rowLen, rows:=int(h.Ints["NAXIS1"]), int(h.Ints["NAXIS2"])
+	heapStart:=rowLen*rows
+	if v, ok:=h.Ints["THEAP"]; ok { heapStart=int(v) }
+	if heapStart>len(buf) { return errors.New("Invalid THEAP value") }
+	heap:=buf[heapStart:]
+	cols, err:=h.binTableColumns()
+	if err!=nil { return err }
+
+	// collect compression parameters, then turn the header into the one of the uncompressed image
+	tc, err:=h.tileCompression()
+	if err!=nil { return err }
+	h.uncompressHeader()
+	fits.readHeaderValues()
+	if len(tc.tile)!=len(fits.Naxisn) { return errors.New("Invalid ZNAXIS or ZTILE values") }
+	fits.Data=make([]float32,int(fits.Pixels))
+
+	// integer images may mark undefined pixels with ZBLANK or BLANK
+	blank, hasBlank:=int64(tc.zBlank), tc.hasZBlank
+	if !hasBlank { blank, hasBlank=fits.blankValue() }
+
+	for r:=0; r<rows; r++ {
+		row:=buf[r*rowLen:(r+1)*rowLen]
+		origin, size, tileLen:=tileGeometry(fits.Naxisn, tc.tile, r)
+		tileData:=make([]float32, tileLen)
+
+		values, isFloat, err:=tc.decompressTile(row, heap, cols, tileLen, fits.Bitpix)
+		if err!=nil { return errors.New(fmt.Sprintf("Tile %d: %s", r, err.Error())) }
+
+		if isFloat {
+			for i, v:=range values { tileData[i]=float32(math.Float64frombits(uint64(v))) }
+		} else if fits.Bitpix<0 {
+			// quantized floating point values
+			zScale, okS:=cols.float(row, "ZSCALE")
+			zZero,  okZ:=cols.float(row, "ZZERO")
+			if !okS || !okZ { return errors.New(fmt.Sprintf("Tile %d: missing ZSCALE or ZZERO", r)) }
+			nullValue, hasNull:=int64(tc.zBlank), tc.hasZBlank
+			if v, ok:=cols.int(row, "ZBLANK"); ok { nullValue, hasNull=v, true }
+			unquantize(tileData, values, zScale, zZero, nullValue, hasNull, tc.quantize, r+tc.dither0-1)
+		} else {
+			for i, v:=range values {
+				if hasBlank && v==blank {
+					tileData[i]=float32(math.NaN())
+				} else {
+					tileData[i]=float32(v)*fits.Bscale+fits.Bzero
+				}
+			}
+		}
+		copyTile(fits.Data, tileData, fits.Naxisn, origin, size, true)
+	}
+	fits.Bzero, fits.Bscale=0, 1 // offset and scale have been adjusted on data values
+	return nil
+}
+
+
+// Parses the column definitions of the binary table described by the header
+func (h *FITSHeader) binTableColumns() (cols binTableColumns, err error) {
+	cols=binTableColumns{}
+	offset:=0
+	for i:=int32(1); i<=h.Ints["TFIELDS"]; i++ {
+		n:=strconv.FormatInt(int64(i),10)
+		tForm:=h.Strings["TFORM"+n]
+		m:=reTForm.FindStringSubmatch(tForm)
+		if m==nil { return nil, errors.New("Invalid TFORM"+n+" value '"+tForm+"'") }
+		repeat:=1
+		if m[1]!="" { repeat, _=strconv.Atoi(m[1]) }
+		col:=binTableColumn{typ:m[2][0], offset:offset}
+		if m[3]!="" { col.arrayTyp=m[3][0] }
+		cols[h.Strings["TTYPE"+n]]=col
+		if col.typ=='X' {
+			offset+=(repeat+7)/8
+		} else {
+			offset+=repeat*binTableWidths[col.typ]
+		}
+	}
+	return cols, nil
+}
+
+// Columns of a binary table by name
+type binTableColumns map[string]binTableColumn
+
+// Returns the contents of the variable length array in the given column of the row, if any
+func (cols binTableColumns) array(row, heap []byte, name string) (data []byte, elemWidth int, ok bool) {
+	col, ok:=cols[name]
+	if !ok || (col.typ!='P' && col.typ!='Q') { return nil, 0, false }
+	var count, offset int64
+	if col.typ=='P' {
+		count, offset=int64(int32(bigEndianUint(row[col.offset:], 4))), int64(int32(bigEndianUint(row[col.offset+4:], 4)))
+	} else {
+		count, offset=int64(bigEndianUint(row[col.offset:], 8)), int64(bigEndianUint(row[col.offset+8:], 8))
+	}
+	elemWidth=binTableWidths[col.arrayTyp]
+	end:=offset+count*int64(elemWidth)
+	if count<=0 || offset<0 || end>int64(len(heap)) { return nil, elemWidth, false }
+	return heap[offset:end], elemWidth, true
+}
+
+// Returns the floating point value in the given column of the row, if any
+func (cols binTableColumns) float(row []byte, name string) (float64, bool) {
+	col, ok:=cols[name]
+	if !ok { return 0, false }
+	switch col.typ {
+	case 'D': return math.Float64frombits(bigEndianUint(row[col.offset:], 8)), true
+	case 'E': return float64(math.Float32frombits(uint32(bigEndianUint(row[col.offset:], 4)))), true
+	}
+	return 0, false
+}
+
+// Returns the integer value in the given column of the row, if any
+func (cols binTableColumns) int(row []byte, name string) (int64, bool) {
+	col, ok:=cols[name]
+	if !ok { return 0, false }
+	switch col.typ {
+	case 'I': return int64(int16(bigEndianUint(row[col.offset:], 2))), true
+	case 'J': return int64(int32(bigEndianUint(row[col.offset:], 4))), true
+	case 'K': return int64(bigEndianUint(row[col.offset:], 8)), true
+	}
+	return 0, false
+}
+
+
+// Collects the parameters of the tile compression from the header
+func (h *FITSHeader) tileCompression() (tc tileCompression, err error) {
+	tc=tileCompression{ cmpType:h.Strings["ZCMPTYPE"], blockSize:riceBlockSize, bytePix:4, quantize:"NO_DITHER", dither0:1 }
+	for i:=int32(1); ; i++ {
+		n:=strconv.FormatInt(int64(i),10)
+		name, ok:=h.Strings["ZNAME"+n]
+		if !ok { break }
+		switch name {
+		case "BLOCKSIZE": tc.blockSize=int(h.Ints["ZVAL"+n])
+		case "BYTEPIX":   tc.bytePix  =int(h.Ints["ZVAL"+n])
+		}
+	}
+	if v, ok:=h.Strings["ZQUANTIZ"]; ok { tc.quantize=v }
+	if v, ok:=h.Ints["ZDITHER0"]; ok { tc.dither0=int(v) }
+	tc.zBlank, tc.hasZBlank=h.Ints["ZBLANK"]
+	if tc.blockSize<=0 { return tc, errors.New("Invalid Rice BLOCKSIZE") }
+
+	// default tiles are image rows
+	naxis:=h.Ints["ZNAXIS"]
+	tc.tile=make([]int32, naxis)
+	for i:=int32(1); i<=naxis; i++ {
+		n:=strconv.FormatInt(int64(i),10)
+		tc.tile[i-1]=1
+		if i==1 { tc.tile[i-1]=h.Ints["ZNAXIS1"] }
+		if v, ok:=h.Ints["ZTILE"+n]; ok { tc.tile[i-1]=v }
+		if tc.tile[i-1]<=0 { return tc, errors.New("Invalid ZTILE"+n+" value") }
+	}
+
+	switch tc.cmpType {
+	case "RICE_1", "RICE_ONE", "GZIP_1", "GZIP_2", "NOCOMPRESS":
+		return tc, nil
+	}
+	return tc, errors.New("Unsupported tile compression '"+tc.cmpType+"'")
+}
+
+
+// Turns the header of the binary table into the header of the uncompressed image
+func (h *FITSHeader) uncompressHeader() {
+	h.SetInt("BITPIX", h.Ints["ZBITPIX"], "")
+	naxis:=h.Ints["ZNAXIS"]
+	for i:=int32(1); i<=h.Ints["NAXIS"]; i++ { h.Delete("NAXIS"+strconv.FormatInt(int64(i),10)) }
+	h.SetInt("NAXIS", naxis, "")
+	for i:=int32(1); i<=naxis; i++ {
+		n:=strconv.FormatInt(int64(i),10)
+		h.SetInt("NAXIS"+n, h.Ints["ZNAXIS"+n], "")
+	}
+	h.Strings["XTENSION"]="IMAGE"
+	for _, key:=range append([]string(nil), h.Keys...) {
+		if compressionKeys[key] || reCompressionKey.MatchString(key) { h.Delete(key) }
+	}
+}
+
+
+// Decompresses the data of a tile into integer values. If isFloat is set,
+// the values are not integers but the bits of float64 values
+func (tc *tileCompression) decompressTile(row, heap []byte, cols binTableColumns, tileLen int, bitpix int32) (values []int64, isFloat bool, err error) {
+	values=make([]int64, tileLen)
+	valueWidth:=int(bitpix)/8
+	if valueWidth<0 { valueWidth=-valueWidth }
+
+	if data, _, ok:=cols.array(row, heap, "COMPRESSED_DATA"); ok {
+		isFloat=bitpix<0 && tc.quantize=="NONE" // lossless floats
+		if bitpix<0 && !isFloat { valueWidth=4 } // quantized floats
+		switch tc.cmpType {
+		case "RICE_1", "RICE_ONE":
+			ints:=make([]int32, tileLen)
+			err=riceDecompress(data, ints, tc.blockSize, tc.bytePix)
+			for i, v:=range ints { values[i]=int64(v) }
+			return values, false, err
+		case "GZIP_1", "GZIP_2":
+			data, err=gunzip(data)
+			if err!=nil { return nil, false, err }
+			if tc.cmpType=="GZIP_2" { data=unshuffleBytes(data, valueWidth) }
+		}
+		return values, isFloat, bytesToInts(values, data, valueWidth, isFloat)
+	}
+
+	// tiles which could not be compressed or quantized are stored as is, or gzipped
+	if data, elemWidth, ok:=cols.array(row, heap, "GZIP_COMPRESSED_DATA"); ok {
+		data, err=gunzip(data)
+		if err!=nil { return nil, false, err }
+		if elemWidth==1 { elemWidth=valueWidth }
+		return values, bitpix<0, bytesToInts(values, data, elemWidth, bitpix<0)
+	}
+	if data, elemWidth, ok:=cols.array(row, heap, "UNCOMPRESSED_DATA"); ok {
+		return values, bitpix<0, bytesToInts(values, data, elemWidth, bitpix<0)
+	}
+	return nil, false, errors.New("No compressed data")
+}
+
+
+// Converts big endian data to integer values with the given width in bytes.
+// If isFloat is set, floating point values are converted to the bits of float64 values
+func bytesToInts(values []int64, data []byte, width int, isFloat bool) error {
+	if len(data)<len(values)*width { return errors.New("Tile data truncated") }
+	for i:=range values {
+		u:=bigEndianUint(data[i*width:], width)
+		switch {
+		case isFloat && width==4: values[i]=int64(math.Float64bits(float64(math.Float32frombits(uint32(u)))))
+		case isFloat:             values[i]=int64(u)
+		case width==1:            values[i]=int64(uint8(u))
+		case width==2:            values[i]=int64(int16(u))
+		case width==4:            values[i]=int64(int32(u))
+		default:                  values[i]=int64(u)
+		}
+	}
+	return nil
+}
+
+// Reads an unsigned big endian value with the given width in bytes
+func bigEndianUint(b []byte, width int) (u uint64) {
+	for i:=0; i<width; i++ { u=(u<<8) | uint64(b[i]) }
+	return u
+}
+
+// Decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	r, err:=gzip.NewReader(bytes.NewReader(data))
+	if err!=nil { return nil, err }
+	return ioutil.ReadAll(r)
+}
+
+// Undoes the byte shuffling of GZIP_2, which stores the most significant bytes of all values first
+func unshuffleBytes(data []byte, width int) []byte {
+	n:=len(data)/width
+	res:=make([]byte, len(data))
+	for i:=0; i<n; i++ {
+		for j:=0; j<width; j++ { res[i*width+j]=data[j*n+i] }
+	}
+	return res
+}
+
+// Shuffles bytes for GZIP_2, storing the most significant bytes of all values first
+func shuffleBytes(data []byte, width int) []byte {
+	n:=len(data)/width
+	res:=make([]byte, len(data))
+	for i:=0; i<n; i++ {
+		for j:=0; j<width; j++ { res[j*n+i]=data[i*width+j] }
+	}
+	return res
+}
+
+
+// Returns the origin and size of the tile with given index in each dimension, and its total number of pixels
+func tileGeometry(naxisn, tile []int32, t int) (origin, size []int, tileLen int) {
+	origin, size, tileLen=make([]int, len(naxisn)), make([]int, len(naxisn)), 1
+	for i:=range naxisn {
+		numTiles:=(int(naxisn[i])+int(tile[i])-1)/int(tile[i])
+		origin[i]=(t%numTiles)*int(tile[i])
+		t/=numTiles
+		size[i]=int(tile[i])
+		if origin[i]+size[i]>int(naxisn[i]) { size[i]=int(naxisn[i])-origin[i] }
+		tileLen*=size[i]
+	}
+	return origin, size, tileLen
+}
+
+// Returns the number of tiles of the given dimensions needed to cover the image
+func numTiles(naxisn, tile []int32) int {
+	n:=1
+	for i:=range naxisn { n*=(int(naxisn[i])+int(tile[i])-1)/int(tile[i]) }
+	return n
+}
+
+// Copies tile data into the image if toImage is set, else from the image into the tile
+func copyTile(image, tileData []float32, naxisn []int32, origin, size []int, toImage bool) {
+	idx:=make([]int, len(size))
+	for tileOffset:=0; tileOffset<len(tileData); tileOffset+=size[0] {
+		imageOffset, stride:=0, 1
+		for i:=range size {
+			imageOffset+=(origin[i]+idx[i])*stride
+			stride*=int(naxisn[i])
+		}
+		if toImage {
+			copy(image[imageOffset:imageOffset+size[0]], tileData[tileOffset:tileOffset+size[0]])
+		} else {
+			copy(tileData[tileOffset:tileOffset+size[0]], image[imageOffset:imageOffset+size[0]])
+		}
+		for i:=1; i<len(size); i++ {
+			idx[i]++
+			if idx[i]<size[i] { break }
+			idx[i]=0
+		}
+	}
+}
+
+
+const numFITSRandoms=10000 // Length of the dithering sequence
+
+// Pseudo-random dithering sequence defined by the FITS tiled image compression convention
+var fitsRandoms=initFITSRandoms()
+
+func initFITSRandoms() []float32 {
+	a, m, seed:=16807.0, 2147483647.0, 1.0
+	r:=make([]float32, numFITSRandoms)
+	for i:=range r {
+		temp:=a*seed
+		seed=temp-m*float64(int64(temp/m))
+		r[i]=float32(seed/m)
+	}
+	return r
+}
+
+// Iterates through the dithering sequence for the tile with given zero-based sequence index
+type ditherer struct {
+	seed int
+	next int
+}
+
+func newDitherer(index int) ditherer {
+	seed:=index%numFITSRandoms
+	if seed<0 { seed+=numFITSRandoms }
+	return ditherer{seed:seed, next:int(fitsRandoms[seed]*500)}
+}
+
+// Returns the next dithering value
+func (d *ditherer) value() float64 {
+	v:=float64(fitsRandoms[d.next])
+	d.next++
+	if d.next==numFITSRandoms {
+		d.seed++
+		if d.seed==numFITSRandoms { d.seed=0 }
+		d.next=int(fitsRandoms[d.seed]*500)
+	}
+	return v
+}
+
+// Converts quantized values back to floating point
+func unquantize(dest []float32, values []int64, zScale, zZero float64, nullValue int64, hasNull bool, method string, ditherIndex int) {
+	dither:=method=="SUBTRACTIVE_DITHER_1" || method=="SUBTRACTIVE_DITHER_2"
+	d:=newDitherer(ditherIndex)
+	for i, v:=range values {
+		r:=0.5
+		if dither { r=d.value() }
+		if hasNull && v==nullValue {
+			dest[i]=float32(math.NaN())
+		} else if method=="SUBTRACTIVE_DITHER_2" && v==zZeroValue {
+			dest[i]=0
+		} else {
+			dest[i]=float32((float64(v)-r+0.5)*zScale+zZero)
+		}
+	}
+}
+
+
+// Writes the image with tile compression following the FITS tiled image compression convention,
+// as an empty primary HDU followed by a binary table with one tile per image row. Integer data is
+// compressed losslessly. Floating point data is quantized with subtractive dithering, using FZQuantLevel.
+// OutputFormat does not apply, as the sample format follows from the data
+func (fits *FITSImage) WriteCompressed(f io.Writer, cmpType string) error {
+	if len(fits.Naxisn)==0 { return errors.New("Cannot compress empty image") }
+	if OutputFormat!=SFFloat32 {
+		warnCompressedFormat.Do(func() { LogPrintf("Warning: -outFormat does not apply to tile compressed .fz outputs, which store integer data losslessly and quantize floating point data\n") })
+	}
+	isInt:=isIntegral(fits.Data)
+	tile:=make([]int32, len(fits.Naxisn))
+	for i:=range tile { tile[i]=1 }
+	tile[0]=fits.Naxisn[0]
+	rows:=numTiles(fits.Naxisn, tile)
+
+	// compress tiles into the heap, and the table rows with their descriptors and scaling
+	rowLen:=8 // descriptor of the compressed data, plus ZSCALE and ZZERO for floats
+	if !isInt { rowLen=24 }
+	table:=make([]byte, 0, rows*rowLen)
+	heap:=bytes.Buffer{}
+	maxLen:=0
+	ints:=make([]int32, 0)
+	for r:=0; r<rows; r++ {
+		origin, size, tileLen:=tileGeometry(fits.Naxisn, tile, r)
+		tileData:=make([]float32, tileLen)
+		copyTile(fits.Data, tileData, fits.Naxisn, origin, size, false)
+
+		ints=ints[:0]
+		zScale, zZero:=1.0, 0.0
+		if isInt {
+			for _, v:=range tileData { ints=append(ints, int32(v)) }
+		} else {
+			ints, zScale, zZero=quantize(ints, tileData, r)
+		}
+
+		data, err:=compressTile(ints, cmpType)
+		if err!=nil { return err }
+		table=appendBigEndian(table, uint64(len(data)), 4)
+		table=appendBigEndian(table, uint64(heap.Len()), 4)
+		if !isInt {
+			table=appendBigEndian(table, math.Float64bits(zScale), 8)
+			table=appendBigEndian(table, math.Float64bits(zZero), 8)
+		}
+		heap.Write(data)
+		if len(data)>maxLen { maxLen=len(data) }
+	}
+
+	// empty primary HDU
+	sb:=strings.Builder{}
+	writeBool(&sb, "SIMPLE", true, "    FITS standard 4.0")
+	writeInt32(&sb, "BITPIX", 8, "    8-bit bytes")
+	writeInt32(&sb, "NAXIS",  0, "[1] Number of axis")
+	writeBool(&sb, "EXTEND", true, "    Extensions are permitted")
+	writeEnd(&sb)
+	padHeader(&sb)
+
+	// binary table extension with the compressed image
+	writeString(&sb, "XTENSION", "BINTABLE", "    Binary table extension")
+	writeInt32(&sb, "BITPIX", 8, "    8-bit bytes")
+	writeInt32(&sb, "NAXIS",  2, "[1] Number of axis")
+	writeInt32(&sb, "NAXIS1", int32(rowLen), "[1] Bytes per table row")
+	writeInt32(&sb, "NAXIS2", int32(rows), "[1] Number of tiles")
+	writeInt32(&sb, "PCOUNT", int32(heap.Len()), "[1] Heap size")
+	writeInt32(&sb, "GCOUNT", 1, "[1] Number of groups")
+	writeInt32(&sb, "TFIELDS", int32(rowLen/8), "[1] Number of columns")
+	writeString(&sb, "TTYPE1", "COMPRESSED_DATA", "Compressed tile data")
+	writeString(&sb, "TFORM1", fmt.Sprintf("1PB(%d)", maxLen), "Variable length byte array")
+	if !isInt {
+		writeString(&sb, "TTYPE2", "ZSCALE", "Quantization scale per tile")
+		writeString(&sb, "TFORM2", "1D", "")
+		writeString(&sb, "TTYPE3", "ZZERO", "Quantization offset per tile")
+		writeString(&sb, "TFORM3", "1D", "")
+	}
+	writeBool(&sb, "ZIMAGE", true, "    Tile compressed image")
+	writeString(&sb, "ZCMPTYPE", cmpType, "Compression algorithm")
+	bitpix:=int32(32)
+	if !isInt { bitpix=-32 }
+	writeInt32(&sb, "ZBITPIX", bitpix, "    Bits per pixel of the image")
+	writeInt32(&sb, "ZNAXIS", int32(len(fits.Naxisn)), "[1] Number of axis of the image")
+	for i:=range fits.Naxisn {
+		writeInt32(&sb, fmt.Sprintf("ZNAXIS%d",i+1), fits.Naxisn[i], "[1] Axis size")
+	}
+	for i:=range tile {
+		writeInt32(&sb, fmt.Sprintf("ZTILE%d",i+1), tile[i], "[1] Tile size")
+	}
+	if cmpType=="RICE_1" {
+		writeString(&sb, "ZNAME1", "BLOCKSIZE", "Rice block size")
+		writeInt32(&sb, "ZVAL1", riceBlockSize, "")
+		writeString(&sb, "ZNAME2", "BYTEPIX", "Rice bytes per value")
+		writeInt32(&sb, "ZVAL2", 4, "")
+	}
+	if !isInt {
+		writeString(&sb, "ZQUANTIZ", "SUBTRACTIVE_DITHER_1", "Quantization method")
+		writeInt32(&sb, "ZDITHER0", 1, "    Dithering seed")
+		writeInt32(&sb, "ZBLANK", zNullValue, "    Value for undefined pixels")
+	}
+	if fits.Exposure!=0 && !fits.Header.Has("EXPOSURE") && !fits.Header.Has("EXPTIME") {
+		writeFloat32(&sb, "EXPOSURE", fits.Exposure, "[s] Exposure duration")
+	}
+	fits.Header.writeValues(&sb, fits.Exposure)
+	writeEnd(&sb)
+	padHeader(&sb)
+
+	// write headers, table and heap, padded to full blocks
+	_, err:=f.Write([]byte(sb.String()))
+	if err!=nil { return err }
+	_, err=f.Write(table)
+	if err!=nil { return err }
+	_, err=f.Write(heap.Bytes())
+	if err!=nil { return err }
+	if rest:=(len(table)+heap.Len())%fitsBlockSize; rest!=0 {
+		_, err=f.Write(make([]byte, fitsBlockSize-rest))
+	}
+	return err
+}
+
+
+// Returns true if all data values are integers which fit into 32 bits
+func isIntegral(data []float32) bool {
+	for _, v:=range data {
+		if v!=float32(math.Floor(float64(v))) || v< -2147483648 || v>=2147483648 { return false }
+	}
+	return true
+}
+
+// Quantizes floating point values of the tile with given zero-based index for compression, using subtractive dithering.
+// The quantization step is the estimated noise divided by FZQuantLevel. NaNs are mapped to zNullValue
+func quantize(dest []int32, values []float32, index int) (res []int32, zScale, zZero float64) {
+	min, max:=float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, v:=range values {
+		if v<min { min=v }
+		if v>max { max=v }
+	}
+	if min>max { min, max=0, 0 } // all NaN
+
+	// choose the quantization step from the noise, making sure all values fit into 32 bits
+	zScale=float64(tileNoise(values)/FZQuantLevel)
+	if zScale<=0 { zScale=float64(max-min)/65536 }
+	if zScale<=0 { zScale=math.Max(math.Abs(float64(min)), 1)*1e-6 }
+	if float64(max-min)/zScale>1<<30 { zScale=float64(max-min)/(1<<30) }
+	zZero=(float64(min)+float64(max))/2
+
+	d:=newDitherer(index)
+	for _, v:=range values {
+		r:=d.value()
+		if math.IsNaN(float64(v)) {
+			dest=append(dest, zNullValue)
+			continue
+		}
+		q:=(float64(v)-zZero)/zScale+r-0.5
+		dest=append(dest, int32(math.Floor(q+0.5)))
+	}
+	return dest, zScale, zZero
+}
+
+// Estimates the noise of the given values from the median of the absolute second order differences, like fpack
+func tileNoise(values []float32) float32 {
+	diffs:=make([]float32, 0, len(values))
+	for i:=2; i+2<len(values); i++ {
+		a, b, c:=values[i-2], values[i], values[i+2]
+		d:=2*b-a-c
+		if d==d { diffs=append(diffs, float32(math.Abs(float64(d)))) }
+	}
+	if len(diffs)==0 { return 0 }
+	return 0.6052697*QSelectMedianFloat32(diffs)
+}
+
+// Compresses the integer values of a tile with the given algorithm
+func compressTile(values []int32, cmpType string) ([]byte, error) {
+	switch cmpType {
+	case "RICE_1":
+		return riceCompress(values, riceBlockSize, 4)
+	case "GZIP_1", "GZIP_2":
+		data:=make([]byte, 0, len(values)*4)
+		for _, v:=range values { data=appendBigEndian(data, uint64(uint32(v)), 4) }
+		if cmpType=="GZIP_2" { data=shuffleBytes(data, 4) }
+		b:=bytes.Buffer{}
+		w:=gzip.NewWriter(&b)
+		_, err:=w.Write(data)
+		if err!=nil { return nil, err }
+		err=w.Close()
+		return b.Bytes(), err
+	}
+	return nil, errors.New("Unsupported tile compression '"+cmpType+"'")
+}
+
+// Appends an unsigned value in big endian format with the given width in bytes
+func appendBigEndian(b []byte, u uint64, width int) []byte {
+	for i:=width-1; i>=0; i-- { b=append(b, byte(u>>(8*uint(i)))) }
+	return b
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Generates an image with a gradient, stars and gaussian noise of the given sigma
+func generateImage(width, height, planes int32, sigma float32, integral bool) FITSImage {
+	rng:=rand.New(rand.NewSource(1))
+	f:=NewFITSImage()
+	f.Naxisn=[]int32{width, height}
+	if planes>1 { f.Naxisn=append(f.Naxisn, planes) }
+	f.Pixels=width*height*planes
+	f.Data=make([]float32, f.Pixels)
+	for i:=range f.Data {
+		x, y:=int32(i)%width, (int32(i)/width)%height
+		v:=1000+2*float32(x)+float32(y)+sigma*float32(rng.NormFloat64())
+		if x%17==3 && y%13==5 { v+=20000 }
+		if integral { v=float32(math.Floor(float64(v))) }
+		f.Data[i]=v
+	}
+	f.Exposure=120
+	f.Header.SetString("OBJECT", "M 42", "")
+	return f
+}
+
+func TestTileCompressionIntegerRoundTrip(t *testing.T) {
+	for _, cmpType:=range []string{"RICE_1", "GZIP_1", "GZIP_2"} {
+		f:=generateImage(123, 45, 3, 10, true)
+		var b bytes.Buffer
+		err:=f.WriteCompressed(&b, cmpType)
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", cmpType, err) }
+		if b.Len()%fitsBlockSize!=0 { t.Errorf("%s: len=%d; want multiple of %d", cmpType, b.Len(), fitsBlockSize) }
+
+		g:=NewFITSImage()
+		err=g.Read(bytes.NewReader(b.Bytes()))
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", cmpType, err) }
+		if !EqualInt32Slice(g.Naxisn, f.Naxisn) { t.Fatalf("%s: Naxisn=%v; want %v", cmpType, g.Naxisn, f.Naxisn) }
+		for i:=range f.Data {
+			if g.Data[i]!=f.Data[i] { t.Errorf("%s: Data[%d]=%f; want %f", cmpType, i, g.Data[i], f.Data[i]); break }
+		}
+		if g.Exposure!=f.Exposure { t.Errorf("%s: Exposure=%f; want %f", cmpType, g.Exposure, f.Exposure) }
+		if g.Header.Strings["OBJECT"]!="M 42" { t.Errorf("%s: OBJECT=%s; want M 42", cmpType, g.Header.Strings["OBJECT"]) }
+		if g.Header.Has("ZCMPTYPE") || g.Header.Has("TFORM1") { t.Errorf("%s: compression keys not removed", cmpType) }
+	}
+}
+
+func TestTileCompressionFloatRoundTrip(t *testing.T) {
+	sigma:=float32(5.5)
+	for _, cmpType:=range []string{"RICE_1", "GZIP_2"} {
+		f:=generateImage(200, 30, 1, sigma, false)
+		f.Data[77]=float32(math.NaN())
+		var b bytes.Buffer
+		err:=f.WriteCompressed(&b, cmpType)
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", cmpType, err) }
+
+		g:=NewFITSImage()
+		err=g.Read(bytes.NewReader(b.Bytes()))
+		if err!=nil { t.Fatalf("%s: err=%s; want nil", cmpType, err) }
+		if !math.IsNaN(float64(g.Data[77])) { t.Errorf("%s: Data[77]=%f; want NaN", cmpType, g.Data[77]) }
+
+		// quantization error is bounded by the quantization step, a fraction of the noise
+		maxErr:=float32(0)
+		for i:=range f.Data {
+			if i==77 { continue }
+			if e:=float32(math.Abs(float64(g.Data[i]-f.Data[i]))); e>maxErr { maxErr=e }
+		}
+		if maxErr>sigma/FZQuantLevel { t.Errorf("%s: maxErr=%f; want <=%f", cmpType, maxErr, sigma/FZQuantLevel) }
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+
+// Weighting scheme for stacking
+type WeightMode int
+const (
+	WMNone         WeightMode = iota  // Unweighted
+	WMExposure                        // By exposure time
+	WMNoise                           // By inverse noise after post-processing
+	WMPSFSignal                       // By squared ratio of median PSF peak to noise
+	WMSNR                             // By squared signal to noise ratio, location over noise
+	WMStarsOverHFR                    // By star count over HFR
+	WMFormula                         // By a user-defined formula of the quality variables
+)
+
+// Names of the quality variables available to weight formulas
+var WeightVariables=[]string{"stars", "hfr", "fwhm", "ecc", "back", "noise", "exposure", "snr", "psfsignal"}
+
+// Returns the quality variables of a frame for weight formulas. PSF variables are zero without fitted PSFs
+func QualityVariables(l *FITSImage) map[string]float64 {
+	v:=map[string]float64{
+		"stars":    float64(len(l.Stars)),
+		"hfr":      float64(l.HFR),
+		"back":     float64(l.Stats.Location),
+		"noise":    float64(l.Stats.Noise),
+		"exposure": float64(l.Exposure),
+	}
+	if l.Stats.Noise>0 { v["snr"]=float64(l.Stats.Location/l.Stats.Noise) }
+	if l.PSF!=nil && l.PSF.Stars>0 {
+		v["fwhm"], v["ecc"]=float64(l.PSF.FWHM), float64(l.PSF.Eccentricity)
+		if l.Stats.Noise>0 { v["psfsignal"]=float64(l.PSF.Peak/l.Stats.Noise) }
+	}
+	return v
+}
+
+// Whether the weight mode or formula needs fitted point spread functions
+func WeightNeedsPSF(mode WeightMode, formula *Formula) bool {
+	if mode==WMPSFSignal { return true }
+	if mode!=WMFormula || formula==nil { return false }
+	return formula.Uses("fwhm") || formula.Uses("ecc") || formula.Uses("psfsignal")
+}
+
+// Calculates the stacking weight of a preprocessed frame with the given mode, before histogram normalization.
+// Inverse noise weights are not supported here, as they are calculated after post-processing
+func FrameWeight(l *FITSImage, mode WeightMode, formula *Formula) (float32, error) {
+	v:=QualityVariables(l)
+	var w float64
+	switch mode {
+	case WMExposure:
+		if l.Exposure==0 { return 0, errors.New("missing exposure information for exposure-weighted stacking") }
+		w=v["exposure"]
+	case WMPSFSignal:
+		if l.PSF==nil || l.PSF.Stars==0 { return 0, errors.New("no PSF fitted for PSF signal weighting") }
+		w=v["psfsignal"]*v["psfsignal"]
+	case WMSNR:
+		w=v["snr"]*v["snr"]
+	case WMStarsOverHFR:
+		if l.HFR>0 { w=v["stars"]/v["hfr"] }
+	case WMFormula:
+		if formula==nil { return 0, errors.New("missing weight formula") }
+		w=formula.Eval(v)
+	default:
+		return 0, errors.New(fmt.Sprintf("unsupported weight mode %d", mode))
+	}
+	if math.IsNaN(w) || math.IsInf(w, 0) || w<0 { return 0, errors.New(fmt.Sprintf("invalid weight %g", w)) }
+	return float32(w), nil
+}
+
+// Scales the weights so the largest is one. Fails if no weight is positive
+func NormalizeWeights(weights []float32) error {
+	max:=float32(0)
+	for _, w:=range weights {
+		if w>max { max=w }
+	}
+	if max<=0 { return errors.New("all stacking weights are zero") }
+	for i:=range weights { weights[i]/=max }
+	return nil
+}
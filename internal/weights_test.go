@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+	vars:=map[string]float64{"snr":4, "stars":120, "hfr":3}
+	for _, c:=range []struct{ text string; want float64 }{
+		{"snr^2*stars/hfr",    640},
+		{"-snr^2 + 2*(hfr-1)", -12},
+		{"2^3^2",              512},
+		{"sqrt(stars/hfr)/2",  math.Sqrt(40)/2},
+		{"1e2 - .5",           99.5},
+	} {
+		f, err:=ParseFormula(c.text, WeightVariables)
+		if err!=nil { t.Errorf("%s: err=%s", c.text, err); continue }
+		if got:=f.Eval(vars); math.Abs(got-c.want)>1e-9 { t.Errorf("%s=%g; want %g", c.text, got, c.want) }
+	}
+	for _, text:=range []string{"snr*", "clouds+1", "(snr", "foo(snr)", "snr snr"} {
+		if _, err:=ParseFormula(text, WeightVariables); err==nil { t.Errorf("%s: err=nil; want error", text) }
+	}
+}
+
+func TestFrameWeight(t *testing.T) {
+	l:=&FITSImage{Stars:make([]Star, 50), HFR:2.5, Exposure:120, Stats:&BasicStats{Location:200, Noise:10}, 
+	              PSF:&PSFStats{Stars:20, FWHM:3, Peak:500}}
+	f, _:=ParseFormula("snr*stars/fwhm", WeightVariables)
+	for _, c:=range []struct{ mode WeightMode; want float32 }{
+		{WMExposure, 120}, {WMPSFSignal, 2500}, {WMSNR, 400}, {WMStarsOverHFR, 20}, {WMFormula, 20*50/3.0},
+	} {
+		w, err:=FrameWeight(l, c.mode, f)
+		if err!=nil { t.Errorf("mode %d: err=%s", c.mode, err); continue }
+		if math.Abs(float64(w-c.want))>1e-3 { t.Errorf("mode %d: weight=%g; want %g", c.mode, w, c.want) }
+	}
+	if !WeightNeedsPSF(WMFormula, f) { t.Errorf("WeightNeedsPSF=false; want true") }
+
+	weights:=[]float32{2, 4, 1}
+	if err:=NormalizeWeights(weights); err!=nil || weights[0]!=0.5 || weights[1]!=1 || weights[2]!=0.25 { t.Errorf("weights=%v, err=%v; want [0.5 1 0.25]", weights, err) }
+	if err:=NormalizeWeights([]float32{0, 0}); err==nil { t.Errorf("err=nil; want error for zero weights") }
+}
@@ -18,17 +18,20 @@ package internal
 
 import (
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 )
 
 // Writes an in-memory FITS image to a file with given filename.
 // Creates/overwrites the file if necessary.
-// Compresses with gzip if .gz or gzip suffix is present.
+// Compresses with gzip if .gz or gzip suffix is present, and with Rice tile compression if .fz suffix is present.
+// Writes XISF if .xisf suffix is present.
 func (fits *FITSImage) WriteFile(fileName string) error {
 	//fmt.Println("Reading from " + fileName + "..." )
 	f, err:=os.OpenFile(fileName, os.O_WRONLY |os.O_CREATE, 0644)
@@ -44,116 +47,287 @@ func (fits *FITSImage) WriteFile(fileName string) error {
 		gw:=gzip.NewWriter(f)
 		defer gw.Close()
 		w=gw
-	} 
+	} else if lExt==".fz" {
+		return fits.WriteCompressed(w, "RICE_1")
+	} else if lExt==".xisf" {
+		return fits.WriteXISF(w)
+	}
 
 	return fits.Write(w)
 }
 
 
-// Writes an in-memory FITS image to an io.Writer.
+// Sample formats for writing FITS image data
+type SampleFormat int
+const (
+	SFFloat32 SampleFormat = iota // 32-bit floating point, BITPIX -32
+	SFFloat64                     // 64-bit floating point, BITPIX -64
+	SFInt32                       // 32-bit signed integer, BITPIX 32
+	SFUint16                      // 16-bit unsigned integer, BITPIX 16 with BZERO 32768
+)
+
+// Sample format for writing FITS files, used by all commands
+var OutputFormat SampleFormat = SFFloat32
+
+// Factor multiplying data before conversion to integer output formats, e.g. 65535 for data normalized to [0,1].
+// Recorded as BSCALE and BZERO, so readers recover the original values
+var OutputScale float64 = 1
+
+// Keep NaNs when writing FITS files, instead of replacing them with zeros. 
+// Integer formats mark them with the BLANK value
+var OutputKeepNaN bool = false
+
+// Parses a sample format name: float32, float64, int32 or uint16
+func ParseSampleFormat(name string) (SampleFormat, error) {
+	switch strings.ToLower(name) {
+	case "float32": return SFFloat32, nil
+	case "float64": return SFFloat64, nil
+	case "int32":   return SFInt32,   nil
+	case "uint16":  return SFUint16,  nil
+	}
+	return SFFloat32, errors.New("Unknown sample format "+name)
+}
+
+
+// Writes an in-memory FITS image to an io.Writer, using OutputFormat and OutputKeepNaN.
 func (fits *FITSImage) Write(f io.Writer) error {
+	hasNaNs:=false
+	for _, v:=range fits.Data {
+		if math.IsNaN(float64(v)) { hasNaNs=true; break }
+	}
+
 	// Build header in string buffer
 	sb:=strings.Builder{}
 	writeBool(&sb, "SIMPLE", true, "    FITS standard 4.0")
-	writeInt32(&sb, "BITPIX", -32, "    32-bit floating point")
+	switch OutputFormat {
+	case SFFloat64: writeInt32(&sb, "BITPIX", -64, "    64-bit floating point")
+	case SFInt32:   writeInt32(&sb, "BITPIX",  32, "    32-bit signed integer")
+	case SFUint16:  writeInt32(&sb, "BITPIX",  16, "    16-bit unsigned integer")
+	default:        writeInt32(&sb, "BITPIX", -32, "    32-bit floating point")
+	}
 	writeInt32(&sb, "NAXIS",  int32(len(fits.Naxisn)), "[1] Number of axis")
 	for i:=0; i<len(fits.Naxisn); i++ {
 		writeInt32(&sb, fmt.Sprintf("NAXIS%d",i+1), fits.Naxisn[i], "[1] Axis size")
 	}
-	writeFloat32(&sb, "BZERO", fits.Bzero, "[1] Zero offset")
-	if fits.Exposure!=0 {
+	switch OutputFormat {
+	case SFUint16: 
+		writeIntScaling(&sb, 32768, OutputScale)
+		if OutputKeepNaN && hasNaNs { writeInt32(&sb, "BLANK", math.MinInt16, "    Value for undefined pixels") }
+	case SFInt32:
+		writeIntScaling(&sb, 0, OutputScale)
+		if OutputKeepNaN && hasNaNs { writeInt32(&sb, "BLANK", math.MinInt32, "    Value for undefined pixels") }
+	default:
+		writeFloat32(&sb, "BZERO", fits.Bzero, "[1] Zero offset")
+	}
+	if fits.Exposure!=0 && !fits.Header.Has("EXPOSURE") && !fits.Header.Has("EXPTIME") {
 		writeFloat32(&sb, "EXPOSURE", fits.Exposure, "[s] Exposure duration")
 	}
-	// FIXME: currently omitting all other FITS header entries
+	fits.Header.writeValues(&sb, fits.Exposure)
 	writeEnd(&sb)
-
-	// Pad current header block with spaces if necessary
-	bytesInHeaderBlock:=(sb.Len() % 2880)
-	if bytesInHeaderBlock>0 {
-		for i:=bytesInHeaderBlock; i<2880; i++ {
-			sb.WriteRune(' ')
-		} 
-	}
+	padHeader(&sb)
 
 	// Write header block(s)
 	_, err:=f.Write([]byte(sb.String()))
 	if err!=nil { return err }
 
-	// Write payload data, replacing NaNs with zeros for compatibility
-	return writeFloat32Array(f, fits.Data, true)
+	// Write payload data, replacing NaNs with zeros for compatibility unless flagged otherwise.
+	// Integer values are multiplied with OutputScale and clipped to the valid range.
+	// With BLANK, the value for stored 0 in uint16 marks undefined pixels, so valid values start at 1
+	switch OutputFormat {
+	case SFFloat64: 
+		return writeFloat64Array(f, fits.Data, !OutputKeepNaN)
+	case SFInt32:   
+		return writeIntArray(f, fits.Data, 4, math.MinInt32+1, math.MaxInt32, 0, OutputScale, OutputKeepNaN && hasNaNs)
+	case SFUint16:  
+		min:=int64(0)
+		if OutputKeepNaN && hasNaNs { min=1 }
+		return writeIntArray(f, fits.Data, 2, min, math.MaxUint16, 32768, OutputScale, OutputKeepNaN && hasNaNs)
+	}
+	return writeFloat32Array(f, fits.Data, !OutputKeepNaN)
+}
+
+
+// Header keys describing the data layout. These are always written from the in-memory image, 
+// and never copied from the header of the original file
+var fitsStructuralKeys=map[string]bool{
+	"SIMPLE":true, "BITPIX":true, "NAXIS":true, "EXTEND":true, "BZERO":true, "BSCALE":true, "BLANK":true,
+	"END":true, "CHECKSUM":true, "DATASUM":true, "XTENSION":true, "PCOUNT":true, "GCOUNT":true, "INHERIT":true,
+}
+
+// Returns true if the given header key describes the data layout
+func isStructuralKey(key string) bool {
+	return fitsStructuralKeys[key] || strings.HasPrefix(key, "NAXIS")
+}
+
+
+// Writes all non-structural header values in their original order, followed by comments and history entries.
+// Exposure values are replaced with the given exposure if nonzero, as stacking changes them.
+func (h *FITSHeader) writeValues(w io.Writer, exposure float32) {
+	for _, key:=range h.Keys {
+		if isStructuralKey(key) { continue }
+		comment:=h.KeyComments[key]
+		if (key=="EXPOSURE" || key=="EXPTIME") && exposure!=0 {
+			writeFloat32(w, key, exposure, comment)
+		} else if v, ok:=h.Bools[key]; ok {
+			writeBool(w, key, v, comment)
+		} else if v, ok:=h.Ints[key]; ok {
+			writeInt32(w, key, v, comment)
+		} else if v, ok:=h.Floats[key]; ok {
+			writeFloat64(w, key, v, comment)
+		} else if v, ok:=h.Strings[key]; ok {
+			writeString(w, key, v, comment)
+		} else if v, ok:=h.Dates[key]; ok {
+			writeString(w, key, v, comment)
+		} else if v, ok:=h.Complexes[key]; ok {
+			writeComplex64(w, key, v, comment)
+		}
+	}
+	for _, c:=range h.Comments {
+		writeCommentary(w, "COMMENT", c)
+	}
+	for _, hist:=range h.History {
+		writeCommentary(w, "HISTORY", hist)
+	}
 }
 
 
 // Writes a FITS header boolean value 
 func writeBool(w io.Writer, key string, value bool, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
 	v:="F"
 	if value { v="T" }
-	fmt.Fprintf(w, "%-8s= %20s / %-47s", key, v, comment)
+	writeCard(w, key, fmt.Sprintf("%20s", v), comment)
 }
 
 
 // Writes a FITS header integer value 
 func writeInt(w io.Writer, key string, value int, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20d / %-47s", key, value, comment)
+	writeCard(w, key, fmt.Sprintf("%20d", value), comment)
 }
 
 
 // Writes a FITS header int32 value 
 func writeInt32(w io.Writer, key string, value int32, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20d / %-47s", key, value, comment)
+	writeCard(w, key, fmt.Sprintf("%20d", value), comment)
 }
 
 
 // Writes a FITS header int64 value 
 func writeInt64(w io.Writer, key string, value int64, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20d / %-47s", key, value, comment)
+	writeCard(w, key, fmt.Sprintf("%20d", value), comment)
 }
 
 
 // Writes a FITS header float32 value 
 func writeFloat32(w io.Writer, key string, value float32, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20g / %-47s", key, value, comment)
+	writeCard(w, key, fmt.Sprintf("%20s", formatFITSFloat(float64(value), 32)), comment)
 }
 
 
 // Writes a FITS header float64 value 
 func writeFloat64(w io.Writer, key string, value float64, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-	fmt.Fprintf(w, "%-8s= %20g / %-47s", key, value, comment)
+	writeCard(w, key, fmt.Sprintf("%20s", formatFITSFloat(value, 64)), comment)
+}
+
+
+// Writes a FITS header complex value 
+func writeComplex64(w io.Writer, key string, value complex64, comment string) {
+	v:="("+formatFITSFloat(float64(real(value)), 32)+", "+formatFITSFloat(float64(imag(value)), 32)+")"
+	writeCard(w, key, fmt.Sprintf("%20s", v), comment)
+}
+
+
+// Writes a FITS header card with the given key, formatted value and comment, truncating the comment to the card size.
+// Values of HIERARCH keys are not padded. Keys are skipped with a warning if key and value do not fit into one card
+func writeCard(w io.Writer, key, value, comment string) {
+	if !isStandardKey(key) { value=strings.TrimSpace(value) }
+	card:=formatKey(key)+value
+	if len(card)>80 {
+		LogPrintf("Warning: skipping header key %s, as key and value do not fit into one card\n", key)
+		return
+	}
+	fmt.Fprintf(w, "%-80.80s", card+" / "+comment)
+}
+
+
+// Formats the given key and the value indicator. Keys which are not valid standard FITS keywords, 
+// e.g. because they are too long or contain spaces, are written with the HIERARCH convention
+func formatKey(key string) string {
+	if isStandardKey(key) { return fmt.Sprintf("%-8s= ", key) }
+	return "HIERARCH "+key+" = "
+}
+
+
+// Returns true if the key is a valid standard FITS keyword, with up to 8 uppercase letters, digits, - or _
+func isStandardKey(key string) bool {
+	if len(key)>8 { return false }
+	for _, c:=range key {
+		if !((c>='A' && c<='Z') || (c>='0' && c<='9') || c=='-' || c=='_') { return false }
+	}
+	return true
+}
+
+
+// Formats a floating point value as a FITS real number. Always contains a decimal point, 
+// so it is not mistaken for an integer, and uses an uppercase exponent character.
+// Prefers plain decimal notation if it fits the value field, so e.g. Julian dates stay readable
+func formatFITSFloat(value float64, bitSize int) string {
+	s:=strconv.FormatFloat(value, 'G', -1, bitSize)
+	if abs:=math.Abs(value); strings.Contains(s, "E") && abs>=1e-4 && abs<1e16 {
+		if f:=strconv.FormatFloat(value, 'f', -1, bitSize); len(f)<=20 { s=f }
+	}
+	if !strings.ContainsAny(s, ".EIN") { 
+		s+=".0" 
+	} else if !strings.Contains(s, ".") && strings.Contains(s, "E") {
+		s=strings.Replace(s, "E", ".0E", 1)
+	}
+	return s
 }
 
 
 // Writes a FITS header string value, with escaping and continuations if necessary. 
 func writeString(w io.Writer, key, value, comment string) {
-	if len(key)>8 { key=key[0:8] }
-	if len(comment)>47 { comment=comment[0:47] }
-
 	// escape ' characters
-	value=strings.Join(strings.Split(value, "'"), "''")
-	// FIXME: Malformatted output ERROR if printing breaks the '' characters!
+	value=strings.Replace(value, "'", "''", -1)
 
+	// short strings are padded for readability
 	if len(value)<=18 {
-		fmt.Fprintf(w, "%-8s= '%s'%s / %-47s", key, value, strings.Repeat(" ", 18-len(value)), comment)
-	} else {
-		fmt.Fprintf(w, "%-8s= '%s&' / %-47s", key, value[0:17], comment)
-		value=value[17:]
-		for ; len(value)>66 ; {
-			fmt.Fprintf(w, "CONTINUE  '%s&' ", value[0:66])
-			value=value[66:]
+		writeCard(w, key, "'"+value+"'"+strings.Repeat(" ", 18-len(value)), comment)
+		return
+	}
+	if len(formatKey(key))+len(value)+2<=80 {
+		writeCard(w, key, "'"+value+"'", comment)
+		return
+	}
+
+	// long strings are split across CONTINUE cards, each but the last ending with &.
+	// Never split an escaped '' pair, and place the comment on the last card
+	card:=formatKey(key)
+	for {
+		maxLen:=80-len(card)-3
+		if maxLen<2 {
+			LogPrintf("Warning: skipping header key %s, as key and value do not fit into one card\n", key)
+			return
 		}
-		fmt.Fprintf(w, "CONTINUE  '%s'%s", value, strings.Repeat(" ", 50+(18-len(value))))
-	}	
+		if len(value)<=maxLen { break }
+		n:=maxLen
+		if strings.Count(value[:n], "'")%2==1 { n-- }
+		fmt.Fprintf(w, "%-80s", card+"'"+value[:n]+"&'")
+		value=value[n:]
+		card="CONTINUE  "
+	}
+	fmt.Fprintf(w, "%-80.80s", card+"'"+value+"' / "+comment)
+}
+
+
+// Writes a FITS header commentary record like COMMENT or HISTORY. Splits long texts across multiple records
+func writeCommentary(w io.Writer, key, text string) {
+	for {
+		line:=text
+		if len(line)>72 { line=line[0:72] }
+		fmt.Fprintf(w, "%-8s%-72s", key, line)
+		text=text[len(line):]
+		if len(text)==0 { break }
+	}
 }
 
 
@@ -162,6 +336,16 @@ func writeEnd(w io.Writer) {
 	fmt.Fprintf(w, "END%s", strings.Repeat(" ", 80-3))
 }
 
+// Pads the current header block with spaces if necessary
+func padHeader(sb *strings.Builder) {
+	bytesInHeaderBlock:=(sb.Len() % 2880)
+	if bytesInHeaderBlock>0 {
+		for i:=bytesInHeaderBlock; i<2880; i++ {
+			sb.WriteRune(' ')
+		} 
+	}
+}
+
 // Writes FITS binary body data in network byte order. 
 // Optionally replaces NaNs with zeros for compatibility with other software
 func writeFloat32Array(w io.Writer, data []float32, replaceNaNs bool) error {
@@ -183,18 +367,81 @@ func writeFloat32Array(w io.Writer, data []float32, replaceNaNs bool) error {
 		_, err:=w.Write(buf[:(size<<2)])
 		if err!=nil { return err }
 	}
+	return writePadding(w, len(data)<<2)
+}
 
-	// complete the last partial block, for strictly FITS compliant software
-	bytesWritten:=len(data)<<2
-	lastPartialBlock:=bytesWritten % 2880
-	if lastPartialBlock!=0 {
-		sb:=strings.Builder{}
-		for i:=lastPartialBlock; i<2880; i++ {
-			sb.WriteRune(' ')
+// Writes FITS binary body data as 64-bit floating point values in network byte order. 
+// Optionally replaces NaNs with zeros for compatibility with other software
+func writeFloat64Array(w io.Writer, data []float32, replaceNaNs bool) error {
+	buf:=make([]byte,bufLen)
+
+	for block:=0; block<len(data); block+=(bufLen>>3) {
+		size:=len(data)-block
+		if size>(bufLen>>3) { size=(bufLen>>3) }
+
+		for offset:=0; offset<size; offset++ {
+			d:=float64(data[block+offset])
+			if replaceNaNs && math.IsNaN(d) { d=0 }
+			val:=math.Float64bits(d)
+			for i:=0; i<8; i++ {
+				buf[(offset<<3)+i]=byte(val>>(56-8*uint(i)))
+			}
+		}
+		_, err:=w.Write(buf[:(size<<3)])
+		if err!=nil { return err }
+	}
+	return writePadding(w, len(data)<<3)
+}
+
+// Writes the BZERO and BSCALE values for integer data stored with the given offset after multiplying with the given scale
+func writeIntScaling(w io.Writer, offset int64, scale float64) {
+	if scale==1 {
+		writeInt64(w, "BZERO", offset, "[1] Zero offset")
+		return
+	}
+	writeFloat64(w, "BZERO",  float64(offset)/scale, "[1] Zero offset")
+	writeFloat64(w, "BSCALE", 1/scale,               "[1] Scale factor")
+}
+
+// Writes FITS binary body data as signed integers with the given width in bytes, in network byte order. 
+// Values are multiplied with the scale, rounded and clipped to [min, max], then the offset is subtracted. 
+// NaNs are written as the smallest value of the width if useBlank is set, else as zero
+func writeIntArray(w io.Writer, data []float32, width int, min, max, offset int64, scale float64, useBlank bool) error {
+	blank:=-int64(1)<<(8*uint(width)-1)
+
+	buf:=make([]byte,bufLen)
+	perBlock:=bufLen/width
+	clipped:=0
+	for block:=0; block<len(data); block+=perBlock {
+		size:=len(data)-block
+		if size>perBlock { size=perBlock }
+
+		for i:=0; i<size; i++ {
+			d:=float64(data[block+i])
+			var val int64
+			if math.IsNaN(d) {
+				if useBlank { val=blank } else { val=-offset }
+			} else {
+				v:=math.Floor(d*scale+0.5)
+				if v<float64(min) { v=float64(min); clipped++ }
+				if v>float64(max) { v=float64(max); clipped++ }
+				val=int64(v)-offset
+			}
+			for j:=0; j<width; j++ {
+				buf[i*width+j]=byte(val>>(8*uint(width-1-j)))
+			}
 		}
-		_, err:=w.Write([]byte(sb.String()))
+		_, err:=w.Write(buf[:size*width])
 		if err!=nil { return err }
 	}
-	
-	return nil
+	if clipped>0 { LogPrintf("Warning: clipped %d values to the output range [%d, %d]\n", clipped, min, max) }
+	return writePadding(w, len(data)*width)
+}
+
+// Completes the last partial block of binary data with zeros, for strictly FITS compliant software
+func writePadding(w io.Writer, bytesWritten int) error {
+	lastPartialBlock:=bytesWritten % fitsBlockSize
+	if lastPartialBlock==0 { return nil }
+	_, err:=w.Write(make([]byte, fitsBlockSize-lastPartialBlock))
+	return err
 }
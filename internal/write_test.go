@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWriteSampleFormats(t *testing.T) {
+	defer func() { OutputFormat, OutputKeepNaN=SFFloat32, false }()
+	nan:=float32(math.NaN())
+	tests:=[]struct{ format SampleFormat; keepNaN bool; data, want []float32 }{
+		{ SFFloat32, false, []float32{-1.5, nan, 70000},    []float32{-1.5, 0, 70000}       },
+		{ SFFloat32, true,  []float32{-1.5, nan, 70000},    []float32{-1.5, nan, 70000}     },
+		{ SFFloat64, true,  []float32{-1.5, nan, 70000},    []float32{-1.5, nan, 70000}     },
+		{ SFUint16,  false, []float32{-1.5, nan, 70000, 2.4}, []float32{0, 0, 65535, 2}     },
+		{ SFUint16,  true,  []float32{-1.5, nan, 70000, 2.4}, []float32{1, nan, 65535, 2}   },
+		{ SFUint16,  false, []float32{0, 0.5, 1},           []float32{0, 1, 1}              },
+		{ SFInt32,   true,  []float32{-1.5, nan, 70000},    []float32{-1, nan, 70000}       },
+	}
+	for i, test:=range tests {
+		OutputFormat, OutputKeepNaN=test.format, test.keepNaN
+		f:=NewFITSImage()
+		f.Naxisn, f.Pixels, f.Data=[]int32{int32(len(test.data))}, int32(len(test.data)), test.data
+		buf:=bytes.Buffer{}
+		if err:=f.Write(&buf); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		if buf.Len()%fitsBlockSize!=0 { t.Errorf("%d: len=%d; want multiple of %d", i, buf.Len(), fitsBlockSize) }
+
+		g:=NewFITSImage()
+		if err:=g.Read(&buf); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		for j, w:=range test.want {
+			if w!=w {
+				if g.Data[j]==g.Data[j] { t.Errorf("%d: Data[%d]=%f; want NaN", i, j, g.Data[j]) }
+			} else if g.Data[j]!=w { t.Errorf("%d: Data[%d]=%f; want %f", i, j, g.Data[j], w) }
+		}
+	}
+}
+
+func TestWriteIntegerScale(t *testing.T) {
+	defer func() { OutputFormat, OutputScale=SFFloat32, 1 }()
+	data:=[]float32{0, 0.25, 0.5, 0.75, 1, 1.0001}
+	tests:=[]struct{ format SampleFormat; scale float64; want []float32 }{
+		{ SFUint16, 65535,         []float32{0, 0.25, 0.5, 0.75, 1, 1}      },  // clipped above 1
+		{ SFInt32,  65535,         []float32{0, 0.25, 0.5, 0.75, 1, 1.0001} },
+		{ SFInt32,  math.MaxInt32, []float32{0, 0.25, 0.5, 0.75, 1, 1}      },  // clipped above 1
+	}
+	for i, test:=range tests {
+		OutputFormat, OutputScale=test.format, test.scale
+		f:=NewFITSImage()
+		f.Naxisn, f.Pixels, f.Data=[]int32{int32(len(data))}, int32(len(data)), data
+		buf:=bytes.Buffer{}
+		if err:=f.Write(&buf); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		if !strings.Contains(buf.String(), "BSCALE  =") { t.Errorf("%d: header lacks BSCALE", i) }
+
+		g:=NewFITSImage()
+		if err:=g.Read(&buf); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		for j, w:=range test.want {
+			if math.Abs(float64(g.Data[j]-w))>1/test.scale { t.Errorf("%d: Data[%d]=%f; want %f", i, j, g.Data[j], w) }
+		}
+	}
+}
+
+func TestWriteLongHierarchKeys(t *testing.T) {
+	long:="VERY LONG HIERARCH KEY "+strings.Repeat("X", 40)
+	tooLong:=strings.Repeat("Y", 75)
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels, f.Data=[]int32{1}, 1, []float32{0}
+	f.Header.SetBool(long, true, "fits without padding, comment is truncated")
+	f.Header.SetFloat(long+" F", 1.5, "")
+	f.Header.SetString(long+" S", "a string value which needs a continuation", "")
+	f.Header.SetString(tooLong, "a value", "does not fit")
+	f.Header.SetString(tooLong+" LONG", strings.Repeat("z", 100), "does not fit either")
+
+	var b bytes.Buffer
+	err:=f.Write(&b)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	g:=NewFITSImage()
+	err=g.Read(bytes.NewReader(b.Bytes()))
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	if v, ok:=g.Header.Bools[long]; !ok || !v { t.Errorf("%s=%t,%t; want true,true", long, v, ok) }
+	if v:=g.Header.Floats[long+" F"]; v!=1.5 { t.Errorf("%s F=%f; want 1.5", long, v) }
+	if g.Header.Has(tooLong) || g.Header.Has(tooLong+" LONG") { t.Errorf("keys too long for a card were written") }
+}
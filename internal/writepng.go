@@ -0,0 +1,114 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// Write a FITS image to a 16-bit PNG file. Image must be normalized to [0,1]
+func (f *FITSImage) WritePNGToFile(fileName string) error {
+	file, err:=os.Create(fileName)
+	if err!=nil { return err }
+	defer file.Close()
+
+	writer:=bufio.NewWriter(file)
+	if err=f.WritePNG(writer); err!=nil { return err }
+	if err=writer.Flush(); err!=nil { return err }
+	return file.Close()
+}
+
+// Write a FITS image to 16-bit PNG, as grayscale for one plane or as RGB for three planes.
+// Image must be normalized to [0,1]. Marks the data as sRGB with sRGB, gAMA and cHRM chunks
+func (f *FITSImage) WritePNG(writer io.Writer) error {
+	// convert pixels into Golang Image
+	width, height:=int(f.Naxisn[0]), int(f.Naxisn[1])
+	size:=width*height
+	rect:=image.Rectangle{image.Point{0,0}, image.Point{width, height}}
+	var img image.Image
+	switch f.NumPlanes() {
+	case 1:
+		gray:=image.NewGray16(rect)
+		for i, v:=range f.Data[:size] {
+			binary.BigEndian.PutUint16(gray.Pix[2*i:], toUint16(v))
+		}
+		img=gray
+	case 3:
+		rgb:=image.NewRGBA64(rect)
+		for i:=0; i<size; i++ {
+			pix:=rgb.Pix[8*i:8*i+8]
+			binary.BigEndian.PutUint16(pix[0:], toUint16(f.Data[i       ]))
+			binary.BigEndian.PutUint16(pix[2:], toUint16(f.Data[i+size  ]))
+			binary.BigEndian.PutUint16(pix[4:], toUint16(f.Data[i+size*2]))
+			binary.BigEndian.PutUint16(pix[6:], 0xffff)
+		}
+		img=rgb
+	default:
+		return errors.New("PNG output requires one or three image planes")
+	}
+
+	buf:=bytes.Buffer{}
+	err:=png.Encode(&buf, img)
+	if err!=nil { return err }
+
+	// insert color space chunks after the signature and the IHDR chunk
+	data:=buf.Bytes()
+	const ihdrEnd=8+4+4+13+4
+	_, err=writer.Write(data[:ihdrEnd])
+	if err!=nil { return err }
+	err=writePNGChunk(writer, "sRGB", []byte{0})                              // perceptual rendering intent
+	if err!=nil { return err }
+	err=writePNGChunk(writer, "gAMA", []byte{0, 0, 0xb1, 0x8f})              // 1/2.2 times 100000
+	if err!=nil { return err }
+	if f.NumPlanes()==3 {
+		chrm:=make([]byte, 32)
+		for i, v:=range []uint32{31270, 32900, 64000, 33000, 30000, 60000, 15000, 6000} { // white, r, g, b
+			binary.BigEndian.PutUint32(chrm[4*i:], v)
+		}
+		err=writePNGChunk(writer, "cHRM", chrm)
+		if err!=nil { return err }
+	}
+	_, err=writer.Write(data[ihdrEnd:])
+	return err
+}
+
+// Writes a PNG chunk with the given type and data, followed by its CRC
+func writePNGChunk(writer io.Writer, chunkType string, data []byte) error {
+	chunk:=make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	copy(chunk[8:], data)
+	binary.BigEndian.PutUint32(chunk[8+len(data):], crc32.ChecksumIEEE(chunk[4:8+len(data)]))
+	_, err:=writer.Write(chunk)
+	return err
+}
+
+// Converts a value normalized to [0,1] into a 16-bit unsigned integer, clamping to the valid range.
+// Replaces NaNs with zeros for export, as for JPG
+func toUint16(v float32) uint16 {
+	if v!=v || v<=0 { return 0 }
+	if v>=1 { return 0xffff }
+	return uint16(v*65535+0.5)
+}
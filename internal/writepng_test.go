@@ -0,0 +1,47 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func TestWritePNG(t *testing.T) {
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels=[]int32{2, 1, 3}, 6
+	f.Data=[]float32{0, 1, 0.5, float32(math.NaN()), -0.5, 2}
+
+	buf:=bytes.Buffer{}
+	if err:=f.WritePNG(&buf); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	for _, chunk:=range []string{"sRGB", "gAMA", "cHRM"} {
+		if !bytes.Contains(buf.Bytes(), []byte(chunk)) { t.Errorf("chunk %s missing", chunk) }
+	}
+
+	img, err:=png.Decode(&buf)
+	if err!=nil { t.Fatalf("err=%s; want nil", err) }
+	rgb, ok:=img.(*image.RGBA64)
+	if !ok { t.Fatalf("image type %T; want *image.RGBA64", img) }
+	want:=[][3]uint16{ {0, 32768, 0}, {65535, 0, 65535} }
+	for x, w:=range want {
+		c:=rgb.RGBA64At(x, 0)
+		if c.R!=w[0] || c.G!=w[1] || c.B!=w[2] { t.Errorf("pixel %d=%v; want %v", x, c, w) }
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// TIFF field types
+const (
+	tiffShort     uint16 = 3
+	tiffLong      uint16 = 4
+	tiffRational  uint16 = 5
+	tiffUndefined uint16 = 7
+)
+
+// A TIFF image file directory entry, with its value in little endian byte order
+type tiffEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// Write a FITS image to a TIFF file with 16-bit integer or 32-bit floating point samples. Image must be normalized to [0,1]
+func (f *FITSImage) WriteTIFFToFile(fileName string, float bool) error {
+	file, err:=os.Create(fileName)
+	if err!=nil { return err }
+	defer file.Close()
+
+	writer:=bufio.NewWriter(file)
+	if err=f.WriteTIFF(writer, float); err!=nil { return err }
+	if err=writer.Flush(); err!=nil { return err }
+	return file.Close()
+}
+
+// Write a FITS image to an uncompressed TIFF, as grayscale for one plane or as RGB for three planes.
+// Uses 16-bit integer samples, or 32-bit floating point samples if float is set. Image must be normalized to [0,1].
+// Integer samples are clamped to this range, floating point samples are kept as is. NaNs are replaced with zeros
+// as for JPG. Embeds an sRGB ICC profile
+func (f *FITSImage) WriteTIFF(writer io.Writer, float bool) error {
+	width, height, planes:=uint32(f.Naxisn[0]), uint32(f.Naxisn[1]), uint32(f.NumPlanes())
+	if planes!=1 && planes!=3 { return errors.New("TIFF output requires one or three image planes") }
+	bytesPerSample, sampleFormat:=uint32(2), uint16(1)
+	if float { bytesPerSample, sampleFormat=4, 3 }
+	photometric:=uint16(1)  // black is zero
+	if planes==3 { photometric=2 } // RGB
+	stripBytes:=width*height*planes*bytesPerSample
+
+	// prepare image file directory, sorted by tag
+	perSample:=func(v uint16) []byte {
+		b:=make([]byte, 2*planes)
+		for i:=uint32(0); i<planes; i++ { binary.LittleEndian.PutUint16(b[2*i:], v) }
+		return b
+	}
+	resolution:=[]byte{72,0,0,0, 1,0,0,0}
+	icc:=sRGBICCProfile(planes==1)
+	entries:=[]tiffEntry{
+		{256,   tiffLong,      1,                 tiffUint32(width)       }, // image width
+		{257,   tiffLong,      1,                 tiffUint32(height)      }, // image length
+		{258,   tiffShort,     planes,            perSample(uint16(8*bytesPerSample)) }, // bits per sample
+		{259,   tiffShort,     1,                 tiffUint16(1)           }, // no compression
+		{262,   tiffShort,     1,                 tiffUint16(photometric) }, // photometric interpretation
+		{273,   tiffLong,      1,                 tiffUint32(0)           }, // strip offset, set below
+		{277,   tiffShort,     1,                 tiffUint16(uint16(planes)) }, // samples per pixel
+		{278,   tiffLong,      1,                 tiffUint32(height)      }, // rows per strip
+		{279,   tiffLong,      1,                 tiffUint32(stripBytes)  }, // strip byte count
+		{282,   tiffRational,  1,                 resolution              }, // x resolution
+		{283,   tiffRational,  1,                 resolution              }, // y resolution
+		{284,   tiffShort,     1,                 tiffUint16(1)           }, // chunky planar configuration
+		{296,   tiffShort,     1,                 tiffUint16(2)           }, // resolution unit inch
+		{339,   tiffShort,     planes,            perSample(sampleFormat) }, // sample format
+		{34675, tiffUndefined, uint32(len(icc)),  icc                     }, // ICC profile
+	}
+
+	// lay out header, directory, values which do not fit into the directory, and the strip
+	ifdSize:=uint32(2+12*len(entries)+4)
+	offset:=8+ifdSize
+	valueOffsets:=make([]uint32, len(entries))
+	for i, e:=range entries {
+		if len(e.Value)<=4 { continue }
+		valueOffsets[i]=offset
+		offset+=uint32(len(e.Value)+len(e.Value)%2)  // values start on word boundaries
+	}
+	entries[5].Value=tiffUint32(offset)
+
+	// write header and image file directory
+	buf:=make([]byte, 8+ifdSize)
+	copy(buf, "II")
+	binary.LittleEndian.PutUint16(buf[2:], 42)
+	binary.LittleEndian.PutUint32(buf[4:], 8)
+	binary.LittleEndian.PutUint16(buf[8:], uint16(len(entries)))
+	for i, e:=range entries {
+		p:=buf[10+12*i:]
+		binary.LittleEndian.PutUint16(p[0:], e.Tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Type)
+		binary.LittleEndian.PutUint32(p[4:], e.Count)
+		if len(e.Value)<=4 {
+			copy(p[8:12], e.Value)
+		} else {
+			binary.LittleEndian.PutUint32(p[8:], valueOffsets[i])
+		}
+	}
+	_, err:=writer.Write(buf)  // offset of next directory remains zero
+	if err!=nil { return err }
+	for _, e:=range entries {
+		if len(e.Value)<=4 { continue }
+		_, err=writer.Write(e.Value)
+		if err!=nil { return err }
+		if len(e.Value)%2!=0 { 
+			_, err=writer.Write([]byte{0}) 
+			if err!=nil { return err }
+		}
+	}
+
+	// write the strip with interleaved samples, row by row
+	size:=int(width*height)
+	row:=make([]byte, width*planes*bytesPerSample)
+	for y:=0; y<int(height); y++ {
+		o:=0
+		for x:=0; x<int(width); x++ {
+			for p:=0; p<int(planes); p++ {
+				v:=f.Data[y*int(width)+x+p*size]
+				if float {
+					if math.IsNaN(float64(v)) { v=0 }
+					binary.LittleEndian.PutUint32(row[o:], math.Float32bits(v))
+				} else {
+					binary.LittleEndian.PutUint16(row[o:], toUint16(v))
+				}
+				o+=int(bytesPerSample)
+			}
+		}
+		_, err=writer.Write(row)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+func tiffUint16(v uint16) []byte {
+	b:=make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func tiffUint32(v uint32) []byte {
+	b:=make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+
+// Returns an ICC version 4 display profile for the sRGB color space, or for grayscale with the sRGB tone curve
+func sRGBICCProfile(gray bool) []byte {
+	be:=binary.BigEndian
+	s15Fixed16:=func(vs ...float64) []byte {
+		b:=make([]byte, 4*len(vs))
+		for i, v:=range vs { be.PutUint32(b[4*i:], uint32(int32(math.Floor(v*65536+0.5)))) }
+		return b
+	}
+	typed:=func(sig string, data []byte) []byte {
+		return append(append([]byte(sig), 0, 0, 0, 0), data...)
+	}
+	mluc:=func(text string) []byte {
+		b:=make([]byte, 20+2*len(text))
+		be.PutUint32(b[0:], 1)                      // number of records
+		be.PutUint32(b[4:], 12)                     // record size
+		copy(b[8:], "enUS")
+		be.PutUint32(b[12:], uint32(2*len(text)))   // string length
+		be.PutUint32(b[16:], 28)                    // string offset from start of tag
+		for i, c:=range []byte(text) { b[20+2*i+1]=c } // UTF-16BE, ASCII only
+		return typed("mluc", b)
+	}
+	xyz:=func(x, y, z float64) []byte { return typed("XYZ ", s15Fixed16(x, y, z)) }
+	// sRGB tone curve as parametric function type 3
+	trc:=typed("para", append([]byte{0, 3, 0, 0}, s15Fixed16(2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)...))
+
+	// tags and their data, with primaries adapted to the D50 profile connection space
+	type tag struct { sig string; data []byte }
+	colorSpace:="RGB "
+	tags:=[]tag{
+		{"desc", mluc("sRGB IEC61966-2.1")},
+		{"cprt", mluc("No copyright, use freely")},
+		{"wtpt", xyz(0.9642, 1.0, 0.8249)},
+		{"chad", typed("sf32", s15Fixed16(1.0478112, 0.0228866, -0.0501270, 0.0295424, 0.9904844, -0.0170491, -0.0092345, 0.0150436, 0.7521316))},
+	}
+	if gray {
+		colorSpace="GRAY"
+		tags[0].data=mluc("Gray with sRGB tone curve")
+		tags=append(tags, tag{"kTRC", trc})
+	} else {
+		tags=append(tags, 
+			tag{"rXYZ", xyz(0.4360747, 0.2225045, 0.0139322)},
+			tag{"gXYZ", xyz(0.3850649, 0.7168786, 0.0971045)},
+			tag{"bXYZ", xyz(0.1430804, 0.0606169, 0.7141733)},
+			tag{"rTRC", trc}, tag{"gTRC", trc}, tag{"bTRC", trc},
+		)
+	}
+
+	// header, tag table and 4-byte aligned tag data
+	p:=make([]byte, 128+4+12*len(tags))
+	be.PutUint32(p[128:], uint32(len(tags)))
+	for i, t:=range tags {
+		e:=p[132+12*i:]
+		copy(e, t.sig)
+		be.PutUint32(e[4:], uint32(len(p)))
+		be.PutUint32(e[8:], uint32(len(t.data)))
+		p=append(p, t.data...)
+		for len(p)%4!=0 { p=append(p, 0) }
+	}
+	be.PutUint32(p[0:], uint32(len(p)))           // profile size
+	be.PutUint32(p[8:], 0x04300000)               // version 4.3
+	copy(p[12:], "mntr")                          // display device profile
+	copy(p[16:], colorSpace)
+	copy(p[20:], "XYZ ")                          // profile connection space
+	for i, v:=range []uint16{2020, 1, 1, 0, 0, 0} { be.PutUint16(p[24+2*i:], v) } // creation date
+	copy(p[36:], "acsp")
+	copy(p[68:], s15Fixed16(0.9642, 1.0, 0.8249)) // D50 illuminant
+	return p
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestWriteTIFF(t *testing.T) {
+	f:=NewFITSImage()
+	f.Naxisn, f.Pixels=[]int32{3, 2}, 6
+	f.Data=[]float32{0, 0.25, 1, 1.5, float32(math.NaN()), -1}
+
+	for _, float:=range []bool{false, true} {
+		buf:=bytes.Buffer{}
+		if err:=f.WriteTIFF(&buf, float); err!=nil { t.Fatalf("err=%s; want nil", err) }
+		b:=buf.Bytes()
+		if string(b[:4])!="II*\x00" { t.Fatalf("header %q; want II*\\x00", b[:4]) }
+
+		// collect single-valued directory entries and the ICC profile location
+		le:=binary.LittleEndian
+		ifd:=le.Uint32(b[4:])
+		values:=map[uint16]uint32{}
+		iccOffset, iccCount:=uint32(0), uint32(0)
+		for i:=uint32(0); i<uint32(le.Uint16(b[ifd:])); i++ {
+			e:=b[ifd+2+12*i:]
+			tag, typ, count:=le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+			if tag==34675 { iccOffset, iccCount=le.Uint32(e[8:]), count }
+			if count!=1 { continue }
+			if typ==tiffShort { values[tag]=uint32(le.Uint16(e[8:])) } else { values[tag]=le.Uint32(e[8:]) }
+		}
+		if values[256]!=3 || values[257]!=2 || values[277]!=1 || values[262]!=1 {
+			t.Errorf("float=%v: width %d height %d samples %d photometric %d; want 3 2 1 1", float, values[256], values[257], values[277], values[262])
+		}
+		icc:=b[iccOffset:iccOffset+iccCount]
+		if binary.BigEndian.Uint32(icc)!=iccCount || string(icc[36:40])!="acsp" || string(icc[16:20])!="GRAY" {
+			t.Errorf("float=%v: invalid ICC profile header %q", float, icc[:40])
+		}
+
+		strip:=b[values[273]:]
+		if uint32(len(strip))!=values[279] { t.Errorf("float=%v: strip length %d; want %d", float, len(strip), values[279]) }
+		for i, w:=range []float32{0, 0.25, 1, 1.5, 0, -1} {
+			if float {
+				if v:=math.Float32frombits(le.Uint32(strip[4*i:])); v!=w { t.Errorf("sample %d=%f; want %f", i, v, w) }
+			} else {
+				w=float32(math.Max(0, math.Min(1, float64(w))))
+				if v:=le.Uint16(strip[2*i:]); v!=uint16(w*65535+0.5) { t.Errorf("sample %d=%d; want %d", i, v, uint16(w*65535+0.5)) }
+			}
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading and writing of XISF, the native image format of PixInsight.
+// Spec here: https://pixinsight.com/doc/docs/XISF-1.0-spec/XISF-1.0-spec.html
+
+const xisfSignature  ="XISF0100"                        // Signature at the start of monolithic XISF files
+const xisfNamespace  ="http://www.pixinsight.com/xisf"  // XML namespace of the XISF header
+const xisfBlockAlign =4096                              // Alignment of attached data blocks when writing
+
+// Compression codec for writing XISF files. One of zlib or lz4, optionally with +sh suffix
+// for byte shuffling, or empty for no compression
+var XISFCompression string = ""
+
+// XML header of an XISF file
+type xisfDocument struct {
+	XMLName  xml.Name
+	Version  string          `xml:"version,attr"`
+	Images   []xisfImage     `xml:"Image"`
+	Metadata []xisfProperty  `xml:"Metadata>Property"`
+}
+
+// An image element of the XISF header, with the location of its data block
+type xisfImage struct {
+	ID           string          `xml:"id,attr,omitempty"`
+	Geometry     string          `xml:"geometry,attr"`
+	SampleFormat string          `xml:"sampleFormat,attr"`
+	Bounds       string          `xml:"bounds,attr,omitempty"`
+	ColorSpace   string          `xml:"colorSpace,attr,omitempty"`
+	PixelStorage string          `xml:"pixelStorage,attr,omitempty"`
+	ByteOrder    string          `xml:"byteOrder,attr,omitempty"`
+	Compression  string          `xml:"compression,attr,omitempty"`
+	Subblocks    string          `xml:"subblocks,attr,omitempty"`
+	Location     string          `xml:"location,attr"`
+	Properties   []xisfProperty  `xml:"Property"`
+	Keywords     []xisfKeyword   `xml:"FITSKeyword"`
+	Data         *xisfData       `xml:"Data"`
+	Inline       string          `xml:",chardata"`   // data of inline blocks
+}
+
+// A FITS header keyword, with the value formatted as in a FITS header card
+type xisfKeyword struct {
+	Name    string `xml:"name,attr"`
+	Value   string `xml:"value,attr"`
+	Comment string `xml:"comment,attr"`
+}
+
+// An XISF property. Scalar values are stored as attribute, strings as character data
+type xisfProperty struct {
+	ID    string `xml:"id,attr"`
+	Type  string `xml:"type,attr"`
+	Value string `xml:"value,attr,omitempty"`
+	Text  string `xml:",chardata"`
+}
+
+// Data of an embedded block
+type xisfData struct {
+	Encoding string `xml:"encoding,attr"`
+	Text     string `xml:",chardata"`
+}
+
+
+// Read image data from an XISF file. The image is selected by index or id, or the first image if empty.
+// Supports attached, inline and embedded blocks, with optional zlib or LZ4 compression and byte shuffling
+func (fits *FITSImage) ReadXISF(r io.Reader, image string) error {
+	file, err:=ioutil.ReadAll(r)
+	if err!=nil { return err }
+	if len(file)<16 || string(file[:8])!=xisfSignature { return errors.New("Not a valid XISF file; signature missing") }
+	headerLen:=int(binary.LittleEndian.Uint32(file[8:]))
+	if 16+headerLen>len(file) { return errors.New("XISF header truncated") }
+
+	doc:=xisfDocument{}
+	err=xml.Unmarshal(file[16:16+headerLen], &doc)
+	if err!=nil { return err }
+	img, err:=doc.selectImage(image)
+	if err!=nil { return err }
+
+	// image geometry, with the number of channels last
+	dims:=strings.Split(img.Geometry, ":")
+	if len(dims)!=3 { return errors.New("Unsupported XISF geometry "+img.Geometry) }
+	geometry:=make([]int32, len(dims))
+	for i, d:=range dims {
+		v, err:=strconv.Atoi(d)
+		if err!=nil || v<1 { return errors.New("Invalid XISF geometry "+img.Geometry) }
+		geometry[i]=int32(v)
+	}
+	fits.Naxisn=geometry
+	if geometry[2]==1 { fits.Naxisn=geometry[:2] }
+	fits.Pixels=geometry[0]*geometry[1]*geometry[2]
+
+	// header values from FITS keywords
+	fits.Header=NewFITSHeader()
+	fits.Header.readXISFKeywords(img.Keywords)
+	fits.Exposure=fits.Header.exposure()
+	for _, p:=range img.Properties {
+		if p.ID=="Instrument:ExposureTime" && fits.Exposure==0 {
+			if v, err:=strconv.ParseFloat(p.Value, 32); err==nil { fits.Exposure=float32(v) }
+		}
+	}
+
+	// data block
+	block, err:=img.readBlock(file)
+	if err!=nil { return err }
+	return fits.readXISFSamples(block, img.SampleFormat, img.ByteOrder=="big", img.PixelStorage=="Normal")
+}
+
+
+// Returns the image with the given index or id, or the first one if empty
+func (doc *xisfDocument) selectImage(image string) (*xisfImage, error) {
+	if len(doc.Images)==0 { return nil, errors.New("No image found in XISF file") }
+	if image=="" { return &doc.Images[0], nil }
+	if i, err:=strconv.Atoi(image); err==nil {
+		if i>=0 && i<len(doc.Images) { return &doc.Images[i], nil }
+	} else {
+		for i:=range doc.Images {
+			if doc.Images[i].ID==image { return &doc.Images[i], nil }
+		}
+	}
+	return nil, errors.New("XISF image "+image+" not found")
+}
+
+
+// Parses FITS keywords into the header, reusing the FITS header line parser
+func (h *FITSHeader) readXISFKeywords(keywords []xisfKeyword) {
+	parser:=reParser.Copy()
+	prevKey:=""
+	for lineNo, k:=range keywords {
+		switch k.Name {
+		case "COMMENT": h.Comments=append(h.Comments, k.Comment)
+		case "HISTORY": h.History =append(h.History,  k.Comment)
+		default:
+			line:=[]byte(formatKey(k.Name)+k.Value+" / "+k.Comment)
+			if k.Name=="CONTINUE" { line=[]byte("CONTINUE  "+k.Value+" / "+k.Comment) }
+			subValues:=parser.FindSubmatch(line)
+			if subValues==nil {
+				LogPrintf("Warning:Cannot parse XISF keyword %s='%s', ignoring\n", k.Name, k.Value)
+				prevKey=""
+			} else {
+				prevKey=h.readLine(parser.SubexpNames(), subValues, lineNo, prevKey)
+			}
+		}
+	}
+}
+
+
+// Returns the uncompressed data block of the image from the given file contents
+func (img *xisfImage) readBlock(file []byte) (block []byte, err error) {
+	loc:=strings.Split(img.Location, ":")
+	switch {
+	case loc[0]=="attachment" && len(loc)==3:
+		pos, err1:=strconv.ParseInt(loc[1], 10, 64)
+		size, err2:=strconv.ParseInt(loc[2], 10, 64)
+		if err1!=nil || err2!=nil || pos<0 || size<0 || pos+size>int64(len(file)) { 
+			return nil, errors.New("Invalid XISF attachment "+img.Location) 
+		}
+		block=file[pos:pos+size]
+	case loc[0]=="inline" && len(loc)==2:
+		block, err=decodeXISFText(img.Inline, loc[1])
+	case loc[0]=="embedded" && img.Data!=nil:
+		block, err=decodeXISFText(img.Data.Text, img.Data.Encoding)
+	default:
+		return nil, errors.New("Unsupported XISF block location "+img.Location)
+	}
+	if err!=nil || img.Compression=="" { return block, err }
+	return decompressXISF(block, img.Compression, img.Subblocks)
+}
+
+
+// Decodes the text of an inline or embedded block with base64 or hex encoding
+func decodeXISFText(text, encoding string) ([]byte, error) {
+	text=strings.Join(strings.Fields(text), "")
+	switch encoding {
+	case "base64": return base64.StdEncoding.DecodeString(text)
+	case "hex":    return hex.DecodeString(text)
+	}
+	return nil, errors.New("Unsupported XISF block encoding "+encoding)
+}
+
+
+// Decompresses a data block given the compression attribute codec:size or codec+sh:size:itemsize,
+// and the optional subblocks attribute with colon-separated pairs of compressed and uncompressed sizes
+func decompressXISF(block []byte, compression, subblocks string) ([]byte, error) {
+	codec, size, itemSize, err:=parseXISFCompression(compression)
+	if err!=nil { return nil, err }
+
+	// split into subblocks
+	type subblock struct { compressed, uncompressed int }
+	subs:=[]subblock{ {len(block), size} }
+	if subblocks!="" {
+		subs=subs[:0]
+		for _, pair:=range strings.Split(subblocks, ":") {
+			sizes:=strings.Split(pair, ",")
+			if len(sizes)!=2 { return nil, errors.New("Invalid XISF subblocks "+subblocks) }
+			c, err1:=strconv.Atoi(sizes[0])
+			u, err2:=strconv.Atoi(sizes[1])
+			if err1!=nil || err2!=nil { return nil, errors.New("Invalid XISF subblocks "+subblocks) }
+			subs=append(subs, subblock{c, u})
+		}
+	}
+
+	res:=make([]byte, 0, size)
+	for _, sub:=range subs {
+		if sub.compressed>len(block) { return nil, errors.New("XISF compressed block truncated") }
+		var data []byte
+		switch codec {
+		case "zlib":
+			zr, err:=zlib.NewReader(bytes.NewReader(block[:sub.compressed]))
+			if err!=nil { return nil, err }
+			data, err=ioutil.ReadAll(zr)
+			if err!=nil { return nil, err }
+		case "lz4", "lz4hc":
+			data=make([]byte, sub.uncompressed)
+			err=lz4Decompress(block[:sub.compressed], data)
+			if err!=nil { return nil, err }
+		default:
+			return nil, errors.New("Unsupported XISF compression codec "+codec)
+		}
+		res=append(res, data...)
+		block=block[sub.compressed:]
+	}
+	if len(res)!=size { return nil, errors.New("XISF uncompressed size mismatch") }
+	if itemSize>1 { res=unshuffleBytes(res, itemSize) }
+	return res, nil
+}
+
+
+// Parses an XISF compression attribute codec:size or codec+sh:size:itemsize into its parts.
+// The item size is zero if bytes are not shuffled
+func parseXISFCompression(compression string) (codec string, size, itemSize int, err error) {
+	parts:=strings.Split(compression, ":")
+	codec=parts[0]
+	shuffled:=strings.HasSuffix(codec, "+sh")
+	codec=strings.TrimSuffix(codec, "+sh")
+	if (!shuffled && len(parts)!=2) || (shuffled && len(parts)!=3) { 
+		return "", 0, 0, errors.New("Invalid XISF compression "+compression) 
+	}
+	size, err=strconv.Atoi(parts[1])
+	if err!=nil { return "", 0, 0, errors.New("Invalid XISF compression "+compression) }
+	if shuffled {
+		itemSize, err=strconv.Atoi(parts[2])
+		if err!=nil { return "", 0, 0, errors.New("Invalid XISF compression "+compression) }
+	}
+	return codec, size, itemSize, nil
+}
+
+
+// Converts samples of the given format from the data block into planar float32 data. 
+// Normal pixel storage interleaves the channels of each pixel
+func (fits *FITSImage) readXISFSamples(block []byte, sampleFormat string, bigEndian, interleaved bool) error {
+	var order binary.ByteOrder=binary.LittleEndian
+	if bigEndian { order=binary.BigEndian }
+	width:=map[string]int{"UInt8":1, "UInt16":2, "UInt32":4, "Float32":4, "Float64":8}[sampleFormat]
+	if width==0 { return errors.New("Unsupported XISF sample format "+sampleFormat) }
+	if len(block)<int(fits.Pixels)*width { return errors.New("XISF data block truncated") }
+	fits.Bitpix=int32(8*width)
+	if strings.HasPrefix(sampleFormat, "Float") { fits.Bitpix=-fits.Bitpix }
+	fits.Bzero, fits.Bscale=0, 1
+
+	planes:=int(fits.NumPlanes())
+	planeSize:=int(fits.Pixels)/planes
+	fits.Data=make([]float32, int(fits.Pixels))
+	for i:=range fits.Data {
+		src:=i
+		if interleaved { src=(i%planeSize)*planes + i/planeSize }
+		b:=block[src*width:]
+		switch sampleFormat {
+		case "UInt8":   fits.Data[i]=float32(b[0])
+		case "UInt16":  fits.Data[i]=float32(order.Uint16(b))
+		case "UInt32":  fits.Data[i]=float32(order.Uint32(b))
+		case "Float32": fits.Data[i]=math.Float32frombits(order.Uint32(b))
+		case "Float64": fits.Data[i]=float32(math.Float64frombits(order.Uint64(b)))
+		}
+	}
+
+	// integer samples written with a scale carry BSCALE and BZERO keywords, as in FITS
+	if fits.Bitpix>0 && (fits.Header.Has("BSCALE") || fits.Header.Has("BZERO")) {
+		if v, ok:=fits.Header.floatValue("BSCALE"); ok { fits.Bscale=v }
+		if v, ok:=fits.Header.floatValue("BZERO");  ok { fits.Bzero =v }
+		for i, d:=range fits.Data { fits.Data[i]=d*fits.Bscale+fits.Bzero }
+		fits.Bzero, fits.Bscale=0, 1
+	}
+	fits.Header.Delete("BSCALE")
+	fits.Header.Delete("BZERO")
+	return nil
+}
+
+
+// Writes an in-memory image as XISF with an attached data block, using OutputFormat and OutputKeepNaN.
+// Uses UInt16 samples for uint16 output, Float64 samples for float64 output and Float32 samples otherwise.
+// Compresses the data block if XISFCompression is set
+func (fits *FITSImage) WriteXISF(w io.Writer) error {
+	planes:=fits.NumPlanes()
+	img:=xisfImage{
+		Geometry:   fmt.Sprintf("%d:%d:%d", fits.Naxisn[0], fits.Naxisn[1], planes),
+		ColorSpace: "Gray",
+		Keywords:   fits.Header.xisfKeywords(fits.Exposure),
+	}
+	if planes==3 { img.ColorSpace="RGB" }
+
+	// convert samples to little endian planar data
+	block, itemSize, err:=fits.xisfSamples(&img)
+	if err!=nil { return err }
+	if XISFCompression!="" {
+		codec:=strings.TrimSuffix(XISFCompression, "+sh")
+		data:=block
+		if codec!=XISFCompression { 
+			data=shuffleBytes(block, itemSize)
+			img.Compression=fmt.Sprintf("%s+sh:%d:%d", codec, len(block), itemSize)
+		} else {
+			img.Compression=fmt.Sprintf("%s:%d", codec, len(block))
+		}
+		switch codec {
+		case "zlib":
+			buf:=bytes.Buffer{}
+			zw:=zlib.NewWriter(&buf)
+			_, err=zw.Write(data)
+			if err!=nil { return err }
+			err=zw.Close()
+			if err!=nil { return err }
+			block=buf.Bytes()
+		case "lz4":
+			block=lz4Compress(data)
+		default:
+			return errors.New("Unsupported XISF compression "+XISFCompression)
+		}
+	}
+
+	doc:=xisfDocument{
+		XMLName:  xml.Name{Space:xisfNamespace, Local:"xisf"},
+		Version:  "1.0",
+		Metadata: []xisfProperty{
+			{ID:"XISF:CreationTime",      Type:"TimePoint", Value:time.Now().UTC().Format(time.RFC3339)},
+			{ID:"XISF:CreatorApplication", Type:"String",   Text:"nightlight"},
+		},
+	}
+
+	// place the data block after the header on the next aligned position. As the position is part 
+	// of the header, repeat until the header length is stable
+	var header []byte
+	pos:=0
+	for {
+		img.Location=fmt.Sprintf("attachment:%d:%d", pos, len(block))
+		doc.Images=[]xisfImage{img}
+		header, err=xml.MarshalIndent(&doc, "", " ")
+		if err!=nil { return err }
+		header=append([]byte(xml.Header), header...)
+		newPos:=(16+len(header)+xisfBlockAlign-1)/xisfBlockAlign*xisfBlockAlign
+		if newPos==pos { break }
+		pos=newPos
+	}
+
+	prefix:=make([]byte, 16)
+	copy(prefix, xisfSignature)
+	binary.LittleEndian.PutUint32(prefix[8:], uint32(len(header)))
+	for _, b:=range [][]byte{prefix, header, make([]byte, pos-16-len(header)), block} {
+		_, err=w.Write(b)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+
+// Converts the image data into a little endian data block, and sets sample format and bounds of the image element.
+// Returns the block and the size of each sample in bytes
+func (fits *FITSImage) xisfSamples(img *xisfImage) (block []byte, itemSize int, err error) {
+	switch OutputFormat {
+	case SFUint16:
+		img.SampleFormat, itemSize="UInt16", 2
+		if OutputScale!=1 {
+			img.Keywords=append(img.Keywords, xisfKeyword{"BSCALE", formatFITSFloat(1/OutputScale, 64), "[1] Scale factor"})
+		}
+		block=make([]byte, 2*len(fits.Data))
+		for i, d:=range fits.Data {
+			v:=math.Floor(float64(d)*OutputScale+0.5)
+			if math.IsNaN(v) || v<0 { v=0 }
+			if v>math.MaxUint16 { v=math.MaxUint16 }
+			binary.LittleEndian.PutUint16(block[2*i:], uint16(v))
+		}
+		return block, itemSize, nil
+	case SFFloat64:
+		img.SampleFormat, itemSize="Float64", 8
+	default:
+		img.SampleFormat, itemSize="Float32", 4
+	}
+
+	// floating point samples need the bounds of the value range
+	min, max:=float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, d:=range fits.Data {
+		if d<min { min=d }
+		if d>max { max=d }
+	}
+	if min>=0 && max<=1 { min, max=0, 1 }
+	if !(min<max) { max=min+1 }
+	img.Bounds=formatFITSFloat(float64(min), 32)+":"+formatFITSFloat(float64(max), 32)
+
+	block=make([]byte, itemSize*len(fits.Data))
+	for i, d:=range fits.Data {
+		if !OutputKeepNaN && math.IsNaN(float64(d)) { d=0 }
+		if itemSize==8 {
+			binary.LittleEndian.PutUint64(block[8*i:], math.Float64bits(float64(d)))
+		} else {
+			binary.LittleEndian.PutUint32(block[4*i:], math.Float32bits(d))
+		}
+	}
+	return block, itemSize, nil
+}
+
+
+// Returns the non-structural header values as XISF FITS keywords, with values formatted as in FITS header cards.
+// Exposure values are replaced with the given exposure if nonzero, as in FITS files
+func (h *FITSHeader) xisfKeywords(exposure float32) (keywords []xisfKeyword) {
+	if exposure!=0 && !h.Has("EXPOSURE") && !h.Has("EXPTIME") {
+		keywords=append(keywords, xisfKeyword{"EXPOSURE", formatFITSFloat(float64(exposure), 32), "[s] Exposure duration"})
+	}
+	for _, key:=range h.Keys {
+		if isStructuralKey(key) { continue }
+		value:=""
+		if (key=="EXPOSURE" || key=="EXPTIME") && exposure!=0 {
+			value=formatFITSFloat(float64(exposure), 32)
+		} else if v, ok:=h.Bools[key]; ok {
+			value="F"
+			if v { value="T" }
+		} else if v, ok:=h.Ints[key]; ok {
+			value=strconv.FormatInt(int64(v), 10)
+		} else if v, ok:=h.Floats[key]; ok {
+			value=formatFITSFloat(v, 64)
+		} else if v, ok:=h.Strings[key]; ok {
+			value="'"+strings.Replace(v, "'", "''", -1)+"'"
+		} else if v, ok:=h.Dates[key]; ok {
+			value="'"+v+"'"
+		} else if v, ok:=h.Complexes[key]; ok {
+			value="("+formatFITSFloat(float64(real(v)), 32)+", "+formatFITSFloat(float64(imag(v)), 32)+")"
+		}
+		keywords=append(keywords, xisfKeyword{key, value, h.KeyComments[key]})
+	}
+	for _, c:=range h.Comments {
+		keywords=append(keywords, xisfKeyword{"COMMENT", "", c})
+	}
+	for _, hist:=range h.History {
+		keywords=append(keywords, xisfKeyword{"HISTORY", "", hist})
+	}
+	return keywords
+}
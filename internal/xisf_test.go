@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestXISFRoundTrip(t *testing.T) {
+	defer func() { OutputFormat, OutputScale, XISFCompression=SFFloat32, 1, "" }()
+	tests:=[]struct{ format SampleFormat; scale float64; compression string; planes int32; want []float32 }{
+		{ SFFloat32, 1,     "",        1, []float32{0, 0.25, 0.5, 1, 0.75, 0.125} },
+		{ SFFloat64, 1,     "zlib",    1, []float32{0, 0.25, 0.5, 1, 0.75, 0.125} },
+		{ SFFloat32, 1,     "lz4+sh",  3, []float32{0, 0.25, 0.5, 1, 0.75, 0.125} },
+		{ SFUint16,  1,     "zlib+sh", 3, []float32{0, 0, 1, 1, 1, 0} },
+		{ SFUint16,  4096,  "lz4",     1, []float32{0, 0.25, 0.5, 1, 0.75, 0.125} },
+	}
+	for i, test:=range tests {
+		OutputFormat, OutputScale, XISFCompression=test.format, test.scale, test.compression
+		f:=NewFITSImage()
+		f.Naxisn=[]int32{3, 2}
+		if test.planes>1 { f.Naxisn=append(f.Naxisn, test.planes) }
+		f.Pixels=6*test.planes
+		f.Data=make([]float32, f.Pixels)
+		for j:=range f.Data { f.Data[j]=[]float32{0, 0.25, 0.5, 1, 0.75, 0.125}[j%6] }
+		f.Exposure=120
+		f.Header.SetString("OBJECT", "M 42's core", "Target")
+		f.Header.SetInt("GAIN", 139, "")
+		f.Header.Comments=append(f.Header.Comments, "A comment")
+
+		buf:=bytes.Buffer{}
+		if err:=f.WriteXISF(&buf); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		g:=NewFITSImage()
+		if err:=g.ReadXISF(&buf, ""); err!=nil { t.Fatalf("%d: err=%s; want nil", i, err) }
+		if len(g.Naxisn)!=len(f.Naxisn) || g.Pixels!=f.Pixels { t.Fatalf("%d: Naxisn=%v; want %v", i, g.Naxisn, f.Naxisn) }
+		for j, d:=range g.Data {
+			if d!=test.want[j%6] { t.Errorf("%d: Data[%d]=%f; want %f", i, j, d, test.want[j%6]) }
+		}
+		if g.Exposure!=120 { t.Errorf("%d: Exposure=%f; want 120", i, g.Exposure) }
+		if g.Header.Strings["OBJECT"]!="M 42's core" { t.Errorf("%d: OBJECT=%s; want M 42's core", i, g.Header.Strings["OBJECT"]) }
+		if g.Header.Ints["GAIN"]!=139 { t.Errorf("%d: GAIN=%d; want 139", i, g.Header.Ints["GAIN"]) }
+		if len(g.Header.Comments)!=1 || g.Header.Comments[0]!="A comment" { t.Errorf("%d: Comments=%v; want [A comment]", i, g.Header.Comments) }
+	}
+}
+
+func TestXISFInline(t *testing.T) {
+	data:=make([]byte, 8)
+	binary.BigEndian.PutUint16(data[0:], 1)
+	binary.BigEndian.PutUint16(data[2:], 2)
+	binary.BigEndian.PutUint16(data[4:], 3)
+	binary.BigEndian.PutUint16(data[6:], 4)
+	header:=`<?xml version="1.0" encoding="UTF-8"?><xisf version="1.0" xmlns="http://www.pixinsight.com/xisf">` +
+		`<Image id="main" geometry="2:2:1" sampleFormat="UInt16" byteOrder="big" location="inline:base64">` +
+		`<FITSKeyword name="EXPTIME" value="30." comment="Exposure"/>` + base64.StdEncoding.EncodeToString(data) +
+		`</Image></xisf>`
+	file:=make([]byte, 16)
+	copy(file, xisfSignature)
+	binary.LittleEndian.PutUint32(file[8:], uint32(len(header)))
+	file=append(file, header...)
+
+	f:=NewFITSImage()
+	if err:=f.ReadXISF(bytes.NewReader(file), "main"); err!=nil { t.Fatalf("err=%s; want nil", err) }
+	for i, want:=range []float32{1, 2, 3, 4} {
+		if f.Data[i]!=want { t.Errorf("Data[%d]=%f; want %f", i, f.Data[i], want) }
+	}
+	if f.Bitpix!=16 { t.Errorf("Bitpix=%d; want 16", f.Bitpix) }
+	if f.Exposure!=30 { t.Errorf("Exposure=%f; want 30", f.Exposure) }
+	if err:=f.ReadXISF(bytes.NewReader(file), "other"); err==nil { t.Errorf("err=nil; want image not found") }
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	src:=make([]byte, 100000)
+	for i:=range src { src[i]=byte(math.Sqrt(float64(i%1000))) }
+	copy(src[5000:], "incompressible tail 0123456789")
+	for _, n:=range []int{0, 5, 13, 1000, len(src)} {
+		comp:=lz4Compress(src[:n])
+		res:=make([]byte, n)
+		if err:=lz4Decompress(comp, res); err!=nil { t.Fatalf("n=%d: err=%s; want nil", n, err) }
+		if !bytes.Equal(res, src[:n]) { t.Errorf("n=%d: round trip mismatch", n) }
+		if n==len(src) && len(comp)>=n/10 { t.Errorf("n=%d: compressed len=%d; want <%d", n, len(comp), n/10) }
+	}
+}